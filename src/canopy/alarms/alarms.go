@@ -0,0 +1,151 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alarms evaluates the threshold alarms declared in device SDDL (see
+// sddl.AlarmDef) when Cloud Variables change.
+//
+// An alarm moves through these states:
+//
+//      normal -> active        Thresholds exceeded for the min-duration.
+//      active -> acknowledged  A user acknowledged the alarm.
+//      active, acknowledged -> cleared
+//                              Value recovered, past the hysteresis band.
+//      cleared -> active       Thresholds exceeded again.
+//
+// Transitions to active and cleared send a notification from the device.
+package alarms
+
+import (
+    "canopy/canolog"
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "canopy/notify"
+    "canopy/sddl"
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Get the Cloud Variables in <doc> that declare alarms, including struct
+// members.
+func AlarmVars(doc sddl.Document) []sddl.VarDef {
+    out := []sddl.VarDef{}
+    var collect func(varDefs []sddl.VarDef)
+    collect = func(varDefs []sddl.VarDef) {
+        for _, varDef := range varDefs {
+            if len(varDef.Alarms()) > 0 {
+                out = append(out, varDef)
+            }
+            if varDef.Datatype() == sddl.DATATYPE_STRUCT {
+                members, _ := varDef.StructMembers()
+                collect(members)
+            }
+        }
+    }
+    collect(doc.VarDefs())
+    return out
+}
+
+// Was Cloud Variable <varName> changed, directly or as part of a struct?
+func varChanged(varName string, changed []string) bool {
+    for _, name := range changed {
+        if varName == name || strings.HasPrefix(varName, name + ".") {
+            return true
+        }
+    }
+    return false
+}
+
+// Evaluate the alarms declared on Cloud Variables <changed> of <device>
+// against their latest values.  Errors evaluating individual alarms are
+// logged, and do not prevent other alarms from being evaluated.
+func ProcessVarChange(device datalayer.Device, changed []string, services notify.Services) {
+    now := time.Now().UTC()
+    for _, varDef := range AlarmVars(device.SDDLDocument()) {
+        if !varChanged(varDef.Fullname(), changed) {
+            continue
+        }
+        sample, err := device.LatestDataByName(varDef.Fullname())
+        if err != nil {
+            canolog.Error("Alarms: could not fetch ", varDef.Fullname(), ": ", err)
+            continue
+        }
+        value, ok := cloudvar.CloudVarValueToFloat64(sample.Value)
+        if !ok {
+            continue
+        }
+        for _, def := range varDef.Alarms() {
+            err = evaluate(device, varDef, def, value, now, services)
+            if err != nil {
+                canolog.Error("Alarms: error evaluating ", varDef.Fullname(), "/", def.Name(), ": ", err)
+            }
+        }
+    }
+}
+
+func evaluate(device datalayer.Device, varDef sddl.VarDef, def *sddl.AlarmDef, value float64, t time.Time, services notify.Services) error {
+    alarm, err := device.Alarm(varDef.Fullname(), def.Name())
+    if err != nil {
+        return err
+    }
+
+    switch alarm.State() {
+    case datalayer.AlarmNormal, datalayer.AlarmCleared:
+        if !def.Exceeded(value) {
+            if !alarm.PendingSince().IsZero() {
+                return alarm.SetPendingSince(time.Time{})
+            }
+            return nil
+        }
+        // Not raised until the condition has held for the min-duration.
+        // This is only noticed on the next report from the device.
+        pendingSince := alarm.PendingSince()
+        if pendingSince.IsZero() {
+            if def.MinDuration() > 0 {
+                return alarm.SetPendingSince(t)
+            }
+        } else if t.Sub(pendingSince) < def.MinDuration() {
+            return nil
+        }
+        err = alarm.SetState(datalayer.AlarmActive, value, t, "")
+        if err != nil {
+            return err
+        }
+        return sendNotification(device, varDef, def, datalayer.AlarmActive, value, services)
+
+    case datalayer.AlarmActive, datalayer.AlarmAcknowledged:
+        if !def.Recovered(value) {
+            return nil
+        }
+        err = alarm.SetState(datalayer.AlarmCleared, value, t, "")
+        if err != nil {
+            return err
+        }
+        return sendNotification(device, varDef, def, datalayer.AlarmCleared, value, services)
+    }
+    return nil
+}
+
+func sendNotification(device datalayer.Device, varDef sddl.VarDef, def *sddl.AlarmDef, state datalayer.AlarmState, value float64, services notify.Services) error {
+    var msg string
+    if state == datalayer.AlarmActive {
+        msg = def.Msg()
+        if msg == "" {
+            msg = fmt.Sprintf("Alarm %s raised: %s is %v", def.Name(), varDef.Fullname(), value)
+        }
+    } else {
+        msg = fmt.Sprintf("Alarm %s cleared: %s is %v", def.Name(), varDef.Fullname(), value)
+    }
+    return notify.ProcessNotification(device, def.NotifyType(), services, msg)
+}
@@ -33,7 +33,11 @@ var cmds = []canopy_ops.Command{
 
     canopy_ops.CreateDBCommand{},
     canopy_ops.EraseDBCommand{},
+    canopy_ops.MailOutboxCommand{},
+    canopy_ops.MailQueueCommand{},
     canopy_ops.ResetDBCommand{},
+    canopy_ops.SDDLLintCommand{},
+    canopy_ops.SDDLSchemaCommand{},
     canopy_ops.WorkersCommand{},
 }
 
@@ -131,7 +131,7 @@ func main() {
 
     pigeonOutbox := pigeonSys.NewOutbox()
 
-    err = jobs.InitJobServer(cfg, pigeonServer)
+    err = jobs.InitJobServer(cfg, pigeonServer, pigeonOutbox)
     if err != nil {
         canolog.Error("Unable to initialize Job Server", err)
         return
@@ -0,0 +1,134 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package canopy_ops
+
+// canopy-ops mail-outbox [show [<n>|<file>] | clear]
+// List or show emails captured by the "file" email service
+
+import (
+    "canopy/mail"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "time"
+)
+
+type MailOutboxCommand struct{}
+
+func (MailOutboxCommand)HelpOneLiner() string {
+    return "    mail-outbox List or show emails captured by the file mail service"
+}
+
+func (MailOutboxCommand)Help() {
+    fmt.Println("COMMAND:")
+    fmt.Println("   canopy-ops mail-outbox")
+    fmt.Println("   canopy-ops mail-outbox show [<n>|<file>]")
+    fmt.Println("   canopy-ops mail-outbox clear")
+    fmt.Println("")
+    fmt.Println("DESCRIPTION:")
+    fmt.Println("   When email-service is \"file\", emails are written to email-dir")
+    fmt.Println("   instead of being sent.")
+    fmt.Println("")
+    fmt.Println("   With no arguments, lists the captured emails, oldest first.")
+    fmt.Println("")
+    fmt.Println("   \"show\" prints the headers and decoded body of email number <n>")
+    fmt.Println("   from the list, or of <file>.  Defaults to the most recent email.")
+    fmt.Println("")
+    fmt.Println("   \"clear\" deletes all captured emails.")
+    fmt.Println("")
+}
+
+func (MailOutboxCommand)Match(cmdString string) bool {
+    return (cmdString == "mail-outbox")
+}
+
+func (MailOutboxCommand)Perform(info CommandInfo) {
+    dir := info.Cfg.OptEmailDir()
+    names, err := mail.ListStoredMail(dir)
+    if err != nil && !os.IsNotExist(err) {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    if len(info.Args) == 1 {
+        for i, name := range names {
+            msg, err := mail.ReadStoredMail(filepath.Join(dir, name))
+            if err != nil {
+                fmt.Printf("%4d  %s: %s\n", i + 1, name, err)
+                continue
+            }
+            fmt.Printf("%4d  %s  %s  %s\n", i + 1, msg.Date.Format(time.RFC3339), msg.To, msg.Subject)
+        }
+        return
+    }
+
+    switch info.Args[1] {
+    case "show":
+        if len(info.Args) > 3 {
+            fmt.Println("Usage: canopy-ops mail-outbox show [<n>|<file>]")
+            os.Exit(2)
+        }
+        filename := ""
+        if len(info.Args) == 2 {
+            if len(names) == 0 {
+                fmt.Println("No emails in", dir)
+                os.Exit(1)
+            }
+            filename = filepath.Join(dir, names[len(names) - 1])
+        } else if n, err := strconv.Atoi(info.Args[2]); err == nil {
+            if n < 1 || n > len(names) {
+                fmt.Printf("No email number %d in %s\n", n, dir)
+                os.Exit(1)
+            }
+            filename = filepath.Join(dir, names[n - 1])
+        } else {
+            filename = info.Args[2]
+            if _, err := os.Stat(filename); os.IsNotExist(err) {
+                filename = filepath.Join(dir, info.Args[2])
+            }
+        }
+        msg, err := mail.ReadStoredMail(filename)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        fmt.Println("File:   ", msg.Filename)
+        fmt.Println("Date:   ", msg.Date.Format(time.RFC3339))
+        fmt.Println("From:   ", msg.From)
+        fmt.Println("To:     ", msg.To)
+        fmt.Println("Subject:", msg.Subject)
+        if msg.Text != "" {
+            fmt.Println("")
+            fmt.Println(msg.Text)
+        }
+        if msg.HTML != "" {
+            fmt.Println("")
+            fmt.Println("--- HTML ---")
+            fmt.Println(msg.HTML)
+        }
+    case "clear":
+        for _, name := range names {
+            err = os.Remove(filepath.Join(dir, name))
+            if err != nil {
+                fmt.Println(err)
+                os.Exit(1)
+            }
+        }
+        fmt.Printf("Deleted %d email(s)\n", len(names))
+    default:
+        fmt.Println("Usage: canopy-ops mail-outbox [show [<n>|<file>] | clear]")
+        os.Exit(2)
+    }
+}
@@ -0,0 +1,169 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package canopy_ops
+
+// canopy-ops mail-queue [show <id> | retry <id>]
+// Inspect the queue of outgoing email
+
+import (
+    "canopy/datalayer"
+    "canopy/datalayer/cassandra_datalayer"
+    "canopy/mailqueue"
+    "canopy/pigeon"
+    "fmt"
+    "github.com/gocql/gocql"
+    "os"
+    "time"
+)
+
+type MailQueueCommand struct{}
+
+func (MailQueueCommand)HelpOneLiner() string {
+    return "    mail-queue  Inspect the queue of outgoing email"
+}
+
+func (MailQueueCommand)Help() {
+    fmt.Println("COMMAND:")
+    fmt.Println("   canopy-ops mail-queue")
+    fmt.Println("   canopy-ops mail-queue show <id>")
+    fmt.Println("   canopy-ops mail-queue retry <id>")
+    fmt.Println("")
+    fmt.Println("DESCRIPTION:")
+    fmt.Println("   Email is queued in the database and sent in the background by")
+    fmt.Println("   canopy workers.  Messages are kept for a week.")
+    fmt.Println("")
+    fmt.Println("   With no arguments, lists queued messages, oldest first, with")
+    fmt.Println("   their status: queued, retrying, sent, failed or bounced.")
+    fmt.Println("")
+    fmt.Println("   \"show\" prints a message's delivery status, last error and")
+    fmt.Println("   contents.")
+    fmt.Println("")
+    fmt.Println("   \"retry\" tries to send a message again, even if it failed or")
+    fmt.Println("   bounced, and prints its new status.  A canopy worker must be")
+    fmt.Println("   running.")
+    fmt.Println("")
+}
+
+func (MailQueueCommand)Match(cmdString string) bool {
+    return (cmdString == "mail-queue")
+}
+
+// Lookup queued message by the ID in <idString>, or exit.
+func lookupQueuedMail(conn datalayer.Connection, idString string) datalayer.QueuedMail {
+    id, err := gocql.ParseUUID(idString)
+    if err != nil {
+        fmt.Println("Invalid message id:", idString)
+        os.Exit(2)
+    }
+    queued, err := conn.LookupQueuedMail(id)
+    if err != nil {
+        fmt.Println("Message", idString, "not found:", err)
+        os.Exit(1)
+    }
+    return queued
+}
+
+func (MailQueueCommand)Perform(info CommandInfo) {
+    dl := cassandra_datalayer.NewDatalayer(info.Cfg)
+    conn, err := dl.Connect("canopy")
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    if len(info.Args) == 1 {
+        mails, err := conn.QueuedMails()
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        for _, queued := range mails {
+            fmt.Printf("%s  %s  %-8s %d  %s  %s\n", queued.ID,
+                    queued.TimeQueued.UTC().Format(time.RFC3339),
+                    datalayer.MailStatusToString(queued.Status),
+                    queued.Attempts, queued.Recipients, queued.Subject)
+        }
+        return
+    }
+
+    if len(info.Args) != 3 {
+        fmt.Println("Usage: canopy-ops mail-queue [show <id> | retry <id>]")
+        os.Exit(2)
+    }
+    queued := lookupQueuedMail(conn, info.Args[2])
+
+    switch info.Args[1] {
+    case "show":
+        fmt.Println("ID:      ", queued.ID)
+        fmt.Println("Status:  ", datalayer.MailStatusToString(queued.Status))
+        fmt.Println("Attempts:", queued.Attempts)
+        fmt.Println("Queued:  ", queued.TimeQueued.UTC().Format(time.RFC3339))
+        fmt.Println("Updated: ", queued.TimeUpdated.UTC().Format(time.RFC3339))
+        if !queued.NextAttempt.IsZero() {
+            fmt.Println("Next:    ", queued.NextAttempt.UTC().Format(time.RFC3339))
+        }
+        if queued.Error != "" {
+            fmt.Println("Error:   ", queued.Error)
+        }
+        msg, err := mailqueue.DecodeMessage(queued)
+        if err != nil {
+            fmt.Println("Could not decode message:", err)
+            os.Exit(1)
+        }
+        fmt.Println("From:    ", msg.From.Email)
+        fmt.Println("To:      ", queued.Recipients)
+        fmt.Println("Subject: ", msg.Subject)
+        if msg.Text != "" {
+            fmt.Println("")
+            fmt.Println(msg.Text)
+        }
+        if msg.HTML != "" {
+            fmt.Println("")
+            fmt.Println("--- HTML ---")
+            fmt.Println(msg.HTML)
+        }
+    case "retry":
+        queued.Status = datalayer.MailRetrying
+        queued.TimeUpdated = time.Now().UTC()
+        queued.NextAttempt = queued.TimeUpdated
+        err = conn.UpdateQueuedMail(queued)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        pigeonSys, err := jobqueue.NewPigeonSystem(info.Cfg)
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        respChan, err := pigeonSys.NewOutbox().Launch(mailqueue.SendJobKey, map[string]interface{}{
+            "id" : queued.ID.String(),
+        })
+        if err != nil {
+            fmt.Println(err)
+            os.Exit(1)
+        }
+        select {
+        case <-respChan:
+        case <-time.After(time.Minute):
+            fmt.Println("Timed out waiting for a canopy worker")
+            os.Exit(1)
+        }
+        queued = lookupQueuedMail(conn, info.Args[2])
+        fmt.Println(queued.ID, datalayer.MailStatusToString(queued.Status), queued.Error)
+    default:
+        fmt.Println("Usage: canopy-ops mail-queue [show <id> | retry <id>]")
+        os.Exit(2)
+    }
+}
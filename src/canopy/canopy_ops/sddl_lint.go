@@ -0,0 +1,98 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package canopy_ops
+
+// canopy-ops sddl-lint <file>
+// Check an SDDL document for mistakes
+
+import (
+    "canopy/device_filter"
+    "canopy/sddl"
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+)
+
+type SDDLLintCommand struct{}
+
+func (SDDLLintCommand)HelpOneLiner() string {
+    return "    sddl-lint   Check an SDDL document for mistakes"
+}
+
+func (SDDLLintCommand)Help() {
+    fmt.Println("COMMAND:")
+    fmt.Println("   canopy-ops sddl-lint <file>")
+    fmt.Println("")
+    fmt.Println("DESCRIPTION:")
+    fmt.Println("   Check the SDDL document in <file> for mistakes, such as unknown")
+    fmt.Println("   properties, min-value greater than max-value, invalid regexes, and")
+    fmt.Println("   min-value/max-value on non-numeric variables.  Derived variable")
+    fmt.Println("   expressions are also checked for undeclared inputs and cycles.")
+    fmt.Println("   Each problem is printed with its location as a JSON Pointer into")
+    fmt.Println("   the document.")
+    fmt.Println("")
+    fmt.Println("   Exits with status 1 if any problems are found.")
+    fmt.Println("")
+}
+
+func (SDDLLintCommand)Match(cmdString string) bool {
+    return (cmdString == "sddl-lint")
+}
+
+// Read and JSON-decode the SDDL document in <filename>.
+func readSDDLFile(filename string) (map[string]interface{}, error) {
+    contents, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    var jsn map[string]interface{}
+    err = json.Unmarshal(contents, &jsn)
+    if err != nil {
+        return nil, fmt.Errorf("%s: invalid JSON: %s", filename, err)
+    }
+    return jsn, nil
+}
+
+func (SDDLLintCommand)Perform(info CommandInfo) {
+    if len(info.Args) != 2 {
+        fmt.Println("Usage: canopy-ops sddl-lint <file>")
+        os.Exit(2)
+    }
+    jsn, err := readSDDLFile(info.Args[1])
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+
+    problems := sddl.Lint(jsn)
+    if len(problems) == 0 {
+        // Derived variable expressions are checked by device_filter, which
+        // the sddl package can't depend on.
+        doc, _ := sddl.Sys.ParseDocument(jsn)
+        err = device_filter.CheckDerivedVars(doc)
+        if err != nil {
+            problems = append(problems, sddl.LintProblem{Path: "/", Msg: err.Error()})
+        }
+    }
+    for _, problem := range problems {
+        fmt.Printf("%s:%s\n", info.Args[1], problem)
+    }
+    if len(problems) > 0 {
+        fmt.Printf("%d problem(s) found\n", len(problems))
+        os.Exit(1)
+    }
+    fmt.Println("OK")
+}
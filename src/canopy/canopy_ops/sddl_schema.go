@@ -0,0 +1,70 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package canopy_ops
+
+// canopy-ops sddl-schema <file>
+// Generate a JSON Schema for device payloads
+
+import (
+    "canopy/sddl"
+    "encoding/json"
+    "fmt"
+    "os"
+)
+
+type SDDLSchemaCommand struct{}
+
+func (SDDLSchemaCommand)HelpOneLiner() string {
+    return "    sddl-schema Generate JSON Schema for an SDDL document"
+}
+
+func (SDDLSchemaCommand)Help() {
+    fmt.Println("COMMAND:")
+    fmt.Println("   canopy-ops sddl-schema <file>")
+    fmt.Println("")
+    fmt.Println("DESCRIPTION:")
+    fmt.Println("   Print a JSON Schema (draft 4) for the payloads a device using the")
+    fmt.Println("   SDDL document in <file> may report.  Use it to validate payloads")
+    fmt.Println("   without a connection to the server.")
+    fmt.Println("")
+}
+
+func (SDDLSchemaCommand)Match(cmdString string) bool {
+    return (cmdString == "sddl-schema")
+}
+
+func (SDDLSchemaCommand)Perform(info CommandInfo) {
+    if len(info.Args) != 2 {
+        fmt.Println("Usage: canopy-ops sddl-schema <file>")
+        os.Exit(2)
+    }
+    jsn, err := readSDDLFile(info.Args[1])
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    doc, err := sddl.Sys.ParseDocument(jsn)
+    if err != nil {
+        fmt.Printf("%s: %s (run 'canopy-ops sddl-lint' for details)\n", info.Args[1], err)
+        os.Exit(1)
+    }
+
+    out, err := json.MarshalIndent(sddl.JSONSchema(doc), "", "    ")
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    fmt.Println(string(out))
+}
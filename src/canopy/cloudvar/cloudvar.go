@@ -15,9 +15,13 @@
 package cloudvar
 
 import (
+    "bytes"
     "canopy/sddl"
+    "encoding/base64"
     "time"
     "fmt"
+    "math/big"
+    "strconv"
 )
 
 // CloudVarValue represents the value of a Cloud Variable
@@ -39,6 +43,22 @@ import (
 //  sddl.DATATYPE_FLOAT32                   float32
 //  sddl.DATATYPE_FLOAT64                   float64
 //  sddl.DATATYPE_DATETIME                  time.Time
+//  sddl.DATATYPE_STRUCT                    map[string]CloudVarValue
+//  sddl.DATATYPE_ARRAY                     []CloudVarValue
+//  sddl.DATATYPE_ENUM                      string
+//  sddl.DATATYPE_INT64                     int64
+//  sddl.DATATYPE_UINT64                    uint64
+//  sddl.DATATYPE_BYTES                     []byte
+//
+// Struct values are keyed by member name (not full name).  Members that were
+// not reported are omitted from the map.
+//
+// Enum values are the name of one of the Cloud Variable's allowed values.
+// (They are stored in the database by index.)
+//
+// JSON numbers can't represent every 64-bit integer, so int64 and uint64
+// values are exchanged in JSON as decimal strings (ex: "18446744073709551615").
+// Bytes values are exchanged as base64-encoded strings.
 
 type CloudVarValue interface {}
 
@@ -63,9 +83,10 @@ type CloudVar struct {
 }
 
 func CloudVarValueDatatype(value CloudVarValue) sddl.DatatypeEnum{
-    switch value.(type) {
-    case interface{}:
+    if value == nil {
         return sddl.DATATYPE_VOID
+    }
+    switch value.(type) {
     case string:
         return sddl.DATATYPE_STRING
     case bool:
@@ -82,17 +103,29 @@ func CloudVarValueDatatype(value CloudVarValue) sddl.DatatypeEnum{
         return sddl.DATATYPE_UINT16
     case uint32:
         return sddl.DATATYPE_UINT32
+    case int64:
+        return sddl.DATATYPE_INT64
+    case uint64:
+        return sddl.DATATYPE_UINT64
+    case []byte:
+        return sddl.DATATYPE_BYTES
     case float32:
         return sddl.DATATYPE_FLOAT32
     case float64:
         return sddl.DATATYPE_FLOAT64
     case time.Time:
         return sddl.DATATYPE_DATETIME
+    case map[string]CloudVarValue:
+        return sddl.DATATYPE_STRUCT
+    case []CloudVarValue:
+        return sddl.DATATYPE_ARRAY
     }
     return sddl.DATATYPE_INVALID
 }
 
-func cloudVarValueToFloat64(v CloudVarValue) (float64, bool) {
+// Convert a numeric (or bool) Cloud Variable value to a float64.  Returns
+// false if <v> is not numeric.
+func CloudVarValueToFloat64(v CloudVarValue) (float64, bool) {
     switch v := v.(type) {
     case bool:
         if v {
@@ -111,6 +144,10 @@ func cloudVarValueToFloat64(v CloudVarValue) (float64, bool) {
         return float64(v), true
     case uint32:
         return float64(v), true
+    case int64:
+        return float64(v), true
+    case uint64:
+        return float64(v), true
     case float32:
         return float64(v), true
     case float64:
@@ -119,13 +156,83 @@ func cloudVarValueToFloat64(v CloudVarValue) (float64, bool) {
     return 0, false
 }
 
+// Convert an integer value to a big.Int, so that 64-bit values can be
+// compared without the precision loss of converting to float64.
+func cloudVarValueToBigInt(v CloudVarValue) (*big.Int, bool) {
+    switch v := v.(type) {
+    case int8:
+        return big.NewInt(int64(v)), true
+    case int16:
+        return big.NewInt(int64(v)), true
+    case int32:
+        return big.NewInt(int64(v)), true
+    case int64:
+        return big.NewInt(v), true
+    case uint8:
+        return big.NewInt(int64(v)), true
+    case uint16:
+        return big.NewInt(int64(v)), true
+    case uint32:
+        return big.NewInt(int64(v)), true
+    case uint64:
+        return new(big.Int).SetUint64(v), true
+    }
+    return nil, false
+}
+
+// Apply comparison <op> to the result of a three-way comparison (-1, 0 or 1).
+func compareResult(cmp int, op CompareOpEnum) (bool, error) {
+    switch op {
+    case LT:
+        return (cmp < 0), nil
+    case LTE:
+        return (cmp <= 0), nil
+    case EQ:
+        return (cmp == 0), nil
+    case NEQ:
+        return (cmp != 0), nil
+    case GT:
+        return (cmp > 0), nil
+    case GTE:
+        return (cmp >= 0), nil
+    }
+    return false, fmt.Errorf("Unsupported comparison op")
+}
+
 // Loose comparison (i.e. datatypes typically don't have to match exactly)
+//
+// Strings (including enum values) are compared by name.  Integers are
+// compared exactly, even if they don't fit in a float64.
 func CompareValues(v0, v1 CloudVarValue, op CompareOpEnum) (bool, error) {
-    f0, ok := cloudVarValueToFloat64(v0)
+    s0, ok0 := v0.(string)
+    s1, ok1 := v1.(string)
+    if ok0 && ok1 {
+        switch {
+        case s0 < s1:
+            return compareResult(-1, op)
+        case s0 > s1:
+            return compareResult(1, op)
+        }
+        return compareResult(0, op)
+    }
+
+    b0, ok0 := v0.([]byte)
+    b1, ok1 := v1.([]byte)
+    if ok0 && ok1 {
+        return compareResult(bytes.Compare(b0, b1), op)
+    }
+
+    i0, ok0 := cloudVarValueToBigInt(v0)
+    i1, ok1 := cloudVarValueToBigInt(v1)
+    if ok0 && ok1 {
+        return compareResult(i0.Cmp(i1), op)
+    }
+
+    f0, ok := CloudVarValueToFloat64(v0)
     if !ok {
         return false, fmt.Errorf("Only numerics supported at this time")
     }
-    f1, ok := cloudVarValueToFloat64(v1)
+    f1, ok := CloudVarValueToFloat64(v1)
     if !ok {
         return false, fmt.Errorf("Only numerics supported at this time")
     }
@@ -150,7 +257,7 @@ func Greater(datatype sddl.DatatypeEnum, value0, value1 CloudVarValue) (bool, er
     switch datatype {
     case sddl.DATATYPE_VOID:
         return false, nil
-    case sddl.DATATYPE_STRING:
+    case sddl.DATATYPE_STRING, sddl.DATATYPE_ENUM:
         v0, ok := value0.(string)
         if !ok {
             return false, fmt.Errorf("cloudvar.Greater expects string value for v0")
@@ -230,6 +337,36 @@ func Greater(datatype sddl.DatatypeEnum, value0, value1 CloudVarValue) (bool, er
             return false, fmt.Errorf("cloudvar.Greater expects uint32 value for v1")
         }
         return (v0 > v1), nil
+    case sddl.DATATYPE_INT64:
+        v0, ok := value0.(int64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Greater expects int64 value for v0")
+        }
+        v1, ok := value1.(int64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Greater expects int64 value for v1")
+        }
+        return (v0 > v1), nil
+    case sddl.DATATYPE_UINT64:
+        v0, ok := value0.(uint64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Greater expects uint64 value for v0")
+        }
+        v1, ok := value1.(uint64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Greater expects uint64 value for v1")
+        }
+        return (v0 > v1), nil
+    case sddl.DATATYPE_BYTES:
+        v0, ok := value0.([]byte)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Greater expects []byte value for v0")
+        }
+        v1, ok := value1.([]byte)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Greater expects []byte value for v1")
+        }
+        return (bytes.Compare(v0, v1) > 0), nil
     case sddl.DATATYPE_FLOAT32:
         v0, ok := value0.(float32)
         if !ok {
@@ -269,7 +406,7 @@ func Less(datatype sddl.DatatypeEnum, value0, value1 CloudVarValue) (bool, error
     switch datatype {
     case sddl.DATATYPE_VOID:
         return false, nil
-    case sddl.DATATYPE_STRING:
+    case sddl.DATATYPE_STRING, sddl.DATATYPE_ENUM:
         v0, ok := value0.(string)
         if !ok {
             return false, fmt.Errorf("cloudvar.Less expects string value for v0")
@@ -349,6 +486,36 @@ func Less(datatype sddl.DatatypeEnum, value0, value1 CloudVarValue) (bool, error
             return false, fmt.Errorf("cloudvar.Less expects uint32 value for v1")
         }
         return (v0 < v1), nil
+    case sddl.DATATYPE_INT64:
+        v0, ok := value0.(int64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Less expects int64 value for v0")
+        }
+        v1, ok := value1.(int64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Less expects int64 value for v1")
+        }
+        return (v0 < v1), nil
+    case sddl.DATATYPE_UINT64:
+        v0, ok := value0.(uint64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Less expects uint64 value for v0")
+        }
+        v1, ok := value1.(uint64)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Less expects uint64 value for v1")
+        }
+        return (v0 < v1), nil
+    case sddl.DATATYPE_BYTES:
+        v0, ok := value0.([]byte)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Less expects []byte value for v0")
+        }
+        v1, ok := value1.([]byte)
+        if !ok {
+            return false, fmt.Errorf("cloudvar.Less expects []byte value for v1")
+        }
+        return (bytes.Compare(v0, v1) < 0), nil
     case sddl.DATATYPE_FLOAT32:
         v0, ok := value0.(float32)
         if !ok {
@@ -384,6 +551,38 @@ func Less(datatype sddl.DatatypeEnum, value0, value1 CloudVarValue) (bool, error
     }
 }
 
+// Largest integer magnitude that a JSON number (float64) represents exactly.
+const maxExactJsonInt = 1 << 53
+
+// Convert a Cloud Variable value to its golang JSON representation.  This is
+// the inverse of JsonToCloudVarValue: 64-bit integers become decimal strings
+// and bytes become base64 strings.  Other values are returned as-is.
+func CloudVarValueToJson(value CloudVarValue) interface{} {
+    switch v := value.(type) {
+    case int64:
+        return strconv.FormatInt(v, 10)
+    case uint64:
+        return strconv.FormatUint(v, 10)
+    case []byte:
+        return base64.StdEncoding.EncodeToString(v)
+    case time.Time:
+        return v.Format(time.RFC3339Nano)
+    case map[string]CloudVarValue:
+        out := map[string]interface{}{}
+        for name, member := range v {
+            out[name] = CloudVarValueToJson(member)
+        }
+        return out
+    case []CloudVarValue:
+        out := []interface{}{}
+        for _, elem := range v {
+            out = append(out, CloudVarValueToJson(elem))
+        }
+        return out
+    }
+    return value
+}
+
 func JsonToCloudVarValue(varDef sddl.VarDef, value interface{}) (interface{}, error) {
     switch varDef.Datatype() {
     case sddl.DATATYPE_VOID:
@@ -436,6 +635,48 @@ func JsonToCloudVarValue(varDef sddl.VarDef, value interface{}) (interface{}, er
             return nil, fmt.Errorf("JsonToCloudVarValue expects number value for %s", varDef.Name())
         }
         return uint32(v), nil
+    case sddl.DATATYPE_INT64:
+        // Decimal strings are preferred, since JSON numbers lose precision
+        // above 2^53.
+        switch v := value.(type) {
+        case string:
+            i, err := strconv.ParseInt(v, 10, 64)
+            if err != nil {
+                return nil, fmt.Errorf("JsonToCloudVarValue: invalid int64 value %q for %s", v, varDef.Name())
+            }
+            return i, nil
+        case float64:
+            if v > maxExactJsonInt || v < -maxExactJsonInt || v != float64(int64(v)) {
+                return nil, fmt.Errorf("JsonToCloudVarValue: int64 value for %s must be a string to be represented exactly", varDef.Name())
+            }
+            return int64(v), nil
+        }
+        return nil, fmt.Errorf("JsonToCloudVarValue expects string value for %s", varDef.Name())
+    case sddl.DATATYPE_UINT64:
+        switch v := value.(type) {
+        case string:
+            i, err := strconv.ParseUint(v, 10, 64)
+            if err != nil {
+                return nil, fmt.Errorf("JsonToCloudVarValue: invalid uint64 value %q for %s", v, varDef.Name())
+            }
+            return i, nil
+        case float64:
+            if v < 0 || v > maxExactJsonInt || v != float64(uint64(v)) {
+                return nil, fmt.Errorf("JsonToCloudVarValue: uint64 value for %s must be a string to be represented exactly", varDef.Name())
+            }
+            return uint64(v), nil
+        }
+        return nil, fmt.Errorf("JsonToCloudVarValue expects string value for %s", varDef.Name())
+    case sddl.DATATYPE_BYTES:
+        v, ok := value.(string)
+        if !ok {
+            return nil, fmt.Errorf("JsonToCloudVarValue expects base64 string value for %s", varDef.Name())
+        }
+        b, err := base64.StdEncoding.DecodeString(v)
+        if err != nil {
+            return nil, fmt.Errorf("JsonToCloudVarValue expects base64 string value for %s", varDef.Name())
+        }
+        return b, nil
     case sddl.DATATYPE_FLOAT32:
         v, ok := value.(float64)
         if !ok {
@@ -458,7 +699,79 @@ func JsonToCloudVarValue(varDef sddl.VarDef, value interface{}) (interface{}, er
             return nil, fmt.Errorf("JsonToCloudVarValue expects RFC3339 formatted time value for %s", varDef.Name())
         }
         return tval, nil
+    case sddl.DATATYPE_ENUM:
+        // Accept either the value's name or its index.
+        values, err := varDef.EnumValues()
+        if err != nil {
+            return nil, err
+        }
+        switch v := value.(type) {
+        case string:
+            if sddl.EnumValueIndex(varDef, v) == -1 {
+                return nil, fmt.Errorf("JsonToCloudVarValue: %q is not an allowed value for %s", v, varDef.Fullname())
+            }
+            return v, nil
+        case float64:
+            idx := int(v)
+            if float64(idx) != v || idx < 0 || idx >= len(values) {
+                return nil, fmt.Errorf("JsonToCloudVarValue: invalid enum index %v for %s", v, varDef.Fullname())
+            }
+            return values[idx], nil
+        }
+        return nil, fmt.Errorf("JsonToCloudVarValue expects string value for %s", varDef.Fullname())
+    case sddl.DATATYPE_STRUCT:
+        v, ok := value.(map[string]interface{})
+        if !ok {
+            return nil, fmt.Errorf("JsonToCloudVarValue expects object value for %s", varDef.Fullname())
+        }
+        members, err := varDef.StructMembers()
+        if err != nil {
+            return nil, err
+        }
+        out := map[string]CloudVarValue{}
+        for memberName, memberJsn := range v {
+            var memberDef sddl.VarDef
+            for _, member := range members {
+                if member.Name() == memberName {
+                    memberDef = member
+                    break
+                }
+            }
+            if memberDef == nil {
+                return nil, fmt.Errorf("JsonToCloudVarValue: %s has no member %s", varDef.Fullname(), memberName)
+            }
+            out[memberName], err = JsonToCloudVarValue(memberDef, memberJsn)
+            if err != nil {
+                return nil, err
+            }
+        }
+        return out, nil
+    case sddl.DATATYPE_ARRAY:
+        v, ok := value.([]interface{})
+        if !ok {
+            return nil, fmt.Errorf("JsonToCloudVarValue expects array value for %s", varDef.Fullname())
+        }
+        size, err := varDef.ArraySize()
+        if err != nil {
+            return nil, err
+        }
+        if size != 0 && len(v) != size {
+            return nil, fmt.Errorf("JsonToCloudVarValue expects %d elements for %s, got %d", size, varDef.Fullname(), len(v))
+        }
+        elemDef, err := varDef.ArrayElement()
+        if err != nil {
+            return nil, err
+        }
+        out := []CloudVarValue{}
+        for _, elemJsn := range v {
+            elem, err := JsonToCloudVarValue(elemDef, elemJsn)
+            if err != nil {
+                return nil, err
+            }
+            out = append(out, elem)
+        }
+        return out, nil
     default:
-        return nil, fmt.Errorf("InsertSample unsupported datatype ", varDef.Datatype())
+        return nil, fmt.Errorf("JsonToCloudVarValue unsupported datatype %d", varDef.Datatype())
     }
 }
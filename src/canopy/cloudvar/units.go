@@ -0,0 +1,52 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudvar
+
+import (
+    "canopy/sddl"
+    "fmt"
+)
+
+// Convert a numeric Cloud Variable value (or each element of a numeric
+// array) from the units declared in <varDef> to <toUnits>.  Converted values
+// are float64, since the result rarely fits the original datatype.
+func ConvertValueUnits(varDef sddl.VarDef, value CloudVarValue, toUnits string) (CloudVarValue, error) {
+    fromUnits, _ := varDef.Units()
+    if fromUnits == "" {
+        return nil, fmt.Errorf("%s has no units", varDef.Fullname())
+    }
+
+    if arr, ok := value.([]CloudVarValue); ok {
+        out := []CloudVarValue{}
+        for _, elem := range arr {
+            f, ok := CloudVarValueToFloat64(elem)
+            if !ok {
+                return nil, fmt.Errorf("Expected numeric elements for %s", varDef.Fullname())
+            }
+            converted, err := sddl.ConvertUnits(f, fromUnits, toUnits)
+            if err != nil {
+                return nil, err
+            }
+            out = append(out, converted)
+        }
+        return out, nil
+    }
+
+    f, ok := CloudVarValueToFloat64(value)
+    if !ok {
+        return nil, fmt.Errorf("Expected numeric value for %s", varDef.Fullname())
+    }
+    return sddl.ConvertUnits(f, fromUnits, toUnits)
+}
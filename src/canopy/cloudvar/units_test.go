@@ -0,0 +1,63 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package cloudvar
+
+import (
+    "canopy/sddl"
+    "math"
+    "testing"
+)
+
+func TestConvertValueUnits(t *testing.T) {
+    varDef, err := sddl.ParseVar("out int16 temperature", map[string]interface{}{"units" : "degrees_c"})
+    if err != nil {
+        t.Fatalf("ParseVar: %s", err)
+    }
+    result, err := ConvertValueUnits(varDef, int16(100), "degrees_f")
+    if err != nil || math.Abs(result.(float64) - 212) > 1e-9 {
+        t.Errorf("ConvertValueUnits(100 degrees_c): got %v %v, expected 212", result, err)
+    }
+    _, err = ConvertValueUnits(varDef, "hot", "degrees_f")
+    if err == nil {
+        t.Errorf("ConvertValueUnits accepted non-numeric value")
+    }
+    _, err = ConvertValueUnits(varDef, int16(100), "meter")
+    if err == nil {
+        t.Errorf("ConvertValueUnits converted temperature to length")
+    }
+
+    arrayDef, err := sddl.ParseVar("out float32[] lengths", map[string]interface{}{"units" : "inch"})
+    if err != nil {
+        t.Fatalf("ParseVar: %s", err)
+    }
+    result, err = ConvertValueUnits(arrayDef, []CloudVarValue{float32(12), float32(36)}, "foot")
+    if err != nil {
+        t.Fatalf("ConvertValueUnits: %s", err)
+    }
+    arr, ok := result.([]CloudVarValue)
+    if !ok || len(arr) != 2 || math.Abs(arr[0].(float64) - 1) > 1e-9 || math.Abs(arr[1].(float64) - 3) > 1e-9 {
+        t.Errorf("ConvertValueUnits(12, 36 inch): got %v, expected [1 3]", result)
+    }
+
+    noUnits, err := sddl.ParseVar("out float32 level", map[string]interface{}{})
+    if err != nil {
+        t.Fatalf("ParseVar: %s", err)
+    }
+    _, err = ConvertValueUnits(noUnits, float32(1), "ratio")
+    if err == nil {
+        t.Errorf("ConvertValueUnits converted a value without units")
+    }
+}
@@ -0,0 +1,286 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudvar
+
+import (
+    "canopy/sddl"
+    "fmt"
+    "math"
+    "math/big"
+)
+
+// ValidationWarning describes a problem with a single reported Cloud Variable
+// value.  Ingestion paths collect these and report them back to the caller
+// instead of silently dropping the value.
+type ValidationWarning struct {
+    // Name of the Cloud Variable the warning applies to.
+    VarName string
+
+    // Machine-readable problem code, ex: "above_max_value".
+    Problem string
+
+    // What was done with the value: "rejected" or "clamped".
+    Action string
+
+    // Human-readable description of the problem.
+    Msg string
+}
+
+// Get golang JSON representation of a validation warning.
+func (warning *ValidationWarning) Json() map[string]interface{} {
+    return map[string]interface{}{
+        "var_name" : warning.VarName,
+        "problem" : warning.Problem,
+        "action" : warning.Action,
+        "msg" : warning.Msg,
+    }
+}
+
+// Get golang JSON representation of a list of validation warnings.
+func ValidationWarningsToJson(warnings []ValidationWarning) []interface{} {
+    out := []interface{}{}
+    for i := range warnings {
+        out = append(out, warnings[i].Json())
+    }
+    return out
+}
+
+func newRejectWarning(varDef sddl.VarDef, problem, msg string) *ValidationWarning {
+    return &ValidationWarning{
+        VarName: varDef.Fullname(),
+        Problem: problem,
+        Action: "rejected",
+        Msg: msg,
+    }
+}
+
+// Compare a numeric Cloud Variable value with an SDDL "min-value" or
+// "max-value" limit, returning -1, 0 or +1.  int64 and uint64 values are
+// compared exactly, because float64 can't represent all of them.
+func compareWithLimit(value CloudVarValue, f, limit float64) int {
+    switch v := value.(type) {
+    case int64:
+        return new(big.Float).SetInt64(v).Cmp(big.NewFloat(limit))
+    case uint64:
+        return new(big.Float).SetUint64(v).Cmp(big.NewFloat(limit))
+    }
+    if f < limit {
+        return -1
+    } else if f > limit {
+        return 1
+    }
+    return 0
+}
+
+// Convert an SDDL limit to the golang type used for <datatype>, for
+// clamping.  Integer types round the limit into the allowed range: up for
+// "min-value" and down for "max-value".  int64 and uint64 saturate at the
+// bounds of their type instead of overflowing.
+func limitToCloudVarValue(datatype sddl.DatatypeEnum, limit float64, isMin bool) (CloudVarValue, error) {
+    if datatype != sddl.DATATYPE_FLOAT32 && datatype != sddl.DATATYPE_FLOAT64 {
+        if isMin {
+            limit = math.Ceil(limit)
+        } else {
+            limit = math.Floor(limit)
+        }
+    }
+    switch datatype {
+    case sddl.DATATYPE_INT8:
+        return int8(limit), nil
+    case sddl.DATATYPE_UINT8:
+        return uint8(limit), nil
+    case sddl.DATATYPE_INT16:
+        return int16(limit), nil
+    case sddl.DATATYPE_UINT16:
+        return uint16(limit), nil
+    case sddl.DATATYPE_INT32:
+        return int32(limit), nil
+    case sddl.DATATYPE_UINT32:
+        return uint32(limit), nil
+    case sddl.DATATYPE_INT64:
+        i, _ := big.NewFloat(limit).Int64()
+        return i, nil
+    case sddl.DATATYPE_UINT64:
+        u, _ := big.NewFloat(limit).Uint64()
+        return u, nil
+    case sddl.DATATYPE_FLOAT32:
+        return float32(limit), nil
+    case sddl.DATATYPE_FLOAT64:
+        return limit, nil
+    }
+    return nil, fmt.Errorf("limitToCloudVarValue unsupported datatype %d", datatype)
+}
+
+// Validate a basic (non-struct, non-array) Cloud Variable value.
+func validateBasicValue(varDef sddl.VarDef, value CloudVarValue) (CloudVarValue, *ValidationWarning) {
+    if varDef.IsNumeric() {
+        f, ok := CloudVarValueToFloat64(value)
+        if !ok {
+            return nil, newRejectWarning(varDef, "bad_value",
+                fmt.Sprintf("Expected numeric value for %s", varDef.Fullname()))
+        }
+
+        problem := ""
+        limit := f
+        if varDef.HasMinValue() {
+            minValue, _ := varDef.MinValue()
+            if compareWithLimit(value, f, minValue) < 0 {
+                problem = "below_min_value"
+                limit = minValue
+            }
+        }
+        if varDef.HasMaxValue() {
+            maxValue, _ := varDef.MaxValue()
+            if compareWithLimit(value, f, maxValue) > 0 {
+                problem = "above_max_value"
+                limit = maxValue
+            }
+        }
+        if problem == "" {
+            return value, nil
+        }
+
+        if varDef.OutOfRangePolicy() != sddl.OUT_OF_RANGE_POLICY_CLAMP {
+            return nil, newRejectWarning(varDef, problem,
+                fmt.Sprintf("Value %v for %s is out of range", value, varDef.Fullname()))
+        }
+
+        clamped, err := limitToCloudVarValue(varDef.Datatype(), limit,
+                problem == "below_min_value")
+        if err != nil {
+            return nil, newRejectWarning(varDef, problem, err.Error())
+        }
+        return clamped, &ValidationWarning{
+            VarName: varDef.Fullname(),
+            Problem: problem,
+            Action: "clamped",
+            Msg: fmt.Sprintf("Value %v for %s is out of range, clamped to %v", value, varDef.Fullname(), clamped),
+        }
+    }
+
+    if varDef.Datatype() == sddl.DATATYPE_ENUM {
+        s, ok := value.(string)
+        if !ok || sddl.EnumValueIndex(varDef, s) == -1 {
+            return nil, newRejectWarning(varDef, "invalid_enum_value",
+                fmt.Sprintf("Value %v is not an allowed value for %s", value, varDef.Fullname()))
+        }
+        return value, nil
+    }
+
+    if varDef.Datatype() == sddl.DATATYPE_STRING {
+        regex, _ := varDef.Regex()
+        if regex == "" {
+            return value, nil
+        }
+        s, ok := value.(string)
+        if !ok {
+            return nil, newRejectWarning(varDef, "bad_value",
+                fmt.Sprintf("Expected string value for %s", varDef.Fullname()))
+        }
+        re, err := varDef.RegexMatcher()
+        if err != nil {
+            return nil, newRejectWarning(varDef, "invalid_regex",
+                fmt.Sprintf("Invalid regex for %s: %s", varDef.Fullname(), err))
+        }
+        if !re.MatchString(s) {
+            return nil, newRejectWarning(varDef, "regex_mismatch",
+                fmt.Sprintf("Value %q for %s does not match regex %s", s, varDef.Fullname(), regex))
+        }
+    }
+
+    return value, nil
+}
+
+// Validate a Cloud Variable value against the constraints ("min-value",
+// "max-value", "regex") declared in its SDDL definition.
+//
+// Returns the value that should be stored, which may differ from <value> if
+// a variable's "out-of-range" policy is "clamp", along with any warnings.
+// The final return value is false if the value was rejected and should not be
+// stored.
+//
+// Struct members are validated individually; rejected members are dropped
+// from the struct.  An array is rejected if any of its elements is rejected.
+func ValidateValue(varDef sddl.VarDef, value CloudVarValue) (CloudVarValue, []ValidationWarning, bool) {
+    warnings := []ValidationWarning{}
+
+    switch varDef.Datatype() {
+    case sddl.DATATYPE_STRUCT:
+        v, ok := value.(map[string]CloudVarValue)
+        if !ok {
+            warning := newRejectWarning(varDef, "bad_value",
+                fmt.Sprintf("Expected struct value for %s", varDef.Fullname()))
+            return nil, append(warnings, *warning), false
+        }
+        members, _ := varDef.StructMembers()
+        out := map[string]CloudVarValue{}
+        for _, member := range members {
+            memberVal, present := v[member.Name()]
+            if !present {
+                continue
+            }
+            newVal, memberWarnings, accepted := ValidateValue(member, memberVal)
+            warnings = append(warnings, memberWarnings...)
+            if accepted {
+                out[member.Name()] = newVal
+            }
+        }
+        if len(out) == 0 && len(v) > 0 {
+            return nil, warnings, false
+        }
+        return out, warnings, true
+    case sddl.DATATYPE_ARRAY:
+        v, ok := value.([]CloudVarValue)
+        if !ok {
+            warning := newRejectWarning(varDef, "bad_value",
+                fmt.Sprintf("Expected array value for %s", varDef.Fullname()))
+            return nil, append(warnings, *warning), false
+        }
+        elemDef, _ := varDef.ArrayElement()
+        out := []CloudVarValue{}
+        for i, elem := range v {
+            newElem, warning := validateBasicValue(elemDef, elem)
+            if warning != nil {
+                warning.VarName = fmt.Sprintf("%s[%d]", varDef.Fullname(), i)
+                warnings = append(warnings, *warning)
+                if warning.Action == "rejected" {
+                    return nil, warnings, false
+                }
+            }
+            out = append(out, newElem)
+        }
+        return out, warnings, true
+    }
+
+    newVal, warning := validateBasicValue(varDef, value)
+    if warning == nil {
+        return newVal, warnings, true
+    }
+    return newVal, append(warnings, *warning), (warning.Action != "rejected")
+}
+
+// Convert a JSON value to a Cloud Variable value and validate it.  This is
+// the entry point that every ingestion path (device reports, REST updates,
+// ...) should use.
+//
+// Return values are the same as ValidateValue.
+func JsonToValidatedCloudVarValue(varDef sddl.VarDef, value interface{}) (CloudVarValue, []ValidationWarning, bool) {
+    varVal, err := JsonToCloudVarValue(varDef, value)
+    if err != nil {
+        warning := newRejectWarning(varDef, "bad_value", err.Error())
+        return nil, []ValidationWarning{*warning}, false
+    }
+    return ValidateValue(varDef, varVal)
+}
@@ -0,0 +1,202 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudvar
+
+import (
+    "canopy/sddl"
+    "math"
+    "testing"
+)
+
+func TestCompareWithLimit(t *testing.T) {
+    // 2^53 + 1 is the first integer float64 can't represent; converted to
+    // float64 it equals 2^53.
+    tests := []struct {
+        value CloudVarValue
+        limit float64
+        expected int
+    }{
+        {int64(9007199254740993), 9007199254740992, 1},
+        {int64(9007199254740992), 9007199254740992, 0},
+        {int64(9007199254740991), 9007199254740992, -1},
+        {int64(-9007199254740993), -9007199254740992, -1},
+        {uint64(9007199254740993), 9007199254740992, 1},
+        {uint64(18446744073709551615), 18446744073709551616, -1},
+        {int32(5), 5, 0},
+        {float32(1.5), 2, -1},
+        {float64(2.5), 2, 1},
+    }
+    for _, test := range tests {
+        f, _ := CloudVarValueToFloat64(test.value)
+        result := compareWithLimit(test.value, f, test.limit)
+        if result != test.expected {
+            t.Errorf("compareWithLimit(%T %v, %v) = %d, expected %d",
+                test.value, test.value, test.limit, result, test.expected)
+        }
+    }
+}
+
+func TestLimitToCloudVarValue(t *testing.T) {
+    tests := []struct {
+        datatype sddl.DatatypeEnum
+        limit float64
+        isMin bool
+        expected CloudVarValue
+    }{
+        // Integer limits round into the allowed range.
+        {sddl.DATATYPE_INT8, 1.2, true, int8(2)},
+        {sddl.DATATYPE_INT8, 1.8, false, int8(1)},
+        {sddl.DATATYPE_INT16, -1.5, true, int16(-1)},
+        {sddl.DATATYPE_INT16, -1.5, false, int16(-2)},
+        {sddl.DATATYPE_UINT8, 0.5, true, uint8(1)},
+        {sddl.DATATYPE_UINT32, 7.9, false, uint32(7)},
+        {sddl.DATATYPE_INT32, 3, true, int32(3)},
+        // int64 and uint64 saturate.
+        {sddl.DATATYPE_INT64, 1e19, false, int64(math.MaxInt64)},
+        {sddl.DATATYPE_INT64, -1e19, true, int64(math.MinInt64)},
+        {sddl.DATATYPE_INT64, 9007199254740992.5, false, int64(9007199254740992)},
+        {sddl.DATATYPE_UINT64, -1, true, uint64(0)},
+        {sddl.DATATYPE_UINT64, 1e20, false, uint64(math.MaxUint64)},
+        // Floating point limits are used as-is.
+        {sddl.DATATYPE_FLOAT32, 1.5, false, float32(1.5)},
+        {sddl.DATATYPE_FLOAT64, -0.5, true, float64(-0.5)},
+    }
+    for _, test := range tests {
+        result, err := limitToCloudVarValue(test.datatype, test.limit, test.isMin)
+        if err != nil {
+            t.Errorf("limitToCloudVarValue(%d, %v, %t): %s", test.datatype, test.limit, test.isMin, err)
+            continue
+        }
+        if result != test.expected {
+            t.Errorf("limitToCloudVarValue(%d, %v, %t) = %T %v, expected %T %v",
+                test.datatype, test.limit, test.isMin, result, result, test.expected, test.expected)
+        }
+    }
+
+    _, err := limitToCloudVarValue(sddl.DATATYPE_STRING, 1, true)
+    if err == nil {
+        t.Errorf("limitToCloudVarValue accepted string datatype")
+    }
+}
+
+func TestValidateLimits(t *testing.T) {
+    tests := []struct {
+        decl string
+        policy string
+        value interface{}
+        expected CloudVarValue
+        problem string
+        action string
+    }{
+        {"in int64 count", "reject", "9007199254740992", int64(9007199254740992), "", ""},
+        {"in int64 count", "reject", "9007199254740993", nil, "above_max_value", "rejected"},
+        {"in int64 count", "clamp", "9007199254740993", int64(9007199254740992), "above_max_value", "clamped"},
+        {"in int64 count", "clamp", "-2", int64(-1), "below_min_value", "clamped"},
+        {"in uint64 count", "clamp", "18446744073709551615", uint64(9007199254740992), "above_max_value", "clamped"},
+        {"in int8 level", "clamp", float64(-100), int8(-1), "below_min_value", "clamped"},
+        {"in int8 level", "reject", float64(-100), nil, "below_min_value", "rejected"},
+        {"in float32 level", "clamp", float64(-100), float32(-1.5), "below_min_value", "clamped"},
+    }
+    for _, test := range tests {
+        varDef, err := sddl.ParseVar(test.decl, map[string]interface{}{
+            "min-value" : -1.5,
+            "max-value" : 9007199254740992.0,
+            "out-of-range" : test.policy,
+        })
+        if err != nil {
+            t.Fatalf("ParseVar(%q): %s", test.decl, err)
+        }
+        result, warnings, accepted := JsonToValidatedCloudVarValue(varDef, test.value)
+        if accepted != (test.action != "rejected") {
+            t.Errorf("%s (%s) %v: accepted = %t", test.decl, test.policy, test.value, accepted)
+        }
+        if accepted && result != test.expected {
+            t.Errorf("%s (%s) %v: got %T %v, expected %T %v", test.decl, test.policy,
+                test.value, result, result, test.expected, test.expected)
+        }
+        if test.problem == "" {
+            if len(warnings) != 0 {
+                t.Errorf("%s (%s) %v: unexpected warnings %v", test.decl, test.policy, test.value, warnings)
+            }
+            continue
+        }
+        if len(warnings) != 1 || warnings[0].Problem != test.problem || warnings[0].Action != test.action {
+            t.Errorf("%s (%s) %v: got warnings %v, expected %s/%s", test.decl, test.policy,
+                test.value, warnings, test.problem, test.action)
+        }
+    }
+}
+
+func TestValidateEnum(t *testing.T) {
+    varDef, err := sddl.ParseVar("inout enum mode", map[string]interface{}{
+        "values" : []interface{}{"off", "heat", "cool"},
+    })
+    if err != nil {
+        t.Fatalf("ParseVar: %s", err)
+    }
+
+    // JSON values may name an allowed value or give its index.
+    jsonTests := []struct {
+        value interface{}
+        expected CloudVarValue
+    }{
+        {"heat", "heat"},
+        {"cool", "cool"},
+        {float64(0), "off"},
+        {"Heat", nil},
+        {"auto", nil},
+        {"", nil},
+        {float64(3), nil},
+        {float64(-1), nil},
+        {float64(1.5), nil},
+        {true, nil},
+    }
+    for _, test := range jsonTests {
+        result, warnings, accepted := JsonToValidatedCloudVarValue(varDef, test.value)
+        if test.expected != nil {
+            if !accepted || result != test.expected || len(warnings) != 0 {
+                t.Errorf("%v: got %v %v %t, expected %v", test.value, result, warnings, accepted, test.expected)
+            }
+            continue
+        }
+        if accepted {
+            t.Errorf("%v: accepted as %v", test.value, result)
+        }
+        if len(warnings) != 1 || warnings[0].Problem != "bad_value" || warnings[0].Action != "rejected" {
+            t.Errorf("%v: got warnings %v, expected bad_value", test.value, warnings)
+        }
+    }
+
+    // Values that bypass JSON conversion are checked too.
+    for _, value := range []CloudVarValue{"auto", "", int32(1)} {
+        _, warnings, accepted := ValidateValue(varDef, value)
+        if accepted || len(warnings) != 1 || warnings[0].Problem != "invalid_enum_value" {
+            t.Errorf("ValidateValue(%v): got %v %t, expected invalid_enum_value", value, warnings, accepted)
+        }
+    }
+
+    // Enum array elements are checked individually.
+    arrayDef, err := sddl.ParseVar("inout enum[2] modes", map[string]interface{}{
+        "values" : []interface{}{"off", "heat", "cool"},
+    })
+    if err != nil {
+        t.Fatalf("ParseVar: %s", err)
+    }
+    _, warnings, accepted := ValidateValue(arrayDef, []CloudVarValue{"heat", "auto"})
+    if accepted || len(warnings) != 1 || warnings[0].VarName != "modes[1]" ||
+            warnings[0].Problem != "invalid_enum_value" {
+        t.Errorf("Enum array with invalid element: got %v %t", warnings, accepted)
+    }
+}
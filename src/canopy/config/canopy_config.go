@@ -29,7 +29,9 @@ type CanopyConfig struct {
     buildDate string
     buildCommit string
     buildVersion string
+    emailDir string
     emailService string
+    emailTemplateDir string
     enableHTTP bool
     enableHTTPS bool
     forwardOtherHosts string
@@ -39,12 +41,28 @@ type CanopyConfig struct {
     httpsPrivKeyFile string
     httpsPort int16
     logFile string
+    notifyDedupWindow int
+    notifyDeviceRateLimit int
+    notifyDigestHour int
+    notifyRecipientRateLimit int
     webManagerPath string
     passwordHashCost int16
     passwordSecretSalt string
     productionSecret string
     sendgridSecretKey string
     sendgridUsername string
+    smtpFrom string
+    smtpHost string
+    smtpPassword string
+    smtpPort int16
+    smtpSecurity string
+    smtpUsername string
+    smsFile string
+    smsFrom string
+    smsGatewayToken string
+    smsGatewayURL string
+    smsRateLimit int
+    smsService string
     javascriptClientPath string
 }
 
@@ -52,7 +70,9 @@ func (config *CanopyConfig) ToString() string {
     return fmt.Sprint(`SERVER CONFIG SETTINGS:
 allow-anon-devices:  `, config.allowAnonDevices, `
 allow-origin:        `, config.allowOrigin, `
+email-dir:           `, config.emailDir, `
 email-service:       `, config.emailService, `
+email-template-dir:  `, config.emailTemplateDir, `
 enable-http:         `, config.enableHTTP, `
 enable-https:        `, config.enableHTTPS, `
 forward-other-hosts: `, config.forwardOtherHosts, `
@@ -63,7 +83,21 @@ https-port:          `, config.httpsPort, `
 https-priv-key-file: `, config.httpsPrivKeyFile, `
 js-client-path:      `, config.javascriptClientPath, `
 log-file:            `, config.logFile, `
+notify-dedup-window: `, config.notifyDedupWindow, `
+notify-device-rate-limit: `, config.notifyDeviceRateLimit, `
+notify-digest-hour:  `, config.notifyDigestHour, `
+notify-recipient-rate-limit: `, config.notifyRecipientRateLimit, `
 sendgrid-username:   `, config.sendgridUsername, `
+smtp-from:           `, config.smtpFrom, `
+smtp-host:           `, config.smtpHost, `
+smtp-port:           `, config.smtpPort, `
+smtp-security:       `, config.smtpSecurity, `
+smtp-username:       `, config.smtpUsername, `
+sms-file:            `, config.smsFile, `
+sms-from:            `, config.smsFrom, `
+sms-gateway-url:     `, config.smsGatewayURL, `
+sms-rate-limit:      `, config.smsRateLimit, `
+sms-service:         `, config.smsService, `
 web-manager-path:    `, config.webManagerPath)
 }
 
@@ -71,7 +105,9 @@ func (config *CanopyConfig) ToJsonObject() map[string]interface{}{
     return map[string]interface{} {
         "allow-anon-devices" : config.allowAnonDevices,
         "allow-origin" : config.allowOrigin,
+        "email-dir" : config.emailDir,
         "email-service" : config.emailService,
+        "email-template-dir" : config.emailTemplateDir,
         "enable-http" : config.enableHTTP,
         "enable-https" : config.enableHTTPS,
         "forward-other-hosts" : config.forwardOtherHosts,
@@ -82,7 +118,21 @@ func (config *CanopyConfig) ToJsonObject() map[string]interface{}{
         "https-priv-key-file" : config.httpsPrivKeyFile,
         "js-client-path" : config.javascriptClientPath,
         "log-file" : config.logFile,
+        "notify-dedup-window" : config.notifyDedupWindow,
+        "notify-device-rate-limit" : config.notifyDeviceRateLimit,
+        "notify-digest-hour" : config.notifyDigestHour,
+        "notify-recipient-rate-limit" : config.notifyRecipientRateLimit,
         "sendgrid-username" : config.sendgridUsername,
+        "smtp-from" : config.smtpFrom,
+        "smtp-host" : config.smtpHost,
+        "smtp-port" : config.smtpPort,
+        "smtp-security" : config.smtpSecurity,
+        "smtp-username" : config.smtpUsername,
+        "sms-file" : config.smsFile,
+        "sms-from" : config.smsFrom,
+        "sms-gateway-url" : config.smsGatewayURL,
+        "sms-rate-limit" : config.smsRateLimit,
+        "sms-service" : config.smsService,
         "web-manager-path" : config.webManagerPath,
     }
 }
@@ -152,14 +202,24 @@ func (config *CanopyConfig) LoadConfigEnv() error {
         config.allowOrigin = allowOrigin
     }
 
+    emailDir := os.Getenv("CCS_EMAIL_DIR")
+    if emailDir != "" {
+        config.emailDir = emailDir
+    }
+
     emailService := os.Getenv("CCS_EMAIL_SERVICE")
     if emailService != "" {
-        if !(emailService == "none" || emailService == "sendgrid") {
+        if !isValidEmailService(emailService) {
             return fmt.Errorf("Unknown email service: %s",  emailService)
         }
         config.emailService = emailService
     }
 
+    emailTemplateDir := os.Getenv("CCS_EMAIL_TEMPLATE_DIR")
+    if emailTemplateDir != "" {
+        config.emailTemplateDir = emailTemplateDir
+    }
+
     enableHTTP := os.Getenv("CCS_ENABLE_HTTP")
     if enableHTTP == "1" || enableHTTP == "true" {
         config.enableHTTP = true
@@ -226,6 +286,42 @@ func (config *CanopyConfig) LoadConfigEnv() error {
         config.logFile = logFile
     }
 
+    notifyDedupWindow := os.Getenv("CCS_NOTIFY_DEDUP_WINDOW")
+    if notifyDedupWindow != "" {
+        limit, err := strconv.ParseInt(notifyDedupWindow, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for CCS_NOTIFY_DEDUP_WINDOW: %s", notifyDedupWindow)
+        }
+        config.notifyDedupWindow = int(limit)
+    }
+
+    notifyDeviceRateLimit := os.Getenv("CCS_NOTIFY_DEVICE_RATE_LIMIT")
+    if notifyDeviceRateLimit != "" {
+        limit, err := strconv.ParseInt(notifyDeviceRateLimit, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for CCS_NOTIFY_DEVICE_RATE_LIMIT: %s", notifyDeviceRateLimit)
+        }
+        config.notifyDeviceRateLimit = int(limit)
+    }
+
+    notifyDigestHour := os.Getenv("CCS_NOTIFY_DIGEST_HOUR")
+    if notifyDigestHour != "" {
+        limit, err := strconv.ParseInt(notifyDigestHour, 0, 32)
+        if err != nil || limit < -1 || limit > 23 {
+            return fmt.Errorf("Invalid value for CCS_NOTIFY_DIGEST_HOUR: %s", notifyDigestHour)
+        }
+        config.notifyDigestHour = int(limit)
+    }
+
+    notifyRecipientRateLimit := os.Getenv("CCS_NOTIFY_RECIPIENT_RATE_LIMIT")
+    if notifyRecipientRateLimit != "" {
+        limit, err := strconv.ParseInt(notifyRecipientRateLimit, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for CCS_NOTIFY_RECIPIENT_RATE_LIMIT: %s", notifyRecipientRateLimit)
+        }
+        config.notifyRecipientRateLimit = int(limit)
+    }
+
     passwordHashCost := os.Getenv("CCS_PASSWORD_HASH_COST")
     if passwordHashCost != "" {
         hashCost, err := strconv.ParseInt(passwordHashCost, 0, 16)
@@ -255,6 +351,80 @@ func (config *CanopyConfig) LoadConfigEnv() error {
         config.sendgridUsername = sendgridUsername
     }
 
+    smtpFrom := os.Getenv("CCS_SMTP_FROM")
+    if smtpFrom != "" {
+        config.smtpFrom = smtpFrom
+    }
+
+    smtpHost := os.Getenv("CCS_SMTP_HOST")
+    if smtpHost != "" {
+        config.smtpHost = smtpHost
+    }
+
+    smtpPassword := os.Getenv("CCS_SMTP_PASSWORD")
+    if smtpPassword != "" {
+        config.smtpPassword = smtpPassword
+    }
+
+    smtpPort := os.Getenv("CCS_SMTP_PORT")
+    if smtpPort != "" {
+        port, err := strconv.ParseInt(smtpPort, 0, 16)
+        if err != nil {
+            return fmt.Errorf("Invalid value for CCS_SMTP_PORT: %s", smtpPort)
+        }
+        config.smtpPort = int16(port)
+    }
+
+    smtpSecurity := os.Getenv("CCS_SMTP_SECURITY")
+    if smtpSecurity != "" {
+        if !isValidSMTPSecurity(smtpSecurity) {
+            return fmt.Errorf("Invalid value for CCS_SMTP_SECURITY: %s", smtpSecurity)
+        }
+        config.smtpSecurity = smtpSecurity
+    }
+
+    smtpUsername := os.Getenv("CCS_SMTP_USERNAME")
+    if smtpUsername != "" {
+        config.smtpUsername = smtpUsername
+    }
+
+    smsFile := os.Getenv("CCS_SMS_FILE")
+    if smsFile != "" {
+        config.smsFile = smsFile
+    }
+
+    smsFrom := os.Getenv("CCS_SMS_FROM")
+    if smsFrom != "" {
+        config.smsFrom = smsFrom
+    }
+
+    smsGatewayToken := os.Getenv("CCS_SMS_GATEWAY_TOKEN")
+    if smsGatewayToken != "" {
+        config.smsGatewayToken = smsGatewayToken
+    }
+
+    smsGatewayURL := os.Getenv("CCS_SMS_GATEWAY_URL")
+    if smsGatewayURL != "" {
+        config.smsGatewayURL = smsGatewayURL
+    }
+
+    smsRateLimit := os.Getenv("CCS_SMS_RATE_LIMIT")
+    if smsRateLimit != "" {
+        limit, err := strconv.ParseInt(smsRateLimit, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for CCS_SMS_RATE_LIMIT: %s", smsRateLimit)
+        }
+        config.smsRateLimit = int(limit)
+    }
+
+    smsService := os.Getenv("CCS_SMS_SERVICE")
+    if smsService != "" {
+        if !isValidSMSService(smsService) {
+            return fmt.Errorf("Unknown SMS service: %s", smsService)
+        }
+        config.smsService = smsService
+    }
+
     webMgrPath := os.Getenv("CCS_WEB_MANAGER_PATH")
     if webMgrPath != "" {
         config.webManagerPath = webMgrPath
@@ -266,7 +436,9 @@ func (config *CanopyConfig) LoadConfigEnv() error {
 func (config *CanopyConfig) LoadConfigCLI() error {
     allowAnonDevices := flag.String("allow-anon-devices", "", "")
     allowOrigin := flag.String("allow-origin", "", "")
+    emailDir := flag.String("email-dir", "", "")
     emailService := flag.String("email-service", "", "")
+    emailTemplateDir := flag.String("email-template-dir", "", "")
     enableHTTP := flag.String("enable-http", "", "")
     enableHTTPS := flag.String("enable-https", "", "")
     forwardOtherHosts := flag.String("forward-other-hosts", "", "")
@@ -277,11 +449,27 @@ func (config *CanopyConfig) LoadConfigCLI() error {
     httpsPrivKeyFile := flag.String("https-priv-key-file", "", "")
     jsClientPath := flag.String("js-client-path", "", "")
     logFile := flag.String("log-file", "", "")
+    notifyDedupWindow := flag.String("notify-dedup-window", "", "")
+    notifyDeviceRateLimit := flag.String("notify-device-rate-limit", "", "")
+    notifyDigestHour := flag.String("notify-digest-hour", "", "")
+    notifyRecipientRateLimit := flag.String("notify-recipient-rate-limit", "", "")
     passwordHashCost := flag.String("password-hash-cost", "", "")
     passwordSecretSalt := flag.String("password-secret-salt", "", "")
     productionSecret := flag.String("production-secret", "", "")
     sendgridSecretKey := flag.String("sendgrid-secret-key", "", "")
     sendgridUsername := flag.String("sendgrid-username", "", "")
+    smtpFrom := flag.String("smtp-from", "", "")
+    smtpHost := flag.String("smtp-host", "", "")
+    smtpPassword := flag.String("smtp-password", "", "")
+    smtpPort := flag.String("smtp-port", "", "")
+    smtpSecurity := flag.String("smtp-security", "", "")
+    smtpUsername := flag.String("smtp-username", "", "")
+    smsFile := flag.String("sms-file", "", "")
+    smsFrom := flag.String("sms-from", "", "")
+    smsGatewayToken := flag.String("sms-gateway-token", "", "")
+    smsGatewayURL := flag.String("sms-gateway-url", "", "")
+    smsRateLimit := flag.String("sms-rate-limit", "", "")
+    smsService := flag.String("sms-service", "", "")
     webMgrPath := flag.String("web-manager-path", "", "")
 
     flag.Parse()
@@ -300,13 +488,21 @@ func (config *CanopyConfig) LoadConfigCLI() error {
         config.allowOrigin = *allowOrigin
     }
 
+    if *emailDir != "" {
+        config.emailDir = *emailDir
+    }
+
     if *emailService != "" {
-        if !(*emailService == "none" || *emailService == "sendgrid") {
+        if !isValidEmailService(*emailService) {
             return fmt.Errorf("Unknown email service: %s",  *emailService)
         }
         config.emailService = *emailService
     }
 
+    if *emailTemplateDir != "" {
+        config.emailTemplateDir = *emailTemplateDir
+    }
+
     if *enableHTTP != "" {
         if *enableHTTP == "1" || *enableHTTP == "true" {
             config.enableHTTP = true
@@ -367,6 +563,38 @@ func (config *CanopyConfig) LoadConfigCLI() error {
         config.logFile = *logFile
     }
 
+    if *notifyDedupWindow != "" {
+        limit, err := strconv.ParseInt(*notifyDedupWindow, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for --notify-dedup-window: %s", *notifyDedupWindow)
+        }
+        config.notifyDedupWindow = int(limit)
+    }
+
+    if *notifyDeviceRateLimit != "" {
+        limit, err := strconv.ParseInt(*notifyDeviceRateLimit, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for --notify-device-rate-limit: %s", *notifyDeviceRateLimit)
+        }
+        config.notifyDeviceRateLimit = int(limit)
+    }
+
+    if *notifyDigestHour != "" {
+        limit, err := strconv.ParseInt(*notifyDigestHour, 0, 32)
+        if err != nil || limit < -1 || limit > 23 {
+            return fmt.Errorf("Invalid value for --notify-digest-hour: %s", *notifyDigestHour)
+        }
+        config.notifyDigestHour = int(limit)
+    }
+
+    if *notifyRecipientRateLimit != "" {
+        limit, err := strconv.ParseInt(*notifyRecipientRateLimit, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for --notify-recipient-rate-limit: %s", *notifyRecipientRateLimit)
+        }
+        config.notifyRecipientRateLimit = int(limit)
+    }
+
     if *passwordHashCost != "" {
         hashCost, err := strconv.ParseInt(*passwordHashCost, 0, 16)
         if err != nil {
@@ -391,6 +619,68 @@ func (config *CanopyConfig) LoadConfigCLI() error {
         config.sendgridUsername = *sendgridUsername
     }
 
+    if *smtpFrom != "" {
+        config.smtpFrom = *smtpFrom
+    }
+
+    if *smtpHost != "" {
+        config.smtpHost = *smtpHost
+    }
+
+    if *smtpPassword != "" {
+        config.smtpPassword = *smtpPassword
+    }
+
+    if *smtpPort != "" {
+        port, err := strconv.ParseInt(*smtpPort, 0, 16)
+        if err != nil {
+            return fmt.Errorf("Invalid value for --smtp-port: %s", *smtpPort)
+        }
+        config.smtpPort = int16(port)
+    }
+
+    if *smtpSecurity != "" {
+        if !isValidSMTPSecurity(*smtpSecurity) {
+            return fmt.Errorf("Invalid value for --smtp-security: %s", *smtpSecurity)
+        }
+        config.smtpSecurity = *smtpSecurity
+    }
+
+    if *smtpUsername != "" {
+        config.smtpUsername = *smtpUsername
+    }
+
+    if *smsFile != "" {
+        config.smsFile = *smsFile
+    }
+
+    if *smsFrom != "" {
+        config.smsFrom = *smsFrom
+    }
+
+    if *smsGatewayToken != "" {
+        config.smsGatewayToken = *smsGatewayToken
+    }
+
+    if *smsGatewayURL != "" {
+        config.smsGatewayURL = *smsGatewayURL
+    }
+
+    if *smsRateLimit != "" {
+        limit, err := strconv.ParseInt(*smsRateLimit, 0, 32)
+        if err != nil || limit < 0 {
+            return fmt.Errorf("Invalid value for --sms-rate-limit: %s", *smsRateLimit)
+        }
+        config.smsRateLimit = int(limit)
+    }
+
+    if *smsService != "" {
+        if !isValidSMSService(*smsService) {
+            return fmt.Errorf("Unknown SMS service: %s", *smsService)
+        }
+        config.smsService = *smsService
+    }
+
     if *webMgrPath != "" {
         config.webManagerPath = *webMgrPath
     }
@@ -429,13 +719,17 @@ func (config *CanopyConfig) LoadConfigJson(jsonObj map[string]interface{}) error
             config.allowAnonDevices, ok = v.(bool)
         case "allow-origin":
             config.allowOrigin, ok = v.(string)
+        case "email-dir":
+            config.emailDir, ok = v.(string)
         case "email-service":
             var emailService string
             emailService, ok = v.(string)
-            if !(emailService == "none" || emailService == "sendgrid") {
+            if !isValidEmailService(emailService) {
                 return fmt.Errorf("Unknown email service: %s", emailService)
             }
             config.emailService = emailService
+        case "email-template-dir":
+            config.emailTemplateDir, ok = v.(string)
         case "enable-http":
             config.enableHTTP, ok = v.(bool)
         case "enable-https":
@@ -465,6 +759,42 @@ func (config *CanopyConfig) LoadConfigJson(jsonObj map[string]interface{}) error
             config.javascriptClientPath, ok = v.(string)
         case "log-file": 
             config.logFile, ok = v.(string)
+        case "notify-dedup-window":
+            var limit float64
+            limit, ok = v.(float64)
+            if ok {
+                if limit < 0 {
+                    return fmt.Errorf("Invalid value for notify-dedup-window: %v", limit)
+                }
+                config.notifyDedupWindow = int(limit)
+            }
+        case "notify-device-rate-limit":
+            var limit float64
+            limit, ok = v.(float64)
+            if ok {
+                if limit < 0 {
+                    return fmt.Errorf("Invalid value for notify-device-rate-limit: %v", limit)
+                }
+                config.notifyDeviceRateLimit = int(limit)
+            }
+        case "notify-digest-hour":
+            var limit float64
+            limit, ok = v.(float64)
+            if ok {
+                if limit < -1 || limit > 23 {
+                    return fmt.Errorf("Invalid value for notify-digest-hour: %v", limit)
+                }
+                config.notifyDigestHour = int(limit)
+            }
+        case "notify-recipient-rate-limit":
+            var limit float64
+            limit, ok = v.(float64)
+            if ok {
+                if limit < 0 {
+                    return fmt.Errorf("Invalid value for notify-recipient-rate-limit: %v", limit)
+                }
+                config.notifyRecipientRateLimit = int(limit)
+            }
         case "password-hash-cost": 
             var passwordHashCost float64
             passwordHashCost, ok = v.(float64)
@@ -480,6 +810,51 @@ func (config *CanopyConfig) LoadConfigJson(jsonObj map[string]interface{}) error
             config.sendgridSecretKey, ok = v.(string)
         case "sendgrid-username": 
             config.sendgridUsername, ok = v.(string)
+        case "smtp-from":
+            config.smtpFrom, ok = v.(string)
+        case "smtp-host":
+            config.smtpHost, ok = v.(string)
+        case "smtp-password":
+            config.smtpPassword, ok = v.(string)
+        case "smtp-port":
+            var port float64
+            port, ok = v.(float64)
+            if ok {
+                config.smtpPort = int16(port)
+            }
+        case "smtp-security":
+            var smtpSecurity string
+            smtpSecurity, ok = v.(string)
+            if !isValidSMTPSecurity(smtpSecurity) {
+                return fmt.Errorf("Invalid value for smtp-security: %s", smtpSecurity)
+            }
+            config.smtpSecurity = smtpSecurity
+        case "smtp-username":
+            config.smtpUsername, ok = v.(string)
+        case "sms-file":
+            config.smsFile, ok = v.(string)
+        case "sms-from":
+            config.smsFrom, ok = v.(string)
+        case "sms-gateway-token":
+            config.smsGatewayToken, ok = v.(string)
+        case "sms-gateway-url":
+            config.smsGatewayURL, ok = v.(string)
+        case "sms-rate-limit":
+            var limit float64
+            limit, ok = v.(float64)
+            if ok {
+                if limit < 0 {
+                    return fmt.Errorf("Invalid value for sms-rate-limit: %v", limit)
+                }
+                config.smsRateLimit = int(limit)
+            }
+        case "sms-service":
+            var smsService string
+            smsService, ok = v.(string)
+            if !isValidSMSService(smsService) {
+                return fmt.Errorf("Unknown SMS service: %s", smsService)
+            }
+            config.smsService = smsService
         case "web-manager-path": 
             config.webManagerPath, ok = v.(string)
         default:
@@ -500,10 +875,18 @@ func (config *CanopyConfig) OptAllowOrigin() string {
     return config.allowOrigin
 }
 
+func (config *CanopyConfig) OptEmailDir() string {
+    return config.emailDir
+}
+
 func (config *CanopyConfig) OptEmailService() string {
     return config.emailService
 }
 
+func (config *CanopyConfig) OptEmailTemplateDir() string {
+    return config.emailTemplateDir
+}
+
 func (config *CanopyConfig) OptEnableHTTP() bool {
     return config.enableHTTP
 }
@@ -544,6 +927,22 @@ func (config *CanopyConfig) OptLogFile() string {
     return config.logFile
 }
 
+func (config *CanopyConfig) OptNotifyDedupWindow() int {
+    return config.notifyDedupWindow
+}
+
+func (config *CanopyConfig) OptNotifyDeviceRateLimit() int {
+    return config.notifyDeviceRateLimit
+}
+
+func (config *CanopyConfig) OptNotifyDigestHour() int {
+    return config.notifyDigestHour
+}
+
+func (config *CanopyConfig) OptNotifyRecipientRateLimit() int {
+    return config.notifyRecipientRateLimit
+}
+
 func (config *CanopyConfig) OptPasswordHashCost() int16 {
     return config.passwordHashCost
 }
@@ -564,10 +963,73 @@ func (config *CanopyConfig) OptSendgridSecretKey() string {
     return config.sendgridSecretKey
 }
 
+func (config *CanopyConfig) OptSMTPFrom() string {
+    return config.smtpFrom
+}
+
+func (config *CanopyConfig) OptSMTPHost() string {
+    return config.smtpHost
+}
+
+func (config *CanopyConfig) OptSMTPPassword() string {
+    return config.smtpPassword
+}
+
+func (config *CanopyConfig) OptSMTPPort() int16 {
+    return config.smtpPort
+}
+
+func (config *CanopyConfig) OptSMTPSecurity() string {
+    return config.smtpSecurity
+}
+
+func (config *CanopyConfig) OptSMTPUsername() string {
+    return config.smtpUsername
+}
+
+func (config *CanopyConfig) OptSMSFile() string {
+    return config.smsFile
+}
+
+func (config *CanopyConfig) OptSMSFrom() string {
+    return config.smsFrom
+}
+
+func (config *CanopyConfig) OptSMSGatewayToken() string {
+    return config.smsGatewayToken
+}
+
+func (config *CanopyConfig) OptSMSGatewayURL() string {
+    return config.smsGatewayURL
+}
+
+func (config *CanopyConfig) OptSMSRateLimit() int {
+    return config.smsRateLimit
+}
+
+func (config *CanopyConfig) OptSMSService() string {
+    return config.smsService
+}
+
 func (config *CanopyConfig) OptWebManagerPath() string {
     return config.webManagerPath
 }
 
+func isValidEmailService(emailService string) bool {
+    return emailService == "none" || emailService == "sendgrid" || emailService == "smtp" || emailService == "file"
+}
+
+// SMTP connection security: "starttls" upgrades a plaintext connection,
+// "tls" connects with TLS from the start (usually port 465), and "none"
+// never encrypts.
+func isValidSMTPSecurity(security string) bool {
+    return security == "starttls" || security == "tls" || security == "none"
+}
+
+func isValidSMSService(smsService string) bool {
+    return smsService == "none" || smsService == "http" || smsService == "file"
+}
+
 func justGetOptLogFile() string {
     out := "/var/log/canopy/canopy-server.log"
 
@@ -27,7 +27,9 @@ type Config interface {
 
     OptAllowAnonDevices() bool
     OptAllowOrigin() string
+    OptEmailDir() string
     OptEmailService() string
+    OptEmailTemplateDir() string
     OptEnableHTTP() bool
     OptEnableHTTPS() bool
     OptForwardOtherHosts() string
@@ -38,11 +40,27 @@ type Config interface {
     OptHTTPSPort() int16
     OptJavascriptClientPath() string
     OptLogFile() string
+    OptNotifyDedupWindow() int
+    OptNotifyDeviceRateLimit() int
+    OptNotifyDigestHour() int
+    OptNotifyRecipientRateLimit() int
     OptPasswordHashCost() int16
     OptPasswordSecretSalt() string
     OptProductionSecret() string
     OptSendgridUsername() string
     OptSendgridSecretKey() string
+    OptSMTPFrom() string
+    OptSMTPHost() string
+    OptSMTPPassword() string
+    OptSMTPPort() int16
+    OptSMTPSecurity() string
+    OptSMTPUsername() string
+    OptSMSFile() string
+    OptSMSFrom() string
+    OptSMSGatewayToken() string
+    OptSMSGatewayURL() string
+    OptSMSRateLimit() int
+    OptSMSService() string
     OptWebManagerPath() string
 
     ToString() string
@@ -54,11 +72,21 @@ func NewDefaultConfig(buildVersion, buildDate, buildCommit string) Config {
         buildVersion: buildVersion,
         buildDate: buildDate,
         buildCommit: buildCommit,
+        emailDir: "/var/log/canopy/mail",
         enableHTTPS: true,
         httpPort: 80,
         httpsPort: 443,
         logFile: "/var/log/canopy/server.log",
+        notifyDedupWindow: 300,
+        notifyDeviceRateLimit: 60,
+        notifyDigestHour: 8,
+        notifyRecipientRateLimit: 30,
         passwordHashCost: 10,
+        smtpPort: 587,
+        smtpSecurity: "starttls",
+        smsFile: "/var/log/canopy/sms.log",
+        smsRateLimit: 10,
+        smsService: "none",
     }
 }
 
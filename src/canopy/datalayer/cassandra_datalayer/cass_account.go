@@ -20,6 +20,9 @@ import (
     "canopy/datalayer"
     "canopy/util/random"
     "code.google.com/p/go.crypto/bcrypt"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
     "errors"
     "fmt"
     "time"
@@ -35,6 +38,13 @@ type CassAccount struct {
     activation_code string
     password_reset_code string
     password_reset_code_expiry time.Time
+    default_var_decl_policy datalayer.VarDeclPolicy
+    phone_number string
+    phone_verified bool
+    phone_verify_code string // Hashed, see hashPhoneVerifyCode
+    phone_verify_code_expiry time.Time
+    phone_verify_attempts int
+    locale string
 }
 
 func (account *CassAccount) ActivationCode() string {
@@ -64,6 +74,10 @@ func (account *CassAccount) Activate(username, code string) error {
 }
 
 
+func (account *CassAccount) DefaultVarDeclPolicy() datalayer.VarDeclPolicy {
+    return account.default_var_decl_policy
+}
+
 // Obtain list of devices I have access to.
 func (account *CassAccount) Devices() datalayer.DeviceQuery {
     return &CassDeviceQuery{
@@ -188,6 +202,27 @@ func (account *CassAccount) ResetPassword(code, newPassword string) error {
     return nil
 }
 
+func (account *CassAccount) Locale() string {
+    return account.locale
+}
+
+func (account *CassAccount) SetLocale(locale string) error {
+    err := validateLocale(locale)
+    if err != nil {
+        return err
+    }
+    err = account.conn.session.Query(`
+            UPDATE accounts
+            SET locale = ?
+            WHERE username = ?
+    `, locale, account.Username()).Exec()
+    if err != nil {
+        return err
+    }
+    account.locale = locale
+    return nil
+}
+
 func (account *CassAccount) SetPassword(password string) error {
     err := validatePassword(password)
     if err != nil {
@@ -215,6 +250,119 @@ func (account *CassAccount) SetPassword(password string) error {
     return nil;
 }
 
+func (account *CassAccount) NotificationPrefs() (map[datalayer.NotificationChannel]datalayer.NotificationPref, error) {
+    prefs := map[datalayer.NotificationChannel]datalayer.NotificationPref{}
+    for _, channel := range datalayer.NotificationChannels {
+        prefs[channel] = datalayer.DefaultNotificationPref(channel)
+    }
+
+    var channel int
+    var pref datalayer.NotificationPref
+    query := account.conn.session.Query(`
+            SELECT channel, enabled, min_priority, digest
+            FROM notification_prefs
+            WHERE username = ?
+    `, account.Username()).Consistency(gocql.One)
+    iter := query.Iter()
+    for iter.Scan(&channel, &pref.Enabled, &pref.MinPriority, &pref.Digest) {
+        prefs[datalayer.NotificationChannel(channel)] = pref
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return prefs, nil
+}
+
+func (account *CassAccount) SetNotificationPref(channel datalayer.NotificationChannel, pref datalayer.NotificationPref) error {
+    return account.conn.session.Query(`
+            INSERT INTO notification_prefs (username, channel, enabled,
+                min_priority, digest)
+            VALUES (?, ?, ?, ?, ?)
+    `, account.Username(), int(channel), pref.Enabled, pref.MinPriority,
+            pref.Digest).Exec()
+}
+
+func (account *CassAccount) PhoneNumber() string {
+    return account.phone_number
+}
+
+func (account *CassAccount) PhoneVerified() bool {
+    return account.phone_verified
+}
+
+func (account *CassAccount) RecordSMSSent(t time.Time) error {
+    return account.conn.session.Query(`
+            INSERT INTO sms_sent (username, time)
+            VALUES (?, ?)
+            USING TTL 86400
+    `, account.Username(), t).Exec()
+}
+
+func (account *CassAccount) SetDefaultVarDeclPolicy(policy datalayer.VarDeclPolicy) error {
+    err := account.conn.session.Query(`
+            UPDATE accounts
+            SET default_var_decl_policy = ?
+            WHERE username = ?
+    `, policy, account.Username()).Exec()
+    if err != nil {
+        return err;
+    }
+    account.default_var_decl_policy = policy
+    return nil
+}
+
+func (account *CassAccount) SetPhoneNumber(number string) (string, error) {
+    if number == "" {
+        err := account.conn.session.Query(`
+                UPDATE accounts
+                SET phone_number = ?,
+                    phone_verified = false,
+                    phone_verify_code = ?
+                WHERE username = ?
+        `, "", "", account.Username()).Exec()
+        if err != nil {
+            return "", err
+        }
+        account.phone_number = ""
+        account.phone_verified = false
+        account.phone_verify_code = ""
+        return "", nil
+    }
+
+    err := validatePhoneNumber(number)
+    if err != nil {
+        return "", err
+    }
+
+    code, err := random.DigitString(6)
+    if err != nil {
+        return "", err
+    }
+    codeHash := account.hashPhoneVerifyCode(code)
+    expiry := time.Now().Add(datalayer.PhoneVerificationCodeLifetime)
+
+    err = account.conn.session.Query(`
+            UPDATE accounts
+            SET phone_number = ?,
+                phone_verified = false,
+                phone_verify_code = ?,
+                phone_verify_code_expiry = ?,
+                phone_verify_attempts = 0
+            WHERE username = ?
+    `, number, codeHash, expiry, account.Username()).Exec()
+    if err != nil {
+        canolog.Error("Error changing phone number to", number, ":", err)
+        return "", err
+    }
+
+    account.phone_number = number
+    account.phone_verified = false
+    account.phone_verify_code = codeHash
+    account.phone_verify_code_expiry = expiry
+    account.phone_verify_attempts = 0
+    return code, nil
+}
+
 func (account *CassAccount)SetEmail(newEmail string) error {
     // validate new email address
     err := validateEmail(newEmail)
@@ -271,6 +419,19 @@ func (account *CassAccount)SetEmail(newEmail string) error {
     return nil
 }
 
+func (account *CassAccount) SMSSentSince(t time.Time) (int, error) {
+    var count int
+    err := account.conn.session.Query(`
+            SELECT COUNT(*)
+            FROM sms_sent
+            WHERE username = ? AND time > ?
+    `, account.Username(), t).Consistency(gocql.One).Scan(&count)
+    if err != nil {
+        return 0, err
+    }
+    return count, nil
+}
+
 func (account *CassAccount)Username() string {
     return account.username
 }
@@ -280,3 +441,61 @@ func (account* CassAccount)VerifyPassword(password string) bool {
     err := bcrypt.CompareHashAndPassword(account.password_hash, []byte(password + salt))
     return (err == nil)
 }
+
+// Phone verification codes are short, so only a hash is stored, salted with
+// the username and the server's secret salt.
+func (account *CassAccount) hashPhoneVerifyCode(code string) string {
+    salt := account.conn.dl.cfg.OptPasswordSecretSalt()
+    sum := sha256.Sum256([]byte(salt + ":" + account.Username() + ":" + code))
+    return hex.EncodeToString(sum[:])
+}
+
+func (account *CassAccount) VerifyPhoneNumber(code string) error {
+    if account.phone_number == "" {
+        return datalayer.NewValidationError("No phone number to verify")
+    }
+    errInvalid := datalayer.NewValidationError("Invalid or expired verification code")
+    if account.phone_verify_code == "" ||
+            account.phone_verify_code_expiry.Before(time.Now()) {
+        return errInvalid
+    }
+    if account.phone_verify_attempts >= datalayer.PhoneVerificationMaxAttempts {
+        return datalayer.NewValidationError("Too many attempts, request a new verification code")
+    }
+
+    // Count the attempt before checking the code.  The lightweight
+    // transaction makes concurrent guesses each use up an attempt.
+    applied, err := account.conn.session.Query(`
+            UPDATE accounts
+            SET phone_verify_attempts = ?
+            WHERE username = ?
+            IF phone_verify_attempts = ?
+    `, account.phone_verify_attempts + 1, account.Username(),
+            account.phone_verify_attempts).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return err
+    }
+    if !applied {
+        return errInvalid
+    }
+    account.phone_verify_attempts++
+
+    codeHash := account.hashPhoneVerifyCode(code)
+    if code == "" || subtle.ConstantTimeCompare([]byte(codeHash), []byte(account.phone_verify_code)) != 1 {
+        return errInvalid
+    }
+
+    // Invalidate the code
+    err = account.conn.session.Query(`
+            UPDATE accounts
+            SET phone_verified = true,
+                phone_verify_code = ?
+            WHERE username = ?
+    `, "", account.Username()).Exec()
+    if err != nil {
+        return err
+    }
+    account.phone_verified = true
+    account.phone_verify_code = ""
+    return nil
+}
@@ -0,0 +1,172 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Alarm state is stored in the alarms table.  Alarms that have never been
+// raised have no row.  Every state change is appended to the alarm_history
+// table.
+
+type CassAlarm struct {
+    conn *CassConnection
+    deviceId gocql.UUID
+    varName string
+    name string
+    state datalayer.AlarmState
+    value float64
+    pendingSince time.Time
+    timeChanged time.Time
+    acknowledgedBy string
+}
+
+func (device *CassDevice) Alarm(varName, name string) (datalayer.Alarm, error) {
+    alarm := CassAlarm{
+        conn: device.conn,
+        deviceId: device.ID(),
+        varName: varName,
+        name: name,
+    }
+
+    var state int
+    err := device.conn.session.Query(`
+            SELECT state, value, pending_since, time_changed, acknowledged_by
+            FROM alarms
+            WHERE device_id = ? AND var_name = ? AND name = ?
+            LIMIT 1
+    `, device.ID(), varName, name).Consistency(gocql.One).Scan(
+            &state,
+            &alarm.value,
+            &alarm.pendingSince,
+            &alarm.timeChanged,
+            &alarm.acknowledgedBy)
+    if err != nil && err != gocql.ErrNotFound {
+        return nil, err
+    }
+    alarm.state = datalayer.AlarmState(state)
+
+    return &alarm, nil
+}
+
+func (device *CassDevice) AlarmHistory() ([]datalayer.AlarmEvent, error) {
+    var event datalayer.AlarmEvent
+    var state int
+
+    query := device.conn.session.Query(`
+            SELECT time, var_name, name, state, value, username
+            FROM alarm_history
+            WHERE device_id = ?
+    `, device.ID()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    events := []datalayer.AlarmEvent{}
+    for iter.Scan(&event.Time, &event.VarName, &event.AlarmName, &state,
+            &event.Value, &event.Username) {
+        event.State = datalayer.AlarmState(state)
+        events = append(events, event)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return events, nil
+}
+
+func (alarm *CassAlarm) AcknowledgedBy() string {
+    return alarm.acknowledgedBy
+}
+
+func (alarm *CassAlarm) Name() string {
+    return alarm.name
+}
+
+func (alarm *CassAlarm) PendingSince() time.Time {
+    return alarm.pendingSince
+}
+
+func (alarm *CassAlarm) SetPendingSince(t time.Time) error {
+    var err error
+    if t.IsZero() {
+        err = alarm.conn.session.Query(`
+                UPDATE alarms
+                SET pending_since = null
+                WHERE device_id = ? AND var_name = ? AND name = ?
+        `, alarm.deviceId, alarm.varName, alarm.name).Exec()
+    } else {
+        err = alarm.conn.session.Query(`
+                UPDATE alarms
+                SET pending_since = ?
+                WHERE device_id = ? AND var_name = ? AND name = ?
+        `, t, alarm.deviceId, alarm.varName, alarm.name).Exec()
+    }
+    if err != nil {
+        return err
+    }
+
+    alarm.pendingSince = t
+    return nil
+}
+
+func (alarm *CassAlarm) SetState(state datalayer.AlarmState, value float64, t time.Time, username string) error {
+    // TODO: Race condition if the alarm is evaluated by two workers
+    // concurrently.
+    err := alarm.conn.session.Query(`
+            UPDATE alarms
+            SET state = ?, value = ?, pending_since = null, time_changed = ?,
+                acknowledged_by = ?
+            WHERE device_id = ? AND var_name = ? AND name = ?
+    `, int(state), value, t, username, alarm.deviceId, alarm.varName,
+            alarm.name).Exec()
+    if err != nil {
+        return err
+    }
+
+    err = alarm.conn.session.Query(`
+            INSERT INTO alarm_history (device_id, time, var_name, name, state,
+                value, username)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, alarm.deviceId, t, alarm.varName, alarm.name, int(state), value,
+            username).Exec()
+    if err != nil {
+        return err
+    }
+
+    alarm.state = state
+    alarm.value = value
+    alarm.pendingSince = time.Time{}
+    alarm.timeChanged = t
+    alarm.acknowledgedBy = username
+    return nil
+}
+
+func (alarm *CassAlarm) State() datalayer.AlarmState {
+    return alarm.state
+}
+
+func (alarm *CassAlarm) TimeChanged() time.Time {
+    return alarm.timeChanged
+}
+
+func (alarm *CassAlarm) Value() float64 {
+    return alarm.value
+}
+
+func (alarm *CassAlarm) VarName() string {
+    return alarm.varName
+}
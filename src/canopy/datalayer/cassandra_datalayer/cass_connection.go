@@ -91,6 +91,25 @@ func validateEmail(email string) error {
     return nil
 }
 
+// Locales are BCP 47 language tags, ex: "en", "pt-BR".
+var localePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+func validateLocale(locale string) error {
+    if locale != "" && !localePattern.MatchString(locale) {
+        return datalayer.NewValidationError("Invalid locale, expected a language tag such as \"en\" or \"pt-BR\"")
+    }
+    return nil
+}
+
+// Phone numbers must be in E.164 format, ex: "+15551234567".
+var phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+func validatePhoneNumber(number string) error {
+    if !phoneNumberPattern.MatchString(number) {
+        return datalayer.NewValidationError("Invalid phone number, expected E.164 format such as +15551234567")
+    }
+    return nil
+}
+
 func (conn *CassConnection) CreateAccount(
         username, 
         email, 
@@ -148,7 +167,7 @@ func (conn *CassConnection) CreateAccount(
         return nil, err
     }
 
-    return &CassAccount{conn, username, email, password_hash, false, activation_code, "", now}, nil
+    return &CassAccount{conn, username, email, password_hash, false, activation_code, "", now, datalayer.VarDeclPolicyUnset, "", false, "", time.Time{}, 0, ""}, nil
 }
 
 func (conn *CassConnection) CreateDevice(
@@ -221,6 +240,27 @@ func (conn *CassConnection) DeleteAccount(username string) error {
         return err
     }
 
+    var deviceId gocql.UUID
+    iter := conn.session.Query(`
+            SELECT device_id FROM device_permissions
+            WHERE username = ?
+    `, username).Iter()
+    for iter.Scan(&deviceId) {
+        err = conn.session.Query(`
+                DELETE FROM device_accounts
+                WHERE device_id = ? AND username = ?
+        `, deviceId, username).Exec()
+        if err != nil {
+            iter.Close()
+            canolog.Error("Error deleting account's permission", err)
+            return err
+        }
+    }
+    if err = iter.Close(); err != nil {
+        canolog.Error("Error deleting account's permission", err)
+        return err
+    }
+
     err = conn.session.Query(`
             DELETE FROM device_permissions
             WHERE username = ?
@@ -230,6 +270,51 @@ func (conn *CassConnection) DeleteAccount(username string) error {
         return err
     }
 
+    err = conn.session.Query(`
+            DELETE FROM notification_prefs
+            WHERE username = ?
+    `, username).Exec()
+    if err != nil {
+        canolog.Error("Error deleting account's notification preferences", err)
+        return err
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM notification_reads
+            WHERE username = ?
+    `, username).Exec()
+    if err != nil {
+        canolog.Error("Error deleting account's read notifications", err)
+        return err
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM notification_digests
+            WHERE username = ?
+    `, username).Exec()
+    if err != nil {
+        canolog.Error("Error deleting account's notification digest", err)
+        return err
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM notifications_sent
+            WHERE username = ?
+    `, username).Exec()
+    if err != nil {
+        canolog.Error("Error deleting account's notification log", err)
+        return err
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM sms_sent
+            WHERE username = ?
+    `, username).Exec()
+    if err != nil {
+        canolog.Error("Error deleting account's SMS log", err)
+        return err
+    }
+
     err = conn.session.Query(`
             DELETE FROM account_emails
             WHERE email = ?
@@ -253,12 +338,82 @@ func (conn *CassConnection) DeleteAccount(username string) error {
 
 func (conn *CassConnection)DeleteDevice(deviceId gocql.UUID) error {
     // TODO: Should we archive the device, not actually delete it?
-    device, err := conn.LookupDevice(deviceId)
+    device, err := conn.lookupDevice(deviceId)
     if err != nil {
         canolog.Error("Error deleting device", err)
         return err
     }
 
+    if device.className != "" {
+        err = conn.session.Query(`
+                DELETE FROM sddl_class_members
+                WHERE owner = ? AND name = ? AND device_id = ?
+        `, device.classOwner, device.className, device.ID()).Exec()
+        if err != nil {
+            canolog.Error("Error removing device from SDDL class", err)
+            return err
+        }
+    }
+
+    // Rules that watch the device are kept, but are no longer triggered by
+    // it.
+    err = conn.session.Query(`
+            DELETE FROM device_rules
+            WHERE device_id = ?
+    `, device.ID()).Exec()
+    if err != nil {
+        canolog.Error("Error removing device from rules", err)
+        return err
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM alarms
+            WHERE device_id = ?
+    `, device.ID()).Exec()
+    if err != nil {
+        canolog.Error("Error deleting device alarms", err)
+        return err
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM alarm_history
+            WHERE device_id = ?
+    `, device.ID()).Exec()
+    if err != nil {
+        canolog.Error("Error deleting device alarm history", err)
+        return err
+    }
+
+    var username string
+    iter := conn.session.Query(`
+            SELECT username FROM device_accounts
+            WHERE device_id = ?
+    `, device.ID()).Iter()
+    for iter.Scan(&username) {
+        err = conn.session.Query(`
+                DELETE FROM device_permissions
+                WHERE username = ? AND device_id = ?
+        `, username, device.ID()).Exec()
+        if err != nil {
+            iter.Close()
+            canolog.Error("Error deleting device permissions", err)
+            return err
+        }
+    }
+    if err = iter.Close(); err != nil {
+        canolog.Error("Error deleting device permissions", err)
+        return err
+    }
+
+    err = conn.session.Query(`
+            DELETE FROM device_accounts
+            WHERE device_id = ?
+    `, device.ID()).Exec()
+    if err != nil {
+        canolog.Error("Error deleting device permissions", err)
+        return err
+    }
+
     err = conn.session.Query(`
             DELETE FROM devices
             WHERE device_id = ?
@@ -268,8 +423,6 @@ func (conn *CassConnection)DeleteDevice(deviceId gocql.UUID) error {
         return err
     }
 
-    // TODO: How to cleanup device_permissions?
-
     // TODO: transactionize
     // TODO: Cleanup cloud variable data
     return nil
@@ -311,7 +464,14 @@ func (conn *CassConnection) LookupAccount(
                 activated, 
                 activation_code, 
                 password_reset_code, 
-                password_reset_code_expiry 
+                password_reset_code_expiry,
+                default_var_decl_policy,
+                phone_number,
+                phone_verified,
+                phone_verify_code,
+                phone_verify_code_expiry,
+                phone_verify_attempts,
+                locale
             FROM accounts 
             WHERE username = ?
             LIMIT 1
@@ -322,7 +482,14 @@ func (conn *CassConnection) LookupAccount(
          &account.activated, 
          &account.activation_code,
          &account.password_reset_code,
-         &account.password_reset_code_expiry)
+         &account.password_reset_code_expiry,
+         &account.default_var_decl_policy,
+         &account.phone_number,
+         &account.phone_verified,
+         &account.phone_verify_code,
+         &account.phone_verify_code_expiry,
+         &account.phone_verify_attempts,
+         &account.locale)
     
     if (err != nil) {
         canolog.Error("Error looking up account", err)
@@ -353,7 +520,17 @@ func (conn *CassConnection) LookupAccountVerifyPassword(
 
 func (conn *CassConnection) LookupDevice(
         deviceId gocql.UUID) (datalayer.Device, error) {
+    device, err := conn.lookupDevice(deviceId)
+    if err != nil {
+        return nil, err
+    }
+    return device, nil
+}
+
+func (conn *CassConnection) lookupDevice(
+        deviceId gocql.UUID) (*CassDevice, error) {
     var device CassDevice
+    var storedSDDL string
 
     device.deviceId = deviceId
     device.conn = conn
@@ -361,16 +538,20 @@ func (conn *CassConnection) LookupDevice(
     var ws_connected bool
 
     err := conn.session.Query(`
-        SELECT friendly_name, location_note, secret_key, sddl, last_seen, ws_connected
+        SELECT friendly_name, location_note, secret_key, sddl, sddl_version, last_seen, ws_connected, var_decl_policy, sddl_class_owner, sddl_class_name
         FROM devices
         WHERE device_id = ?
         LIMIT 1`, deviceId).Consistency(gocql.One).Scan(
             &device.name,
             &device.locationNote,
             &device.secretKey,
-            &device.docString,
+            &storedSDDL,
+            &device.sddlVersion,
             &last_seen,
-            &ws_connected)
+            &ws_connected,
+            &device.varDeclPolicy,
+            &device.classOwner,
+            &device.className)
     if err != nil {
         canolog.Error(err)
         return nil, err
@@ -385,7 +566,27 @@ func (conn *CassConnection) LookupDevice(
 
     device.wsConnected = ws_connected
 
-    if device.docString != "" {
+    if device.className != "" {
+        // The stored SDDL only contains this device's extensions to its
+        // SDDL class.
+        classDocString := ""
+        class, err := conn.lookupSDDLClass(device.classOwner, device.className)
+        if err != nil {
+            canolog.Error("Error looking up SDDL class for device: ", device.classOwner, "/", device.className, err)
+        } else {
+            classDocString = class.DocumentString()
+        }
+        device.doc, err = composeClassSDDL(classDocString, storedSDDL)
+        if err != nil {
+            canolog.Error("Error combining SDDL class with extensions for device: ", storedSDDL, err)
+            return nil, err
+        }
+        device.docString, err = device.doc.ToString()
+        if err != nil {
+            return nil, err
+        }
+    } else if storedSDDL != "" {
+        device.docString = storedSDDL
         device.doc, err = sddl.Sys.ParseDocumentString(device.docString)
         if err != nil {
             canolog.Error("Error parsing class string for device: ", device.docString, err)
@@ -288,6 +288,40 @@ var creationQueries []string = []string{
         PRIMARY KEY((device_id, propname, timeprefix), time)
     ) WITH COMPACT STORAGE`,
 
+    // used for:
+    //  arrays (JSON-encoded)
+    `CREATE TABLE varsample_array (
+        device_id uuid,
+        propname text,
+        timeprefix text,
+        time timestamp,
+        value text,
+        PRIMARY KEY((device_id, propname, timeprefix), time)
+    ) WITH COMPACT STORAGE`,
+
+    // used for:
+    //  int64
+    //  uint64 (stored as the equivalent two's-complement int64)
+    `CREATE TABLE varsample_int64 (
+        device_id uuid,
+        propname text,
+        timeprefix text,
+        time timestamp,
+        value bigint,
+        PRIMARY KEY((device_id, propname, timeprefix), time)
+    ) WITH COMPACT STORAGE`,
+
+    // used for:
+    //  bytes
+    `CREATE TABLE varsample_blob (
+        device_id uuid,
+        propname text,
+        timeprefix text,
+        time timestamp,
+        value blob,
+        PRIMARY KEY((device_id, propname, timeprefix), time)
+    ) WITH COMPACT STORAGE`,
+
     // used for:
     //  uint8
     //  int8
@@ -392,13 +426,246 @@ var creationQueries []string = []string{
         secret_key text,
         friendly_name text,
         sddl text,
+        sddl_version int,
         public_access_level int,
         last_seen timestamp,
         location_note text,
         ws_connected boolean,
+        var_decl_policy int,
+        sddl_class_owner text,
+        sddl_class_name text,
         PRIMARY KEY(device_id)
     ) WITH COMPACT STORAGE`,
 
+    // Every version of each device's SDDL document
+    `CREATE TABLE device_sddl_history (
+        device_id uuid,
+        version int,
+        time_created timestamp,
+        origin int,
+        sddl text,
+        PRIMARY KEY(device_id, version)
+    )`,
+
+    // SDDL documents shared by many devices
+    `CREATE TABLE sddl_classes (
+        owner text,
+        name text,
+        version int,
+        time_updated timestamp,
+        sddl text,
+        PRIMARY KEY(owner, name)
+    )`,
+
+    // Every version of each SDDL class
+    `CREATE TABLE sddl_class_history (
+        owner text,
+        name text,
+        version int,
+        time_created timestamp,
+        sddl text,
+        PRIMARY KEY((owner, name), version)
+    )`,
+
+    `CREATE TABLE sddl_class_members (
+        owner text,
+        name text,
+        device_id uuid,
+        PRIMARY KEY((owner, name), device_id)
+    )`,
+
+    // User-defined rules
+    `CREATE TABLE rules (
+        owner text,
+        id uuid,
+        name text,
+        condition text,
+        device_ids list<uuid>,
+        match int,
+        actions text,
+        cooldown_s int,
+        enabled boolean,
+        time_created timestamp,
+        last_state boolean,
+        last_fired timestamp,
+        PRIMARY KEY(owner, id)
+    )`,
+
+    // Rules that watch each device
+    `CREATE TABLE device_rules (
+        device_id uuid,
+        owner text,
+        rule_id uuid,
+        PRIMARY KEY(device_id, owner, rule_id)
+    )`,
+
+    // Threshold alarm state, for alarms declared in device SDDL
+    `CREATE TABLE alarms (
+        device_id uuid,
+        var_name text,
+        name text,
+        state int,
+        value double,
+        pending_since timestamp,
+        time_changed timestamp,
+        acknowledged_by text,
+        PRIMARY KEY(device_id, var_name, name)
+    )`,
+
+    // Threshold alarm state changes
+    `CREATE TABLE alarm_history (
+        device_id uuid,
+        time timestamp,
+        var_name text,
+        name text,
+        state int,
+        value double,
+        username text,
+        PRIMARY KEY(device_id, time, var_name, name)
+    ) WITH CLUSTERING ORDER BY (time DESC, var_name ASC, name ASC)`,
+
+    // Reverse index of device_permissions, used to find the accounts with
+    // access to a device
+    `CREATE TABLE device_accounts (
+        device_id uuid,
+        username text,
+        access_level int,
+        share_level int,
+        PRIMARY KEY(device_id, username)
+    )`,
+
+    // Per-channel notification preferences.  Channels without a row use
+    // datalayer.DefaultNotificationPref.
+    `CREATE TABLE notification_prefs (
+        username text,
+        channel int,
+        enabled boolean,
+        min_priority int,
+        digest boolean,
+        PRIMARY KEY(username, channel)
+    )`,
+
+    // Delivery status of each notification, per recipient and channel
+    `CREATE TABLE notification_deliveries (
+        device_id uuid,
+        time_issued timestamp,
+        username text,
+        channel int,
+        status int,
+        error text,
+        time timestamp,
+        PRIMARY KEY((device_id, time_issued), username, channel)
+    )`,
+
+    // Notifications each account has marked as read
+    `CREATE TABLE notification_reads (
+        username text,
+        device_id uuid,
+        time_issued timestamp,
+        time_read timestamp,
+        PRIMARY KEY(username, device_id, time_issued)
+    )`,
+
+    // Webhook subscriptions to device events
+    `CREATE TABLE webhooks (
+        owner text,
+        id uuid,
+        url text,
+        device_ids list<uuid>,
+        filter text,
+        events list<text>,
+        enabled boolean,
+        secret text,
+        time_created timestamp,
+        PRIMARY KEY(owner, id)
+    )`,
+
+    // Webhook delivery attempts
+    `CREATE TABLE webhook_deliveries (
+        owner text,
+        webhook_id uuid,
+        time timestamp,
+        delivery_id uuid,
+        attempt int,
+        event text,
+        device_id uuid,
+        status_code int,
+        error text,
+        PRIMARY KEY((owner, webhook_id), time, delivery_id, attempt)
+    ) WITH CLUSTERING ORDER BY (time DESC, delivery_id ASC, attempt ASC)`,
+
+    // Webhook deliveries waiting to be attempted or retried, kept for a day
+    // after they are queued
+    `CREATE TABLE webhook_queue (
+        id uuid,
+        owner text,
+        webhook_id uuid,
+        device_id uuid,
+        event text,
+        body text,
+        attempt int,
+        time_queued timestamp,
+        next_attempt timestamp,
+        PRIMARY KEY(id)
+    )`,
+
+    // SMS messages sent to each account, kept for a day to enforce rate
+    // limits
+    `CREATE TABLE sms_sent (
+        username text,
+        time timestamp,
+        PRIMARY KEY(username, time)
+    ) WITH CLUSTERING ORDER BY (time DESC)`,
+
+    // Notifications waiting to be sent in each account's digest
+    `CREATE TABLE notification_digests (
+        username text,
+        time_issued timestamp,
+        device_id uuid,
+        device_name text,
+        notify_type int,
+        msg text,
+        PRIMARY KEY(username, time_issued, device_id)
+    )`,
+
+    // Email and SMS notifications sent to each account, kept for a day to
+    // enforce per-recipient rate limits
+    `CREATE TABLE notifications_sent (
+        username text,
+        time timestamp,
+        channel int,
+        PRIMARY KEY(username, time, channel)
+    ) WITH CLUSTERING ORDER BY (time DESC, channel ASC)`,
+
+    // Outgoing email, kept for a week after it is queued
+    `CREATE TABLE mail_queue (
+        id uuid,
+        recipients text,
+        subject text,
+        message text,
+        status int,
+        attempts int,
+        error text,
+        time_queued timestamp,
+        time_updated timestamp,
+        next_attempt timestamp,
+        PRIMARY KEY(id)
+    )`,
+
+    // Pending share invitations, keyed by a hash of the invitation token
+    // and kept until they expire or are accepted
+    `CREATE TABLE share_invitations (
+        token_hash text,
+        device_id uuid,
+        inviter text,
+        email text,
+        access_level int,
+        share_level int,
+        time_created timestamp,
+        expiry timestamp,
+        PRIMARY KEY(token_hash)
+    )`,
+
     `CREATE TABLE device_group (
         username text,
         group_name text,
@@ -431,6 +698,13 @@ var creationQueries []string = []string{
         activation_code text,
         password_reset_code text,
         password_reset_code_expiry timestamp,
+        default_var_decl_policy int,
+        phone_number text,
+        phone_verified boolean,
+        phone_verify_code text,
+        phone_verify_code_expiry timestamp,
+        phone_verify_attempts int,
+        locale text,
         PRIMARY KEY(username)
     ) WITH COMPACT STORAGE`,
 
@@ -556,6 +830,12 @@ func (dl *CassDatalayer) migrateNext(session *gocql.Session, startVersion string
             return startVersion, err
         }
         return "15.04.03", nil
+    } else if startVersion == "15.04.03" {
+        err := migrations.Migrate_15_04_03_to_15_05_08(session)
+        if err != nil {
+            return startVersion, err
+        }
+        return "15.05.08", nil
     }
     return  startVersion, fmt.Errorf("Unknown DB version %s", startVersion)
 }
@@ -574,7 +854,7 @@ func (dl *CassDatalayer) MigrateDB(keyspace, startVersion, endVersion string) er
     curVersion := startVersion
     for curVersion != endVersion {
         canolog.Info("Migrating from %s to next version", curVersion)
-        curVersion, err = dl.migrateNext(session, startVersion)
+        curVersion, err = dl.migrateNext(session, curVersion)
         if err != nil {
             canolog.Error("Failed migrating from %s:", curVersion, err)
             return err
@@ -29,13 +29,17 @@ import (
 type CassDevice struct {
     conn *CassConnection
     deviceId gocql.UUID
+    classOwner string
+    className string
     doc sddl.Document
     docString string
+    sddlVersion int
     last_seen *time.Time
     locationNote string
     name string
     publicAccessLevel datalayer.AccessLevel
     secretKey string
+    varDeclPolicy datalayer.VarDeclPolicy
     wsConnected bool
 }
 
@@ -164,18 +168,47 @@ func (device *CassDevice) getHistoricData_generic(propname string, datatype sddl
     return samples, nil
 }
 
-func (device *CassDevice) ExtendSDDL(jsn map[string]interface{}) error {
+func (device *CassDevice) AccountAccess(account datalayer.Account) (datalayer.AccessLevel, datalayer.ShareLevel, error) {
+    var accessLevel, shareLevel int
+    err := device.conn.session.Query(`
+            SELECT access_level, share_level
+            FROM device_accounts
+            WHERE device_id = ? AND username = ?
+            LIMIT 1
+    `, device.ID(), account.Username()).Consistency(gocql.One).Scan(
+            &accessLevel, &shareLevel)
+    if err == gocql.ErrNotFound {
+        return datalayer.NoAccess, datalayer.NoSharing, nil
+    } else if err != nil {
+        return datalayer.NoAccess, datalayer.NoSharing, err
+    }
+    return datalayer.AccessLevel(accessLevel), datalayer.ShareLevel(shareLevel), nil
+}
+
+func (device *CassDevice) ExtendSDDL(jsn map[string]interface{}, origin datalayer.SDDLOrigin) error {
     // TODO: Race condition?
-    doc := device.SDDLDocument()
+    // Extend a copy, so that the cached document is left unchanged if the
+    // extension is invalid or can't be saved.
+    doc := sddl.Sys.NewEmptyDocument()
+    if device.SDDLDocument() != nil {
+        sddlText, err := device.SDDLDocument().ToString()
+        if err != nil {
+            return err
+        }
+        doc, err = sddl.Sys.ParseDocumentString(sddlText)
+        if err != nil {
+            return err
+        }
+    }
 
     err := doc.Extend(jsn)
     if err != nil {
         canolog.Error("Error extending class ", jsn, err)
-        return err
+        return datalayer.NewValidationError(err.Error())
     }
 
     // save modified SDDL class to DB
-    err = device.SetSDDLDocument(doc)
+    err = device.SetSDDLDocument(doc, origin)
     if err != nil {
         canolog.Error("Error saving SDDL: ", err)
         return err
@@ -225,7 +258,7 @@ func (device *CassDevice) HistoricNotifications() ([]datalayer.Notification, err
 
     for iter.Scan(&uuid, &timestamp, &dismissed, &msg, &notifyType) {
         notifications = append(notifications, &CassNotification{
-                uuid, timestamp, dismissed, msg, notifyType})
+                device.conn, uuid, timestamp, dismissed, msg, notifyType})
     }
 
     if err := iter.Close(); err != nil {
@@ -236,15 +269,16 @@ func (device *CassDevice) HistoricNotifications() ([]datalayer.Notification, err
 }
 
 
-func (device *CassDevice)InsertNotification(notifyType int, t time.Time, msg string) error {
+func (device *CassDevice)InsertNotification(notifyType int, t time.Time, msg string) (datalayer.Notification, error) {
     err := device.conn.session.Query(`
             INSERT INTO notifications (device_id, time_issued, dismissed, msg, notify_type)
             VALUES (?, ?, false, ?, ?)
     `, device.ID(), t, msg, notifyType).Exec()
     if err != nil {
-        return err;
+        return nil, err;
     }
-    return nil
+    return &CassNotification{
+            device.conn, device.ID(), t, false, msg, notifyType}, nil
 }
 
 func (device *CassDevice) LastActivityTime() *time.Time {
@@ -517,6 +551,39 @@ func (device *CassDevice) Name() string {
     return device.name
 }
 
+func (device *CassDevice) Permissions() ([]datalayer.DevicePermission, error) {
+    var username string
+    var accessLevel, shareLevel int
+
+    query := device.conn.session.Query(`
+            SELECT username, access_level, share_level
+            FROM device_accounts
+            WHERE device_id = ?
+    `, device.ID()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    perms := []datalayer.DevicePermission{}
+    for iter.Scan(&username, &accessLevel, &shareLevel) {
+        if accessLevel == datalayer.NoAccess {
+            continue
+        }
+        account, err := device.conn.LookupAccount(username)
+        if err != nil {
+            canolog.Error("Error looking up account ", username, " with access to ", device.ID(), ": ", err)
+            continue
+        }
+        perms = append(perms, datalayer.DevicePermission{
+            Account: account,
+            AccessLevel: datalayer.AccessLevel(accessLevel),
+            ShareLevel: datalayer.ShareLevel(shareLevel),
+        })
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return perms, nil
+}
+
 func (device *CassDevice) PublicAccessLevel() datalayer.AccessLevel {
     return device.publicAccessLevel
 }
@@ -529,14 +596,37 @@ func (device *CassDevice) SDDLDocumentString() string {
     return device.docString
 }
 
+func (device *CassDevice) RevokeAccountAccess(username string) error {
+    err := device.conn.session.Query(`
+            DELETE FROM device_permissions
+            WHERE username = ? AND device_id = ?
+    `, username, device.ID()).Exec()
+    if err != nil {
+        return err
+    }
+
+    return device.conn.session.Query(`
+            DELETE FROM device_accounts
+            WHERE device_id = ? AND username = ?
+    `, device.ID(), username).Exec()
+}
+
 func (device *CassDevice) SetAccountAccess(account datalayer.Account, access datalayer.AccessLevel, sharing datalayer.ShareLevel) error {
-    /* TODO: Incorporate sharing level */
+    // device_permissions uses compact storage and can't hold the sharing
+    // level, so it is only recorded in device_accounts.
     err := device.conn.session.Query(`
             INSERT INTO device_permissions (username, device_id, access_level)
             VALUES (?, ?, ?)
     `, account.Username(), device.ID(), access).Exec()
+    if err != nil {
+        return err
+    }
 
-    return err
+    return device.conn.session.Query(`
+            INSERT INTO device_accounts (device_id, username, access_level,
+                share_level)
+            VALUES (?, ?, ?, ?)
+    `, device.ID(), account.Username(), access, sharing).Exec()
 }
 
 func (device *CassDevice) SetLocationNote(locationNote string) error {
@@ -566,20 +656,65 @@ func (device *CassDevice) SetName(name string) error {
 }
 
 
-func (device *CassDevice) SetSDDLDocument(doc sddl.Document) error {
+func (device *CassDevice) SetSDDLDocument(doc sddl.Document, origin datalayer.SDDLOrigin) error {
     sddlText, err := doc.ToString()
     if err != nil {
         return err
     }
 
+    // Devices re-send their SDDL frequently.  Only record actual changes.
+    if sddlText == device.docString {
+        device.doc = doc
+        return nil
+    }
+
+    err = validateDerivedVars(doc)
+    if err != nil {
+        return err
+    }
+
+    // Devices that belong to an SDDL class only store their extensions to
+    // the class document.
+    storedText := sddlText
+    if device.className != "" {
+        class, err := device.conn.lookupSDDLClass(device.classOwner, device.className)
+        if err != nil {
+            return err
+        }
+        storedText, err = sddlExtensionString(class.Document(), doc)
+        if err != nil {
+            return err
+        }
+    }
+
+    err = device.addSDDLVersion(sddlText, origin)
+    if err != nil {
+        return err
+    }
+
     err = device.conn.session.Query(`
             UPDATE devices
             SET sddl = ?
             WHERE device_id = ?
-    `, sddlText, device.ID()).Exec()
+    `, storedText, device.ID()).Exec()
     if err != nil {
         return err;
     }
+    device.doc = doc
+    device.docString = sddlText
+    return nil;
+}
+
+func (device *CassDevice) SetVarDeclPolicy(policy datalayer.VarDeclPolicy) error {
+    err := device.conn.session.Query(`
+            UPDATE devices
+            SET var_decl_policy = ?
+            WHERE device_id = ?
+    `, policy, device.ID()).Exec()
+    if err != nil {
+        return err;
+    }
+    device.varDeclPolicy = policy
     return nil;
 }
 
@@ -615,6 +750,10 @@ func (device *CassDevice) UpdateWSConnected(connected bool) error {
     return nil;
 }
 
+func (device *CassDevice) VarDeclPolicy() datalayer.VarDeclPolicy {
+    return device.varDeclPolicy
+}
+
 func (device *CassDevice) WSConnected() bool {
     return device.wsConnected
 }
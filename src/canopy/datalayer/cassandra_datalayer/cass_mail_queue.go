@@ -0,0 +1,139 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "github.com/gocql/gocql"
+    "sort"
+    "time"
+)
+
+// Outgoing email is stored in the mail_queue table, keyed by ID.  Rows
+// expire mailQueueTTL after the message is queued.  Updates only write some
+// columns, so they use the remaining TTL to expire along with the rest of
+// the row.
+
+const mailQueueTTL = 7*24*time.Hour
+
+// Columns selected by LookupQueuedMail and QueuedMails, in the order
+// expected by scanQueuedMail.
+const queuedMailColumns = `id, recipients, subject, message, status, attempts,
+        error, time_queued, time_updated, next_attempt`
+
+func scanQueuedMail(iter *gocql.Iter) (datalayer.QueuedMail, bool) {
+    var mail datalayer.QueuedMail
+    var status int
+    ok := iter.Scan(
+            &mail.ID,
+            &mail.Recipients,
+            &mail.Subject,
+            &mail.Message,
+            &status,
+            &mail.Attempts,
+            &mail.Error,
+            &mail.TimeQueued,
+            &mail.TimeUpdated,
+            &mail.NextAttempt)
+    mail.Status = datalayer.MailStatus(status)
+    return mail, ok
+}
+
+func (conn *CassConnection) EnqueueMail(mail *datalayer.QueuedMail) error {
+    id, err := gocql.RandomUUID()
+    if err != nil {
+        return err
+    }
+    now := time.Now().UTC()
+
+    err = conn.session.Query(`
+            INSERT INTO mail_queue (id, recipients, subject, message, status,
+                attempts, error, time_queued, time_updated, next_attempt)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            USING TTL ?
+    `, id, mail.Recipients, mail.Subject, mail.Message, int(mail.Status),
+            mail.Attempts, mail.Error, now, now, mail.NextAttempt,
+            int(mailQueueTTL/time.Second)).Exec()
+    if err != nil {
+        return err
+    }
+    mail.ID = id
+    mail.TimeQueued = now
+    mail.TimeUpdated = now
+    return nil
+}
+
+func (conn *CassConnection) LookupQueuedMail(id gocql.UUID) (datalayer.QueuedMail, error) {
+    iter := conn.session.Query(`
+            SELECT ` + queuedMailColumns + `
+            FROM mail_queue
+            WHERE id = ?
+            LIMIT 1
+    `, id).Consistency(gocql.One).Iter()
+    mail, ok := scanQueuedMail(iter)
+    if err := iter.Close(); err != nil {
+        return datalayer.QueuedMail{}, err
+    }
+    if !ok {
+        return datalayer.QueuedMail{}, gocql.ErrNotFound
+    }
+    return mail, nil
+}
+
+func (conn *CassConnection) QueuedMails() ([]datalayer.QueuedMail, error) {
+    iter := conn.session.Query(`
+            SELECT ` + queuedMailColumns + `
+            FROM mail_queue
+    `).Consistency(gocql.One).Iter()
+    mails := []datalayer.QueuedMail{}
+    for {
+        mail, ok := scanQueuedMail(iter)
+        if !ok {
+            break
+        }
+        mails = append(mails, mail)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    sort.Sort(queuedMailsByTime(mails))
+    return mails, nil
+}
+
+type queuedMailsByTime []datalayer.QueuedMail
+
+func (p queuedMailsByTime) Len() int           { return len(p) }
+func (p queuedMailsByTime) Less(i, j int) bool { return p[i].TimeQueued.Before(p[j].TimeQueued) }
+func (p queuedMailsByTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (conn *CassConnection) UpdateQueuedMail(mail datalayer.QueuedMail) error {
+    ttl := mail.TimeQueued.Add(mailQueueTTL).Sub(time.Now())
+    if ttl < time.Second {
+        // About to expire anyway.
+        return nil
+    }
+    return conn.session.Query(`
+            UPDATE mail_queue
+            USING TTL ?
+            SET status = ?,
+                attempts = ?,
+                error = ?,
+                time_updated = ?,
+                next_attempt = ?
+            WHERE id = ?
+    `, int(ttl/time.Second), int(mail.Status), mail.Attempts, mail.Error,
+            mail.TimeUpdated, mail.NextAttempt, mail.ID).Exec()
+}
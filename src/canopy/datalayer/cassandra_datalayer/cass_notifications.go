@@ -16,16 +16,16 @@
 package cassandra_datalayer
 
 import (
-    //"canopy/datalayer"
+    "canopy/datalayer"
     "github.com/gocql/gocql"
     "time"
     //"canopy/sddl"
     //"canopy/canolog"
-    "fmt"
 )
 
 
 type CassNotification struct {
+    conn *CassConnection
     deviceId gocql.UUID
     t time.Time
     isDismissed bool
@@ -37,8 +37,25 @@ func (note *CassNotification) Datetime() time.Time {
     return note.t;
 }
 
+func (note *CassNotification) DeviceID() gocql.UUID {
+    return note.deviceId
+}
+
 func (note *CassNotification) Dismiss() error {
-    return fmt.Errorf("Not implemented")
+    err := note.conn.session.Query(`
+            UPDATE notifications
+            SET dismissed = true
+            WHERE device_id = ? AND time_issued = ?
+    `, note.deviceId, note.t).Exec()
+    if err != nil {
+        return err
+    }
+    note.isDismissed = true
+    return nil
+}
+
+func (note *CassNotification) ID() string {
+    return datalayer.NotificationID(note.deviceId, note.t)
 }
 
 func (note *CassNotification) IsDismissed() bool {
@@ -52,3 +69,231 @@ func (note *CassNotification) Msg() string {
 func (note *CassNotification) NotifyType() int {
     return note.notifyType;
 }
+
+func (note *CassNotification) Deliveries() ([]datalayer.NotificationDelivery, error) {
+    var delivery datalayer.NotificationDelivery
+    var channel, status int
+
+    query := note.conn.session.Query(`
+            SELECT username, channel, status, error, time
+            FROM notification_deliveries
+            WHERE device_id = ? AND time_issued = ?
+    `, note.deviceId, note.t).Consistency(gocql.One)
+
+    iter := query.Iter()
+    deliveries := []datalayer.NotificationDelivery{}
+    for iter.Scan(&delivery.Username, &channel, &status, &delivery.Error,
+            &delivery.Time) {
+        delivery.Channel = datalayer.NotificationChannel(channel)
+        delivery.Status = datalayer.DeliveryStatus(status)
+        deliveries = append(deliveries, delivery)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return deliveries, nil
+}
+
+func (note *CassNotification) RecordDelivery(delivery datalayer.NotificationDelivery) error {
+    return note.conn.session.Query(`
+            INSERT INTO notification_deliveries (device_id, time_issued,
+                username, channel, status, error, time)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, note.deviceId, note.t, delivery.Username, int(delivery.Channel),
+            int(delivery.Status), delivery.Error, delivery.Time).Exec()
+}
+
+func (device *CassDevice) Notification(t time.Time) (datalayer.Notification, error) {
+    note := CassNotification{
+        conn: device.conn,
+        deviceId: device.ID(),
+        t: t,
+    }
+    err := device.conn.session.Query(`
+            SELECT dismissed, msg, notify_type
+            FROM notifications
+            WHERE device_id = ? AND time_issued = ?
+            LIMIT 1
+    `, device.ID(), t).Consistency(gocql.One).Scan(
+            &note.isDismissed,
+            &note.msg,
+            &note.notifyType)
+    if err != nil {
+        return nil, err
+    }
+    return &note, nil
+}
+
+func (account *CassAccount) MarkNotificationRead(note datalayer.Notification) error {
+    return account.conn.session.Query(`
+            INSERT INTO notification_reads (username, device_id, time_issued,
+                time_read)
+            VALUES (?, ?, ?, ?)
+    `, account.Username(), note.DeviceID(), note.Datetime(),
+            time.Now().UTC()).Exec()
+}
+
+func (account *CassAccount) ReadNotifications() (map[string]bool, error) {
+    var deviceId gocql.UUID
+    var t time.Time
+
+    query := account.conn.session.Query(`
+            SELECT device_id, time_issued
+            FROM notification_reads
+            WHERE username = ?
+    `, account.Username()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    read := map[string]bool{}
+    for iter.Scan(&deviceId, &t) {
+        read[datalayer.NotificationID(deviceId, t)] = true
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return read, nil
+}
+
+func (device *CassDevice) NotificationsBefore(t time.Time, limit int) ([]datalayer.Notification, error) {
+    var timeIssued time.Time
+    var dismissed bool
+    var msg string
+    var notifyType int
+
+    var query *gocql.Query
+    if t.IsZero() {
+        query = device.conn.session.Query(`
+                SELECT time_issued, dismissed, msg, notify_type
+                FROM notifications
+                WHERE device_id = ?
+                ORDER BY time_issued DESC
+                LIMIT ?
+        `, device.ID(), limit)
+    } else {
+        query = device.conn.session.Query(`
+                SELECT time_issued, dismissed, msg, notify_type
+                FROM notifications
+                WHERE device_id = ? AND time_issued < ?
+                ORDER BY time_issued DESC
+                LIMIT ?
+        `, device.ID(), t, limit)
+    }
+
+    iter := query.Consistency(gocql.One).Iter()
+    notifications := []datalayer.Notification{}
+    for iter.Scan(&timeIssued, &dismissed, &msg, &notifyType) {
+        notifications = append(notifications, &CassNotification{
+                device.conn, device.ID(), timeIssued, dismissed, msg, notifyType})
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return notifications, nil
+}
+
+func (device *CassDevice) NotificationsSince(t time.Time) ([]datalayer.Notification, error) {
+    var timeIssued time.Time
+    var dismissed bool
+    var msg string
+    var notifyType int
+
+    query := device.conn.session.Query(`
+            SELECT time_issued, dismissed, msg, notify_type
+            FROM notifications
+            WHERE device_id = ? AND time_issued > ?
+    `, device.ID(), t).Consistency(gocql.One)
+
+    iter := query.Iter()
+    notifications := []datalayer.Notification{}
+    for iter.Scan(&timeIssued, &dismissed, &msg, &notifyType) {
+        notifications = append(notifications, &CassNotification{
+                device.conn, device.ID(), timeIssued, dismissed, msg, notifyType})
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return notifications, nil
+}
+
+func (account *CassAccount) AddToDigest(item datalayer.DigestItem) error {
+    return account.conn.session.Query(`
+            INSERT INTO notification_digests (username, time_issued,
+                device_id, device_name, notify_type, msg)
+            VALUES (?, ?, ?, ?, ?, ?)
+    `, account.Username(), item.Time, item.DeviceID, item.DeviceName,
+            item.NotifyType, item.Msg).Exec()
+}
+
+func (account *CassAccount) ClearDigest(items []datalayer.DigestItem) error {
+    for _, item := range items {
+        err := account.conn.session.Query(`
+                DELETE FROM notification_digests
+                WHERE username = ? AND time_issued = ? AND device_id = ?
+        `, account.Username(), item.Time, item.DeviceID).Exec()
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (account *CassAccount) NotificationsSentSince(t time.Time) (int, error) {
+    var count int
+    err := account.conn.session.Query(`
+            SELECT COUNT(*)
+            FROM notifications_sent
+            WHERE username = ? AND time > ?
+    `, account.Username(), t).Consistency(gocql.One).Scan(&count)
+    if err != nil {
+        return 0, err
+    }
+    return count, nil
+}
+
+func (account *CassAccount) PendingDigest() ([]datalayer.DigestItem, error) {
+    var item datalayer.DigestItem
+
+    query := account.conn.session.Query(`
+            SELECT time_issued, device_id, device_name, notify_type, msg
+            FROM notification_digests
+            WHERE username = ?
+    `, account.Username()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    items := []datalayer.DigestItem{}
+    for iter.Scan(&item.Time, &item.DeviceID, &item.DeviceName,
+            &item.NotifyType, &item.Msg) {
+        items = append(items, item)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return items, nil
+}
+
+func (account *CassAccount) RecordNotificationSent(channel datalayer.NotificationChannel, t time.Time) error {
+    return account.conn.session.Query(`
+            INSERT INTO notifications_sent (username, time, channel)
+            VALUES (?, ?, ?)
+            USING TTL 86400
+    `, account.Username(), t, int(channel)).Exec()
+}
+
+func (conn *CassConnection) DigestUsernames() ([]string, error) {
+    var username string
+
+    query := conn.session.Query(`
+            SELECT DISTINCT username
+            FROM notification_digests
+    `).Consistency(gocql.One)
+
+    iter := query.Iter()
+    usernames := []string{}
+    for iter.Scan(&username) {
+        usernames = append(usernames, username)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return usernames, nil
+}
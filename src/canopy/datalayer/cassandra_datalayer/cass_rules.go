@@ -0,0 +1,383 @@
+/*
+ * Copright 2014-2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "encoding/json"
+    "fmt"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Rules are stored in the rules table, keyed by owner.  The device_rules
+// table is a reverse index used to find the rules that watch a device when
+// one of its Cloud Variables changes.
+
+type CassRule struct {
+    conn *CassConnection
+    owner string
+    id gocql.UUID
+    params datalayer.RuleParams
+    timeCreated time.Time
+    lastState bool
+    lastFired time.Time
+}
+
+// JSON representation of a RuleAction, as stored in the rules.actions
+// column.
+type storedRuleAction struct {
+    Type string `json:"type"`
+    Params map[string]interface{} `json:"params"`
+}
+
+func encodeRuleActions(actions []datalayer.RuleAction) (string, error) {
+    stored := []storedRuleAction{}
+    for _, action := range actions {
+        stored = append(stored, storedRuleAction{action.Type, action.Params})
+    }
+    bytes, err := json.Marshal(stored)
+    if err != nil {
+        return "", err
+    }
+    return string(bytes), nil
+}
+
+func decodeRuleActions(actionsString string) ([]datalayer.RuleAction, error) {
+    stored := []storedRuleAction{}
+    if actionsString != "" {
+        err := json.Unmarshal([]byte(actionsString), &stored)
+        if err != nil {
+            return nil, err
+        }
+    }
+    actions := []datalayer.RuleAction{}
+    for _, action := range stored {
+        actions = append(actions, datalayer.RuleAction{Type: action.Type, Params: action.Params})
+    }
+    return actions, nil
+}
+
+// Columns selected by lookupRule and Rules, in the order expected by
+// scanRule.
+const ruleColumns = `id, name, condition, device_ids, match, actions,
+        cooldown_s, enabled, time_created, last_state, last_fired`
+
+// Read the next rule from <iter>.  Returns false when there are no more rows.
+// Returns a nil rule for rows that can't be decoded.
+func (conn *CassConnection) scanRule(owner string, iter *gocql.Iter) (*CassRule, bool) {
+    rule := CassRule{
+        conn: conn,
+        owner: owner,
+    }
+    var match, cooldown int
+    var actionsString string
+    if !iter.Scan(
+            &rule.id,
+            &rule.params.Name,
+            &rule.params.Condition,
+            &rule.params.DeviceIDs,
+            &match,
+            &actionsString,
+            &cooldown,
+            &rule.params.Enabled,
+            &rule.timeCreated,
+            &rule.lastState,
+            &rule.lastFired) {
+        return nil, false
+    }
+    rule.params.Match = datalayer.RuleMatch(match)
+    rule.params.Cooldown = time.Duration(cooldown)*time.Second
+
+    var err error
+    rule.params.Actions, err = decodeRuleActions(actionsString)
+    if err != nil {
+        canolog.Error("Error decoding actions for rule ", owner, "/", rule.id, ": ", err)
+        return nil, true
+    }
+    return &rule, true
+}
+
+func (conn *CassConnection) lookupRule(owner string, id gocql.UUID) (*CassRule, error) {
+    iter := conn.session.Query(`
+            SELECT ` + ruleColumns + `
+            FROM rules
+            WHERE owner = ? AND id = ?
+            LIMIT 1
+    `, owner, id).Consistency(gocql.One).Iter()
+    rule, ok := conn.scanRule(owner, iter)
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    if !ok {
+        return nil, gocql.ErrNotFound
+    }
+    if rule == nil {
+        return nil, fmt.Errorf("Could not decode rule %s", id)
+    }
+    return rule, nil
+}
+
+func (conn *CassConnection) RulesForDevice(deviceId gocql.UUID) ([]datalayer.Rule, error) {
+    var owner string
+    var ruleId gocql.UUID
+
+    query := conn.session.Query(`
+            SELECT owner, rule_id
+            FROM device_rules
+            WHERE device_id = ?
+    `, deviceId).Consistency(gocql.One)
+
+    iter := query.Iter()
+    rules := []datalayer.Rule{}
+    for iter.Scan(&owner, &ruleId) {
+        rule, err := conn.lookupRule(owner, ruleId)
+        if err != nil {
+            canolog.Error("Error looking up rule ", owner, "/", ruleId, ": ", err)
+            continue
+        }
+        rules = append(rules, rule)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return rules, nil
+}
+
+// Add or remove the device_rules entries for a rule.
+func (conn *CassConnection) indexRuleDevices(owner string, id gocql.UUID, deviceIds []gocql.UUID, add bool) error {
+    for _, deviceId := range deviceIds {
+        var err error
+        if add {
+            err = conn.session.Query(`
+                    INSERT INTO device_rules (device_id, owner, rule_id)
+                    VALUES (?, ?, ?)
+            `, deviceId, owner, id).Exec()
+        } else {
+            err = conn.session.Query(`
+                    DELETE FROM device_rules
+                    WHERE device_id = ? AND owner = ? AND rule_id = ?
+            `, deviceId, owner, id).Exec()
+        }
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Write a rule's settings, resetting its state.
+func (conn *CassConnection) saveRule(owner string, id gocql.UUID, params datalayer.RuleParams, timeCreated time.Time) error {
+    actionsString, err := encodeRuleActions(params.Actions)
+    if err != nil {
+        return err
+    }
+    return conn.session.Query(`
+            INSERT INTO rules (owner, id, name, condition, device_ids, match,
+                    actions, cooldown_s, enabled, time_created, last_state,
+                    last_fired)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, false, null)
+    `, owner, id, params.Name, params.Condition, params.DeviceIDs,
+            int(params.Match), actionsString,
+            int(params.Cooldown/time.Second), params.Enabled,
+            timeCreated).Exec()
+}
+
+func (account *CassAccount) CreateRule(params datalayer.RuleParams) (datalayer.Rule, error) {
+    id, err := gocql.RandomUUID()
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now().UTC()
+
+    err = account.conn.saveRule(account.Username(), id, params, now)
+    if err != nil {
+        canolog.Error("Error creating rule: ", err)
+        return nil, err
+    }
+    err = account.conn.indexRuleDevices(account.Username(), id, params.DeviceIDs, true)
+    if err != nil {
+        canolog.Error("Error indexing rule devices: ", err)
+        return nil, err
+    }
+
+    return &CassRule{
+        conn: account.conn,
+        owner: account.Username(),
+        id: id,
+        params: params,
+        timeCreated: now,
+    }, nil
+}
+
+func (account *CassAccount) DeleteRule(id gocql.UUID) error {
+    rule, err := account.conn.lookupRule(account.Username(), id)
+    if err != nil {
+        return err
+    }
+
+    err = account.conn.indexRuleDevices(rule.owner, rule.id, rule.params.DeviceIDs, false)
+    if err != nil {
+        return err
+    }
+
+    return account.conn.session.Query(`
+            DELETE FROM rules
+            WHERE owner = ? AND id = ?
+    `, rule.owner, rule.id).Exec()
+}
+
+func (account *CassAccount) Rule(id gocql.UUID) (datalayer.Rule, error) {
+    rule, err := account.conn.lookupRule(account.Username(), id)
+    if err != nil {
+        return nil, err
+    }
+    return rule, nil
+}
+
+func (account *CassAccount) Rules() ([]datalayer.Rule, error) {
+    query := account.conn.session.Query(`
+            SELECT ` + ruleColumns + `
+            FROM rules
+            WHERE owner = ?
+    `, account.Username()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    rules := []datalayer.Rule{}
+    for {
+        rule, ok := account.conn.scanRule(account.Username(), iter)
+        if !ok {
+            break
+        }
+        if rule != nil {
+            rules = append(rules, rule)
+        }
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return rules, nil
+}
+
+func (rule *CassRule) Actions() []datalayer.RuleAction {
+    return rule.params.Actions
+}
+
+func (rule *CassRule) Condition() string {
+    return rule.params.Condition
+}
+
+func (rule *CassRule) Cooldown() time.Duration {
+    return rule.params.Cooldown
+}
+
+func (rule *CassRule) DeviceIDs() []gocql.UUID {
+    return rule.params.DeviceIDs
+}
+
+func (rule *CassRule) Enabled() bool {
+    return rule.params.Enabled
+}
+
+func (rule *CassRule) ID() gocql.UUID {
+    return rule.id
+}
+
+func (rule *CassRule) LastFired() time.Time {
+    return rule.lastFired
+}
+
+func (rule *CassRule) LastState() bool {
+    return rule.lastState
+}
+
+func (rule *CassRule) Match() datalayer.RuleMatch {
+    return rule.params.Match
+}
+
+func (rule *CassRule) Name() string {
+    return rule.params.Name
+}
+
+func (rule *CassRule) Owner() string {
+    return rule.owner
+}
+
+func (rule *CassRule) RecordEvaluation(state, fired bool, t time.Time) (bool, error) {
+    if state == rule.lastState && !fired {
+        return true, nil
+    }
+
+    set := "last_state = ?"
+    values := []interface{}{state}
+    if fired {
+        set += ", last_fired = ?"
+        values = append(values, t)
+    }
+    values = append(values, rule.owner, rule.id, rule.lastState)
+
+    // Condition on the state this rule was loaded with, including when it
+    // last fired, so that only one evaluation records each transition and
+    // the cooldown can't be bypassed.
+    cond := "last_state = ? AND last_fired = null"
+    if !rule.lastFired.IsZero() {
+        cond = "last_state = ? AND last_fired = ?"
+        values = append(values, rule.lastFired)
+    }
+
+    applied, err := rule.conn.session.Query(`
+            UPDATE rules
+            SET ` + set + `
+            WHERE owner = ? AND id = ?
+            IF ` + cond, values...).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        return false, err
+    }
+    if !applied {
+        return false, nil
+    }
+
+    rule.lastState = state
+    if fired {
+        rule.lastFired = t
+    }
+    return true, nil
+}
+
+func (rule *CassRule) TimeCreated() time.Time {
+    return rule.timeCreated
+}
+
+func (rule *CassRule) Update(params datalayer.RuleParams) error {
+    err := rule.conn.indexRuleDevices(rule.owner, rule.id, rule.params.DeviceIDs, false)
+    if err != nil {
+        return err
+    }
+    err = rule.conn.saveRule(rule.owner, rule.id, params, rule.timeCreated)
+    if err != nil {
+        return err
+    }
+    err = rule.conn.indexRuleDevices(rule.owner, rule.id, params.DeviceIDs, true)
+    if err != nil {
+        return err
+    }
+
+    rule.params = params
+    rule.lastState = false
+    rule.lastFired = time.Time{}
+    return nil
+}
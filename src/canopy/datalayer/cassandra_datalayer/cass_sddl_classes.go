@@ -0,0 +1,621 @@
+/*
+ * Copright 2014-2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "canopy/device_filter"
+    "canopy/sddl"
+    "encoding/json"
+    "fmt"
+    "github.com/gocql/gocql"
+    "reflect"
+    "regexp"
+    "sort"
+    "time"
+)
+
+// SDDL classes let many identical devices share a single SDDL document.  The
+// class document is stored once, in the sddl_classes table.  For devices that
+// belong to a class, the devices.sddl column only holds the device's
+// extensions to the class, which are combined with the class document when
+// the device is loaded.
+
+type CassSDDLClass struct {
+    conn *CassConnection
+    owner string
+    name string
+    version int
+    timeUpdated time.Time
+    doc sddl.Document
+    docString string
+}
+
+var sddlClassNamePattern = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+func validateSDDLClassName(name string) error {
+    if len(name) == 0 {
+        return datalayer.NewValidationError("SDDL class name required")
+    }
+    if len(name) > 64 {
+        return datalayer.NewValidationError("SDDL class name too long")
+    }
+    if !sddlClassNamePattern.MatchString(name) {
+        return datalayer.NewValidationError("Invalid SDDL class name")
+    }
+    return nil
+}
+
+// Reject SDDL documents whose derived Cloud Variables can't be computed,
+// such as expressions that reference undeclared variables or each other in a
+// cycle.
+func validateDerivedVars(doc sddl.Document) error {
+    err := device_filter.CheckDerivedVars(doc)
+    if err != nil {
+        return datalayer.NewValidationError(err.Error())
+    }
+    return nil
+}
+
+// Parse an SDDL document string as stored in the database.  An empty string
+// is an empty document.
+func parseStoredSDDL(docString string) (sddl.Document, error) {
+    if docString == "" {
+        return sddl.Sys.NewEmptyDocument(), nil
+    }
+    return sddl.Sys.ParseDocumentString(docString)
+}
+
+// Combine an SDDL class document with a device's per-device extensions.
+// Extensions override class Cloud Variables that have the same name.
+func composeClassSDDL(classDocString, extString string) (sddl.Document, error) {
+    doc, err := parseStoredSDDL(classDocString)
+    if err != nil {
+        return nil, err
+    }
+    if extString == "" {
+        return doc, nil
+    }
+    ext, err := sddl.Sys.ParseDocumentString(extString)
+    if err != nil {
+        return nil, err
+    }
+    err = doc.Extend(ext.Json())
+    if err != nil {
+        return nil, err
+    }
+    return doc, nil
+}
+
+// Get the parts of <doc> that differ from SDDL class document <classDoc>, as
+// a marshalled JSON string.  Returns "" if there are no differences.
+//
+// Cloud Variables declared by the class cannot be removed from member
+// devices, so only additions and overrides are kept.
+func sddlExtensionString(classDoc, doc sddl.Document) (string, error) {
+    ext := map[string]interface{}{}
+    classJson := classDoc.Json()
+    for k, v := range doc.Json() {
+        if k == "authors" || k == "description" {
+            // Document metadata always comes from the class
+            continue
+        }
+        classV, ok := classJson[k]
+        if ok && reflect.DeepEqual(classV, v) {
+            continue
+        }
+        ext[k] = v
+    }
+    if len(ext) == 0 {
+        return "", nil
+    }
+    bytes, err := json.Marshal(ext)
+    if err != nil {
+        return "", err
+    }
+    return string(bytes), nil
+}
+
+func (conn *CassConnection) LookupSDDLClass(owner, name string) (datalayer.SDDLClass, error) {
+    class, err := conn.lookupSDDLClass(owner, name)
+    if err != nil {
+        return nil, err
+    }
+    return class, nil
+}
+
+func (conn *CassConnection) lookupSDDLClass(owner, name string) (*CassSDDLClass, error) {
+    class := CassSDDLClass{
+        conn: conn,
+        owner: owner,
+        name: name,
+    }
+
+    err := conn.session.Query(`
+            SELECT version, time_updated, sddl
+            FROM sddl_classes
+            WHERE owner = ? AND name = ?
+            LIMIT 1
+    `, owner, name).Consistency(gocql.One).Scan(
+        &class.version,
+        &class.timeUpdated,
+        &class.docString)
+    if err != nil {
+        return nil, err
+    }
+
+    class.doc, err = parseStoredSDDL(class.docString)
+    if err != nil {
+        canolog.Error("Error parsing SDDL class ", owner, "/", name, ": ", err)
+        return nil, err
+    }
+    return &class, nil
+}
+
+// Record <version> of an SDDL class in its history.  The version must have
+// been claimed in sddl_classes first.
+func (conn *CassConnection) insertSDDLClassRevision(owner, name string, version int, t time.Time, docString string) error {
+    return conn.session.Query(`
+            INSERT INTO sddl_class_history (owner, name, version, time_created, sddl)
+            VALUES (?, ?, ?, ?, ?)
+    `, owner, name, version, t, docString).Exec()
+}
+
+// Replace the stored document of an SDDL class with <docString> as version
+// <version>.  The update is a lightweight transaction that only applies if
+// the stored version is still <version> - 1, so concurrent updates can't
+// claim the same version.  Returns false if it didn't apply.
+func (conn *CassConnection) claimSDDLClassVersion(owner, name string, version int, t time.Time, docString string) (bool, error) {
+    return conn.session.Query(`
+            UPDATE sddl_classes
+            SET version = ?, time_updated = ?, sddl = ?
+            WHERE owner = ? AND name = ?
+            IF version = ?
+    `, version, t, docString, owner, name, version - 1).MapScanCAS(map[string]interface{}{})
+}
+
+func (account *CassAccount) CreateSDDLClass(name string, doc sddl.Document) (datalayer.SDDLClass, error) {
+    err := validateSDDLClassName(name)
+    if err != nil {
+        return nil, err
+    }
+    err = validateDerivedVars(doc)
+    if err != nil {
+        return nil, err
+    }
+
+    if len(doc.Authors()) == 0 {
+        err = doc.Extend(map[string]interface{}{
+            "authors" : []interface{}{account.Username()},
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    docString, err := doc.ToString()
+    if err != nil {
+        return nil, err
+    }
+
+    // Create the class with a lightweight transaction, so that concurrent
+    // requests can't overwrite each other.
+    now := time.Now().UTC()
+    applied, err := account.conn.session.Query(`
+            INSERT INTO sddl_classes (owner, name, version, time_updated, sddl)
+            VALUES (?, ?, ?, ?, ?)
+            IF NOT EXISTS
+    `, account.Username(), name, 1, now, docString).MapScanCAS(map[string]interface{}{})
+    if err != nil {
+        canolog.Error("Error creating SDDL class: ", err)
+        return nil, err
+    }
+    if !applied {
+        return nil, datalayer.NewValidationError(fmt.Sprintf("SDDL class %s already exists", name))
+    }
+    err = account.conn.insertSDDLClassRevision(account.Username(), name, 1, now, docString)
+    if err != nil {
+        canolog.Error("Error creating SDDL class: ", err)
+        return nil, err
+    }
+
+    return &CassSDDLClass{
+        conn: account.conn,
+        owner: account.Username(),
+        name: name,
+        version: 1,
+        timeUpdated: now,
+        doc: doc,
+        docString: docString,
+    }, nil
+}
+
+func (account *CassAccount) DeleteSDDLClass(name string) error {
+    class, err := account.conn.lookupSDDLClass(account.Username(), name)
+    if err != nil {
+        return err
+    }
+
+    members, err := class.Members()
+    if err != nil {
+        return err
+    }
+    if len(members) > 0 {
+        return datalayer.NewValidationError(fmt.Sprintf("SDDL class %s still has %d member devices", name, len(members)))
+    }
+
+    err = account.conn.session.Query(`
+            DELETE FROM sddl_classes
+            WHERE owner = ? AND name = ?
+    `, account.Username(), name).Exec()
+    if err != nil {
+        return err
+    }
+
+    return account.conn.session.Query(`
+            DELETE FROM sddl_class_history
+            WHERE owner = ? AND name = ?
+    `, account.Username(), name).Exec()
+}
+
+func (account *CassAccount) SDDLClass(name string) (datalayer.SDDLClass, error) {
+    return account.conn.LookupSDDLClass(account.Username(), name)
+}
+
+func (account *CassAccount) SDDLClasses() ([]datalayer.SDDLClass, error) {
+    var name string
+    var version int
+    var timeUpdated time.Time
+    var docString string
+
+    query := account.conn.session.Query(`
+            SELECT name, version, time_updated, sddl
+            FROM sddl_classes
+            WHERE owner = ?
+    `, account.Username()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    classes := []datalayer.SDDLClass{}
+    for iter.Scan(&name, &version, &timeUpdated, &docString) {
+        doc, err := parseStoredSDDL(docString)
+        if err != nil {
+            canolog.Error("Error parsing SDDL class ", name, ": ", err)
+            continue
+        }
+        classes = append(classes, &CassSDDLClass{
+            conn: account.conn,
+            owner: account.Username(),
+            name: name,
+            version: version,
+            timeUpdated: timeUpdated,
+            doc: doc,
+            docString: docString,
+        })
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return classes, nil
+}
+
+func (class *CassSDDLClass) Document() sddl.Document {
+    return class.doc
+}
+
+func (class *CassSDDLClass) DocumentString() string {
+    return class.docString
+}
+
+func (class *CassSDDLClass) History() ([]datalayer.SDDLRevision, error) {
+    var version int
+    var t time.Time
+    var docString string
+
+    query := class.conn.session.Query(`
+            SELECT version, time_created, sddl
+            FROM sddl_class_history
+            WHERE owner = ? AND name = ?
+    `, class.owner, class.name).Consistency(gocql.One)
+
+    iter := query.Iter()
+    revisions := []*CassSDDLRevision{}
+    for iter.Scan(&version, &t, &docString) {
+        revisions = append(revisions, &CassSDDLRevision{
+            version: version,
+            t: t,
+            origin: datalayer.SDDLOriginUser,
+            docString: docString,
+        })
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+
+    sort.Sort(sddlRevisionsByVersion(revisions))
+    out := []datalayer.SDDLRevision{}
+    for _, rev := range revisions {
+        out = append(out, rev)
+    }
+    return out, nil
+}
+
+func (class *CassSDDLClass) Members() ([]gocql.UUID, error) {
+    var deviceId gocql.UUID
+
+    query := class.conn.session.Query(`
+            SELECT device_id
+            FROM sddl_class_members
+            WHERE owner = ? AND name = ?
+    `, class.owner, class.name).Consistency(gocql.One)
+
+    iter := query.Iter()
+    members := []gocql.UUID{}
+    for iter.Scan(&deviceId) {
+        members = append(members, deviceId)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return members, nil
+}
+
+func (class *CassSDDLClass) Name() string {
+    return class.name
+}
+
+func (class *CassSDDLClass) Owner() string {
+    return class.owner
+}
+
+// Check that every member device's document is still valid when its
+// extensions are combined with class document <docString>.
+func (class *CassSDDLClass) validateMembers(docString string) error {
+    members, err := class.Members()
+    if err != nil {
+        return err
+    }
+    for _, deviceId := range members {
+        var extString string
+        err := class.conn.session.Query(`
+                SELECT sddl
+                FROM devices
+                WHERE device_id = ?
+                LIMIT 1
+        `, deviceId).Consistency(gocql.One).Scan(&extString)
+        if err == gocql.ErrNotFound {
+            continue
+        } else if err != nil {
+            return err
+        }
+        doc, err := composeClassSDDL(docString, extString)
+        if err != nil {
+            return datalayer.NewValidationError(fmt.Sprintf(
+                    "Incompatible with device %s: %s", deviceId, err))
+        }
+        err = device_filter.CheckDerivedVars(doc)
+        if err != nil {
+            return datalayer.NewValidationError(fmt.Sprintf(
+                    "Incompatible with device %s: %s", deviceId, err))
+        }
+    }
+    return nil
+}
+
+func (class *CassSDDLClass) PropagateDocument() ([]gocql.UUID, error) {
+    // Member devices pick up the new class document the next time they are
+    // loaded, but each one needs a new SDDL version so that its history
+    // stays accurate.
+    members, err := class.Members()
+    if err != nil {
+        return nil, err
+    }
+    updated := []gocql.UUID{}
+    for _, deviceId := range members {
+        device, err := class.conn.lookupDevice(deviceId)
+        if err != nil {
+            canolog.Error("Error propagating SDDL class to device ", deviceId, ": ", err)
+            continue
+        }
+        changed, err := device.recordClassChange()
+        if err != nil {
+            canolog.Error("Error propagating SDDL class to device ", deviceId, ": ", err)
+            continue
+        }
+        if changed {
+            updated = append(updated, deviceId)
+        }
+    }
+    return updated, nil
+}
+
+func (class *CassSDDLClass) SetDocument(doc sddl.Document) (bool, error) {
+    docString, err := doc.ToString()
+    if err != nil {
+        return false, err
+    }
+    if docString == class.docString {
+        return false, nil
+    }
+    err = validateDerivedVars(doc)
+    if err != nil {
+        return false, err
+    }
+    err = class.validateMembers(docString)
+    if err != nil {
+        return false, err
+    }
+
+    // If another request updated the class in the meantime, store this
+    // document as the version after theirs, like addSDDLVersion does.
+    version := class.version + 1
+    now := time.Now().UTC()
+    for attempt := 1; ; attempt++ {
+        applied, err := class.conn.claimSDDLClassVersion(class.owner, class.name, version, now, docString)
+        if err != nil {
+            return false, err
+        }
+        if applied {
+            break
+        }
+        if attempt == maxSDDLVersionAttempts {
+            return false, fmt.Errorf("Could not record SDDL class version for %s/%s", class.owner, class.name)
+        }
+        latest, err := class.conn.lookupSDDLClass(class.owner, class.name)
+        if err != nil {
+            return false, err
+        }
+        if latest.docString == docString {
+            *class = *latest
+            return false, nil
+        }
+        version = latest.version + 1
+        now = time.Now().UTC()
+    }
+
+    err = class.conn.insertSDDLClassRevision(class.owner, class.name, version, now, docString)
+    if err != nil {
+        return false, err
+    }
+    class.version = version
+    class.timeUpdated = now
+    class.doc = doc
+    class.docString = docString
+    return true, nil
+}
+
+func (class *CassSDDLClass) TimeUpdated() time.Time {
+    return class.timeUpdated
+}
+
+func (class *CassSDDLClass) Version() int {
+    return class.version
+}
+
+func (device *CassDevice) SDDLClass() (datalayer.SDDLClass, error) {
+    if device.className == "" {
+        return nil, nil
+    }
+    return device.conn.LookupSDDLClass(device.classOwner, device.className)
+}
+
+func (device *CassDevice) SDDLClassRef() string {
+    if device.className == "" {
+        return ""
+    }
+    return device.classOwner + "/" + device.className
+}
+
+func (device *CassDevice) SetSDDLClass(class datalayer.SDDLClass, origin datalayer.SDDLOrigin) error {
+    var owner, name, storedText string
+    var doc sddl.Document
+    var err error
+
+    if class != nil {
+        owner = class.Owner()
+        name = class.Name()
+        if owner == device.classOwner && name == device.className {
+            return nil
+        }
+        storedText, err = sddlExtensionString(class.Document(), device.doc)
+        if err != nil {
+            return err
+        }
+        doc, err = composeClassSDDL(class.DocumentString(), storedText)
+        if err != nil {
+            return err
+        }
+    } else {
+        if device.className == "" {
+            return nil
+        }
+        // Leaving the class: keep a private copy of the full document.
+        doc = device.doc
+        storedText = device.docString
+    }
+
+    docString, err := doc.ToString()
+    if err != nil {
+        return err
+    }
+
+    err = device.conn.session.Query(`
+            UPDATE devices
+            SET sddl_class_owner = ?,
+                sddl_class_name = ?,
+                sddl = ?
+            WHERE device_id = ?
+    `, owner, name, storedText, device.ID()).Exec()
+    if err != nil {
+        return err
+    }
+
+    if device.className != "" {
+        err = device.conn.session.Query(`
+                DELETE FROM sddl_class_members
+                WHERE owner = ? AND name = ? AND device_id = ?
+        `, device.classOwner, device.className, device.ID()).Exec()
+        if err != nil {
+            return err
+        }
+    }
+    if class != nil {
+        err = device.conn.session.Query(`
+                INSERT INTO sddl_class_members (owner, name, device_id)
+                VALUES (?, ?, ?)
+        `, owner, name, device.ID()).Exec()
+        if err != nil {
+            return err
+        }
+    }
+    device.classOwner = owner
+    device.className = name
+    device.doc = doc
+
+    if docString != device.docString {
+        err = device.addSDDLVersion(docString, origin)
+        if err != nil {
+            return err
+        }
+        device.docString = docString
+    }
+    return nil
+}
+
+// Record a new SDDL version for this device if its SDDL class has changed
+// since the device's latest version.  Returns true if a new version was
+// recorded.
+func (device *CassDevice) recordClassChange() (bool, error) {
+    var latest string
+    if device.sddlVersion > 0 {
+        err := device.conn.session.Query(`
+                SELECT sddl
+                FROM device_sddl_history
+                WHERE device_id = ? AND version = ?
+                LIMIT 1
+        `, device.ID(), device.sddlVersion).Consistency(gocql.One).Scan(&latest)
+        if err != nil && err != gocql.ErrNotFound {
+            return false, err
+        }
+    }
+    if latest == device.docString {
+        return false, nil
+    }
+    err := device.addSDDLVersion(device.docString, datalayer.SDDLOriginClass)
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Copright 2014-2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "canopy/sddl"
+    "fmt"
+    "github.com/gocql/gocql"
+    "sort"
+    "time"
+)
+
+// Every change to a device's SDDL document is recorded in the
+// device_sddl_history table as a new version.  This lets us interpret old
+// samples using the Cloud Variable definitions that were active when they
+// were stored, even after the device changes a variable's datatype.
+
+type CassSDDLRevision struct {
+    version int
+    t time.Time
+    origin datalayer.SDDLOrigin
+    docString string
+}
+
+func (rev *CassSDDLRevision) Document() (sddl.Document, error) {
+    return parseStoredSDDL(rev.docString)
+}
+
+func (rev *CassSDDLRevision) DocumentString() string {
+    return rev.docString
+}
+
+func (rev *CassSDDLRevision) Origin() datalayer.SDDLOrigin {
+    return rev.origin
+}
+
+func (rev *CassSDDLRevision) Timestamp() time.Time {
+    return rev.t
+}
+
+func (rev *CassSDDLRevision) Version() int {
+    return rev.version
+}
+
+type sddlRevisionsByVersion []*CassSDDLRevision
+func (p sddlRevisionsByVersion) Len() int           { return len(p) }
+func (p sddlRevisionsByVersion) Less(i, j int) bool { return p[i].version < p[j].version }
+func (p sddlRevisionsByVersion) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Fetch all recorded SDDL versions for this device, oldest first.
+func (device *CassDevice) sddlRevisions() ([]*CassSDDLRevision, error) {
+    var version int
+    var t time.Time
+    var origin int
+    var docString string
+
+    query := device.conn.session.Query(`
+            SELECT version, time_created, origin, sddl
+            FROM device_sddl_history
+            WHERE device_id = ?
+    `, device.ID()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    revisions := []*CassSDDLRevision{}
+    for iter.Scan(&version, &t, &origin, &docString) {
+        revisions = append(revisions, &CassSDDLRevision{
+            version: version,
+            t: t,
+            origin: datalayer.SDDLOrigin(origin),
+            docString: docString,
+        })
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+
+    sort.Sort(sddlRevisionsByVersion(revisions))
+    return revisions, nil
+}
+
+// How many times addSDDLVersion tries to claim a version number before
+// giving up.
+const maxSDDLVersionAttempts = 5
+
+// Record a new SDDL version for this device.  Returns false if the version
+// has already been recorded.
+func (device *CassDevice) insertSDDLRevision(version int, t time.Time, origin datalayer.SDDLOrigin, docString string) (bool, error) {
+    return device.conn.session.Query(`
+            INSERT INTO device_sddl_history (device_id, version, time_created, origin, sddl)
+            VALUES (?, ?, ?, ?, ?)
+            IF NOT EXISTS
+    `, device.ID(), version, t, origin, docString).MapScanCAS(map[string]interface{}{})
+}
+
+// Get the newest SDDL version recorded for this device, or 0 if there is
+// none.
+func (device *CassDevice) latestSDDLVersion() (int, error) {
+    var version int
+    err := device.conn.session.Query(`
+            SELECT version
+            FROM device_sddl_history
+            WHERE device_id = ?
+            ORDER BY version DESC
+            LIMIT 1
+    `, device.ID()).Scan(&version)
+    if err == gocql.ErrNotFound {
+        return 0, nil
+    }
+    return version, err
+}
+
+// Record <docString> as this device's next SDDL version.  Version numbers
+// are claimed with a lightweight transaction, so that concurrent changes
+// get different versions instead of overwriting each other.
+func (device *CassDevice) addSDDLVersion(docString string, origin datalayer.SDDLOrigin) error {
+    version := device.sddlVersion + 1
+    for attempt := 1; ; attempt++ {
+        applied, err := device.insertSDDLRevision(version, time.Now().UTC(), origin, docString)
+        if err != nil {
+            return err
+        }
+        if applied {
+            break
+        }
+        if attempt == maxSDDLVersionAttempts {
+            return fmt.Errorf("Could not record SDDL version for device %s", device.ID())
+        }
+        latest, err := device.latestSDDLVersion()
+        if err != nil {
+            return err
+        }
+        version = latest + 1
+    }
+
+    err := device.conn.session.Query(`
+            UPDATE devices
+            SET sddl_version = ?
+            WHERE device_id = ?
+    `, version, device.ID()).Exec()
+    if err != nil {
+        return err
+    }
+    device.sddlVersion = version
+    return nil
+}
+
+func (device *CassDevice) SDDLDocumentAt(t time.Time) (sddl.Document, error) {
+    revisions, err := device.sddlRevisions()
+    if err != nil {
+        return nil, err
+    }
+    if len(revisions) == 0 {
+        return device.SDDLDocument(), nil
+    }
+
+    active := revisions[0]
+    for _, rev := range revisions {
+        if rev.t.After(t) {
+            break
+        }
+        active = rev
+    }
+    return active.Document()
+}
+
+func (device *CassDevice) SDDLHistory() ([]datalayer.SDDLRevision, error) {
+    revisions, err := device.sddlRevisions()
+    if err != nil {
+        return nil, err
+    }
+    out := []datalayer.SDDLRevision{}
+    for _, rev := range revisions {
+        out = append(out, rev)
+    }
+    return out, nil
+}
+
+func (device *CassDevice) SDDLVersion() int {
+    return device.sddlVersion
+}
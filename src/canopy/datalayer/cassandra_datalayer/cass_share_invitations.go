@@ -0,0 +1,194 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "canopy/util/random"
+    "crypto/sha256"
+    "encoding/hex"
+    "github.com/gocql/gocql"
+    "strings"
+    "time"
+)
+
+// Share invitations are stored in the share_invitations table, keyed by the
+// SHA-256 hash of their token so that a copy of the database is not enough
+// to accept them.  Rows expire along with the invitation.
+
+func hashShareToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+func validateShareLevels(access datalayer.AccessLevel, sharing datalayer.ShareLevel) error {
+    if access != datalayer.ReadOnlyAccess && access != datalayer.ReadWriteAccess {
+        return datalayer.NewValidationError("Invalid access level")
+    }
+    if sharing < datalayer.NoSharing || sharing > datalayer.ShareRevokeAllowed {
+        return datalayer.NewValidationError("Invalid sharing level")
+    }
+    return nil
+}
+
+func (device *CassDevice) CreateShareInvitation(inviter datalayer.Account, email string, access datalayer.AccessLevel, sharing datalayer.ShareLevel) (string, error) {
+    err := validateEmail(email)
+    if err != nil {
+        return "", err
+    }
+    err = validateShareLevels(access, sharing)
+    if err != nil {
+        return "", err
+    }
+
+    token, err := random.Base64String(24)
+    if err != nil {
+        return "", err
+    }
+    now := time.Now().UTC()
+    expiry := now.Add(datalayer.ShareInvitationLifetime)
+
+    err = device.conn.session.Query(`
+            INSERT INTO share_invitations (token_hash, device_id, inviter,
+                email, access_level, share_level, time_created, expiry)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+            USING TTL ?
+    `, hashShareToken(token), device.ID(), inviter.Username(), email,
+            int(access), int(sharing), now, expiry,
+            int(datalayer.ShareInvitationLifetime/time.Second)).Exec()
+    if err != nil {
+        canolog.Error("Error creating share invitation for ", device.ID(), ": ", err)
+        return "", err
+    }
+    return token, nil
+}
+
+func (conn *CassConnection) AcceptShareInvitation(token string, account datalayer.Account) (datalayer.Device, datalayer.ShareInvitation, error) {
+    var inv datalayer.ShareInvitation
+    var accessLevel, shareLevel int
+    errInvalid := datalayer.NewValidationError("Invalid or expired share invitation")
+
+    // Checked before the token, so the response doesn't depend on whether
+    // the token is valid.
+    if !account.IsActivated() {
+        return nil, inv, datalayer.NewValidationError(
+                "Account must be activated to accept share invitations")
+    }
+
+    hash := hashShareToken(token)
+    err := conn.session.Query(`
+            SELECT device_id, inviter, email, access_level, share_level,
+                time_created, expiry
+            FROM share_invitations
+            WHERE token_hash = ?
+            LIMIT 1
+    `, hash).Consistency(gocql.One).Scan(
+            &inv.DeviceID,
+            &inv.Inviter,
+            &inv.Email,
+            &accessLevel,
+            &shareLevel,
+            &inv.TimeCreated,
+            &inv.Expiry)
+    if err == gocql.ErrNotFound {
+        canolog.Info("Share invitation not found, for ", account.Username())
+        return nil, inv, errInvalid
+    } else if err != nil {
+        return nil, inv, err
+    }
+    inv.AccessLevel = datalayer.AccessLevel(accessLevel)
+    inv.ShareLevel = datalayer.ShareLevel(shareLevel)
+    if time.Now().After(inv.Expiry) {
+        canolog.Info("Share invitation for ", inv.DeviceID, " expired, for ", account.Username())
+        return nil, inv, errInvalid
+    }
+
+    // The token is only a proof of receipt when it's redeemed by the
+    // account that owns the invited address, and that account has proven
+    // it owns the address.  Use the same error as for an unknown token, so
+    // that guessed tokens can't be confirmed.
+    if !strings.EqualFold(strings.TrimSpace(account.Email()), strings.TrimSpace(inv.Email)) {
+        canolog.Warn("Share invitation for ", inv.DeviceID, " sent to ", inv.Email,
+                " used by ", account.Username())
+        return nil, inv, errInvalid
+    }
+
+    device, err := conn.LookupDevice(inv.DeviceID)
+    if err == gocql.ErrNotFound {
+        return nil, inv, errInvalid
+    } else if err != nil {
+        return nil, inv, err
+    }
+
+    // The inviter may have lost access since sending the invitation, so
+    // check their permissions again and never grant more than they have.
+    inviter, err := conn.LookupAccount(inv.Inviter)
+    if err == gocql.ErrNotFound {
+        return nil, inv, errInvalid
+    } else if err != nil {
+        return nil, inv, err
+    }
+    inviterAccess, inviterSharing, err := device.AccountAccess(inviter)
+    if err != nil {
+        return nil, inv, err
+    }
+    if inviterAccess == datalayer.NoAccess || inviterSharing < datalayer.SharingAllowed {
+        return nil, inv, datalayer.NewValidationError(
+                "Inviter is no longer allowed to share this device")
+    }
+    access := inv.AccessLevel
+    if access > inviterAccess {
+        access = inviterAccess
+    }
+    sharing := inv.ShareLevel
+    if sharing > inviterSharing {
+        sharing = inviterSharing
+    }
+
+    // Accepting an invitation never reduces access the account already has.
+    curAccess, curSharing, err := device.AccountAccess(account)
+    if err != nil {
+        return nil, inv, err
+    }
+    if curAccess > access {
+        access = curAccess
+    }
+    if curSharing > sharing {
+        sharing = curSharing
+    }
+
+    // Consume the invitation with a lightweight transaction so that
+    // concurrent requests can't both accept it.
+    applied, err := conn.session.Query(`
+            DELETE FROM share_invitations
+            WHERE token_hash = ?
+            IF EXISTS
+    `, hash).ScanCAS()
+    if err != nil {
+        return nil, inv, err
+    }
+    if !applied {
+        return nil, inv, errInvalid
+    }
+
+    err = device.SetAccountAccess(account, access, sharing)
+    if err != nil {
+        canolog.Error("Error granting access to ", device.ID(), " for ", account.Username(), ": ", err)
+        return nil, inv, err
+    }
+    return device, inv, nil
+}
@@ -0,0 +1,536 @@
+/*
+ * Copright 2014-2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/canolog"
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "canopy/device_filter"
+    "canopy/sddl"
+    "fmt"
+    "github.com/gocql/gocql"
+    "strings"
+    "time"
+)
+
+// Removing and renaming Cloud Variables.  Both operations rewrite the
+// device's SDDL document and then either purge or migrate the samples stored
+// in the varsample_* tables, along with the bookkeeping in var_buckets and
+// var_lastupdatetime.
+
+type varBucketRow struct {
+    lod lodEnum
+    timeprefix string
+    endTime time.Time
+}
+
+// Get all sample buckets tracked for Cloud Variable <varName>, across all
+// LODs.
+func (device *CassDevice) varBucketRows(varName string) ([]varBucketRow, error) {
+    rows := []varBucketRow{}
+    for lod := LOD_0; lod < LOD_END; lod++ {
+        var timeprefix string
+        var endTime time.Time
+
+        query := device.conn.session.Query(`
+                SELECT timeprefix, endtime
+                FROM var_buckets
+                WHERE device_id = ?
+                    AND var_name = ?
+                    AND lod = ?
+        `, device.ID(), varName, lod).Consistency(gocql.One)
+
+        iter := query.Iter()
+        for iter.Scan(&timeprefix, &endTime) {
+            rows = append(rows, varBucketRow{lod, timeprefix, endTime})
+        }
+        if err := iter.Close(); err != nil {
+            return nil, err
+        }
+    }
+    return rows, nil
+}
+
+// Get the basic (non-struct) Cloud Variables that make up <varDef>.  Struct
+// members are stored individually, so these are what actually have samples.
+func leafVarDefs(varDef sddl.VarDef) []sddl.VarDef {
+    if varDef.Datatype() != sddl.DATATYPE_STRUCT {
+        return []sddl.VarDef{varDef}
+    }
+    leaves := []sddl.VarDef{}
+    members, _ := varDef.StructMembers()
+    for _, member := range members {
+        leaves = append(leaves, leafVarDefs(member)...)
+    }
+    return leaves
+}
+
+// Get the definitions that basic Cloud Variable <leaf> has had in the
+// device's SDDL history, starting with its current one.  Definitions that
+// store samples the same way as an earlier one in the list are left out.
+func (device *CassDevice) historicVarDefs(leaf sddl.VarDef) ([]sddl.VarDef, error) {
+    defs := []sddl.VarDef{leaf}
+    revisions, err := device.sddlRevisions()
+    if err != nil {
+        return nil, err
+    }
+    for _, rev := range revisions {
+        doc, err := rev.Document()
+        if err != nil {
+            canolog.Error("Error parsing SDDL version ", rev.version, ": ", err)
+            continue
+        }
+        revVarDef, err := doc.LookupVarDef(leaf.Fullname())
+        if err != nil || revVarDef.Datatype() == sddl.DATATYPE_STRUCT {
+            continue
+        }
+        known := false
+        for _, def := range defs {
+            if sameSampleEncoding(def, revVarDef) {
+                known = true
+                break
+            }
+        }
+        if !known {
+            defs = append(defs, revVarDef)
+        }
+    }
+    return defs, nil
+}
+
+// Get the varsample_* tables that samples of basic Cloud Variable <leaf>
+// may be stored in.  Older samples stay in the table for the datatype the
+// Cloud Variable had when they were stored.
+func (device *CassDevice) varSampleTables(leaf sddl.VarDef) ([]string, error) {
+    defs, err := device.historicVarDefs(leaf)
+    if err != nil {
+        return nil, err
+    }
+    tables := []string{}
+    for _, def := range defs {
+        tableName, err := varTableNameByDatatype(def.Datatype())
+        if err != nil {
+            return nil, err
+        }
+        known := false
+        for _, t := range tables {
+            if t == tableName {
+                known = true
+                break
+            }
+        }
+        if !known {
+            tables = append(tables, tableName)
+        }
+    }
+    return tables, nil
+}
+
+// Count the stored data for a Cloud Variable, including samples stored
+// under earlier datatypes.
+func (device *CassDevice) varDataReport(varDef sddl.VarDef) (*datalayer.VarDataReport, error) {
+    report := &datalayer.VarDataReport{
+        VarNames: []string{},
+    }
+    for _, leaf := range leafVarDefs(varDef) {
+        report.VarNames = append(report.VarNames, leaf.Fullname())
+
+        tables, err := device.varSampleTables(leaf)
+        if err != nil {
+            return nil, err
+        }
+        rows, err := device.varBucketRows(leaf.Fullname())
+        if err != nil {
+            return nil, err
+        }
+        for _, row := range rows {
+            for _, tableName := range tables {
+                var count int64
+                err = device.conn.session.Query(`
+                        SELECT COUNT(*)
+                        FROM ` + tableName + `
+                        WHERE device_id = ?
+                            AND propname = ?
+                            AND timeprefix = ?
+                `, device.ID(), leaf.Fullname(), row.timeprefix).Consistency(gocql.One).Scan(&count)
+                if err != nil {
+                    return nil, err
+                }
+                report.Samples += int(count)
+            }
+            report.Buckets++
+        }
+    }
+    return report, nil
+}
+
+// Delete all stored data for a Cloud Variable, including samples stored
+// under earlier datatypes, which ClearVarData doesn't know about.
+func (device *CassDevice) purgeVarData(varDef sddl.VarDef) error {
+    for _, leaf := range leafVarDefs(varDef) {
+        tables, err := device.varSampleTables(leaf)
+        if err != nil {
+            return err
+        }
+        rows, err := device.varBucketRows(leaf.Fullname())
+        if err != nil {
+            return err
+        }
+        // The first table is the current one, which ClearVarData purges
+        // along with the bucket bookkeeping.
+        for _, tableName := range tables[1:] {
+            for _, row := range rows {
+                err = device.conn.session.Query(`
+                        DELETE FROM ` + tableName + `
+                        WHERE device_id = ?
+                            AND propname = ?
+                            AND timeprefix = ?
+                `, device.ID(), leaf.Fullname(), row.timeprefix).Consistency(gocql.One).Exec()
+                if err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return device.ClearVarData(varDef)
+}
+
+// Fail unless every stored sample of <varDef> is encoded according to its
+// current definition.  Samples stored under an earlier datatype are decoded
+// using the SDDL history of the Cloud Variable's name, so they can't be
+// migrated to a new name.
+func (device *CassDevice) checkMigratable(varDef sddl.VarDef) error {
+    for _, leaf := range leafVarDefs(varDef) {
+        defs, err := device.historicVarDefs(leaf)
+        if err != nil {
+            return err
+        }
+        if len(defs) > 1 {
+            return datalayer.NewValidationError(fmt.Sprintf(
+                    "Cloud Variable %s has changed datatype, so its data can't be migrated", leaf.Fullname()))
+        }
+    }
+    return nil
+}
+
+// Does a device filter or Cloud Variable name <prop> refer to top-level
+// Cloud Variable <varName> or one of its members?
+func refersToVar(prop, varName string) bool {
+    return prop == varName || strings.HasPrefix(prop, varName + ".")
+}
+
+// Fail if a rule or webhook refers to top-level Cloud Variable <varName> of
+// this device, since it would silently stop matching once the Cloud
+// Variable is removed or renamed.
+func (device *CassDevice) checkVarUnreferenced(varName string) error {
+    rules, err := device.conn.RulesForDevice(device.ID())
+    if err != nil {
+        return err
+    }
+    for _, rule := range rules {
+        filter, err := device_filter.Compile(rule.Condition())
+        if err == nil {
+            for _, prop := range filter.Properties() {
+                if refersToVar(prop, varName) {
+                    return datalayer.NewValidationError(fmt.Sprintf(
+                            "Cloud Variable %s is used by rule %s", varName, rule.ID()))
+                }
+            }
+        }
+    }
+
+    // set_var actions of any rule may target this device, and webhooks
+    // aren't indexed by device, so check those of every account with
+    // access.
+    perms, err := device.Permissions()
+    if err != nil {
+        return err
+    }
+    for _, perm := range perms {
+        accountRules, err := perm.Account.Rules()
+        if err != nil {
+            return err
+        }
+        for _, rule := range accountRules {
+            for _, action := range rule.Actions() {
+                deviceId, _ := action.Params["device_id"].(string)
+                targetVar, _ := action.Params["var"].(string)
+                if action.Type == "set_var" && deviceId == device.ID().String() && refersToVar(targetVar, varName) {
+                    return datalayer.NewValidationError(fmt.Sprintf(
+                            "Cloud Variable %s is set by rule %s", varName, rule.ID()))
+                }
+            }
+        }
+
+        webhooks, err := perm.Account.Webhooks()
+        if err != nil {
+            return err
+        }
+        for _, webhook := range webhooks {
+            if webhook.Filter() == "" || !webhookWatchesDevice(webhook, device.ID()) {
+                continue
+            }
+            filter, err := device_filter.Compile(webhook.Filter())
+            if err != nil {
+                continue
+            }
+            for _, prop := range filter.Properties() {
+                if refersToVar(prop, varName) {
+                    return datalayer.NewValidationError(fmt.Sprintf(
+                            "Cloud Variable %s is used by the filter of webhook %s", varName, webhook.ID()))
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// Does <webhook> receive events from device <deviceId>?
+func webhookWatchesDevice(webhook datalayer.Webhook, deviceId gocql.UUID) bool {
+    if len(webhook.DeviceIDs()) == 0 {
+        return true
+    }
+    for _, id := range webhook.DeviceIDs() {
+        if id == deviceId {
+            return true
+        }
+    }
+    return false
+}
+
+// Copy all stored samples of basic Cloud Variable <varDef> so that they are
+// stored under <newFullname> instead.  The original samples are left in
+// place.
+func (device *CassDevice) copyVarData(varDef sddl.VarDef, newFullname string) error {
+    tableName, err := varTableNameByDatatype(varDef.Datatype())
+    if err != nil {
+        return err
+    }
+    rows, err := device.varBucketRows(varDef.Fullname())
+    if err != nil {
+        return err
+    }
+
+    for _, row := range rows {
+        samples, err := device.fetchAndAppendBucketSamples(varDef,
+                []cloudvar.CloudVarSample{},
+                time.Unix(0, 0),
+                row.endTime,
+                row.timeprefix)
+        if err != nil {
+            return err
+        }
+        for _, sample := range samples {
+            value, err := encodeSampleValue(varDef, sample.Value)
+            if err != nil {
+                return err
+            }
+            err = device.conn.session.Query(`
+                    INSERT INTO ` + tableName + ` 
+                        (device_id, propname, timeprefix, time, value)
+                    VALUES (?, ?, ?, ?, ?)
+            `, device.ID(), newFullname, row.timeprefix, sample.Timestamp, value).Exec()
+            if err != nil {
+                return err
+            }
+        }
+
+        err = device.conn.session.Query(`
+                UPDATE var_buckets
+                SET endtime = ?
+                WHERE device_id = ?
+                    AND var_name = ?
+                    AND lod = ?
+                    AND timeprefix = ?
+        `, row.endTime, device.ID(), newFullname, row.lod, row.timeprefix).Consistency(gocql.One).Exec()
+        if err != nil {
+            return err
+        }
+    }
+
+    lastUpdateTime, err := device.varLastUpdateTime(varDef.Fullname())
+    if err != nil {
+        return err
+    }
+    if !lastUpdateTime.IsZero() {
+        err = device.varSetLastUpdateTime(newFullname, lastUpdateTime)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Lookup a top-level Cloud Variable that may be removed or renamed on this
+// device.  Cloud Variables declared by the device's SDDL class can only be
+// changed by updating the class.
+func (device *CassDevice) lookupChangeableVar(varName string) (sddl.VarDef, error) {
+    if strings.Contains(varName, ".") {
+        return nil, datalayer.NewValidationError("Struct members cannot be removed or renamed individually")
+    }
+    varDef, err := device.LookupVarDef(varName)
+    if err != nil {
+        return nil, err
+    }
+    if device.className != "" {
+        class, err := device.conn.lookupSDDLClass(device.classOwner, device.className)
+        if err != nil {
+            return nil, err
+        }
+        _, err = class.Document().LookupVarDef(varName)
+        if err == nil {
+            return nil, datalayer.NewValidationError(fmt.Sprintf(
+                "Cloud Variable %s is declared by SDDL class %s", varName, device.SDDLClassRef()))
+        }
+    }
+    return varDef, nil
+}
+
+// Copy the device's SDDL document, replacing the declaration of top-level
+// Cloud Variable <varDef> with <newDecl>.  If <newDecl> is "", the Cloud
+// Variable is removed.
+func (device *CassDevice) rewriteVarDecl(varDef sddl.VarDef, newDecl string) (sddl.Document, error) {
+    jsn := map[string]interface{}{}
+    for k, v := range device.doc.Json() {
+        jsn[k] = v
+    }
+    props := jsn[varDef.Declaration()]
+    delete(jsn, varDef.Declaration())
+    if newDecl != "" {
+        jsn[newDecl] = props
+    }
+    return sddl.Sys.ParseDocument(jsn)
+}
+
+func (device *CassDevice) RemoveVar(varName string, dryRun bool) (*datalayer.VarDataReport, error) {
+    varDef, err := device.lookupChangeableVar(varName)
+    if err != nil {
+        return nil, err
+    }
+
+    // Validate the new document before touching any data, so that dry runs
+    // report the same problems as the real thing.
+    newDoc, err := device.rewriteVarDecl(varDef, "")
+    if err != nil {
+        return nil, datalayer.NewValidationError(err.Error())
+    }
+    err = validateDerivedVars(newDoc)
+    if err != nil {
+        return nil, err
+    }
+    err = device.checkVarUnreferenced(varName)
+    if err != nil {
+        return nil, err
+    }
+
+    report, err := device.varDataReport(varDef)
+    if err != nil {
+        return nil, err
+    }
+    if dryRun {
+        return report, nil
+    }
+
+    // Purge data first, so that a failure doesn't leave orphaned samples for
+    // a Cloud Variable that no longer exists.  Retrying after a failure is
+    // safe.
+    err = device.purgeVarData(varDef)
+    if err != nil {
+        canolog.Error("Error purging data for ", varName, ": ", err)
+        return nil, err
+    }
+
+    err = device.SetSDDLDocument(newDoc, datalayer.SDDLOriginUser)
+    if err != nil {
+        return nil, err
+    }
+    return report, nil
+}
+
+func (device *CassDevice) RenameVar(oldName, newName string, migrate, dryRun bool) (*datalayer.VarDataReport, error) {
+    varDef, err := device.lookupChangeableVar(oldName)
+    if err != nil {
+        return nil, err
+    }
+    if newName == oldName {
+        return nil, datalayer.NewValidationError("New name must differ from old name")
+    }
+    err = sddl.CheckVarName(newName)
+    if err != nil {
+        return nil, datalayer.NewValidationError(err.Error())
+    }
+    _, err = device.LookupVarDef(newName)
+    if err == nil {
+        return nil, datalayer.NewValidationError(fmt.Sprintf("Cloud Variable %s already exists", newName))
+    }
+
+    // The name is always the last token of the declaration, ex:
+    //  "optional inbound float32 temperature"
+    decl := varDef.Declaration()
+    newDecl := decl[:strings.LastIndex(decl, " ") + 1] + newName
+    newDoc, err := device.rewriteVarDecl(varDef, newDecl)
+    if err != nil {
+        return nil, datalayer.NewValidationError(err.Error())
+    }
+    err = validateDerivedVars(newDoc)
+    if err != nil {
+        return nil, err
+    }
+    err = device.checkVarUnreferenced(oldName)
+    if err != nil {
+        return nil, err
+    }
+    if migrate {
+        err = device.checkMigratable(varDef)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    report, err := device.varDataReport(varDef)
+    if err != nil {
+        return nil, err
+    }
+    if dryRun {
+        return report, nil
+    }
+
+    // Copying leaves the original samples in place, so if anything fails
+    // before the new document is saved the rename can simply be retried.
+    if migrate {
+        for _, leaf := range leafVarDefs(varDef) {
+            newFullname := newName + strings.TrimPrefix(leaf.Fullname(), oldName)
+            err = device.copyVarData(leaf, newFullname)
+            if err != nil {
+                canolog.Error("Error migrating data for ", leaf.Fullname(), ": ", err)
+                return nil, err
+            }
+        }
+    }
+
+    err = device.SetSDDLDocument(newDoc, datalayer.SDDLOriginUser)
+    if err != nil {
+        return nil, err
+    }
+
+    err = device.purgeVarData(varDef)
+    if err != nil {
+        canolog.Error("Error purging data for ", oldName, ": ", err)
+        return nil, err
+    }
+    return report, nil
+}
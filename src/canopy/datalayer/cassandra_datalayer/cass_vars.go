@@ -19,8 +19,11 @@ import (
     "canopy/canolog"
     "canopy/cloudvar"
     "canopy/sddl"
+    "encoding/json"
     "fmt"
     "github.com/gocql/gocql"
+    "reflect"
+    "sort"
     "time"
 )
 
@@ -106,6 +109,11 @@ import (
 //  LOD_3       15 min
 //  LOD_4       1 hour
 //  LOD_5       12 hour
+//
+// Struct Cloud Variables are not stored directly.  Instead, each basic member
+// is stored separately under its full name (ex: "gps.latitude"), and struct
+// samples are reassembled from their members when read.  Arrays are stored
+// whole, as JSON-encoded text in the varsample_array table.
 
 type lodEnum int
 const (
@@ -413,6 +421,18 @@ func varTableNameByDatatype(datatype sddl.DatatypeEnum) (string, error) {
         return "varsample_double", nil
     case sddl.DATATYPE_DATETIME:
         return "varsample_timestamp", nil
+    case sddl.DATATYPE_ARRAY:
+        return "varsample_array", nil
+    case sddl.DATATYPE_ENUM:
+        return "varsample_int", nil
+    case sddl.DATATYPE_INT64:
+        return "varsample_int64", nil
+    case sddl.DATATYPE_UINT64:
+        return "varsample_int64", nil
+    case sddl.DATATYPE_BYTES:
+        return "varsample_blob", nil
+    case sddl.DATATYPE_STRUCT:
+        return "", fmt.Errorf("DATATYPE_STRUCT members must be stored individually");
     case sddl.DATATYPE_INVALID:
         return "", fmt.Errorf("DATATYPE_INVALID not allowed in varTableNameByDatatype");
     default: 
@@ -444,7 +464,7 @@ func (device *CassDevice) insertOrDiscardSampleLOD(varDef sddl.VarDef,
 
     // insert sample
     bucket := getBucket(t, lod)
-    propname := varDef.Name()
+    propname := varDef.Fullname()
     err = device.conn.session.Query(`
             INSERT INTO ` + tableName + ` 
                 (device_id, propname, timeprefix, time, value)
@@ -510,14 +530,115 @@ func (device *CassDevice)varSetLastUpdateTime(varName string, t time.Time) error
     return nil
 }
 
+// Encode an array value for storage in the varsample_array table.
+func encodeArraySample(varDef sddl.VarDef, value interface{}) (string, error) {
+    v, ok := value.([]cloudvar.CloudVarValue)
+    if !ok {
+        return "", fmt.Errorf("InsertSample expects []CloudVarValue value for %s", varDef.Fullname())
+    }
+    bytes, err := json.Marshal(cloudvar.CloudVarValueToJson(v))
+    if err != nil {
+        return "", err
+    }
+    return string(bytes), nil
+}
+
+// Decode an array value read from the varsample_array table.
+func decodeArraySample(varDef sddl.VarDef, encoded string) (cloudvar.CloudVarValue, error) {
+    var jsn interface{}
+    err := json.Unmarshal([]byte(encoded), &jsn)
+    if err != nil {
+        return nil, err
+    }
+    return cloudvar.JsonToCloudVarValue(varDef, jsn)
+}
+
+// Encode an enum value for storage as its index in the varsample_int table.
+func encodeEnumSample(varDef sddl.VarDef, value interface{}) (int32, error) {
+    v, ok := value.(string)
+    if !ok {
+        return 0, fmt.Errorf("InsertSample expects string value for %s", varDef.Fullname())
+    }
+    idx := sddl.EnumValueIndex(varDef, v)
+    if idx == -1 {
+        return 0, fmt.Errorf("%q is not an allowed value for %s", v, varDef.Fullname())
+    }
+    return int32(idx), nil
+}
+
+// Decode an enum value read from the varsample_int table.
+func decodeEnumSample(varDef sddl.VarDef, idx int32) (cloudvar.CloudVarValue, error) {
+    values, err := varDef.EnumValues()
+    if err != nil {
+        return nil, err
+    }
+    if idx < 0 || int(idx) >= len(values) {
+        return nil, fmt.Errorf("Enum index %d out of range for %s", idx, varDef.Fullname())
+    }
+    return values[idx], nil
+}
+
+// Convert a Cloud Variable value into the form stored in the database.
+// Arrays are JSON-encoded, enums are stored by index and uint64 values are
+// stored as the int64 with the same bits (Cassandra has no unsigned bigint).
+// Other values are stored as-is.
+func encodeSampleValue(varDef sddl.VarDef, value interface{}) (interface{}, error) {
+    switch varDef.Datatype() {
+    case sddl.DATATYPE_ARRAY:
+        return encodeArraySample(varDef, value)
+    case sddl.DATATYPE_ENUM:
+        return encodeEnumSample(varDef, value)
+    case sddl.DATATYPE_UINT64:
+        v, ok := value.(uint64)
+        if !ok {
+            return nil, fmt.Errorf("InsertSample expects uint64 value for %s", varDef.Fullname())
+        }
+        return int64(v), nil
+    }
+    return value, nil
+}
+
+// Insert a struct sample by inserting each of the members that are present.
+func (device *CassDevice) insertStructSample(varDef sddl.VarDef, t time.Time, value interface{}) error {
+    v, ok := value.(map[string]cloudvar.CloudVarValue)
+    if !ok {
+        return fmt.Errorf("InsertSample expects map[string]CloudVarValue value for %s", varDef.Fullname())
+    }
+    members, err := varDef.StructMembers()
+    if err != nil {
+        return err
+    }
+    for _, member := range members {
+        memberValue, ok := v[member.Name()]
+        if !ok {
+            continue
+        }
+        err = device.InsertSample(member, t, memberValue)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
 // Insert a cloud variable data sample.
 func (device *CassDevice) InsertSample(varDef sddl.VarDef, t time.Time, value interface{}) error {
+    var err error
+
+    if varDef.Datatype() == sddl.DATATYPE_STRUCT {
+        return device.insertStructSample(varDef, t, value)
+    }
+    value, err = encodeSampleValue(varDef, value)
+    if err != nil {
+        return err
+    }
+
     // Convert to UTC before inserting
     t = t.UTC()
-    canolog.Info("Inserting sample", varDef.Name(), t)
+    canolog.Info("Inserting sample", varDef.Fullname(), t)
 
     // check last update time
-    lastUpdateTime, err := device.varLastUpdateTime(varDef.Name())
+    lastUpdateTime, err := device.varLastUpdateTime(varDef.Fullname())
     if err != nil {
         canolog.Error("Error inserting sample:", err.Error())
         return err
@@ -530,7 +651,7 @@ func (device *CassDevice) InsertSample(varDef sddl.VarDef, t time.Time, value in
     }
 
     // update last update time
-    err = device.varSetLastUpdateTime(varDef.Name(), t)
+    err = device.varSetLastUpdateTime(varDef.Fullname(), t)
     if err != nil {
         return err
     }
@@ -571,7 +692,7 @@ func (device *CassDevice) fetchAndAppendBucketSamples(varDef sddl.VarDef,
                 AND timeprefix = ?
                 AND time >= ?
                 AND time <= ?
-    `, device.ID(), varDef.Name(), bucketName, startTime, endTime).Consistency(gocql.One)
+    `, device.ID(), varDef.Fullname(), bucketName, startTime, endTime).Consistency(gocql.One)
 
     iter := query.Iter()
 
@@ -622,6 +743,24 @@ func (device *CassDevice) fetchAndAppendBucketSamples(varDef sddl.VarDef,
         for iter.Scan(&timestamp, &value) {
             apendee = append(apendee, cloudvar.CloudVarSample{timestamp, value})
         }
+    case sddl.DATATYPE_INT64:
+        var value int64
+        for iter.Scan(&timestamp, &value) {
+            apendee = append(apendee, cloudvar.CloudVarSample{timestamp, value})
+        }
+    case sddl.DATATYPE_UINT64:
+        var value int64
+        for iter.Scan(&timestamp, &value) {
+            apendee = append(apendee, cloudvar.CloudVarSample{timestamp, uint64(value)})
+        }
+    case sddl.DATATYPE_BYTES:
+        for {
+            var value []byte
+            if !iter.Scan(&timestamp, &value) {
+                break
+            }
+            apendee = append(apendee, cloudvar.CloudVarSample{timestamp, value})
+        }
     case sddl.DATATYPE_FLOAT32:
         var value float32
         for iter.Scan(&timestamp, &value) {
@@ -637,6 +776,26 @@ func (device *CassDevice) fetchAndAppendBucketSamples(varDef sddl.VarDef,
         for iter.Scan(&timestamp, &value) {
             apendee = append(apendee, cloudvar.CloudVarSample{timestamp, value})
         }
+    case sddl.DATATYPE_ARRAY:
+        var encoded string
+        for iter.Scan(&timestamp, &encoded) {
+            value, err := decodeArraySample(varDef, encoded)
+            if err != nil {
+                canolog.Error("Discarding undecodable array sample for ", varDef.Fullname(), err)
+                continue
+            }
+            apendee = append(apendee, cloudvar.CloudVarSample{timestamp, value})
+        }
+    case sddl.DATATYPE_ENUM:
+        var idx int32
+        for iter.Scan(&timestamp, &idx) {
+            value, err := decodeEnumSample(varDef, idx)
+            if err != nil {
+                canolog.Error("Discarding undecodable enum sample for ", varDef.Fullname(), err)
+                continue
+            }
+            apendee = append(apendee, cloudvar.CloudVarSample{timestamp, value})
+        }
     case sddl.DATATYPE_INVALID:
         return []cloudvar.CloudVarSample{}, fmt.Errorf("Cannot get property values for DATATYPE_INVALID");
     default:
@@ -712,6 +871,57 @@ func cloudVarLODDuration(tier storageTierEnum, lod lodEnum) time.Duration {
     }[LODTier{lod, tier}]
 }
 
+// Fetch historic time series data for a struct cloud variable by fetching the
+// data for each member and merging samples that share a timestamp.
+func (device *CassDevice) historicStructData(
+    varDef sddl.VarDef, 
+    curTime,
+    startTime, 
+    endTime time.Time) ([]cloudvar.CloudVarSample, error) {
+
+    members, err := varDef.StructMembers()
+    if err != nil {
+        return []cloudvar.CloudVarSample{}, err
+    }
+
+    merged := map[int64]*cloudvar.CloudVarSample{}
+    for _, member := range members {
+        memberSamples, err := device.HistoricData(member, curTime, startTime, endTime)
+        if err != nil {
+            return []cloudvar.CloudVarSample{}, err
+        }
+        for _, memberSample := range memberSamples {
+            key := memberSample.Timestamp.UnixNano()
+            sample, ok := merged[key]
+            if !ok {
+                sample = &cloudvar.CloudVarSample{
+                    memberSample.Timestamp,
+                    map[string]cloudvar.CloudVarValue{},
+                }
+                merged[key] = sample
+            }
+            sample.Value.(map[string]cloudvar.CloudVarValue)[member.Name()] = memberSample.Value
+        }
+    }
+
+    keys := []int64{}
+    for key := range merged {
+        keys = append(keys, key)
+    }
+    sort.Sort(int64Slice(keys))
+
+    samples := []cloudvar.CloudVarSample{}
+    for _, key := range keys {
+        samples = append(samples, *merged[key])
+    }
+    return samples, nil
+}
+
+type int64Slice []int64
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 // Fetch historic time series data for a cloud variable. The resolution is
 // automatically selected.
 func (device *CassDevice) HistoricData(
@@ -720,7 +930,11 @@ func (device *CassDevice) HistoricData(
     startTime, 
     endTime time.Time) ([]cloudvar.CloudVarSample, error) {
 
-    canolog.Info("Fetching historic data for", varDef.Name(), startTime, endTime)
+    if varDef.Datatype() == sddl.DATATYPE_STRUCT {
+        return device.historicStructData(varDef, curTime, startTime, endTime)
+    }
+
+    canolog.Info("Fetching historic data for", varDef.Fullname(), startTime, endTime)
 
     // Figure out which resolution to use.
     // Pick the highest resolution that covers the entire requested period.
@@ -739,7 +953,111 @@ func (device *CassDevice) HistoricData(
     canolog.Info("Using LOD", lod)
 
     // Fetch the data from that LOD
-    return device.historicDataLOD(varDef, startTime, endTime, lod)
+    return device.historicDataLODVersioned(varDef, startTime, endTime, lod)
+}
+
+// Returns true if samples for <varDef0> and <varDef1> are stored and decoded
+// identically.
+func sameSampleEncoding(varDef0, varDef1 sddl.VarDef) bool {
+    if varDef0.Datatype() != varDef1.Datatype() {
+        return false
+    }
+    if varDef0.Datatype() == sddl.DATATYPE_ARRAY {
+        elem0, _ := varDef0.ArrayElement()
+        elem1, _ := varDef1.ArrayElement()
+        size0, _ := varDef0.ArraySize()
+        size1, _ := varDef1.ArraySize()
+        if elem0.Datatype() != elem1.Datatype() || size0 != size1 {
+            return false
+        }
+        return sameSampleEncoding(elem0, elem1)
+    }
+    if varDef0.Datatype() == sddl.DATATYPE_ENUM {
+        // Enums are stored by index, so the allowed values must match.
+        values0, _ := varDef0.EnumValues()
+        values1, _ := varDef1.EnumValues()
+        return reflect.DeepEqual(values0, values1)
+    }
+    return true
+}
+
+// Fetch the historic timeseries data for a particular LOD, decoding each
+// sample using the SDDL version that was active when it was stored.  If the
+// Cloud Variable's datatype changed during the requested period, older
+// samples are read from the table corresponding to the older datatype.
+func (device *CassDevice) historicDataLODVersioned(
+    varDef sddl.VarDef, 
+    start, 
+    end time.Time,
+    lod lodEnum) ([]cloudvar.CloudVarSample, error) {
+
+    revisions, err := device.sddlRevisions()
+    if err != nil {
+        canolog.Error("Error reading SDDL history, using current SDDL: ", err)
+        return device.historicDataLOD(varDef, start, end, lod)
+    }
+    if len(revisions) < 2 {
+        return device.historicDataLOD(varDef, start, end, lod)
+    }
+
+    // Split the requested period into segments, each decoded with a
+    // particular Cloud Variable definition.
+    type segment struct {
+        varDef sddl.VarDef
+        start time.Time
+        end time.Time
+    }
+    segments := []segment{}
+    for i, rev := range revisions {
+        // The oldest version also covers samples stored before history was
+        // recorded.  The 15.05.08 migration records each device's document
+        // from before the upgrade as version 1 for this reason.
+        segStart := start
+        if i > 0 && rev.t.After(start) {
+            segStart = rev.t
+        }
+        segEnd := end
+        if i + 1 < len(revisions) && revisions[i+1].t.Before(end) {
+            segEnd = revisions[i+1].t.Add(-time.Millisecond)
+        }
+        if segEnd.Before(segStart) {
+            continue
+        }
+
+        doc, err := rev.Document()
+        if err != nil {
+            canolog.Error("Error parsing SDDL version ", rev.version, ": ", err)
+            continue
+        }
+        revVarDef, err := doc.LookupVarDef(varDef.Fullname())
+        if err != nil {
+            // Either the Cloud Variable did not exist in this version (so
+            // there are no samples to decode), or it has since been renamed
+            // (and its samples were migrated to the current definition).
+            revVarDef = varDef
+        }
+
+        last := len(segments) - 1
+        if last >= 0 && sameSampleEncoding(segments[last].varDef, revVarDef) {
+            segments[last].end = segEnd
+        } else {
+            segments = append(segments, segment{revVarDef, segStart, segEnd})
+        }
+    }
+
+    if len(segments) == 0 || (len(segments) == 1 && sameSampleEncoding(segments[0].varDef, varDef)) {
+        return device.historicDataLOD(varDef, start, end, lod)
+    }
+
+    samples := []cloudvar.CloudVarSample{}
+    for _, seg := range segments {
+        segSamples, err := device.historicDataLOD(seg.varDef, seg.start, seg.end, lod)
+        if err != nil {
+            return samples, err
+        }
+        samples = append(samples, segSamples...)
+    }
+    return samples, nil
 }
 
 // Determine if bucket has expired (and should be garbage collected).
@@ -762,7 +1080,7 @@ func (device *CassDevice)garbageCollectLOD(curTime time.Time,
         lod lodEnum,
         deleteAll bool) error {
 
-    canolog.Info("Running garbage collection for ", varDef.Name(), "LOD", lod)
+    canolog.Info("Running garbage collection for ", varDef.Fullname(), "LOD", lod)
 
     // Get list of expired buckets for that LOD
     var bucketName string
@@ -775,14 +1093,14 @@ func (device *CassDevice)garbageCollectLOD(curTime time.Time,
                 AND var_name = ?
                 AND lod = ?
             ORDER BY timeprefix DESC
-    `, device.ID(), varDef.Name(), lod).Consistency(gocql.One)
+    `, device.ID(), varDef.Fullname(), lod).Consistency(gocql.One)
 
     iter := query.Iter()
 
     var endTime time.Time
     // NOTE: As a special case, we never delete the most recent LOD0 bucket,
     // even if it has expired, because we need it for LastUpdateTime.
-    skipFirst := (lod == LOD_0)
+    skipFirst := (lod == LOD_0) && !deleteAll
     for iter.Scan(&bucketName, &endTime) {
         // determine expiration time
         // TODO: Handle tiers
@@ -809,15 +1127,15 @@ func (device *CassDevice)garbageCollectLOD(curTime time.Time,
         }
 
         // Remove expired bucket
-        canolog.Info("Removing expired bucket", varDef.Name(), bucketName)
+        canolog.Info("Removing expired bucket", varDef.Fullname(), bucketName)
         err = device.conn.session.Query(`
                 DELETE FROM ` + tableName + `
                 WHERE device_id = ?
                     AND propname = ?
                     AND timeprefix = ?
-        `, device.ID(), varDef.Name(), bucketName).Consistency(gocql.One).Exec()
+        `, device.ID(), varDef.Fullname(), bucketName).Consistency(gocql.One).Exec()
         if err != nil {
-            canolog.Error("Problem deleting bucket ", device.ID(), varDef.Name(), bucketName)
+            canolog.Error("Problem deleting bucket ", device.ID(), varDef.Fullname(), bucketName)
         } else {
             // Cleanup var_buckets table, but only if we actually deleted the
             // bucket in the previous step
@@ -827,25 +1145,48 @@ func (device *CassDevice)garbageCollectLOD(curTime time.Time,
                     AND var_name = ?
                     AND lod = ?
                     AND timeprefix = ?
-            `, device.ID(), varDef.Name(), lod, bucketName).Consistency(gocql.One).Exec()
+            `, device.ID(), varDef.Fullname(), lod, bucketName).Consistency(gocql.One).Exec()
             if err != nil {
-                canolog.Error("Problem cleaning var_buckets ", device.ID(), varDef.Name(), bucketName, ":", err)
+                canolog.Error("Problem cleaning var_buckets ", device.ID(), varDef.Fullname(), bucketName, ":", err)
             }
         }
     }
     return nil
 }
 
-func (device *CassDevice)ClearVarData(varDef sddl.VarDef) {
+// Delete all stored data for a Cloud Variable.
+func (device *CassDevice)ClearVarData(varDef sddl.VarDef) error {
+    if varDef.Datatype() == sddl.DATATYPE_STRUCT {
+        members, _ := varDef.StructMembers()
+        for _, member := range members {
+            err := device.ClearVarData(member)
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    }
+
     // Delete all buckets
     for lod := LOD_0; lod < LOD_END; lod++ {
-        device.garbageCollectLOD(time.Now(), varDef, lod, true)
+        err := device.garbageCollectLOD(time.Now(), varDef, lod, true)
+        if err != nil {
+            return err
+        }
     }
+
+    return device.conn.session.Query(`
+            DELETE FROM var_lastupdatetime
+            WHERE device_id = ?
+                AND var_name = ?
+    `, device.ID(), varDef.Fullname()).Consistency(gocql.One).Exec()
 }
 
-func (device *CassDevice) getLatestData_generic(varname string, datatype sddl.DatatypeEnum) (*cloudvar.CloudVarSample, error) {
+func (device *CassDevice) getLatestData_generic(varDef sddl.VarDef) (*cloudvar.CloudVarSample, error) {
     var timestamp time.Time
     var sample *cloudvar.CloudVarSample
+    varname := varDef.Fullname()
+    datatype := varDef.Datatype()
 
     // Get table name
     tableName, err := varTableNameByDatatype(datatype)
@@ -918,6 +1259,18 @@ func (device *CassDevice) getLatestData_generic(varname string, datatype sddl.Da
         var value uint32
         err = query.Scan(&timestamp, &value)
         sample = &cloudvar.CloudVarSample{timestamp, value}
+    case sddl.DATATYPE_INT64:
+        var value int64
+        err = query.Scan(&timestamp, &value)
+        sample = &cloudvar.CloudVarSample{timestamp, value}
+    case sddl.DATATYPE_UINT64:
+        var value int64
+        err = query.Scan(&timestamp, &value)
+        sample = &cloudvar.CloudVarSample{timestamp, uint64(value)}
+    case sddl.DATATYPE_BYTES:
+        var value []byte
+        err = query.Scan(&timestamp, &value)
+        sample = &cloudvar.CloudVarSample{timestamp, value}
     case sddl.DATATYPE_FLOAT32:
         var value float32
         err = query.Scan(&timestamp, &value)
@@ -930,6 +1283,22 @@ func (device *CassDevice) getLatestData_generic(varname string, datatype sddl.Da
         var value time.Time
         err = query.Scan(&timestamp, &value)
         sample = &cloudvar.CloudVarSample{timestamp, value}
+    case sddl.DATATYPE_ARRAY:
+        var encoded string
+        err = query.Scan(&timestamp, &encoded)
+        if err == nil {
+            var value cloudvar.CloudVarValue
+            value, err = decodeArraySample(varDef, encoded)
+            sample = &cloudvar.CloudVarSample{timestamp, value}
+        }
+    case sddl.DATATYPE_ENUM:
+        var idx int32
+        err = query.Scan(&timestamp, &idx)
+        if err == nil {
+            var value cloudvar.CloudVarValue
+            value, err = decodeEnumSample(varDef, idx)
+            sample = &cloudvar.CloudVarSample{timestamp, value}
+        }
     case sddl.DATATYPE_INVALID:
         return nil, fmt.Errorf("Cannot get property values for DATATYPE_INVALID");
     default:
@@ -937,12 +1306,44 @@ func (device *CassDevice) getLatestData_generic(varname string, datatype sddl.Da
     }
 
     if err != nil {
-        return nil, fmt.Errorf("Error reading latest property value: ", err)
+        return nil, fmt.Errorf("Error reading latest property value: %s", err)
     }
 
     return sample, nil
 }
 
+// Get the latest value of a struct cloud variable, assembled from the latest
+// value of each of its members.  The sample's timestamp is the most recent
+// member timestamp.
+func (device *CassDevice) getLatestStructData(varDef sddl.VarDef) (*cloudvar.CloudVarSample, error) {
+    members, err := varDef.StructMembers()
+    if err != nil {
+        return nil, err
+    }
+
+    var timestamp time.Time
+    value := map[string]cloudvar.CloudVarValue{}
+    for _, member := range members {
+        memberSample, err := device.LatestData(member)
+        if err != nil {
+            // Member has never been reported
+            continue
+        }
+        value[member.Name()] = memberSample.Value
+        if memberSample.Timestamp.After(timestamp) {
+            timestamp = memberSample.Timestamp
+        }
+    }
+
+    if len(value) == 0 {
+        return nil, fmt.Errorf("No data for %s", varDef.Fullname())
+    }
+    return &cloudvar.CloudVarSample{timestamp, value}, nil
+}
+
 func (device *CassDevice) LatestData(varDef sddl.VarDef) (*cloudvar.CloudVarSample, error) {
-    return device.getLatestData_generic(varDef.Name(), varDef.Datatype())
+    if varDef.Datatype() == sddl.DATATYPE_STRUCT {
+        return device.getLatestStructData(varDef)
+    }
+    return device.getLatestData_generic(varDef)
 }
@@ -0,0 +1,133 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/datalayer"
+    "github.com/gocql/gocql"
+    "sort"
+    "time"
+)
+
+// Webhook deliveries waiting to be attempted are stored in the
+// webhook_queue table, keyed by delivery ID, so that retries survive a
+// server restart.  Rows expire webhookQueueTTL after the delivery is queued.
+// Like the mail queue, updates use the remaining TTL.
+
+const webhookQueueTTL = 24*time.Hour
+
+// Columns selected by LookupQueuedWebhookDelivery and
+// QueuedWebhookDeliveries, in the order expected by scanQueuedWebhookDelivery.
+const queuedWebhookDeliveryColumns = `id, owner, webhook_id, device_id, event,
+        body, attempt, time_queued, next_attempt`
+
+func scanQueuedWebhookDelivery(iter *gocql.Iter) (datalayer.QueuedWebhookDelivery, bool) {
+    var delivery datalayer.QueuedWebhookDelivery
+    ok := iter.Scan(
+            &delivery.ID,
+            &delivery.Owner,
+            &delivery.WebhookID,
+            &delivery.DeviceID,
+            &delivery.Event,
+            &delivery.Body,
+            &delivery.Attempt,
+            &delivery.TimeQueued,
+            &delivery.NextAttempt)
+    return delivery, ok
+}
+
+func (conn *CassConnection) EnqueueWebhookDelivery(delivery *datalayer.QueuedWebhookDelivery) error {
+    now := time.Now().UTC()
+    err := conn.session.Query(`
+            INSERT INTO webhook_queue (id, owner, webhook_id, device_id, event,
+                body, attempt, time_queued, next_attempt)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+            USING TTL ?
+    `, delivery.ID, delivery.Owner, delivery.WebhookID, delivery.DeviceID,
+            delivery.Event, delivery.Body, delivery.Attempt, now,
+            delivery.NextAttempt, int(webhookQueueTTL/time.Second)).Exec()
+    if err != nil {
+        return err
+    }
+    delivery.TimeQueued = now
+    return nil
+}
+
+func (conn *CassConnection) LookupQueuedWebhookDelivery(id gocql.UUID) (datalayer.QueuedWebhookDelivery, error) {
+    iter := conn.session.Query(`
+            SELECT ` + queuedWebhookDeliveryColumns + `
+            FROM webhook_queue
+            WHERE id = ?
+            LIMIT 1
+    `, id).Consistency(gocql.One).Iter()
+    delivery, ok := scanQueuedWebhookDelivery(iter)
+    if err := iter.Close(); err != nil {
+        return datalayer.QueuedWebhookDelivery{}, err
+    }
+    if !ok {
+        return datalayer.QueuedWebhookDelivery{}, gocql.ErrNotFound
+    }
+    return delivery, nil
+}
+
+func (conn *CassConnection) QueuedWebhookDeliveries() ([]datalayer.QueuedWebhookDelivery, error) {
+    iter := conn.session.Query(`
+            SELECT ` + queuedWebhookDeliveryColumns + `
+            FROM webhook_queue
+    `).Consistency(gocql.One).Iter()
+    deliveries := []datalayer.QueuedWebhookDelivery{}
+    for {
+        delivery, ok := scanQueuedWebhookDelivery(iter)
+        if !ok {
+            break
+        }
+        deliveries = append(deliveries, delivery)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    sort.Sort(queuedWebhookDeliveriesByTime(deliveries))
+    return deliveries, nil
+}
+
+type queuedWebhookDeliveriesByTime []datalayer.QueuedWebhookDelivery
+
+func (p queuedWebhookDeliveriesByTime) Len() int           { return len(p) }
+func (p queuedWebhookDeliveriesByTime) Less(i, j int) bool { return p[i].TimeQueued.Before(p[j].TimeQueued) }
+func (p queuedWebhookDeliveriesByTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (conn *CassConnection) RemoveQueuedWebhookDelivery(id gocql.UUID) error {
+    return conn.session.Query(`
+            DELETE FROM webhook_queue
+            WHERE id = ?
+    `, id).Exec()
+}
+
+func (conn *CassConnection) UpdateQueuedWebhookDelivery(delivery datalayer.QueuedWebhookDelivery) error {
+    ttl := delivery.TimeQueued.Add(webhookQueueTTL).Sub(time.Now())
+    if ttl < time.Second {
+        // About to expire anyway.
+        return nil
+    }
+    return conn.session.Query(`
+            UPDATE webhook_queue
+            USING TTL ?
+            SET attempt = ?,
+                next_attempt = ?
+            WHERE id = ?
+    `, int(ttl/time.Second), delivery.Attempt, delivery.NextAttempt,
+            delivery.ID).Exec()
+}
@@ -0,0 +1,239 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package cassandra_datalayer
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "canopy/util/random"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Webhooks are stored in the webhooks table, keyed by owner.  Delivery
+// attempts are logged in the webhook_deliveries table, newest first.
+
+type CassWebhook struct {
+    conn *CassConnection
+    owner string
+    id gocql.UUID
+    params datalayer.WebhookParams
+    secret string
+    timeCreated time.Time
+}
+
+// Columns selected by lookupWebhook and Webhooks, in the order expected by
+// scanWebhook.
+const webhookColumns = `id, url, device_ids, filter, events, enabled, secret,
+        time_created`
+
+func (conn *CassConnection) scanWebhook(owner string, iter *gocql.Iter) (*CassWebhook, bool) {
+    webhook := CassWebhook{
+        conn: conn,
+        owner: owner,
+    }
+    ok := iter.Scan(
+            &webhook.id,
+            &webhook.params.URL,
+            &webhook.params.DeviceIDs,
+            &webhook.params.Filter,
+            &webhook.params.Events,
+            &webhook.params.Enabled,
+            &webhook.secret,
+            &webhook.timeCreated)
+    if !ok {
+        return nil, false
+    }
+    return &webhook, true
+}
+
+func (conn *CassConnection) lookupWebhook(owner string, id gocql.UUID) (*CassWebhook, error) {
+    iter := conn.session.Query(`
+            SELECT ` + webhookColumns + `
+            FROM webhooks
+            WHERE owner = ? AND id = ?
+            LIMIT 1
+    `, owner, id).Consistency(gocql.One).Iter()
+    webhook, ok := conn.scanWebhook(owner, iter)
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    if !ok {
+        return nil, gocql.ErrNotFound
+    }
+    return webhook, nil
+}
+
+func (account *CassAccount) CreateWebhook(params datalayer.WebhookParams) (datalayer.Webhook, error) {
+    id, err := gocql.RandomUUID()
+    if err != nil {
+        return nil, err
+    }
+    secret, err := random.Base64String(24)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now().UTC()
+
+    err = account.conn.session.Query(`
+            INSERT INTO webhooks (owner, id, url, device_ids, filter, events,
+                    enabled, secret, time_created)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, account.Username(), id, params.URL, params.DeviceIDs, params.Filter,
+            params.Events, params.Enabled, secret, now).Exec()
+    if err != nil {
+        canolog.Error("Error creating webhook: ", err)
+        return nil, err
+    }
+
+    return &CassWebhook{
+        conn: account.conn,
+        owner: account.Username(),
+        id: id,
+        params: params,
+        secret: secret,
+        timeCreated: now,
+    }, nil
+}
+
+func (account *CassAccount) DeleteWebhook(id gocql.UUID) error {
+    err := account.conn.session.Query(`
+            DELETE FROM webhook_deliveries
+            WHERE owner = ? AND webhook_id = ?
+    `, account.Username(), id).Exec()
+    if err != nil {
+        return err
+    }
+
+    return account.conn.session.Query(`
+            DELETE FROM webhooks
+            WHERE owner = ? AND id = ?
+    `, account.Username(), id).Exec()
+}
+
+func (account *CassAccount) Webhook(id gocql.UUID) (datalayer.Webhook, error) {
+    webhook, err := account.conn.lookupWebhook(account.Username(), id)
+    if err != nil {
+        return nil, err
+    }
+    return webhook, nil
+}
+
+func (account *CassAccount) Webhooks() ([]datalayer.Webhook, error) {
+    query := account.conn.session.Query(`
+            SELECT ` + webhookColumns + `
+            FROM webhooks
+            WHERE owner = ?
+    `, account.Username()).Consistency(gocql.One)
+
+    iter := query.Iter()
+    webhooks := []datalayer.Webhook{}
+    for {
+        webhook, ok := account.conn.scanWebhook(account.Username(), iter)
+        if !ok {
+            break
+        }
+        webhooks = append(webhooks, webhook)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return webhooks, nil
+}
+
+func (webhook *CassWebhook) Deliveries(limit int) ([]datalayer.WebhookDelivery, error) {
+    var delivery datalayer.WebhookDelivery
+
+    query := webhook.conn.session.Query(`
+            SELECT time, delivery_id, attempt, event, device_id, status_code,
+                    error
+            FROM webhook_deliveries
+            WHERE owner = ? AND webhook_id = ?
+            LIMIT ?
+    `, webhook.owner, webhook.id, limit).Consistency(gocql.One)
+
+    iter := query.Iter()
+    deliveries := []datalayer.WebhookDelivery{}
+    for iter.Scan(&delivery.Time, &delivery.ID, &delivery.Attempt,
+            &delivery.Event, &delivery.DeviceID, &delivery.StatusCode,
+            &delivery.Error) {
+        deliveries = append(deliveries, delivery)
+    }
+    if err := iter.Close(); err != nil {
+        return nil, err
+    }
+    return deliveries, nil
+}
+
+func (webhook *CassWebhook) DeviceIDs() []gocql.UUID {
+    return webhook.params.DeviceIDs
+}
+
+func (webhook *CassWebhook) Enabled() bool {
+    return webhook.params.Enabled
+}
+
+func (webhook *CassWebhook) Events() []string {
+    return webhook.params.Events
+}
+
+func (webhook *CassWebhook) Filter() string {
+    return webhook.params.Filter
+}
+
+func (webhook *CassWebhook) ID() gocql.UUID {
+    return webhook.id
+}
+
+func (webhook *CassWebhook) Owner() string {
+    return webhook.owner
+}
+
+func (webhook *CassWebhook) RecordDelivery(delivery datalayer.WebhookDelivery) error {
+    return webhook.conn.session.Query(`
+            INSERT INTO webhook_deliveries (owner, webhook_id, time,
+                    delivery_id, attempt, event, device_id, status_code, error)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, webhook.owner, webhook.id, delivery.Time, delivery.ID,
+            delivery.Attempt, delivery.Event, delivery.DeviceID,
+            delivery.StatusCode, delivery.Error).Exec()
+}
+
+func (webhook *CassWebhook) Secret() string {
+    return webhook.secret
+}
+
+func (webhook *CassWebhook) TimeCreated() time.Time {
+    return webhook.timeCreated
+}
+
+func (webhook *CassWebhook) Update(params datalayer.WebhookParams) error {
+    err := webhook.conn.session.Query(`
+            UPDATE webhooks
+            SET url = ?, device_ids = ?, filter = ?, events = ?, enabled = ?
+            WHERE owner = ? AND id = ?
+    `, params.URL, params.DeviceIDs, params.Filter, params.Events,
+            params.Enabled, webhook.owner, webhook.id).Exec()
+    if err != nil {
+        return err
+    }
+    webhook.params = params
+    return nil
+}
+
+func (webhook *CassWebhook) URL() string {
+    return webhook.params.URL
+}
@@ -21,6 +21,9 @@ import (
     "github.com/gocql/gocql"
     "time"
     "errors"
+    "fmt"
+    "strconv"
+    "strings"
 )
 
 var InvalidPasswordError = errors.New("Incorrect password")
@@ -41,6 +44,329 @@ const (
     ShareRevokeAllowed
 )
 
+func AccessLevelToString(access AccessLevel) string {
+    switch access {
+    case NoAccess:
+        return "none"
+    case ReadOnlyAccess:
+        return "read-only"
+    case ReadWriteAccess:
+        return "read-write"
+    }
+    return ""
+}
+
+func AccessLevelFromString(access string) (AccessLevel, error) {
+    switch access {
+    case "none":
+        return NoAccess, nil
+    case "read-only":
+        return ReadOnlyAccess, nil
+    case "read-write":
+        return ReadWriteAccess, nil
+    }
+    return NoAccess, fmt.Errorf("Invalid access_level: %s", access)
+}
+
+func ShareLevelToString(sharing ShareLevel) string {
+    switch sharing {
+    case NoSharing:
+        return "none"
+    case SharingAllowed:
+        return "share"
+    case ShareRevokeAllowed:
+        return "share-revoke"
+    }
+    return ""
+}
+
+func ShareLevelFromString(sharing string) (ShareLevel, error) {
+    switch sharing {
+    case "none":
+        return NoSharing, nil
+    case "share":
+        return SharingAllowed, nil
+    case "share-revoke":
+        return ShareRevokeAllowed, nil
+    }
+    return NoSharing, fmt.Errorf("Invalid sharing_level: %s", sharing)
+}
+
+// DeviceOp is an operation that an account may perform on a device.  Each
+// requires a minimum AccessLevel or ShareLevel:
+//
+//  DeviceOpRead    ReadOnlyAccess
+//  DeviceOpWrite   ReadWriteAccess
+//  DeviceOpShare   SharingAllowed
+//  DeviceOpRevoke  ShareRevokeAllowed
+//  DeviceOpDelete  Owner (ReadWriteAccess and ShareRevokeAllowed)
+type DeviceOp int
+const (
+    DeviceOpRead DeviceOp = iota
+    DeviceOpWrite
+    DeviceOpShare
+    DeviceOpRevoke
+    DeviceOpDelete
+)
+
+// Owners have full control of a device.  Accounts that create devices
+// become their owners.
+func IsDeviceOwner(access AccessLevel, sharing ShareLevel) bool {
+    return access >= ReadWriteAccess && sharing >= ShareRevokeAllowed
+}
+
+// Do <access> and <sharing> permit <op>?
+func DeviceOpAllowed(op DeviceOp, access AccessLevel, sharing ShareLevel) bool {
+    if access == NoAccess {
+        return false
+    }
+    switch op {
+    case DeviceOpRead:
+        return true
+    case DeviceOpWrite:
+        return access >= ReadWriteAccess
+    case DeviceOpShare:
+        return sharing >= SharingAllowed
+    case DeviceOpRevoke:
+        return sharing >= ShareRevokeAllowed
+    case DeviceOpDelete:
+        return IsDeviceOwner(access, sharing)
+    }
+    return false
+}
+
+// VarDeclPolicy determines what happens when a device reports a value for a
+// Cloud Variable that is not declared in its SDDL document.
+type VarDeclPolicy int
+const (
+    VarDeclPolicyUnset = iota // Use the default policy (VarDeclLegacy)
+    VarDeclStrict             // Reject undeclared Cloud Variables
+    VarDeclInfer              // Declare with datatype inferred from the value
+    VarDeclLegacy             // Declare as float32
+)
+
+func VarDeclPolicyToString(policy VarDeclPolicy) string {
+    switch policy {
+    case VarDeclStrict:
+        return "strict"
+    case VarDeclInfer:
+        return "infer"
+    case VarDeclLegacy:
+        return "legacy"
+    }
+    return ""
+}
+
+func VarDeclPolicyFromString(policy string) (VarDeclPolicy, error) {
+    switch policy {
+    case "":
+        return VarDeclPolicyUnset, nil
+    case "strict":
+        return VarDeclStrict, nil
+    case "infer":
+        return VarDeclInfer, nil
+    case "legacy":
+        return VarDeclLegacy, nil
+    }
+    return VarDeclPolicyUnset, fmt.Errorf("Invalid var_decl_policy: %s", policy)
+}
+
+// SDDLOrigin records what caused a change to a device's SDDL document.
+type SDDLOrigin int
+const (
+    SDDLOriginUnknown = iota
+    SDDLOriginDevice    // Reported by the device itself
+    SDDLOriginUser      // Changed by a user through the REST API
+    SDDLOriginClass     // Propagated from the device's SDDL class
+)
+
+func SDDLOriginToString(origin SDDLOrigin) string {
+    switch origin {
+    case SDDLOriginDevice:
+        return "device"
+    case SDDLOriginUser:
+        return "user"
+    case SDDLOriginClass:
+        return "class"
+    }
+    return "unknown"
+}
+
+// VarDataReport describes the stored data affected by removing or renaming a
+// Cloud Variable.
+type VarDataReport struct {
+    // Full names of the affected Cloud Variables.  Struct members are listed
+    // individually.
+    VarNames []string
+
+    // Number of sample buckets affected, across all LODs.
+    Buckets int
+
+    // Number of samples affected, across all LODs.
+    Samples int
+}
+
+// RuleMatch determines how a rule's condition is combined across the rule's
+// devices.
+type RuleMatch int
+const (
+    RuleMatchAny = iota // Condition is satisfied by at least one device
+    RuleMatchAll        // Condition is satisfied by every device
+)
+
+func RuleMatchToString(match RuleMatch) string {
+    switch match {
+    case RuleMatchAny:
+        return "any"
+    case RuleMatchAll:
+        return "all"
+    }
+    return ""
+}
+
+func RuleMatchFromString(match string) (RuleMatch, error) {
+    switch match {
+    case "", "any":
+        return RuleMatchAny, nil
+    case "all":
+        return RuleMatchAll, nil
+    }
+    return RuleMatchAny, fmt.Errorf("Invalid match: %s", match)
+}
+
+// RuleAction is something a rule does when it fires.
+type RuleAction struct {
+    // Kind of action, ex: "notify", "set_var" or "webhook".
+    Type string
+
+    // Action-specific parameters, ex: {"msg" : "Too hot!"}.
+    Params map[string]interface{}
+}
+
+// RuleParams are the user-configurable settings of a rule.
+type RuleParams struct {
+    Name string
+
+    // Condition in device filter syntax, ex: "temperature > 80".
+    Condition string
+
+    // Devices the condition is evaluated against.
+    DeviceIDs []gocql.UUID
+
+    Match RuleMatch
+
+    Actions []RuleAction
+
+    // Minimum time between firings.
+    Cooldown time.Duration
+
+    Enabled bool
+}
+
+// WebhookParams are the user-provided settings of a webhook subscription.
+type WebhookParams struct {
+    // Endpoint that events are POSTed to.
+    URL string
+
+    // Devices whose events are delivered.  If empty, events from every
+    // device the owner has access to are delivered.
+    DeviceIDs []gocql.UUID
+
+    // Device filter expression, ex: "temperature > 80".  If not empty, only
+    // events from devices that satisfy it are delivered.
+    Filter string
+
+    // Event types delivered, ex: "sample".  See package webhooks.
+    Events []string
+
+    Enabled bool
+}
+
+// WebhookDelivery records one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+    // Identifies the event.  Retries of the same event share an ID.
+    ID gocql.UUID
+
+    Event string
+    DeviceID gocql.UUID
+
+    // Attempt number, from 1.
+    Attempt int
+
+    // HTTP status returned by the endpoint, or 0 if no response was
+    // received.
+    StatusCode int
+
+    // Reason the attempt failed, or "" on success.
+    Error string
+
+    Time time.Time
+}
+
+// QueuedWebhookDelivery is an event waiting to be delivered to a webhook,
+// either for the first time or as a retry.
+type QueuedWebhookDelivery struct {
+    // Identifies the event.  Retries of the same event share an ID.
+    ID gocql.UUID
+
+    // The webhook to deliver to.
+    Owner string
+    WebhookID gocql.UUID
+
+    Event string
+    DeviceID gocql.UUID
+
+    // The signed JSON body to POST.
+    Body string
+
+    // Number of the next attempt, from 1.
+    Attempt int
+
+    TimeQueued time.Time
+
+    // When the next attempt is due.
+    NextAttempt time.Time
+}
+
+// AlarmState is the state of a threshold alarm.
+type AlarmState int
+const (
+    AlarmNormal = iota  // Never raised
+    AlarmActive         // Raised and waiting for acknowledgement
+    AlarmAcknowledged   // Raised and acknowledged by a user
+    AlarmCleared        // Value has recovered since the alarm was raised
+)
+
+func AlarmStateToString(state AlarmState) string {
+    switch state {
+    case AlarmNormal:
+        return "normal"
+    case AlarmActive:
+        return "active"
+    case AlarmAcknowledged:
+        return "acknowledged"
+    case AlarmCleared:
+        return "cleared"
+    }
+    return "unknown"
+}
+
+// AlarmEvent is a recorded alarm state change.
+type AlarmEvent struct {
+    VarName string
+    AlarmName string
+    State AlarmState
+
+    // Value of the Cloud Variable that caused the change.  Not meaningful
+    // for acknowledgements.
+    Value float64
+
+    Time time.Time
+
+    // User who acknowledged the alarm, for AlarmAcknowledged events.
+    Username string
+}
+
 type NotificationType int
 const (
     NotificationType_LowPriority = iota
@@ -49,8 +375,239 @@ const (
     NotificationType_SMS
     NotificationType_Email
     NotificationType_InApp
+    NotificationType_Webhook
+)
+
+func NotificationPriorityToString(priority int) string {
+    switch priority {
+    case NotificationType_LowPriority:
+        return "low"
+    case NotificationType_MedPriority:
+        return "med"
+    case NotificationType_HighPriority:
+        return "high"
+    }
+    return ""
+}
+
+func NotificationPriorityFromString(priority string) (int, error) {
+    switch priority {
+    case "low":
+        return NotificationType_LowPriority, nil
+    case "med":
+        return NotificationType_MedPriority, nil
+    case "high":
+        return NotificationType_HighPriority, nil
+    }
+    return 0, fmt.Errorf("Invalid priority: %s", priority)
+}
+
+// NotificationChannel is a way of delivering notifications to an account.
+type NotificationChannel int
+const (
+    NotificationChannelInApp = iota
+    NotificationChannelEmail
+    NotificationChannelSMS
+)
+
+// Every NotificationChannel, in order.
+var NotificationChannels = []NotificationChannel{
+    NotificationChannelInApp,
+    NotificationChannelEmail,
+    NotificationChannelSMS,
+}
+
+func NotificationChannelToString(channel NotificationChannel) string {
+    switch channel {
+    case NotificationChannelInApp:
+        return "in-app"
+    case NotificationChannelEmail:
+        return "email"
+    case NotificationChannelSMS:
+        return "sms"
+    }
+    return ""
+}
+
+func NotificationChannelFromString(channel string) (NotificationChannel, error) {
+    switch channel {
+    case "in-app":
+        return NotificationChannelInApp, nil
+    case "email":
+        return NotificationChannelEmail, nil
+    case "sms":
+        return NotificationChannelSMS, nil
+    }
+    return NotificationChannelInApp, fmt.Errorf("Invalid notification channel: %s", channel)
+}
+
+// NotificationPref is an account's preference for one NotificationChannel.
+type NotificationPref struct {
+    Enabled bool
+
+    // Lowest priority delivered over the channel, ex:
+    // NotificationType_MedPriority.  Notifications that request the channel
+    // explicitly (ex: NotificationType_Email) are delivered regardless.
+    MinPriority int
+
+    // Batch notifications below NotificationType_HighPriority into a daily
+    // digest instead of delivering them immediately.  Only supported for
+    // NotificationChannelEmail.
+    Digest bool
+}
+
+// Get the ID of the notification issued by device <deviceId> at time <t>.
+// Notifications are identified by device and time, to the millisecond.
+func NotificationID(deviceId gocql.UUID, t time.Time) string {
+    return fmt.Sprintf("%s_%d", deviceId, t.UnixNano()/int64(time.Millisecond))
+}
+
+// Parse a notification ID created by NotificationID.
+func ParseNotificationID(id string) (gocql.UUID, time.Time, error) {
+    parts := strings.Split(id, "_")
+    if len(parts) != 2 {
+        return gocql.UUID{}, time.Time{}, fmt.Errorf("Invalid notification ID: %s", id)
+    }
+    deviceId, err := gocql.ParseUUID(parts[0])
+    if err != nil {
+        return gocql.UUID{}, time.Time{}, fmt.Errorf("Invalid notification ID: %s", id)
+    }
+    ms, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+        return gocql.UUID{}, time.Time{}, fmt.Errorf("Invalid notification ID: %s", id)
+    }
+    return deviceId, time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+}
+
+// Get the preference used for <channel> when an account has not set one.
+func DefaultNotificationPref(channel NotificationChannel) NotificationPref {
+    switch channel {
+    case NotificationChannelInApp:
+        return NotificationPref{true, NotificationType_LowPriority, false}
+    case NotificationChannelEmail:
+        return NotificationPref{true, NotificationType_HighPriority, false}
+    }
+    return NotificationPref{false, NotificationType_HighPriority, false}
+}
+
+// DeliveryStatus is the outcome of delivering a notification to one account
+// over one channel.
+type DeliveryStatus int
+const (
+    DeliverySent = iota
+    DeliveryFailed
+    DeliverySkipped // Channel wanted but unavailable, ex: no SMS gateway
+    DeliveryDigested // Queued for the account's next digest
+)
+
+func DeliveryStatusToString(status DeliveryStatus) string {
+    switch status {
+    case DeliverySent:
+        return "sent"
+    case DeliveryFailed:
+        return "failed"
+    case DeliverySkipped:
+        return "skipped"
+    case DeliveryDigested:
+        return "digested"
+    }
+    return "unknown"
+}
+
+// MailStatus is the state of a message in the mail queue.
+type MailStatus int
+const (
+    MailQueued = iota  // Waiting for its first attempt
+    MailRetrying       // An attempt failed and will be retried
+    MailSent
+    MailFailed         // Gave up after too many attempts
+    MailBounced        // Rejected permanently by the mail service
 )
 
+func MailStatusToString(status MailStatus) string {
+    switch status {
+    case MailQueued:
+        return "queued"
+    case MailRetrying:
+        return "retrying"
+    case MailSent:
+        return "sent"
+    case MailFailed:
+        return "failed"
+    case MailBounced:
+        return "bounced"
+    }
+    return "unknown"
+}
+
+// QueuedMail is a message in the mail queue.
+type QueuedMail struct {
+    ID gocql.UUID
+
+    // Recipients and subject, for display.
+    Recipients string
+    Subject string
+
+    // The message itself, encoded by package mailqueue.
+    Message string
+
+    Status MailStatus
+
+    // Number of delivery attempts made.
+    Attempts int
+
+    // Reason the last attempt failed, or "".
+    Error string
+
+    TimeQueued time.Time
+    TimeUpdated time.Time
+
+    // When the next attempt is due, for MailQueued and MailRetrying.
+    NextAttempt time.Time
+}
+
+// DigestItem is a notification waiting to be sent in an account's digest.
+type DigestItem struct {
+    DeviceID gocql.UUID
+    DeviceName string
+    NotifyType int
+    Msg string
+    Time time.Time
+}
+
+// NotificationDelivery records the delivery of a notification to one
+// account over one channel.
+type NotificationDelivery struct {
+    Username string
+    Channel NotificationChannel
+    Status DeliveryStatus
+
+    // Reason for DeliveryFailed or DeliverySkipped.
+    Error string
+
+    Time time.Time
+}
+
+// DevicePermission is an account's access to a device.
+type DevicePermission struct {
+    Account Account
+    AccessLevel AccessLevel
+    ShareLevel ShareLevel
+}
+
+// ShareInvitation is an emailed invitation to access a device.  It is
+// identified by a random single-use token that is only revealed to the
+// inviter when the invitation is created.
+type ShareInvitation struct {
+    DeviceID gocql.UUID
+    Inviter string
+    Email string
+    AccessLevel AccessLevel
+    ShareLevel ShareLevel
+    TimeCreated time.Time
+    Expiry time.Time
+}
+
 // Datalayer provides an abstracted interface for interacting with Canopy's
 // backend perstistant datastore.
 type Datalayer interface {
@@ -69,6 +626,14 @@ type Datalayer interface {
 
 // Connection is a connection to the database.
 type Connection interface {
+    // Redeem the share invitation identified by <token>, granting <account>
+    // the access and sharing levels it carries.  The invitation is consumed,
+    // so each token can only be accepted once.  Returns a ValidationError if
+    // the token is unknown, expired or already used, if <account> is not the
+    // activated account for the invited email address, or if the inviter is
+    // no longer allowed to share the device.
+    AcceptShareInvitation(token string, account Account) (Device, ShareInvitation, error)
+
     // Truncate all sensor data from the database.  Use with care!
     ClearSensorData()
 
@@ -112,10 +677,62 @@ type Connection interface {
     // UUID, and verify the secret key.
     LookupDeviceByStringIDVerifySecretKey(id, secret string) (Device, error)
 
+    // Lookup an SDDL class by owner's username and class name.
+    LookupSDDLClass(owner, name string) (SDDLClass, error)
+
+    // Get the usernames of accounts with notifications waiting to be sent
+    // in a digest.
+    DigestUsernames() ([]string, error)
+
+    // Add a delivery to the webhook queue.  Sets its TimeQueued.  Deliveries
+    // are removed a day after they are queued.
+    EnqueueWebhookDelivery(delivery *QueuedWebhookDelivery) error
+
+    // Add a message to the mail queue.  Sets its ID and TimeQueued.
+    // Messages are removed a week after they are queued.
+    EnqueueMail(mail *QueuedMail) error
+
+    // Lookup a message in the mail queue by ID.
+    LookupQueuedMail(id gocql.UUID) (QueuedMail, error)
+
+    // Lookup a delivery in the webhook queue by ID.
+    LookupQueuedWebhookDelivery(id gocql.UUID) (QueuedWebhookDelivery, error)
+
     // Get the datalayer interface for the Pigeon system
     PigeonSystem() PigeonSystem
+
+    // Get every message in the mail queue, oldest first.
+    QueuedMails() ([]QueuedMail, error)
+
+    // Get every delivery in the webhook queue, oldest first.
+    QueuedWebhookDeliveries() ([]QueuedWebhookDelivery, error)
+
+    // Remove a delivery from the webhook queue, once it has succeeded or
+    // been given up on.
+    RemoveQueuedWebhookDelivery(id gocql.UUID) error
+
+    // Get every rule, from any account, whose condition is evaluated against
+    // device <deviceId>.
+    RulesForDevice(deviceId gocql.UUID) ([]Rule, error)
+
+    // Save the Status, Attempts, Error, TimeUpdated and NextAttempt of a
+    // message in the mail queue.
+    UpdateQueuedMail(mail QueuedMail) error
+
+    // Save the Attempt and NextAttempt of a delivery in the webhook queue.
+    UpdateQueuedWebhookDelivery(delivery QueuedWebhookDelivery) error
 }
 
+// How long a phone number verification code remains valid.
+const PhoneVerificationCodeLifetime = 15*time.Minute
+
+// Number of wrong codes allowed before a new verification code must be
+// requested.
+const PhoneVerificationMaxAttempts = 5
+
+// How long an emailed share invitation remains valid.
+const ShareInvitationLifetime = 7*24*time.Hour
+
 // Account is a user account
 type Account interface {
     // Get the account's activation code.
@@ -124,9 +741,39 @@ type Account interface {
     // Mark this account as activated, using an activation code.
     Activate(username, code string) error
 
+    // Queue a notification for this account's next digest.
+    AddToDigest(item DigestItem) error
+
+    // Remove notifications that have been sent from this account's digest.
+    ClearDigest(items []DigestItem) error
+
+    // Create a new rule owned by this account.
+    CreateRule(params RuleParams) (Rule, error)
+
+    // Create a new webhook owned by this account, with a newly generated
+    // secret.
+    CreateWebhook(params WebhookParams) (Webhook, error)
+
+    // Create a new SDDL class owned by this account.  Returns an error if
+    // the account already has a class named <name>.
+    CreateSDDLClass(name string, doc sddl.Document) (SDDLClass, error)
+
+    // Get the VarDeclPolicy assigned to devices created by this account.
+    DefaultVarDeclPolicy() VarDeclPolicy
+
     // Get all devices that user has access to.
     Devices() DeviceQuery
 
+    // Delete a rule owned by this account.
+    DeleteRule(id gocql.UUID) error
+
+    // Delete an SDDL class owned by this account.  Returns an error if any
+    // devices still belong to the class.
+    DeleteSDDLClass(name string) error
+
+    // Delete a webhook owned by this account, along with its delivery log.
+    DeleteWebhook(id gocql.UUID) error
+
     // Get device by ID, but only if this account has access to it.
     Device(id gocql.UUID) (Device, error)
 
@@ -140,10 +787,80 @@ type Account interface {
     // Has this account been activated?
     IsActivated() bool
 
+    // Get the account's locale, as a BCP 47 language tag such as "en" or
+    // "pt-BR", or "" if unset.  Used to pick the language of emails.
+    Locale() string
+
+    // Mark a notification as read by this account.  Saves the change to the
+    // database.
+    MarkNotificationRead(note Notification) error
+
+    // Get the account's preference for every NotificationChannel.  Channels
+    // the account has not configured use DefaultNotificationPref.
+    NotificationPrefs() (map[NotificationChannel]NotificationPref, error)
+
+    // Count the email and SMS notifications sent to this account since
+    // <t>.  Only the last day of deliveries is retained.
+    NotificationsSentSince(t time.Time) (int, error)
+
+    // Get the notifications waiting to be sent in this account's digest,
+    // oldest first.
+    PendingDigest() ([]DigestItem, error)
+
+    // Get the account's phone number, in E.164 format, or "" if none is
+    // registered.
+    PhoneNumber() string
+
+    // Has the account's phone number been verified?  SMS notifications are
+    // only sent to verified numbers.
+    PhoneVerified() bool
+
+    // Record that a notification was sent to this account over <channel> at
+    // time <t>.  Used to enforce per-recipient rate limits.
+    RecordNotificationSent(channel NotificationChannel, t time.Time) error
+
+    // Record that an SMS was sent to this account at time <t>.  Used to
+    // enforce SMS rate limits.
+    RecordSMSSent(t time.Time) error
+
     // Reset password.  Like SetPassword but requires a valid Password Reset
     // Code, and invalidates <code> on success.
     ResetPassword(code, newPassword string) error
 
+    // Get the IDs of the notifications this account has read.
+    ReadNotifications() (map[string]bool, error)
+
+    // Get a rule owned by this account, by ID.
+    Rule(id gocql.UUID) (Rule, error)
+
+    // Get all rules owned by this account.
+    Rules() ([]Rule, error)
+
+    // Get an SDDL class owned by this account, by name.
+    SDDLClass(name string) (SDDLClass, error)
+
+    // Get all SDDL classes owned by this account.
+    SDDLClasses() ([]SDDLClass, error)
+
+    // Set the VarDeclPolicy assigned to devices created by this account.
+    // Saves the change to the database.
+    SetDefaultVarDeclPolicy(policy VarDeclPolicy) error
+
+    // Set the account's locale.  An empty <locale> clears it.  Saves the
+    // change to the database.
+    SetLocale(locale string) error
+
+    // Set the account's preference for <channel>.  Saves the change to the
+    // database.
+    SetNotificationPref(channel NotificationChannel, pref NotificationPref) error
+
+    // Set the account's phone number, which must be in E.164 format, ex:
+    // "+15551234567".  The number is unverified until VerifyPhoneNumber is
+    // called with the returned code, which expires after
+    // PhoneVerificationCodeLifetime.  An empty <number> removes the phone
+    // number.  Saves changes to the database.
+    SetPhoneNumber(number string) (code string, err error)
+
     // Set email.  This also causes the account to go back to un-activated
     // status and a new activation code is generated.  Saves changes to the
     // database.
@@ -152,11 +869,27 @@ type Account interface {
     // Set password
     SetPassword(string) error
 
+    // Count the SMS messages sent to this account since <t>.  Only the last
+    // day of messages is retained.
+    SMSSentSince(t time.Time) (int, error)
+
     // Get user's username.
     Username() string
 
     // Verify user's password.  Returns true if password is correct.
     VerifyPassword(password string) bool
+
+    // Mark the account's phone number as verified, using the code returned
+    // by SetPhoneNumber.  Saves the change to the database.  After
+    // PhoneVerificationMaxAttempts wrong codes, fails until SetPhoneNumber
+    // issues a new code.
+    VerifyPhoneNumber(code string) error
+
+    // Get a webhook owned by this account, by ID.
+    Webhook(id gocql.UUID) (Webhook, error)
+
+    // Get all webhooks owned by this account.
+    Webhooks() ([]Webhook, error)
 }
 
 // DeviceQuery
@@ -179,8 +912,27 @@ type DeviceQuery interface {
 
 // Device is a Canopy-enabled device
 type Device interface {
-    // Extend the SDDL by adding Cloud Variables
-    ExtendSDDL(jsn map[string]interface{}) error
+    // Get the access and sharing levels that <account> has for this device.
+    // Returns NoAccess and NoSharing if the account has no permissions.
+    AccountAccess(account Account) (AccessLevel, ShareLevel, error)
+
+    // Get the state of the alarm named <name> declared on Cloud Variable
+    // <varName>.  Alarms that have never been raised are in the AlarmNormal
+    // state.
+    Alarm(varName, name string) (Alarm, error)
+
+    // Get the state changes of this device's alarms, newest first.
+    AlarmHistory() ([]AlarmEvent, error)
+
+    // Invite <email> to access this device with the given access and
+    // sharing levels, on behalf of <inviter>.  Returns the invitation's
+    // token, which expires after ShareInvitationLifetime.  The caller is
+    // responsible for checking that <inviter> may share the device.
+    CreateShareInvitation(inviter Account, email string, access AccessLevel, sharing ShareLevel) (string, error)
+
+    // Extend the SDDL by adding Cloud Variables.  The change is recorded as
+    // a new SDDL version.
+    ExtendSDDL(jsn map[string]interface{}, origin SDDLOrigin) error
 
     // Get historic sample data for a Cloud Variable.
     HistoricData(varDef sddl.VarDef, curTime, startTime, endTime time.Time) ([]cloudvar.CloudVarSample, error)
@@ -200,10 +952,14 @@ type Device interface {
     // Store a Cloud Variable data sample.
     // <value> must have an appropriate dynamic type.  See documentation in
     // cloudvar/cloudvar.go for more details.
+    //
+    // The datalayer can't launch Pigeon jobs, so callers must launch rule
+    // and alarm evaluation for the stored variables themselves, with
+    // rules.LaunchVarChanged, after any derived variables have been updated.
     InsertSample(varDef sddl.VarDef, t time.Time, value interface{}) error
 
     // Store a record of a notification.
-    InsertNotification(notifyType int, t time.Time, msg string) error
+    InsertNotification(notifyType int, t time.Time, msg string) (Notification, error)
 
     // Get last time communication occurred with the server
     // Return nil if device has never interacted with the server.
@@ -225,14 +981,75 @@ type Device interface {
     // Get the user-assigned name for this device.
     Name() string
 
+    // Get the notification issued by this device at time <t>.
+    Notification(t time.Time) (Notification, error)
+
+    // Get up to <limit> notifications issued by this device before time
+    // <t>, newest first.  If <t> is the zero time, starts from the newest
+    // notification.
+    NotificationsBefore(t time.Time, limit int) ([]Notification, error)
+
+    // Get the notifications issued by this device after time <t>, oldest
+    // first.
+    NotificationsSince(t time.Time) ([]Notification, error)
+
+    // Get the accounts that have access to this device, along with their
+    // access and sharing levels.
+    Permissions() ([]DevicePermission, error)
+
+    // Remove Cloud Variable <varName> from this device's SDDL document and
+    // purge all of its stored samples, including those stored under earlier
+    // datatypes.  If <dryRun> is true, nothing is changed and the returned
+    // report describes what would be purged.  Fails with a ValidationError,
+    // even on a dry run, if the resulting document would be invalid or a
+    // rule or webhook refers to the Cloud Variable.
+    RemoveVar(varName string, dryRun bool) (*VarDataReport, error)
+
+    // Rename Cloud Variable <oldName> to <newName>.  If <migrate> is true,
+    // its stored samples are moved to the new name; otherwise they are
+    // purged.  If <dryRun> is true, nothing is changed and the returned
+    // report describes the affected data.  Fails with a ValidationError,
+    // even on a dry run, if the resulting document would be invalid, if a
+    // rule or webhook refers to <oldName>, or if <migrate> is true and the
+    // Cloud Variable's datatype has changed over its SDDL history.
+    RenameVar(oldName, newName string, migrate, dryRun bool) (*VarDataReport, error)
+
+    // Remove all access and sharing permissions that account <username> has
+    // for this device.
+    RevokeAccountAccess(username string) error
+
     // Get the public access level
     PublicAccessLevel() AccessLevel
 
+    // Get the SDDL class this device belongs to.  Returns nil if the device
+    // does not belong to a class.
+    SDDLClass() (SDDLClass, error)
+
+    // Get a "<owner>/<name>" reference to the SDDL class this device belongs
+    // to, or "" if the device does not belong to a class.  Does not access
+    // the database.
+    SDDLClassRef() string
+
     // Get the SDDL document for this device.  Returns nil if document is
     // unknown (which may happen for newly provisioned devices that haven't
     // sent any reports yet).
+    //
+    // For devices that belong to an SDDL class, this is the class's document
+    // combined with any per-device extensions.
     SDDLDocument() sddl.Document
 
+    // Get the SDDL document that was active for this device at time <t>.
+    // Returns the oldest known version if <t> precedes all recorded versions.
+    SDDLDocumentAt(t time.Time) (sddl.Document, error)
+
+    // Get every recorded version of this device's SDDL document, ordered
+    // from oldest to newest.
+    SDDLHistory() ([]SDDLRevision, error)
+
+    // Get the version number of this device's current SDDL document.
+    // Returns 0 if no version has been recorded.
+    SDDLVersion() int
+
     // Get the SDDL document for this device, as a marshalled JSON string.
     // Returns "" if document is unknown (which may happen for newly
     // provisioned devices that haven't sent any reports yet).
@@ -252,8 +1069,19 @@ type Device interface {
     // Set the user-assigned name for this device.
     SetName(name string) error
 
-    // Set the SDDL class associated with this device.
-    SetSDDLDocument(doc sddl.Document) error
+    // Make this device a member of SDDL class <class>.  Cloud Variables
+    // that the device declares beyond those in the class are kept as
+    // per-device extensions.  If <class> is nil, the device leaves its
+    // current class and keeps a private copy of its SDDL document.
+    SetSDDLClass(class SDDLClass, origin SDDLOrigin) error
+
+    // Set the SDDL class associated with this device.  If the document
+    // differs from the current one, it is recorded as a new SDDL version.
+    SetSDDLDocument(doc sddl.Document, origin SDDLOrigin) error
+
+    // Set the policy for handling reports of undeclared Cloud Variables.
+    // Saves the change to the database.
+    SetVarDeclPolicy(policy VarDeclPolicy) error
 
     // Update the last activity timestamp.
     // If <t> is nil, the current server time is used.  Otherwise, the last
@@ -261,6 +1089,10 @@ type Device interface {
     // Saves the data to the database.
     UpdateLastActivityTime(t *time.Time) error
 
+    // Get the policy for handling reports of undeclared Cloud Variables.
+    // Returns VarDeclPolicyUnset if no policy has been assigned.
+    VarDeclPolicy() VarDeclPolicy
+
     // Update websocket connectivity status
     // Saves the data to the database
     UpdateWSConnected(connected bool) error
@@ -276,9 +1108,15 @@ type Notification interface {
     // Get the date & time that this notification was sent.
     Datetime() time.Time
 
-    // Mark this notification as dismissed.
+    // Get the ID of the device that issued this notification.
+    DeviceID() gocql.UUID
+
+    // Mark this notification as dismissed.  Saves the change to the database.
     Dismiss() error
 
+    // Get the notification's ID.  See NotificationID.
+    ID() string
+
     // Has this notification been dismissed?
     IsDismissed() bool
  
@@ -287,6 +1125,207 @@ type Notification interface {
 
     // Get the requested notification type.
     NotifyType() int
+
+    // Get the recorded deliveries of this notification.
+    Deliveries() ([]NotificationDelivery, error)
+
+    // Record the delivery of this notification to one account.
+    RecordDelivery(delivery NotificationDelivery) error
+}
+
+// SDDLRevision is a recorded version of a device's SDDL document.
+type SDDLRevision interface {
+    // Get the SDDL document for this version.
+    Document() (sddl.Document, error)
+
+    // Get the SDDL document for this version, as a marshalled JSON string.
+    DocumentString() string
+
+    // Get what caused this version to be created.
+    Origin() SDDLOrigin
+
+    // Get the time at which this version became active.
+    Timestamp() time.Time
+
+    // Get the version number.  Versions are numbered from 1.
+    Version() int
+}
+
+// SDDLClass is a named, versioned SDDL document owned by an account and
+// shared by many devices.  Member devices store only their per-device
+// extensions; changes to the class propagate to all members.
+type SDDLClass interface {
+    // Get the class's SDDL document.
+    Document() sddl.Document
+
+    // Get the class's SDDL document, as a marshalled JSON string.
+    DocumentString() string
+
+    // Get every recorded version of the class's SDDL document, ordered from
+    // oldest to newest.
+    History() ([]SDDLRevision, error)
+
+    // Get the IDs of all devices that belong to this class.
+    Members() ([]gocql.UUID, error)
+
+    // Get the class's name, which is unique for its owner.
+    Name() string
+
+    // Get the username of the account that owns this class.
+    Owner() string
+
+    // Record a new SDDL version for each member device whose latest version
+    // predates the class's current document.  Returns the IDs of the devices
+    // updated.  This touches every member, so call it from a background job
+    // after SetDocument.
+    PropagateDocument() ([]gocql.UUID, error)
+
+    // Replace the class's SDDL document, recording a new class version.
+    // Fails with a ValidationError if the document, or any member device's
+    // document combined with it, is invalid.  Member devices use the new
+    // document immediately but their SDDL history is only updated by
+    // PropagateDocument.  Returns false if the document is unchanged.
+    SetDocument(doc sddl.Document) (bool, error)
+
+    // Get the time at which the current version was created.
+    TimeUpdated() time.Time
+
+    // Get the current version number.  Versions are numbered from 1.
+    Version() int
+}
+
+// Rule is a user-defined automation owned by an account.  Whenever a Cloud
+// Variable of one of the rule's devices changes, its condition is
+// re-evaluated.  Rules are edge-triggered: the actions are performed when the
+// condition goes from unsatisfied to satisfied, at most once per cooldown
+// period.
+type Rule interface {
+    // Get the actions performed when the rule fires.
+    Actions() []RuleAction
+
+    // Get the rule's condition, in device filter syntax.
+    Condition() string
+
+    // Get the minimum time between firings.
+    Cooldown() time.Duration
+
+    // Get the IDs of the devices the condition is evaluated against.
+    DeviceIDs() []gocql.UUID
+
+    // Is the rule enabled?  Disabled rules are never evaluated.
+    Enabled() bool
+
+    // Get the rule's unique ID.
+    ID() gocql.UUID
+
+    // Get the time the rule last fired, or the zero time if it never has.
+    LastFired() time.Time
+
+    // Was the condition satisfied when the rule was last evaluated?
+    LastState() bool
+
+    // Get how the condition is combined across the rule's devices.
+    Match() RuleMatch
+
+    // Get the rule's user-assigned name.
+    Name() string
+
+    // Get the username of the account that owns this rule.
+    Owner() string
+
+    // Record the result of evaluating the rule's condition.  If <fired> is
+    // true, the rule's actions are being performed at time <t>.  The change
+    // is only saved if the stored state is still what this Rule was loaded
+    // with, so that concurrent evaluations can't both record the same
+    // transition.  Returns false if it wasn't saved, in which case the
+    // actions must not be performed.
+    RecordEvaluation(state, fired bool, t time.Time) (bool, error)
+
+    // Get the time the rule was created.
+    TimeCreated() time.Time
+
+    // Replace the rule's settings.  This resets the rule's state, so it may
+    // fire again immediately.  Saves changes to the database.
+    Update(params RuleParams) error
+}
+
+// Webhook is an account's subscription to device events, which are POSTed
+// to the webhook's URL.
+type Webhook interface {
+    // Get the most recent delivery attempts, newest first, up to <limit>.
+    Deliveries(limit int) ([]WebhookDelivery, error)
+
+    // Get the devices whose events are delivered.  See WebhookParams.
+    DeviceIDs() []gocql.UUID
+
+    // Is the webhook enabled?
+    Enabled() bool
+
+    // Get the event types delivered.
+    Events() []string
+
+    // Get the device filter expression, or "".
+    Filter() string
+
+    // Get the webhook's ID.
+    ID() gocql.UUID
+
+    // Get the username of the account that owns this webhook.
+    Owner() string
+
+    // Record a delivery attempt.
+    RecordDelivery(delivery WebhookDelivery) error
+
+    // Get the secret used to sign payloads, generated when the webhook is
+    // created.
+    Secret() string
+
+    // Get the time the webhook was created.
+    TimeCreated() time.Time
+
+    // Replace the webhook's settings.  Saves the change to the database.
+    Update(params WebhookParams) error
+
+    // Get the endpoint that events are POSTed to.
+    URL() string
+}
+
+// Alarm is the persisted state of a threshold alarm declared in a device's
+// SDDL.  See sddl.AlarmDef.
+type Alarm interface {
+    // Get the username of the user who acknowledged the alarm, or "" if it
+    // is not acknowledged.
+    AcknowledgedBy() string
+
+    // Get the alarm's name.
+    Name() string
+
+    // Get the time at which the alarm's thresholds were first exceeded,
+    // while waiting for the alarm's minimum duration to elapse.  Returns the
+    // zero time if the alarm is not pending.
+    PendingSince() time.Time
+
+    // Set or clear (with the zero time) the time at which the thresholds
+    // were first exceeded.  Saves the change to the database.
+    SetPendingSince(t time.Time) error
+
+    // Change the alarm's state and record the change in the alarm history.
+    // <username> is the user acknowledging the alarm, or "".  Clears the
+    // pending time.  Saves the change to the database.
+    SetState(state AlarmState, value float64, t time.Time, username string) error
+
+    // Get the alarm's current state.
+    State() AlarmState
+
+    // Get the time of the latest state change, or the zero time if the
+    // alarm has never been raised.
+    TimeChanged() time.Time
+
+    // Get the Cloud Variable value that caused the latest state change.
+    Value() float64
+
+    // Get the full name of the Cloud Variable the alarm is declared on.
+    VarName() string
 }
 
 type PigeonSystem interface {
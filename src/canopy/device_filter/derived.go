@@ -0,0 +1,593 @@
+/*
+ * Copyright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package device_filter
+
+// Derived Cloud Variables are declared with an "expression" in SDDL:
+//
+//      "out float32 power" : {
+//          "expression" : "voltage * current"
+//      },
+//      "out float32 heat_index" : {
+//          "expression" : "-42.379 + 2.049 * temperature + 10.143 * humidity - 0.2248 * temperature * humidity"
+//      }
+//
+// Expressions support the operators + - * / % ^ (power), parentheses,
+// numeric constants, references to other Cloud Variables (including struct
+// members, ex: "gps.latitude") and the math functions listed in
+// mathFunctions.  They are tokenized with the same tokenizer as device
+// filters.
+
+import (
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "canopy/sddl"
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "time"
+)
+
+type mathFunction struct {
+    // Number of arguments, or -1 for one or more.
+    nargs int
+    fn func(args []float64) float64
+}
+
+func round(x float64) float64 {
+    if x < 0 {
+        return -math.Floor(-x + 0.5)
+    }
+    return math.Floor(x + 0.5)
+}
+
+var mathFunctions = map[string]mathFunction{
+    "abs" : {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+    "ceil" : {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+    "cos" : {1, func(a []float64) float64 { return math.Cos(a[0]) }},
+    "exp" : {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+    "floor" : {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+    "ln" : {1, func(a []float64) float64 { return math.Log(a[0]) }},
+    "log10" : {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+    "pow" : {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+    "round" : {1, func(a []float64) float64 { return round(a[0]) }},
+    "sin" : {1, func(a []float64) float64 { return math.Sin(a[0]) }},
+    "sqrt" : {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+    "tan" : {1, func(a []float64) float64 { return math.Tan(a[0]) }},
+    "max" : {-1, func(a []float64) float64 {
+        out := a[0]
+        for _, x := range a[1:] {
+            out = math.Max(out, x)
+        }
+        return out
+    }},
+    "min" : {-1, func(a []float64) float64 {
+        out := a[0]
+        for _, x := range a[1:] {
+            out = math.Min(out, x)
+        }
+        return out
+    }},
+}
+
+// An ArithmeticExpression is a binary tree node that represents an
+// arithmetic operation.
+//
+//               *
+//             /   \
+//     (operand0)  (operand1)
+//
+type ArithmeticExpression struct {
+    operation ArithOpEnum
+    operand0 Expression
+    operand1 Expression
+}
+
+// A NegateExpression is a link that represents unary minus.
+type NegateExpression struct {
+    operand Expression
+}
+
+// A FunctionExpression is a node that represents a math function call.
+//
+//          sqrt
+//           |
+//        (args[0])
+//
+type FunctionExpression struct {
+    name string
+    args []Expression
+}
+
+// Evaluate <expr> and convert the result to float64.
+func numericValue(expr Expression, device datalayer.Device) (float64, error) {
+    val, err := expr.Value(device)
+    if err != nil {
+        return 0, err
+    }
+    f, ok := cloudvar.CloudVarValueToFloat64(val)
+    if !ok {
+        return 0, fmt.Errorf("Expected numeric operand")
+    }
+    return f, nil
+}
+
+func (expr *ArithmeticExpression)Value(device datalayer.Device) (cloudvar.CloudVarValue, error) {
+    v0, err := numericValue(expr.operand0, device)
+    if err != nil {
+        return nil, err
+    }
+    v1, err := numericValue(expr.operand1, device)
+    if err != nil {
+        return nil, err
+    }
+    switch expr.operation {
+    case ADD:
+        return v0 + v1, nil
+    case SUB:
+        return v0 - v1, nil
+    case MUL:
+        return v0 * v1, nil
+    case DIV:
+        if v1 == 0 {
+            return nil, fmt.Errorf("Division by zero")
+        }
+        return v0 / v1, nil
+    case MOD:
+        if v1 == 0 {
+            return nil, fmt.Errorf("Division by zero")
+        }
+        return math.Mod(v0, v1), nil
+    case POW:
+        return math.Pow(v0, v1), nil
+    default:
+        return nil, fmt.Errorf("Unexpected arithmetic operation")
+    }
+}
+
+func (expr *NegateExpression)Value(device datalayer.Device) (cloudvar.CloudVarValue, error) {
+    v, err := numericValue(expr.operand, device)
+    if err != nil {
+        return nil, err
+    }
+    return -v, nil
+}
+
+func (expr *FunctionExpression)Value(device datalayer.Device) (cloudvar.CloudVarValue, error) {
+    args := []float64{}
+    for _, argExpr := range expr.args {
+        arg, err := numericValue(argExpr, device)
+        if err != nil {
+            return nil, err
+        }
+        args = append(args, arg)
+    }
+    return mathFunctions[expr.name].fn(args), nil
+}
+
+// Recursive descent parser for derived Cloud Variable expressions:
+//
+//      sum     := product (("+" | "-") product)*
+//      product := unary (("*" | "/" | "%") unary)*
+//      unary   := "-" unary | power
+//      power   := primary ("^" unary)?
+//      primary := number | name | name "(" sum ("," sum)* ")" | "(" sum ")"
+type derivedParser struct {
+    tokens []*Token
+    pos int
+    inputs map[string]bool
+}
+
+func (p *derivedParser) peek() *Token {
+    if p.pos >= len(p.tokens) {
+        return nil
+    }
+    return p.tokens[p.pos]
+}
+
+func (p *derivedParser) isArithOp(ops ...ArithOpEnum) bool {
+    tok := p.peek()
+    if tok == nil || tok.token_type != TOKEN_ARITH_OP {
+        return false
+    }
+    for _, op := range ops {
+        if tok.arith_op == op {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *derivedParser) parseSum() (Expression, error) {
+    expr, err := p.parseProduct()
+    if err != nil {
+        return nil, err
+    }
+    for p.isArithOp(ADD, SUB) {
+        op := p.peek().arith_op
+        p.pos++
+        operand1, err := p.parseProduct()
+        if err != nil {
+            return nil, err
+        }
+        expr = &ArithmeticExpression{op, expr, operand1}
+    }
+    return expr, nil
+}
+
+func (p *derivedParser) parseProduct() (Expression, error) {
+    expr, err := p.parseUnary()
+    if err != nil {
+        return nil, err
+    }
+    for p.isArithOp(MUL, DIV, MOD) {
+        op := p.peek().arith_op
+        p.pos++
+        operand1, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        expr = &ArithmeticExpression{op, expr, operand1}
+    }
+    return expr, nil
+}
+
+func (p *derivedParser) parseUnary() (Expression, error) {
+    if p.isArithOp(SUB) {
+        p.pos++
+        operand, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return &NegateExpression{operand}, nil
+    }
+    return p.parsePower()
+}
+
+func (p *derivedParser) parsePower() (Expression, error) {
+    // The tokenizer reads "-2" as a single number.  Negate after raising to
+    // the power so that -2^2 = -(2^2), as for -x^2.
+    tok := p.peek()
+    negLiteral := tok != nil && tok.token_type == TOKEN_FLOAT_VALUE && tok.float_value < 0
+    expr, err := p.parsePrimary()
+    if err != nil {
+        return nil, err
+    }
+    if p.isArithOp(POW) {
+        // Right-associative: 2^3^2 = 2^(3^2)
+        p.pos++
+        exponent, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        if negLiteral {
+            base := &ImmediateExpression{value: -tok.float_value}
+            return &NegateExpression{&ArithmeticExpression{POW, base, exponent}}, nil
+        }
+        expr = &ArithmeticExpression{POW, expr, exponent}
+    }
+    return expr, nil
+}
+
+func (p *derivedParser) expect(tokenType TokenTypeEnum, what string) error {
+    tok := p.peek()
+    if tok == nil || tok.token_type != tokenType {
+        return fmt.Errorf("Expected %s", what)
+    }
+    p.pos++
+    return nil
+}
+
+func (p *derivedParser) parsePrimary() (Expression, error) {
+    tok := p.peek()
+    if tok == nil {
+        return nil, fmt.Errorf("Unexpected end of expression")
+    }
+    p.pos++
+
+    switch tok.token_type {
+    case TOKEN_FLOAT_VALUE:
+        if tok.units != "" {
+            return nil, fmt.Errorf("Units not supported in expressions: %s", tok.units)
+        }
+        return &ImmediateExpression{value: tok.float_value}, nil
+    case TOKEN_OPEN_PAREN:
+        expr, err := p.parseSum()
+        if err != nil {
+            return nil, err
+        }
+        err = p.expect(TOKEN_CLOSE_PAREN, "')'")
+        if err != nil {
+            return nil, err
+        }
+        return expr, nil
+    case TOKEN_SYMBOL:
+        next := p.peek()
+        if next == nil || next.token_type != TOKEN_OPEN_PAREN {
+            p.inputs[tok.string_value] = true
+            return &PropertyExpression{property: tok.string_value}, nil
+        }
+
+        // Function call
+        fn, ok := mathFunctions[tok.string_value]
+        if !ok {
+            return nil, fmt.Errorf("Unknown function %s", tok.string_value)
+        }
+        p.pos++
+        args := []Expression{}
+        next = p.peek()
+        if next != nil && next.token_type == TOKEN_CLOSE_PAREN {
+            // No arguments, rejected below.
+            p.pos++
+        } else {
+            for {
+                arg, err := p.parseSum()
+                if err != nil {
+                    return nil, err
+                }
+                args = append(args, arg)
+                next = p.peek()
+                if next != nil && next.token_type == TOKEN_COMMA {
+                    p.pos++
+                    continue
+                }
+                err = p.expect(TOKEN_CLOSE_PAREN, "')' or ','")
+                if err != nil {
+                    return nil, err
+                }
+                break
+            }
+        }
+        if (fn.nargs == -1 && len(args) == 0) || (fn.nargs != -1 && len(args) != fn.nargs) {
+            return nil, fmt.Errorf("Wrong number of arguments to %s", tok.string_value)
+        }
+        return &FunctionExpression{tok.string_value, args}, nil
+    default:
+        return nil, fmt.Errorf("Unexpected token in expression")
+    }
+}
+
+// DerivedExpression is the compiled "expression" of a derived Cloud Variable.
+type DerivedExpression struct {
+    expr Expression
+    inputs []string
+}
+
+// Parse the "expression" of a derived Cloud Variable, ex:
+// "voltage * current".
+func ParseDerivedExpression(exprString string) (*DerivedExpression, error) {
+    p := &derivedParser{
+        tokens: tokenize(exprString),
+        inputs: map[string]bool{},
+    }
+    expr, err := p.parseSum()
+    if err != nil {
+        return nil, fmt.Errorf("Invalid expression %q: %s", exprString, err)
+    }
+    if p.pos != len(p.tokens) {
+        return nil, fmt.Errorf("Invalid expression %q: unexpected trailing input", exprString)
+    }
+
+    inputs := []string{}
+    for name := range p.inputs {
+        inputs = append(inputs, name)
+    }
+    sort.Strings(inputs)
+    return &DerivedExpression{expr, inputs}, nil
+}
+
+// Get the names of the variables and device properties (ex:
+// "system.activity_status") referenced by the expression.
+func (derived *DerivedExpression) Inputs() []string {
+    return derived.inputs
+}
+
+// Compute the expression from the latest values of its inputs.
+func (derived *DerivedExpression) Evaluate(device datalayer.Device) (float64, error) {
+    f, err := numericValue(derived.expr, device)
+    if err != nil {
+        return 0, err
+    }
+    if math.IsNaN(f) || math.IsInf(f, 0) {
+        return 0, fmt.Errorf("Expression result is not a finite number")
+    }
+    return f, nil
+}
+
+// DerivedVar is a derived Cloud Variable together with its compiled
+// expression.
+type DerivedVar struct {
+    VarDef sddl.VarDef
+    Expr *DerivedExpression
+}
+
+// Collect every Cloud Variable in <varDefs>, including struct members, keyed
+// by full name.
+func collectVarDefs(varDefs []sddl.VarDef, out map[string]sddl.VarDef) {
+    for _, varDef := range varDefs {
+        out[varDef.Fullname()] = varDef
+        if varDef.Datatype() == sddl.DATATYPE_STRUCT {
+            members, _ := varDef.StructMembers()
+            collectVarDefs(members, out)
+        }
+    }
+}
+
+// Compile the derived Cloud Variables in <doc> and sort them so that each
+// comes after any derived variables it depends on.
+//
+// Returns an error if an expression is invalid, references a variable that
+// is not declared or not numeric, or if derived variables depend on
+// themselves, directly or indirectly.
+func sortedDerivedVars(doc sddl.Document) ([]DerivedVar, error) {
+    all := map[string]sddl.VarDef{}
+    collectVarDefs(doc.VarDefs(), all)
+
+    names := []string{}
+    derived := map[string]*DerivedVar{}
+    for name, varDef := range all {
+        if varDef.Expression() == "" {
+            continue
+        }
+        expr, err := ParseDerivedExpression(varDef.Expression())
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", name, err)
+        }
+        for _, input := range expr.Inputs() {
+            if strings.HasPrefix(input, "system.") {
+                continue
+            }
+            inputDef, ok := all[input]
+            if !ok {
+                return nil, fmt.Errorf("%s: expression references undeclared variable %s", name, input)
+            }
+            if !inputDef.IsNumeric() {
+                return nil, fmt.Errorf("%s: expression references non-numeric variable %s", name, input)
+            }
+        }
+        names = append(names, name)
+        derived[name] = &DerivedVar{varDef, expr}
+    }
+    sort.Strings(names)
+
+    // Depth-first topological sort, detecting cycles.
+    const (
+        unvisited = iota
+        visiting
+        visited
+    )
+    state := map[string]int{}
+    out := []DerivedVar{}
+    var visit func(name string, path []string) error
+    visit = func(name string, path []string) error {
+        switch state[name] {
+        case visiting:
+            return fmt.Errorf("Derived variables form a cycle: %s -> %s", strings.Join(path, " -> "), name)
+        case visited:
+            return nil
+        }
+        state[name] = visiting
+        for _, input := range derived[name].Expr.Inputs() {
+            if _, ok := derived[input]; ok {
+                err := visit(input, append(path, name))
+                if err != nil {
+                    return err
+                }
+            }
+        }
+        state[name] = visited
+        out = append(out, *derived[name])
+        return nil
+    }
+    for _, name := range names {
+        err := visit(name, []string{})
+        if err != nil {
+            return nil, err
+        }
+    }
+    return out, nil
+}
+
+// Check the derived Cloud Variables in <doc>.  This should be called
+// whenever a device's SDDL changes.  See sortedDerivedVars for the checks
+// performed.
+func CheckDerivedVars(doc sddl.Document) error {
+    _, err := sortedDerivedVars(doc)
+    return err
+}
+
+// Does <input> refer to one of the variables named in <changed>, or to a
+// member of one of them?
+func inputChanged(input string, changed map[string]bool) bool {
+    for name := range changed {
+        if input == name || strings.HasPrefix(input, name + ".") {
+            return true
+        }
+    }
+    return false
+}
+
+// Determine which derived Cloud Variables in <doc> must be recomputed after
+// the variables named in <changed> are updated.  The result is in evaluation
+// order: each derived variable comes after the derived variables it depends
+// on.
+func DerivedVarsToUpdate(doc sddl.Document, changed []string) ([]DerivedVar, error) {
+    sorted, err := sortedDerivedVars(doc)
+    if err != nil {
+        return nil, err
+    }
+    dirty := map[string]bool{}
+    for _, name := range changed {
+        dirty[name] = true
+    }
+    out := []DerivedVar{}
+    for _, derived := range sorted {
+        for _, input := range derived.Expr.Inputs() {
+            if inputChanged(input, dirty) {
+                dirty[derived.VarDef.Fullname()] = true
+                out = append(out, derived)
+                break
+            }
+        }
+    }
+    return out, nil
+}
+
+// Recompute and store the derived Cloud Variables of <device> that depend on
+// the variables named in <changed>.  Values that can't be computed, or that
+// fail validation, are skipped and reported as warnings.
+//
+// Returns the full names of the derived variables that were stored.
+func UpdateDerivedVars(device datalayer.Device, changed []string) ([]string, []cloudvar.ValidationWarning, error) {
+    updated := []string{}
+    warnings := []cloudvar.ValidationWarning{}
+    doc := device.SDDLDocument()
+    if doc == nil || len(changed) == 0 {
+        return updated, warnings, nil
+    }
+    toUpdate, err := DerivedVarsToUpdate(doc, changed)
+    if err != nil {
+        return updated, warnings, err
+    }
+
+    for _, derived := range toUpdate {
+        f, err := derived.Expr.Evaluate(device)
+        if err != nil {
+            warnings = append(warnings, cloudvar.ValidationWarning{
+                VarName: derived.VarDef.Fullname(),
+                Problem: "derived_eval_failed",
+                Action: "rejected",
+                Msg: fmt.Sprintf("Could not compute %s: %s", derived.VarDef.Fullname(), err),
+            })
+            continue
+        }
+
+        // Numbers from JSON are float64, so this performs the same
+        // conversion and validation as reported values.
+        varVal, varWarnings, accepted := cloudvar.JsonToValidatedCloudVarValue(derived.VarDef, f)
+        warnings = append(warnings, varWarnings...)
+        if !accepted {
+            continue
+        }
+        err = device.InsertSample(derived.VarDef, time.Now(), varVal)
+        if err != nil {
+            return updated, warnings, err
+        }
+        updated = append(updated, derived.VarDef.Fullname())
+    }
+    return updated, warnings, nil
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+
+package device_filter
+
+import (
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "fmt"
+    "math"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// testDevice supplies the latest values of Cloud Variables.  Other Device
+// methods are not used by derived expressions.
+type testDevice struct {
+    datalayer.Device
+    values map[string]cloudvar.CloudVarValue
+}
+
+func (device *testDevice) LatestDataByName(name string) (*cloudvar.CloudVarSample, error) {
+    value, ok := device.values[name]
+    if !ok {
+        return nil, fmt.Errorf("No data for %s", name)
+    }
+    return &cloudvar.CloudVarSample{Value: value}, nil
+}
+
+func TestDerivedExpressionParseErrors(t *testing.T) {
+    tests := []struct {
+        expr string
+        msg string
+    }{
+        {"", "Unexpected end of expression"},
+        {"2 +", "Unexpected end of expression"},
+        {"(2 + 3", "Expected"},
+        {"2 3", "unexpected trailing input"},
+        {"2 + 3)", "unexpected trailing input"},
+        {"5 degrees_c + 1", "Units not supported"},
+        {"max(1,)", "Unexpected token"},
+        {"sinh(1)", "Unknown function sinh"},
+        {"abs()", "Wrong number of arguments to abs"},
+        {"abs(1, 2)", "Wrong number of arguments to abs"},
+        {"pow(2)", "Wrong number of arguments to pow"},
+        {"pow(2, 3, 4)", "Wrong number of arguments to pow"},
+        {"min()", "Wrong number of arguments to min"},
+        {"max()", "Wrong number of arguments to max"},
+    }
+    for _, test := range tests {
+        _, err := ParseDerivedExpression(test.expr)
+        if err == nil {
+            t.Errorf("ParseDerivedExpression(%q) succeeded, expected %q", test.expr, test.msg)
+        } else if !strings.Contains(err.Error(), test.msg) {
+            t.Errorf("ParseDerivedExpression(%q): %q, expected %q", test.expr, err, test.msg)
+        }
+    }
+}
+
+func TestDerivedExpressionEvaluate(t *testing.T) {
+    device := &testDevice{values: map[string]cloudvar.CloudVarValue{
+        "voltage" : float32(12),
+        "current" : int16(2),
+        "offset" : float64(-0.5),
+    }}
+    tests := []struct {
+        expr string
+        expected float64
+    }{
+        // Precedence and associativity
+        {"2 + 3 * 4", 14},
+        {"(2 + 3) * 4", 20},
+        {"10 - 4 - 3", 3},
+        {"24 / 4 / 2", 3},
+        {"7 % 4", 3},
+        {"2 + 7 % 4 * 2", 8},
+        {"-2 ^ 2", -4},
+        {"(-2) ^ 2", 4},
+        {"2 ^ 3 ^ 2", 512},
+        {"2 ^ -1", 0.5},
+        {"-(-3)", 3},
+        {"-(2 ^ 2)", -4},
+        {"- voltage ^ 2", -144},
+        {"2 * -3 ^ 2", -18},
+        // Functions
+        {"abs(-3)", 3},
+        {"ceil(1.2) + floor(1.8)", 3},
+        {"round(2.5) + round(-2.5)", 0},
+        {"sqrt(16)", 4},
+        {"pow(2, 10)", 1024},
+        {"ln(exp(2))", 2},
+        {"log10(1000)", 3},
+        {"sin(0) + cos(0) + tan(0)", 1},
+        {"max(1, 5, 3)", 5},
+        {"min(4)", 4},
+        {"min(4, -1, 2)", -1},
+        // Variables
+        {"voltage * current", 24},
+        {"voltage / current + offset", 5.5},
+        {"max(voltage, current * 10)", 20},
+    }
+    for _, test := range tests {
+        expr, err := ParseDerivedExpression(test.expr)
+        if err != nil {
+            t.Errorf("ParseDerivedExpression(%q): %s", test.expr, err)
+            continue
+        }
+        result, err := expr.Evaluate(device)
+        if err != nil {
+            t.Errorf("Evaluate(%q): %s", test.expr, err)
+        } else if math.Abs(result - test.expected) > 1e-9 {
+            t.Errorf("Evaluate(%q) = %v, expected %v", test.expr, result, test.expected)
+        }
+    }
+}
+
+func TestDerivedExpressionEvaluateErrors(t *testing.T) {
+    device := &testDevice{values: map[string]cloudvar.CloudVarValue{
+        "zero" : int32(0),
+        "status" : "ok",
+    }}
+    tests := []struct {
+        expr string
+        msg string
+    }{
+        {"1 / 0", "Division by zero"},
+        {"1 % 0", "Division by zero"},
+        {"1 / zero", "Division by zero"},
+        {"5 % (2 - 2)", "Division by zero"},
+        {"sqrt(-1)", "not a finite number"},
+        {"ln(0)", "not a finite number"},
+        {"status + 1", "Expected numeric operand"},
+        {"missing * 2", "No data for missing"},
+    }
+    for _, test := range tests {
+        expr, err := ParseDerivedExpression(test.expr)
+        if err != nil {
+            t.Errorf("ParseDerivedExpression(%q): %s", test.expr, err)
+            continue
+        }
+        _, err = expr.Evaluate(device)
+        if err == nil {
+            t.Errorf("Evaluate(%q) succeeded, expected %q", test.expr, test.msg)
+        } else if !strings.Contains(err.Error(), test.msg) {
+            t.Errorf("Evaluate(%q): %q, expected %q", test.expr, err, test.msg)
+        }
+    }
+}
+
+func TestDerivedExpressionInputs(t *testing.T) {
+    expr, err := ParseDerivedExpression("voltage * current + voltage / system.activity_status - abs(amps)")
+    if err != nil {
+        t.Fatalf("ParseDerivedExpression: %s", err)
+    }
+    expected := []string{"amps", "current", "system.activity_status", "voltage"}
+    if !reflect.DeepEqual(expr.Inputs(), expected) {
+        t.Errorf("Inputs() = %v, expected %v", expr.Inputs(), expected)
+    }
+}
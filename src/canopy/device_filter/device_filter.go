@@ -19,7 +19,9 @@ package device_filter
 import (
     "canopy/cloudvar"
     "canopy/datalayer"
+    "canopy/sddl"
     "fmt"
+    "sort"
     "strings"
     "strconv"
     "time"
@@ -37,6 +39,8 @@ const (
     TOKEN_SYMBOL // keyword or variable name
     TOKEN_OPEN_PAREN
     TOKEN_CLOSE_PAREN
+    TOKEN_ARITH_OP
+    TOKEN_COMMA
 )
 
 type BinaryOpEnum int
@@ -51,6 +55,17 @@ const (
     GTE
 )
 
+// Arithmetic operators, used by derived Cloud Variable expressions.
+type ArithOpEnum int
+const (
+    ADD ArithOpEnum = iota
+    SUB
+    MUL
+    DIV
+    MOD
+    POW
+)
+
 type UnaryOpEnum int
 const (
     NOT UnaryOpEnum = iota
@@ -61,9 +76,11 @@ type Token struct {
     token_type TokenTypeEnum
     binary_op BinaryOpEnum
     unary_op UnaryOpEnum
+    arith_op ArithOpEnum
     boolean_value bool
     float_value float64
     string_value string
+    units string
 }
 
 type Expression interface {
@@ -108,13 +125,15 @@ type PropertyExpression struct {
     property string
 }
 
-// An ImmediateExpression is a leaf node that contains a constant value
+// An ImmediateExpression is a leaf node that contains a constant value,
+// optionally with units (ex: "70 degrees_f").
 //
 //          |
 //         50.4
 //
 type ImmediateExpression struct {
     value cloudvar.CloudVarValue
+    units string
 }
 
 func operandTokenToExpression(tok *Token) (Expression, error) {
@@ -229,6 +248,20 @@ func stringToToken(s string) *Token {
         return &Token{ token_type: TOKEN_OPEN_PAREN }
     case s == ")":
         return &Token{ token_type: TOKEN_CLOSE_PAREN }
+    case s == ",":
+        return &Token{ token_type: TOKEN_COMMA }
+    case s == "+":
+        return &Token{ token_type: TOKEN_ARITH_OP, arith_op: ADD }
+    case s == "-":
+        return &Token{ token_type: TOKEN_ARITH_OP, arith_op: SUB }
+    case s == "*":
+        return &Token{ token_type: TOKEN_ARITH_OP, arith_op: MUL }
+    case s == "/":
+        return &Token{ token_type: TOKEN_ARITH_OP, arith_op: DIV }
+    case s == "%":
+        return &Token{ token_type: TOKEN_ARITH_OP, arith_op: MOD }
+    case s == "^":
+        return &Token{ token_type: TOKEN_ARITH_OP, arith_op: POW }
     case s == "AND", s == "&&":
         return &Token{ token_type: TOKEN_BINARY_OP, binary_op: AND }
     case s == "OR", s == "||":
@@ -251,27 +284,45 @@ func stringToToken(s string) *Token {
     }
 }
 
+// Split <expr> into tokens.  This is shared by device filters and derived
+// Cloud Variable expressions.
+//
+// Since variable names may contain '-', subtraction must be surrounded by
+// spaces: "a - b".
 func tokenize(expr string) []*Token {
     out := []*Token{}
-    tokStrings := multiSplit([]string{expr}, []string{" ", "(", ")", "\""})
-    for i, tokString := range tokStrings {
+    tokStrings := multiSplit([]string{expr}, []string{" ", "(", ")", "\"", ",", "+", "*", "/", "%", "^"})
+    for i := 0; i < len(tokStrings); i++ {
+        tokString := tokStrings[i]
 
         // Strings
         if (tokString == "\"") {
             tok := &Token{token_type: TOKEN_STRING_VALUE, string_value: ""}
             // open quote.  Scan until close quote.
-            for j := i + 1; j < len(tokStrings); j++ {
-                if tokStrings[j] == "\"" {
+            for i = i + 1; i < len(tokStrings); i++ {
+                if tokStrings[i] == "\"" {
                     break
                 }
-                tok.string_value += tokStrings[j]
+                tok.string_value += tokStrings[i]
             }
+            out = append(out, tok)
         } else {
         // All other tokens
             tok := stringToToken(tokString)
-            if tok != nil {
-                out = append(out, tok)
+            if tok == nil {
+                continue
+            }
+            // A number may be followed by units, ex: "70 degrees_f"
+            if tok.token_type == TOKEN_SYMBOL && len(out) > 0 {
+                prev := out[len(out)-1]
+                if prev.token_type == TOKEN_FLOAT_VALUE && prev.units == "" {
+                    if _, err := sddl.LookupUnit(tok.string_value); err == nil {
+                        prev.units = tok.string_value
+                        continue
+                    }
+                }
             }
+            out = append(out, tok)
         }
     }
     return out
@@ -384,7 +435,7 @@ func genExpressionTree(prefix []*Token) (Expression, []*Token, error) {
         case TOKEN_BOOLEAN_VALUE:
             expr =  &ImmediateExpression{value: token.boolean_value}
         case TOKEN_FLOAT_VALUE:
-            expr =  &ImmediateExpression{value: token.float_value}
+            expr =  &ImmediateExpression{value: token.float_value, units: token.units}
         case TOKEN_STRING_VALUE:
             expr =  &ImmediateExpression{value: token.string_value}
         case TOKEN_SYMBOL:
@@ -462,9 +513,23 @@ func (expr *BinaryOpExpression)Value(device datalayer.Device) (cloudvar.CloudVar
         }
         v0, err := expr.operand0.Value(device)
         if err != nil {
-            return false, err
+            v0, err = enumSymbolValue(device, expr.operand0, expr.operand1, err)
+            if err != nil {
+                return false, err
+            }
         }
         v1, err := expr.operand1.Value(device)
+        if err != nil {
+            v1, err = enumSymbolValue(device, expr.operand1, expr.operand0, err)
+            if err != nil {
+                return false, err
+            }
+        }
+        v0, err = valueInVarUnits(device, expr.operand0, expr.operand1, v0)
+        if err != nil {
+            return false, err
+        }
+        v1, err = valueInVarUnits(device, expr.operand1, expr.operand0, v1)
         if err != nil {
             return false, err
         }
@@ -474,6 +539,64 @@ func (expr *BinaryOpExpression)Value(device datalayer.Device) (cloudvar.CloudVar
     }
 }
 
+// Enum values are compared by name, and may be written without quotes:
+//
+//      mode = heat
+//
+// Here "heat" parses as a variable reference.  If evaluating <operand> fails
+// and it names one of the allowed values of the enum Cloud Variable
+// referenced by <other>, the name is used as a string value instead.
+// Otherwise <origErr> is returned.
+func enumSymbolValue(device datalayer.Device, operand, other Expression, origErr error) (cloudvar.CloudVarValue, error) {
+    symbol, ok := operand.(*PropertyExpression)
+    if !ok {
+        return nil, origErr
+    }
+    otherProp, ok := other.(*PropertyExpression)
+    if !ok {
+        return nil, origErr
+    }
+    varDef, err := device.LookupVarDef(otherProp.property)
+    if err != nil || varDef.Datatype() != sddl.DATATYPE_ENUM {
+        return nil, origErr
+    }
+    if sddl.EnumValueIndex(varDef, symbol.property) == -1 {
+        return nil, origErr
+    }
+    return symbol.property, nil
+}
+
+// Constants may be written with units:
+//
+//      temperature > 70 degrees_f
+//
+// If <operand> is such a constant, convert its value <value> to the units of
+// the Cloud Variable referenced by <other>.  Other values are returned
+// unchanged.
+func valueInVarUnits(device datalayer.Device, operand, other Expression, value cloudvar.CloudVarValue) (cloudvar.CloudVarValue, error) {
+    imm, ok := operand.(*ImmediateExpression)
+    if !ok || imm.units == "" {
+        return value, nil
+    }
+    prop, ok := other.(*PropertyExpression)
+    if !ok {
+        return nil, fmt.Errorf("Value with units %s must be compared to a variable", imm.units)
+    }
+    varDef, err := device.LookupVarDef(prop.property)
+    if err != nil {
+        return nil, err
+    }
+    varUnits, _ := varDef.Units()
+    if varUnits == "" {
+        return nil, fmt.Errorf("Variable %s has no units", prop.property)
+    }
+    f, ok := value.(float64)
+    if !ok {
+        return nil, fmt.Errorf("Expected numeric value with units %s", imm.units)
+    }
+    return sddl.ConvertUnits(f, imm.units, varUnits)
+}
+
 func (expr *ImmediateExpression)Value(device datalayer.Device) (cloudvar.CloudVarValue, error) {
     return expr.value, nil
 }
@@ -541,6 +664,30 @@ func (filter *DeviceFilterObj)SatisfiedBy(device datalayer.Device) (bool, error)
     return valBool, nil
 }
 
+// Collect the names of the properties referenced by <expr> into <out>.
+func collectProperties(expr Expression, out map[string]bool) {
+    switch e := expr.(type) {
+    case *BinaryOpExpression:
+        collectProperties(e.operand0, out)
+        collectProperties(e.operand1, out)
+    case *UnaryOpExpression:
+        collectProperties(e.operand, out)
+    case *PropertyExpression:
+        out[e.property] = true
+    }
+}
+
+func (filter *DeviceFilterObj)Properties() []string {
+    props := map[string]bool{}
+    collectProperties(filter.expr, props)
+    out := []string{}
+    for prop := range props {
+        out = append(out, prop)
+    }
+    sort.Strings(out)
+    return out
+}
+
 func (filter *DeviceFilterObj)Whittle(devices []datalayer.Device) ([]datalayer.Device, error) {
     out := []datalayer.Device{}
     for _, device := range devices {
@@ -571,6 +718,9 @@ func Parse(expr string) (Expression, error) {
 
     // CONVERT TO PREFIX
     prefixTokens, err := infixToPrefix(tokens)
+    if err != nil {
+        return nil, err
+    }
     fmt.Println(prefixTokens)
 
     // PARSE INTO TO FILTER TREE
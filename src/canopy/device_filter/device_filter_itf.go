@@ -34,6 +34,12 @@ type DeviceFilter interface {
 
     // Count the number of devices in a list of devices that satisfy this filter.
     CountMembers(devices []datalayer.Device) (uint32, error)
+
+    // Get the names of the Cloud Variables and device properties (ex:
+    // "system.ws_connected") referenced by the filter.  Symbols used as enum
+    // values are included too, since they can't be told apart until the
+    // filter is evaluated.
+    Properties() []string
 }
 
 func NewCompiler() Compiler {
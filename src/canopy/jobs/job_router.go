@@ -15,22 +15,28 @@
 package jobs
 
 import (
+    "canopy/canolog"
     "canopy/config"
     "canopy/mail"
+    "canopy/mailqueue"
     "canopy/datalayer/cassandra_datalayer"
     "canopy/pigeon"
     "canopy/jobs/rest"
+    "canopy/notify"
+    "canopy/rules"
+    "canopy/sms"
+    "canopy/webhooks"
 )
 
-func InitJobServer(cfg config.Config, pigeonServer jobqueue.Server) error {
+func InitJobServer(cfg config.Config, pigeonServer jobqueue.Server, pigeonOutbox jobqueue.Outbox) error {
     mailer, err := mail.NewMailClient(cfg)
     if err != nil {
         return err
     }
 
-    userCtx := map[string]interface{}{
-        "cfg" : cfg,
-        "mailer" : mailer,
+    smsClient, err := sms.NewSMSClient(cfg)
+    if err != nil {
+        return err
     }
 
     dl := cassandra_datalayer.NewDatalayer(cfg)
@@ -38,7 +44,17 @@ func InitJobServer(cfg config.Config, pigeonServer jobqueue.Server) error {
     if err != nil {
         return err
     }
-    userCtx["db-conn"] = conn
+
+    // Handlers send email through the mail queue.  Only the mail queue's
+    // worker uses the mail service directly.
+    userCtx := map[string]interface{}{
+        "cfg" : cfg,
+        "db-conn" : conn,
+        "mail-sender" : mailer,
+        "mailer" : mailqueue.NewClient(conn, pigeonOutbox),
+        "pigeon-outbox" : pigeonOutbox,
+        "sms" : smsClient,
+    }
 
     routes := map[string]jobqueue.HandlerFunc{
         "api/activate": rest.RestJobWrapper(rest.ApiActivateHandler),
@@ -47,17 +63,53 @@ func InitJobServer(cfg config.Config, pigeonServer jobqueue.Server) error {
         "GET:api/device/id": rest.RestJobWrapper(rest.GET__api__device__id),
         "POST:api/device/id": rest.RestJobWrapper(rest.POST__api__device__id),
         "DELETE:api/device/id": rest.RestJobWrapper(rest.DELETE__api__device__id),
+        "POST:api/device/self/notify": rest.RestJobWrapper(rest.POST__api__device__self__notify),
+        "api/device/id/sddl/history": rest.RestJobWrapper(rest.GET__api__device__id__sddl__history),
+        "api/device/id/alarms": rest.RestJobWrapper(rest.GET__api__device__id__alarms),
+        "api/device/id/alarms/history": rest.RestJobWrapper(rest.GET__api__device__id__alarms__history),
+        "POST:api/device/id/alarms/var/alarm/ack": rest.RestJobWrapper(rest.POST__api__device__id__alarms__var__alarm__ack),
+        "api/device/id/shares": rest.RestJobWrapper(rest.GET__api__device__id__shares),
+        "POST:api/device/id/shares/username": rest.RestJobWrapper(rest.POST__api__device__id__shares__username),
+        "DELETE:api/device/id/shares/username": rest.RestJobWrapper(rest.DELETE__api__device__id__shares__username),
         "api/device/id/var": rest.RestJobWrapper(rest.GET__api__device__id__var),
+        "POST:api/device/id/var": rest.RestJobWrapper(rest.POST__api__device__id__var),
+        "DELETE:api/device/id/var": rest.RestJobWrapper(rest.DELETE__api__device__id__var),
         "api/devices": rest.RestJobWrapper(rest.GET__api__devices),
         "api/finish_share_transaction": rest.RestJobWrapper(rest.POST__api__finish_share_transaction),
         "api/info": rest.RestJobWrapper(rest.GET__api__info),
         "api/login": rest.RestJobWrapper(rest.POST__api__login),
         "api/logout": rest.RestJobWrapper(rest.GET_POST__api__logout),
+        "GET:api/notifications": rest.RestJobWrapper(rest.GET__api__notifications),
+        "POST:api/notifications/id/dismiss": rest.RestJobWrapper(rest.POST__api__notifications__id__dismiss),
+        "POST:api/notifications/id/read": rest.RestJobWrapper(rest.POST__api__notifications__id__read),
         "GET:api/user/self": rest.RestJobWrapper(rest.GET__api__user__self),
         "POST:api/user/self": rest.RestJobWrapper(rest.POST__api__user__self),
         "DELETE:api/user/self": rest.RestJobWrapper(rest.DELETE__api__user__self),
+        "GET:api/user/self/sddl_classes": rest.RestJobWrapper(rest.GET__api__user__self__sddl_classes),
+        "POST:api/user/self/sddl_classes": rest.RestJobWrapper(rest.POST__api__user__self__sddl_classes),
+        "GET:api/user/self/sddl_classes/name": rest.RestJobWrapper(rest.GET__api__user__self__sddl_classes__name),
+        "POST:api/user/self/sddl_classes/name": rest.RestJobWrapper(rest.POST__api__user__self__sddl_classes__name),
+        "DELETE:api/user/self/sddl_classes/name": rest.RestJobWrapper(rest.DELETE__api__user__self__sddl_classes__name),
         "api/reset_password": rest.RestJobWrapper(rest.POST__api__reset_password),
         "api/share": rest.RestJobWrapper(rest.POST__api__share),
+        "GET:api/user/self/rules": rest.RestJobWrapper(rest.GET__api__user__self__rules),
+        "POST:api/user/self/rules": rest.RestJobWrapper(rest.POST__api__user__self__rules),
+        "GET:api/user/self/rules/id": rest.RestJobWrapper(rest.GET__api__user__self__rules__id),
+        "POST:api/user/self/rules/id": rest.RestJobWrapper(rest.POST__api__user__self__rules__id),
+        "DELETE:api/user/self/rules/id": rest.RestJobWrapper(rest.DELETE__api__user__self__rules__id),
+        "POST:api/user/self/phone/verify": rest.RestJobWrapper(rest.POST__api__user__self__phone__verify),
+        "GET:api/user/self/webhooks": rest.RestJobWrapper(rest.GET__api__user__self__webhooks),
+        "POST:api/user/self/webhooks": rest.RestJobWrapper(rest.POST__api__user__self__webhooks),
+        "GET:api/user/self/webhooks/id": rest.RestJobWrapper(rest.GET__api__user__self__webhooks__id),
+        "POST:api/user/self/webhooks/id": rest.RestJobWrapper(rest.POST__api__user__self__webhooks__id),
+        "DELETE:api/user/self/webhooks/id": rest.RestJobWrapper(rest.DELETE__api__user__self__webhooks__id),
+        "GET:api/user/self/webhooks/id/deliveries": rest.RestJobWrapper(rest.GET__api__user__self__webhooks__id__deliveries),
+        mailqueue.SendJobKey: mailqueue.SendHandler,
+        notify.DigestJobKey: notify.DigestHandler,
+        rest.SDDLClassChangedJobKey: rest.SDDLClassChangedHandler,
+        rules.VarChangedJobKey: rules.VarChangedHandler,
+        webhooks.EventJobKey: webhooks.EventHandler,
+        webhooks.DeliverJobKey: webhooks.DeliverHandler,
     }
 
     // Register handlers
@@ -70,5 +122,17 @@ func InitJobServer(cfg config.Config, pigeonServer jobqueue.Server) error {
         inbox.SetHandlerFunc(handler)
     }
 
+    notify.ScheduleDigests(pigeonOutbox, cfg.OptNotifyDigestHour())
+
+    err = mailqueue.Resume(conn, pigeonOutbox)
+    if err != nil {
+        canolog.Error("Could not resume mail queue: ", err)
+    }
+
+    err = webhooks.Resume(conn, pigeonOutbox)
+    if err != nil {
+        canolog.Error("Could not resume webhook deliveries: ", err)
+    }
+
     return nil
 }
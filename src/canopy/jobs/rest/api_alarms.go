@@ -0,0 +1,159 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/alarms"
+    "canopy/datalayer"
+    "canopy/sddl"
+    canotime "canopy/util/time"
+    "time"
+)
+
+// Threshold alarms are declared in a device's SDDL.  See package alarms.
+//
+//  GET /api/device/{id}/alarms
+//      Lists every declared alarm and its state.
+//  GET /api/device/{id}/alarms/history
+//      Lists alarm state changes, newest first.
+//  POST /api/device/{id}/alarms/{var}/{alarm}/ack
+//      Acknowledges an active alarm.
+
+func alarmTimeJson(t time.Time, timestamp_type string) interface{} {
+    if t.IsZero() {
+        return nil
+    } else if timestamp_type == "epoch_us" {
+        return canotime.EpochMicroseconds(t)
+    }
+    return canotime.RFC3339(t)
+}
+
+func alarmToJsonObj(alarm datalayer.Alarm, timestamp_type string) map[string]interface{} {
+    out := map[string]interface{}{
+        "var_name" : alarm.VarName(),
+        "name" : alarm.Name(),
+        "state" : datalayer.AlarmStateToString(alarm.State()),
+        "time_changed" : alarmTimeJson(alarm.TimeChanged(), timestamp_type),
+        "pending_since" : alarmTimeJson(alarm.PendingSince(), timestamp_type),
+    }
+    if alarm.State() != datalayer.AlarmNormal {
+        out["value"] = alarm.Value()
+    }
+    if alarm.AcknowledgedBy() != "" {
+        out["acknowledged_by"] = alarm.AcknowledgedBy()
+    }
+    return out
+}
+
+func GET__api__device__id__alarms(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpRead)
+    if device == nil {
+        return nil, restErr
+    }
+
+    timestamp_type := timestampTypeParam(info)
+    alarmsJson := []interface{}{}
+    for _, varDef := range alarms.AlarmVars(device.SDDLDocument()) {
+        for _, def := range varDef.Alarms() {
+            alarm, err := device.Alarm(varDef.Fullname(), def.Name())
+            if err != nil {
+                return nil, InternalServerError("Fetching alarm: " + err.Error()).Log()
+            }
+            alarmsJson = append(alarmsJson, alarmToJsonObj(alarm, timestamp_type))
+        }
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "device_id" : device.ID().String(),
+        "alarms" : alarmsJson,
+    }, nil
+}
+
+func GET__api__device__id__alarms__history(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpRead)
+    if device == nil {
+        return nil, restErr
+    }
+
+    events, err := device.AlarmHistory()
+    if err != nil {
+        return nil, InternalServerError("Fetching alarm history: " + err.Error()).Log()
+    }
+
+    timestamp_type := timestampTypeParam(info)
+    history := []interface{}{}
+    for _, event := range events {
+        eventJson := map[string]interface{}{
+            "var_name" : event.VarName,
+            "name" : event.AlarmName,
+            "state" : datalayer.AlarmStateToString(event.State),
+            "time" : alarmTimeJson(event.Time, timestamp_type),
+        }
+        if event.State == datalayer.AlarmAcknowledged {
+            eventJson["acknowledged_by"] = event.Username
+        } else {
+            eventJson["value"] = event.Value
+        }
+        history = append(history, eventJson)
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "device_id" : device.ID().String(),
+        "history" : history,
+    }, nil
+}
+
+// Only users can acknowledge alarms, and only active alarms can be
+// acknowledged.
+func POST__api__device__id__alarms__var__alarm__ack(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpWrite)
+    if device == nil {
+        return nil, restErr
+    }
+
+    varDef, err := device.LookupVarDef(info.URLVars["var"])
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+    var def *sddl.AlarmDef
+    for _, d := range varDef.Alarms() {
+        if d.Name() == info.URLVars["alarm"] {
+            def = d
+        }
+    }
+    if def == nil {
+        return nil, URLNotFoundError()
+    }
+
+    alarm, err := device.Alarm(varDef.Fullname(), def.Name())
+    if err != nil {
+        return nil, InternalServerError("Fetching alarm: " + err.Error()).Log()
+    }
+    if alarm.State() != datalayer.AlarmActive {
+        return nil, BadInputError("Alarm is not active")
+    }
+    err = alarm.SetState(datalayer.AlarmAcknowledged, alarm.Value(), time.Now().UTC(), info.Account.Username())
+    if err != nil {
+        return nil, InternalServerError("Acknowledging alarm: " + err.Error()).Log()
+    }
+
+    out := alarmToJsonObj(alarm, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
@@ -41,6 +41,21 @@ func ApiCreateDevicesHandler(info *RestRequestInfo, sideEffects *RestSideEffects
         return nil, BadInputError("Incorrect number of friendly_names provided")
     }
 
+    // Optionally, all new devices share one of the account's SDDL classes.
+    var class datalayer.SDDLClass
+    _, ok = info.BodyObj["sddl_class"]
+    if ok {
+        className, ok := info.BodyObj["sddl_class"].(string)
+        if !ok {
+            return nil, BadInputError("String \"sddl_class\" expected")
+        }
+        var err error
+        class, err = info.Account.SDDLClass(className)
+        if err != nil {
+            return nil, BadInputError("SDDL class not found: " + className)
+        }
+    }
+
     out := map[string]interface{} {
         "result" : "ok",
         "count" : quantity,
@@ -62,6 +77,22 @@ func ApiCreateDevicesHandler(info *RestRequestInfo, sideEffects *RestSideEffects
             return nil, InternalServerError("Error setting device permissions")
         }
 
+        // New devices inherit the account's policy for undeclared vars
+        policy := info.Account.DefaultVarDeclPolicy()
+        if policy != datalayer.VarDeclPolicyUnset {
+            err = device.SetVarDeclPolicy(policy)
+            if err != nil {
+                return nil, InternalServerError("Error setting device var_decl_policy")
+            }
+        }
+
+        if class != nil {
+            err = device.SetSDDLClass(class, datalayer.SDDLOriginUser)
+            if err != nil {
+                return nil, InternalServerError("Error setting device sddl_class")
+            }
+        }
+
         devicesSlice, ok := out["devices"].([]interface{})
         out["devices"] = append(devicesSlice, map[string]interface{} {
             "friendly_name" : device.Name(),
@@ -71,27 +71,14 @@ func ApiCreateUserHandler(info *RestRequestInfo, sideEffect *RestSideEffects) (m
 
     sideEffect.SetCookie("logged_in_username", username)
 
-    protocol := "http://"
-    if info.Config.OptEnableHTTPS() {
-        protocol = "https://"
-    }
-
-    activationLink := protocol + info.Config.OptHostname() + 
-            "/mgr/activate.html?username=" + account.Username() + 
-            "&code=" + account.ActivationCode()
-
     // Send email
     if !skipEmail {
         msg := sideEffect.SendEmail()
         msg.AddTo(account.Email(), account.Username())
         msg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
         msg.SetReplyTo("no-reply@canopy.link")
-        messages.MailMessageCreatedAccount(msg,
-            account.Username(), 
-            activationLink,
-            protocol + info.Config.OptHostname(),
-            info.Config.OptHostname(),
-        )
+        messages.MailMessageCreatedAccount(msg, info.Config, account,
+            messages.ActivationLink(info.Config, account))
     }
 
     out := map[string]interface{} {
@@ -17,56 +17,63 @@ import (
     "canopy/canolog"
     "canopy/cloudvar"
     "canopy/datalayer"
+    "canopy/device_filter"
+    "canopy/rules"
     "canopy/sddl"
+    "canopy/webhooks"
     "github.com/gocql/gocql"
     "time"
 )
 
 // Lookup device by ID string in the URL.  The ID string may be a UUID or
-// "self".  Verifies that the requester has permission to access to the
-// requested device, returning an error if unathorized.
-func getDeviceByIdString(info *RestRequestInfo) (datalayer.Device, RestError) {
-    deviceIdString := info.URLVars["id"]
+// "self".  Verifies that the requester has permission to perform <op> on
+// the requested device, returning an error if unathorized.
+func getDeviceByIdString(info *RestRequestInfo, op datalayer.DeviceOp) (datalayer.Device, RestError) {
+    return lookupDeviceForOp(info, info.URLVars["id"], op)
+}
+
+// Lookup device by ID string, which may be a UUID or "self", and verify that
+// the requester has permission to perform <op> on it.
+func lookupDeviceForOp(info *RestRequestInfo, deviceIdString string, op datalayer.DeviceOp) (datalayer.Device, RestError) {
+    var device datalayer.Device
 
     if deviceIdString == "self" {
         if info.Device == nil {
             // TODO: should be unauthorized
             return nil, BadInputError("Expected device credentials with /api/device/self").Log()
         }
-        return info.Device, nil
+        device = info.Device
     } else {
         uuid, err := gocql.ParseUUID(deviceIdString)
         if err != nil {
             return nil, URLNotFoundError()
         }
 
-        // TODO: support anonymous device creation
-
-        if info.Account != nil {
-            device, err := info.Account.Device(uuid)
-            if err != nil {
-                // TODO: What errors to return here?
-                return nil, InternalServerError("Device lookup failed").Log()
-            }
-            return device, nil
-        } else if info.Device != nil {
-            if deviceIdString != string(info.Device.IDString()) {
-                // TODO: what error to return?
-                // TODO: This should be allowed if the device has adequate
-                // permissions.
-                return nil, InternalServerError("Device mismatch").Log()
-            }
-            return info.Device, nil
-        } else {
+        // Don't reveal whether the device exists to anonymous requesters
+        // unless they could have access to it.
+        if info.Account == nil && info.Device == nil && !info.Config.OptAllowAnonDevices() {
             return nil, NotLoggedInError()
         }
+
+        device, err = info.Conn.LookupDevice(uuid)
+        if err == gocql.ErrNotFound {
+            return nil, URLNotFoundError()
+        } else if err != nil {
+            return nil, InternalServerError("Device lookup failed: " + err.Error()).Log()
+        }
+    }
+
+    restErr := authorizeDeviceOp(info, device, op)
+    if restErr != nil {
+        return nil, restErr
     }
+    return device, nil
 }
 
 func GET__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
     var err error
 
-    device, restErr := getDeviceByIdString(info)
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpRead)
     if device == nil {
         return nil, restErr
     }
@@ -77,7 +84,12 @@ func GET__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (m
         timestamp_type = "rfc3339"
     }
 
-    out, err := deviceToJsonObj(device, timestamp_type)
+    units, restErr := unitsParam(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    out, err := deviceToJsonObj(device, timestamp_type, units)
     if err != nil {
         return nil, InternalServerError("Generating JSON")
     }
@@ -89,11 +101,13 @@ func GET__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (m
 func POST__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
     var err error
 
-    device, restErr := getDeviceByIdString(info)
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpWrite)
     if device == nil {
         return nil, restErr
     }
 
+    sddlVersion := device.SDDLVersion()
+
     // Check for SDDL doc.  If it doesn't exist, then create it.
     // TODO: should this only be done if the device is reporting?
     doc := device.SDDLDocument()
@@ -101,7 +115,7 @@ func POST__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (
         // Create SDDL for the device if it doesn't exist.
         // TODO: should this be automatically done by device.SDDLClass()?
         newDoc := sddl.Sys.NewEmptyDocument()
-        err := device.SetSDDLDocument(newDoc)
+        err := device.SetSDDLDocument(newDoc, datalayer.SDDLOriginUser)
         if (err != nil) {
             return nil, InternalServerError("Setting new SDDL document").Log()
         }
@@ -123,12 +137,45 @@ func POST__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (
                 continue;
             }
             device.SetLocationNote(locationNote);
+        case "var_decl_policy":
+            policyString, ok := value.(string)
+            if !ok {
+                return nil, BadInputError("Expected string \"var_decl_policy\"")
+            }
+            policy, err := datalayer.VarDeclPolicyFromString(policyString)
+            if err != nil {
+                return nil, BadInputError(err.Error())
+            }
+            err = device.SetVarDeclPolicy(policy)
+            if err != nil {
+                return nil, InternalServerError("Setting var_decl_policy").Log()
+            }
+        case "sddl_class":
+            className, ok := value.(string)
+            if !ok {
+                return nil, BadInputError("Expected string \"sddl_class\"")
+            }
+            // An empty name removes the device from its class.
+            var class datalayer.SDDLClass
+            if className != "" {
+                if info.Account == nil {
+                    return nil, NotLoggedInError()
+                }
+                class, err = info.Account.SDDLClass(className)
+                if err != nil {
+                    return nil, BadInputError("SDDL class not found: " + className)
+                }
+            }
+            err = device.SetSDDLClass(class, datalayer.SDDLOriginUser)
+            if err != nil {
+                return nil, InternalServerError("Setting sddl_class").Log()
+            }
         case "var_decls":
             sddlJsonObj, ok := value.(map[string]interface{})
             if !ok {
                 return nil, BadInputError("Expected object \"var_decls\"")
             }
-            err = device.ExtendSDDL(sddlJsonObj)
+            err = device.ExtendSDDL(sddlJsonObj, datalayer.SDDLOriginUser)
             if err != nil {
                 return nil, BadInputError(err.Error())
             }
@@ -136,6 +183,8 @@ func POST__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (
     }
 
     // Handle vars last
+    warnings := []cloudvar.ValidationWarning{}
+    updated := []string{}
     for fieldName, value := range info.BodyObj {
         switch fieldName {
         case "vars":
@@ -147,38 +196,84 @@ func POST__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (
                 varDef, err := device.LookupVarDef(varName)
                 if err != nil {
                     canolog.Warn("Cloud variable not found: ", varName)
-                    /* TODO: Report warning in response*/
+                    warnings = append(warnings, cloudvar.ValidationWarning{
+                        VarName: varName,
+                        Problem: "not_found",
+                        Action: "rejected",
+                        Msg: "Cloud variable not found: " + varName,
+                    })
+                    continue;
+                }
+                if varDef.Expression() != "" {
+                    warnings = append(warnings, cloudvar.ValidationWarning{
+                        VarName: varName,
+                        Problem: "derived_variable",
+                        Action: "rejected",
+                        Msg: varName + " is derived from other variables and cannot be set",
+                    })
                     continue;
                 }
 
-                varVal, err := cloudvar.JsonToCloudVarValue(varDef, valueJsonObj)
-                if err != nil {
-                    canolog.Warn("Cloud variable value parsing problem: ", varName, err)
-                    /* TODO: Report warning in response*/
+                varVal, varWarnings, accepted := cloudvar.JsonToValidatedCloudVarValue(varDef, valueJsonObj)
+                for _, warning := range varWarnings {
+                    canolog.Warn("Cloud variable value problem: ", warning.Msg)
+                }
+                warnings = append(warnings, varWarnings...)
+                if !accepted {
                     continue;
                 }
-                device.InsertSample(varDef, time.Now(), varVal);
+                err = device.InsertSample(varDef, time.Now(), varVal);
+                if err != nil {
+                    return nil, InternalServerError("Inserting sample: " + err.Error()).Log()
+                }
+                updated = append(updated, varDef.Fullname())
             }
         }
     }
 
+    // Recompute derived Cloud Variables whose inputs changed.
+    derivedUpdated, derivedWarnings, err := device_filter.UpdateDerivedVars(device, updated)
+    if err != nil {
+        return nil, InternalServerError("Updating derived variables: " + err.Error()).Log()
+    }
+    warnings = append(warnings, derivedWarnings...)
+    updated = append(updated, derivedUpdated...)
+
+    // Re-evaluate rules that depend on the changed Cloud Variables.
+    err = rules.LaunchVarChanged(info.PigeonOutbox, device.ID(), updated)
+    if err != nil {
+        canolog.Error("Error launching rule evaluation: ", err)
+    }
+
+    if device.SDDLVersion() != sddlVersion {
+        err = webhooks.LaunchEvent(info.PigeonOutbox, device.ID(), webhooks.EventSDDLChange, map[string]interface{}{
+            "version" : device.SDDLVersion(),
+        })
+        if err != nil {
+            canolog.Error("Error launching webhook delivery: ", err)
+        }
+    }
+
     timestamps := info.Query["timestamps"]
     timestamp_type := "epoch_us"
     if timestamps != nil && timestamps[0] == "rfc3339" {
         timestamp_type = "rfc3339"
     }
 
-    out, err := deviceToJsonObj(device, timestamp_type)
+    out, err := deviceToJsonObj(device, timestamp_type, nil)
     if err != nil {
         return nil, InternalServerError("Generating JSON")
     }
     out["result"] = "ok"
+    if len(warnings) > 0 {
+        out["warnings"] = cloudvar.ValidationWarningsToJson(warnings)
+    }
     return out, nil
 }
 
 // Delete device
 func DELETE__api__device__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
-    device, restErr := getDeviceByIdString(info)
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpDelete)
     if device == nil {
         return nil, restErr
     }
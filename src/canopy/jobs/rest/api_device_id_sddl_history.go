@@ -0,0 +1,68 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/datalayer"
+    canotime "canopy/util/time"
+)
+
+// Lists every recorded version of a device's SDDL document, oldest first.
+func GET__api__device__id__sddl__history(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpRead)
+    if device == nil {
+        return nil, restErr
+    }
+
+    timestamps := info.Query["timestamps"]
+    timestamp_type := "epoch_us"
+    if timestamps != nil && timestamps[0] == "rfc3339" {
+        timestamp_type = "rfc3339"
+    }
+
+    revisions, err := device.SDDLHistory()
+    if err != nil {
+        return nil, InternalServerError("Could not obtain SDDL history: " + err.Error()).Log()
+    }
+
+    history := []interface{}{}
+    for _, rev := range revisions {
+        revJson := map[string]interface{}{
+            "version" : rev.Version(),
+            "origin" : datalayer.SDDLOriginToString(rev.Origin()),
+        }
+        if timestamp_type == "epoch_us" {
+            revJson["time"] = canotime.EpochMicroseconds(rev.Timestamp())
+        } else {
+            revJson["time"] = canotime.RFC3339(rev.Timestamp())
+        }
+
+        doc, err := rev.Document()
+        if err != nil {
+            // Keep the raw text so that unparseable versions are still
+            // visible.
+            revJson["sddl_text"] = rev.DocumentString()
+        } else {
+            revJson["sddl"] = doc.Json()
+        }
+        history = append(history, revJson)
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "device_id" : device.ID().String(),
+        "current_version" : device.SDDLVersion(),
+        "history" : history,
+    }, nil
+}
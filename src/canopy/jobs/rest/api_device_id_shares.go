@@ -0,0 +1,248 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/datalayer"
+)
+
+// The accounts that have access to a device.  New accounts are invited with
+// POST /api/share.
+//
+//  GET /api/device/{id}/shares
+//      Lists the accounts with access to the device.  Requires sharing
+//      permission.
+//  POST /api/device/{id}/shares/{username}
+//      Changes an account's "access_level" and/or "sharing_level".
+//      Requires revoke permission.
+//  DELETE /api/device/{id}/shares/{username}
+//      Revokes an account's access.  Requires revoke permission, except
+//      when removing your own access.
+//
+// Nobody can grant more than they have, or change the permissions of an
+// account with more access than themselves.  Only owners (read-write access
+// with revoke permission) can change or remove another owner, and a device's
+// last owner can't be removed or downgraded, even by themselves.
+
+// Get the device for a shares request, and the logged-in account's
+// permissions for it.  Verifies that the account may perform <op>.
+func getSharedDevice(info *RestRequestInfo, op datalayer.DeviceOp) (datalayer.Device, datalayer.AccessLevel, datalayer.ShareLevel, RestError) {
+    if info.Account == nil {
+        return nil, datalayer.NoAccess, datalayer.NoSharing, NotLoggedInError()
+    }
+    device, restErr := getDeviceByIdString(info, op)
+    if device == nil {
+        return nil, datalayer.NoAccess, datalayer.NoSharing, restErr
+    }
+    access, sharing, err := device.AccountAccess(info.Account)
+    if err != nil {
+        return nil, datalayer.NoAccess, datalayer.NoSharing, InternalServerError("Looking up permissions: " + err.Error()).Log()
+    }
+    return device, access, sharing, nil
+}
+
+// Get the permissions of account <username> for <device>.  Returns nil if
+// the account has no access.
+func lookupSharePermission(device datalayer.Device, username string) (*datalayer.DevicePermission, error) {
+    perms, err := device.Permissions()
+    if err != nil {
+        return nil, err
+    }
+    for _, perm := range perms {
+        if perm.Account.Username() == username {
+            return &perm, nil
+        }
+    }
+    return nil, nil
+}
+
+// Count the owners in <perms>.
+func countOwners(perms []datalayer.DevicePermission) int {
+    count := 0
+    for _, perm := range perms {
+        if datalayer.IsDeviceOwner(perm.AccessLevel, perm.ShareLevel) {
+            count++
+        }
+    }
+    return count
+}
+
+// Check that removing <perm>'s owner status, if it has any, leaves <device>
+// with another owner.
+func checkKeepsOwner(device datalayer.Device, perm *datalayer.DevicePermission) RestError {
+    if !datalayer.IsDeviceOwner(perm.AccessLevel, perm.ShareLevel) {
+        return nil
+    }
+    perms, err := device.Permissions()
+    if err != nil {
+        return InternalServerError("Fetching permissions: " + err.Error()).Log()
+    }
+    if countOwners(perms) <= 1 {
+        return BadInputError("Cannot remove the device's last owner")
+    }
+    return nil
+}
+
+func sharePermissionToJsonObj(perm datalayer.DevicePermission) map[string]interface{} {
+    return map[string]interface{}{
+        "username" : perm.Account.Username(),
+        "access_level" : datalayer.AccessLevelToString(perm.AccessLevel),
+        "sharing_level" : datalayer.ShareLevelToString(perm.ShareLevel),
+    }
+}
+
+func GET__api__device__id__shares(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    device, _, _, restErr := getSharedDevice(info, datalayer.DeviceOpShare)
+    if device == nil {
+        return nil, restErr
+    }
+
+    perms, err := device.Permissions()
+    if err != nil {
+        return nil, InternalServerError("Fetching permissions: " + err.Error()).Log()
+    }
+    sharesJson := []interface{}{}
+    for _, perm := range perms {
+        sharesJson = append(sharesJson, sharePermissionToJsonObj(perm))
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "device_id" : device.ID().String(),
+        "shares" : sharesJson,
+    }, nil
+}
+
+func POST__api__device__id__shares__username(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    device, myAccess, mySharing, restErr := getSharedDevice(info, datalayer.DeviceOpRevoke)
+    if device == nil {
+        return nil, restErr
+    }
+
+    perm, err := lookupSharePermission(device, info.URLVars["username"])
+    if err != nil {
+        return nil, InternalServerError("Fetching permissions: " + err.Error()).Log()
+    }
+    if perm == nil {
+        return nil, BadInputError("Account does not have access to this device")
+    }
+    if perm.AccessLevel > myAccess {
+        return nil, ForbiddenError("Cannot change access of an account with more access than you")
+    }
+    wasOwner := datalayer.IsDeviceOwner(perm.AccessLevel, perm.ShareLevel)
+    if wasOwner && !datalayer.IsDeviceOwner(myAccess, mySharing) {
+        return nil, ForbiddenError("Only owners can change the access of an owner")
+    }
+
+    access := perm.AccessLevel
+    if _, ok := info.BodyObj["access_level"]; ok {
+        accessString, ok := info.BodyObj["access_level"].(string)
+        if !ok {
+            return nil, BadInputError("String \"access_level\" expected")
+        }
+        access, err = datalayer.AccessLevelFromString(accessString)
+        if err != nil {
+            return nil, BadInputError(err.Error())
+        }
+        if access == datalayer.NoAccess {
+            return nil, BadInputError("Use DELETE to revoke access")
+        }
+    }
+
+    sharing := perm.ShareLevel
+    if _, ok := info.BodyObj["sharing_level"]; ok {
+        sharingString, ok := info.BodyObj["sharing_level"].(string)
+        if !ok {
+            return nil, BadInputError("String \"sharing_level\" expected")
+        }
+        sharing, err = datalayer.ShareLevelFromString(sharingString)
+        if err != nil {
+            return nil, BadInputError(err.Error())
+        }
+    }
+
+    if access > myAccess {
+        return nil, ForbiddenError("Cannot grant more access than you have")
+    }
+    if wasOwner && !datalayer.IsDeviceOwner(access, sharing) {
+        restErr = checkKeepsOwner(device, perm)
+        if restErr != nil {
+            return nil, restErr
+        }
+    }
+
+    err = device.SetAccountAccess(perm.Account, access, sharing)
+    if err != nil {
+        return nil, InternalServerError("Changing access: " + err.Error()).Log()
+    }
+    perm.AccessLevel = access
+    perm.ShareLevel = sharing
+
+    out := sharePermissionToJsonObj(*perm)
+    out["result"] = "ok"
+    out["device_id"] = device.ID().String()
+    return out, nil
+}
+
+func DELETE__api__device__id__shares__username(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    // Anyone with access can remove themselves.
+    device, myAccess, mySharing, restErr := getSharedDevice(info, datalayer.DeviceOpRead)
+    if device == nil {
+        return nil, restErr
+    }
+
+    username := info.URLVars["username"]
+    self := (username == info.Account.Username())
+    if !self {
+        restErr = authorizeDeviceOp(info, device, datalayer.DeviceOpRevoke)
+        if restErr != nil {
+            return nil, restErr
+        }
+    }
+    perm, err := lookupSharePermission(device, username)
+    if err != nil {
+        return nil, InternalServerError("Fetching permissions: " + err.Error()).Log()
+    }
+    if perm == nil {
+        if self {
+            // Nothing to remove.
+            return map[string]interface{}{
+                "result" : "ok",
+            }, nil
+        }
+        return nil, BadInputError("Account does not have access to this device")
+    }
+    if !self {
+        if perm.AccessLevel > myAccess {
+            return nil, ForbiddenError("Cannot revoke access of an account with more access than you")
+        }
+        if datalayer.IsDeviceOwner(perm.AccessLevel, perm.ShareLevel) &&
+                !datalayer.IsDeviceOwner(myAccess, mySharing) {
+            return nil, ForbiddenError("Only owners can revoke the access of an owner")
+        }
+    }
+    restErr = checkKeepsOwner(device, perm)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    err = device.RevokeAccountAccess(username)
+    if err != nil {
+        return nil, InternalServerError("Revoking access: " + err.Error()).Log()
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+    }, nil
+}
@@ -16,48 +16,17 @@
 package rest
 
 import (
+    "canopy/cloudvar"
     "canopy/datalayer"
-    "github.com/gocql/gocql"
     "time"
 )
 
 func GET__api__device__id__var(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
-    deviceIdString := info.URLVars["id"]
-    sensorName := info.URLVars["var"]
-    authorized := false;
-    var device datalayer.Device
-
-    uuid, err := gocql.ParseUUID(deviceIdString)
-    if err != nil {
-        return nil, URLNotFoundError()
-    }
-
-    //if info.Config.OptAllowAnonDevices() && device.PublicAccessLevel() > datalayer.NoAccess {
-        device, err = info.Conn.LookupDevice(uuid)
-        if err != nil {
-            // TODO: What errors to return here?
-            return nil, InternalServerError("Device lookup failed")
-        }
-        authorized = true
-    //} else {
-    // TODO: fix anon devices
-    if info.Account == nil {
-        return nil, NotLoggedInError()
-    }
-
-    device, err = info.Account.Device(uuid)
-    if err != nil {
-        // TODO: What errors to return here?
-        return nil, InternalServerError("Device lookup failed")
-    }
-
-    authorized = true
-    //}
-
-    if !authorized {
-        // TODO: What is the correct error for this?
-        return nil, URLNotFoundError()
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpRead)
+    if device == nil {
+        return nil, restErr
     }
+    sensorName := info.URLVars["var"]
 
     doc := device.SDDLDocument()
     if doc == nil {
@@ -69,6 +38,11 @@ func GET__api__device__id__var(info *RestRequestInfo, sideEffect *RestSideEffect
         return nil, URLNotFoundError()
     }
 
+    units, restErr := unitsParam(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
     samples, err := device.HistoricData(varDef, time.Now(), time.Now().Add(-59*time.Minute), time.Now())
     if err != nil {
         return nil, InternalServerError("Could not obtain sample data: " + err.Error())
@@ -79,11 +53,142 @@ func GET__api__device__id__var(info *RestRequestInfo, sideEffect *RestSideEffect
     out["result"] = "ok"
     out["samples"] = []interface{}{}
     for _, sample := range samples {
+        value, varUnits := valueInUnits(varDef, sample.Value, units)
+        if varUnits != "" {
+            out["units"] = varUnits
+        }
         out["samples"] = append(out["samples"].([]interface{}), map[string]interface{}{
             "t" : sample.Timestamp.Format(time.RFC3339),
-            "v" : sample.Value,
+            "v" : cloudvar.CloudVarValueToJson(value),
         })
     }
 
     return out, nil
 }
+
+// Is the "dry_run" option set, either as a query parameter or in the request
+// body?
+func dryRunRequested(info *RestRequestInfo) (bool, RestError) {
+    dryRunParam := info.Query["dry_run"]
+    if dryRunParam != nil && (dryRunParam[0] == "1" || dryRunParam[0] == "true") {
+        return true, nil
+    }
+    dryRunItf, ok := info.BodyObj["dry_run"]
+    if !ok {
+        return false, nil
+    }
+    dryRun, ok := dryRunItf.(bool)
+    if !ok {
+        return false, BadInputError("Expected boolean \"dry_run\"")
+    }
+    return dryRun, nil
+}
+
+func varDataReportToJsonObj(report *datalayer.VarDataReport, dryRun bool) map[string]interface{} {
+    varNames := []interface{}{}
+    for _, varName := range report.VarNames {
+        varNames = append(varNames, varName)
+    }
+    return map[string]interface{}{
+        "result" : "ok",
+        "dry_run" : dryRun,
+        "var_names" : varNames,
+        "buckets" : report.Buckets,
+        "samples" : report.Samples,
+    }
+}
+
+func varChangeError(err error) RestError {
+    switch err.(type) {
+    case *datalayer.ValidationError:
+        return BadInputError(err.Error())
+    }
+    return InternalServerError(err.Error()).Log()
+}
+
+// Removes a Cloud Variable and purges its stored samples.  Fails while a
+// rule or webhook still refers to it.
+func DELETE__api__device__id__var(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpWrite)
+    if device == nil {
+        return nil, restErr
+    }
+
+    varName := info.URLVars["var"]
+    _, err := device.LookupVarDef(varName)
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+
+    dryRun, restErr := dryRunRequested(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    report, err := device.RemoveVar(varName, dryRun)
+    if err != nil {
+        return nil, varChangeError(err)
+    }
+    return varDataReportToJsonObj(report, dryRun), nil
+}
+
+// Renames a Cloud Variable:
+//
+//  {
+//      "rename_to" : "indoor_temperature",
+//      "data" : "migrate",     // or "purge"
+//      "dry_run" : false
+//  }
+//
+// Fails while a rule or webhook still refers to the old name, and data can
+// only be migrated if the Cloud Variable's datatype has never changed.
+func POST__api__device__id__var(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    device, restErr := getDeviceByIdString(info, datalayer.DeviceOpWrite)
+    if device == nil {
+        return nil, restErr
+    }
+
+    varName := info.URLVars["var"]
+    _, err := device.LookupVarDef(varName)
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+
+    newName, ok := info.BodyObj["rename_to"].(string)
+    if !ok || newName == "" {
+        return nil, BadInputError("String \"rename_to\" expected")
+    }
+
+    migrate := true
+    dataItf, ok := info.BodyObj["data"]
+    if ok {
+        data, _ := dataItf.(string)
+        switch data {
+        case "migrate":
+            migrate = true
+        case "purge":
+            migrate = false
+        default:
+            return nil, BadInputError("\"data\" must be \"migrate\" or \"purge\"")
+        }
+    }
+
+    dryRun, restErr := dryRunRequested(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    report, err := device.RenameVar(varName, newName, migrate, dryRun)
+    if err != nil {
+        return nil, varChangeError(err)
+    }
+
+    out := varDataReportToJsonObj(report, dryRun)
+    out["renamed_to"] = newName
+    if migrate {
+        out["data"] = "migrate"
+    } else {
+        out["data"] = "purge"
+    }
+    return out, nil
+}
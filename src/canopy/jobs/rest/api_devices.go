@@ -16,7 +16,6 @@
 package rest
 
 import (
-    "strconv"
     "strings"
 )
 
@@ -41,22 +40,9 @@ func GET__api__devices(info *RestRequestInfo, sideEffects *RestSideEffects) (map
         return nil, InternalServerError("Error determining device count: " + err.Error())
     }
 
-    limit := info.Query["limit"]
-    start := int64(0)
-    count := int64(-1)
-    if limit != nil {
-        limitStrings := strings.Split(limit[0], ",")
-        if len(limitStrings) != 2 {
-            return nil, BadInputError("Expected \"start,count\" for \"limit\"")
-        }
-        start, err = strconv.ParseInt(limitStrings[0], 10, 32)
-        if err != nil {
-            return nil, BadInputError("Expected int for limit start")
-        }
-        count, err = strconv.ParseInt(limitStrings[1], 10, 32)
-        if err != nil {
-            return nil, BadInputError("Expected int for limit count")
-        }
+    start, count, restErr := limitParam(info)
+    if restErr != nil {
+        return nil, restErr
     }
 
     sort := info.Query["sort"]
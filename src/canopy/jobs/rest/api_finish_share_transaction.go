@@ -21,35 +21,45 @@ func POST__api__finish_share_transaction(info *RestRequestInfo, sideEffect *Rest
     /*
      *  POST
      *  {
-     *      "device_id" : <DEVICE_ID>,
+     *      "token" : <SHARE_TOKEN>,
      *  }
      *
+     * Accepts a share invitation sent by POST /api/share, granting the
+     * logged-in account the access and sharing levels it carries.  Each
+     * token can only be used once, and only by the activated account whose
+     * email address the invitation was sent to.
+     *
      * TODO: Add to REST API documentation
-     * TODO: Highly insecure!!!
      */
-    deviceId, ok := info.BodyObj["device_id"].(string)
-    if !ok {
-        return nil, BadInputError("String \"device_id\" expected")
-    }
-
     if info.Account == nil {
         return nil, NotLoggedInError()
     }
 
-    device, err := info.Conn.LookupDeviceByStringID(deviceId)
+    token, ok := info.BodyObj["token"].(string)
+    if !ok {
+        return nil, BadInputError("String \"token\" expected")
+    }
+
+    device, _, err := info.Conn.AcceptShareInvitation(token, info.Account)
     if err != nil {
-        // TODO: return proper error
-        return nil, InternalServerError("Looking up device")
+        switch err.(type) {
+        case *datalayer.ValidationError:
+            return nil, BadInputError(err.Error())
+        default:
+            return nil, InternalServerError("Could not grant access")
+        }
     }
 
-    /* Grant permissions to the user to access the device */
-    err = device.SetAccountAccess(info.Account, datalayer.ReadWriteAccess, datalayer.ShareRevokeAllowed)
+    access, sharing, err := device.AccountAccess(info.Account)
     if err != nil {
-        return nil, InternalServerError("Could not grant access")
+        return nil, InternalServerError("Looking up permissions")
     }
 
     return map[string]interface{} {
         "result" : "ok",
+        "device_id" : device.ID().String(),
         "device_friendly_name" : device.Name(),
+        "access_level" : datalayer.AccessLevelToString(access),
+        "sharing_level" : datalayer.ShareLevelToString(sharing),
     }, nil
 }
@@ -0,0 +1,265 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/datalayer"
+    "canopy/notify"
+    canotime "canopy/util/time"
+    "sort"
+    "time"
+)
+
+// Notifications are raised by devices and delivered to every account with
+// access to the device.  See package notify.
+//
+//  POST /api/device/self/notify
+//      {"msg" : "Filter needs replacing", "notify_type" : "med-priority"}
+//      Device credentials required.  "notify_type" defaults to "in-app".
+//  GET /api/notifications
+//      Lists notifications from all of the account's devices, newest first.
+//      "paging" : {"more" : true} if there are more to fetch.
+//      Query parameters:
+//          limit=start,count       Paging.  Count defaults to 100.
+//          min_priority=med        Only notifications of at least this
+//                                  priority (low, med or high).
+//          dismissed=true          Include dismissed notifications.
+//  POST /api/notifications/{id}/dismiss
+//      Dismisses the notification for every account.  Requires read-write
+//      access to the device.
+//  POST /api/notifications/{id}/read
+//      Marks the notification as read by the account.
+
+// Number of notifications listed when no count is requested.
+const defaultNotificationsPage = 100
+
+type notificationsByTime []datalayer.Notification
+
+func (notes notificationsByTime) Len() int {
+    return len(notes)
+}
+
+func (notes notificationsByTime) Less(i, j int) bool {
+    return notes[i].Datetime().After(notes[j].Datetime())
+}
+
+func (notes notificationsByTime) Swap(i, j int) {
+    notes[i], notes[j] = notes[j], notes[i]
+}
+
+// Get up to <limit> of the newest notifications of <device> for which <keep>
+// returns true.  Notifications are fetched in batches, so that only as many
+// are read as needed.
+func recentNotifications(device datalayer.Device, limit int, keep func(datalayer.Notification) bool) ([]datalayer.Notification, error) {
+    out := []datalayer.Notification{}
+    before := time.Time{}
+    for len(out) < limit {
+        batch, err := device.NotificationsBefore(before, limit)
+        if err != nil {
+            return nil, err
+        }
+        for _, note := range batch {
+            if keep(note) && len(out) < limit {
+                out = append(out, note)
+            }
+        }
+        if len(batch) < limit {
+            break
+        }
+        before = batch[len(batch) - 1].Datetime()
+    }
+    return out, nil
+}
+
+func notificationToJsonObj(note datalayer.Notification, device datalayer.Device, read bool, timestamp_type string) map[string]interface{} {
+    out := map[string]interface{}{
+        "id" : note.ID(),
+        "device_id" : device.ID().String(),
+        "device_name" : device.Name(),
+        "msg" : note.Msg(),
+        "notify_type" : notify.NotifyTypeToString(note.NotifyType()),
+        "priority" : datalayer.NotificationPriorityToString(notify.Priority(note.NotifyType())),
+        "dismissed" : note.IsDismissed(),
+        "read" : read,
+    }
+    if timestamp_type == "epoch_us" {
+        out["time"] = canotime.EpochMicroseconds(note.Datetime())
+    } else {
+        out["time"] = canotime.RFC3339(note.Datetime())
+    }
+    return out
+}
+
+// Lookup the notification referenced by the {id} URL variable, if it was
+// issued by a device on which the account may perform <op>.
+func getNotificationByIdString(info *RestRequestInfo, op datalayer.DeviceOp) (datalayer.Notification, datalayer.Device, RestError) {
+    if info.Account == nil {
+        return nil, nil, NotLoggedInError().Log()
+    }
+    deviceId, t, err := datalayer.ParseNotificationID(info.URLVars["id"])
+    if err != nil {
+        return nil, nil, URLNotFoundError()
+    }
+    device, restErr := lookupDeviceForOp(info, deviceId.String(), op)
+    if restErr != nil {
+        return nil, nil, restErr
+    }
+    note, err := device.Notification(t)
+    if err != nil {
+        return nil, nil, URLNotFoundError()
+    }
+    return note, device, nil
+}
+
+func POST__api__device__self__notify(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Device == nil {
+        return nil, BadInputError("Expected device credentials with /api/device/self").Log()
+    }
+
+    msg, ok := info.BodyObj["msg"].(string)
+    if !ok || msg == "" {
+        return nil, BadInputError("Expected string \"msg\"")
+    }
+    notifyType := "in-app"
+    if notifyTypeItf, ok := info.BodyObj["notify_type"]; ok {
+        notifyType, _ = notifyTypeItf.(string)
+        if !notify.IsValidNotifyType(notifyType) {
+            return nil, BadInputError("Invalid \"notify_type\"")
+        }
+    }
+
+    err := notify.ProcessNotification(info.Device, notifyType, notify.ServicesFromUserCtx(info.UserCtx), msg)
+    if err != nil {
+        return nil, InternalServerError("Processing notification: " + err.Error()).Log()
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+    }, nil
+}
+
+func GET__api__notifications(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    start, count, restErr := limitParam(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+    if count < 0 {
+        count = defaultNotificationsPage
+    }
+    minPriority := datalayer.NotificationType_LowPriority
+    if param := info.Query["min_priority"]; param != nil {
+        var err error
+        minPriority, err = datalayer.NotificationPriorityFromString(param[0])
+        if err != nil {
+            return nil, BadInputError(err.Error())
+        }
+    }
+    includeDismissed := info.Query["dismissed"] != nil && info.Query["dismissed"][0] == "true"
+
+    devices, err := info.Account.Devices().DeviceList(0, -1)
+    if err != nil {
+        return nil, InternalServerError("Device lookup failed").Log()
+    }
+    read, err := info.Account.ReadNotifications()
+    if err != nil {
+        return nil, InternalServerError("Fetching read notifications: " + err.Error()).Log()
+    }
+
+    keep := func(note datalayer.Notification) bool {
+        if note.IsDismissed() && !includeDismissed {
+            return false
+        }
+        return notify.Priority(note.NotifyType()) >= minPriority
+    }
+
+    // The newest <need> matching notifications of each device are enough to
+    // fill the page and tell whether there are more.
+    need := int(start + count) + 1
+    notes := notificationsByTime{}
+    noteDevices := map[string]datalayer.Device{}
+    for _, device := range devices {
+        deviceNotes, err := recentNotifications(device, need, keep)
+        if err != nil {
+            return nil, InternalServerError("Fetching notifications: " + err.Error()).Log()
+        }
+        for _, note := range deviceNotes {
+            notes = append(notes, note)
+            noteDevices[note.ID()] = device
+        }
+    }
+    sort.Sort(notes)
+
+    more := int64(len(notes)) > start + count
+    if start > int64(len(notes)) {
+        start = int64(len(notes))
+    }
+    notes = notes[start:]
+    if count < int64(len(notes)) {
+        notes = notes[:count]
+    }
+
+    timestamp_type := timestampTypeParam(info)
+    notesJson := []interface{}{}
+    for _, note := range notes {
+        notesJson = append(notesJson, notificationToJsonObj(note, noteDevices[note.ID()], read[note.ID()], timestamp_type))
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "notifications" : notesJson,
+        "paging" : map[string]interface{}{
+            "more" : more,
+        },
+    }, nil
+}
+
+func POST__api__notifications__id__dismiss(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    note, device, restErr := getNotificationByIdString(info, datalayer.DeviceOpWrite)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    err := note.Dismiss()
+    if err != nil {
+        return nil, InternalServerError("Dismissing notification: " + err.Error()).Log()
+    }
+
+    read, err := info.Account.ReadNotifications()
+    if err != nil {
+        return nil, InternalServerError("Fetching read notifications: " + err.Error()).Log()
+    }
+    out := notificationToJsonObj(note, device, read[note.ID()], timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func POST__api__notifications__id__read(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    note, device, restErr := getNotificationByIdString(info, datalayer.DeviceOpRead)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    err := info.Account.MarkNotificationRead(note)
+    if err != nil {
+        return nil, InternalServerError("Marking notification read: " + err.Error()).Log()
+    }
+
+    out := notificationToJsonObj(note, device, true, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
@@ -70,30 +70,17 @@ func POST__api__reset_password(info *RestRequestInfo, sideEffect *RestSideEffect
         // Send Reset Password Request (Purpose 1 above)
         canolog.Trace("Sending password reset email")
 
-        protocol := "http://"
-        if info.Config.OptEnableHTTPS() {
-            protocol = "https://"
-        }
-
         code, err := account.GenResetPasswordCode()
         if (err != nil) {
             return nil, InternalServerError("Problem resetting password: " + err.Error())
         }
 
-        activationLink := protocol + info.Config.OptHostname() + 
-                "/mgr/reset_password.html?username=" + account.Username() + 
-                "&code=" + code
-
         msg := sideEffect.SendEmail()
         msg.AddTo(account.Email(), account.Username())
         msg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
         msg.SetReplyTo("no-reply@canopy.link")
-        messages.MailMessageResetPassword(msg,
-            account.Username(), 
-            activationLink,
-            protocol + info.Config.OptHostname(),
-            info.Config.OptHostname(),
-        )
+        messages.MailMessageResetPassword(msg, info.Config, account,
+            messages.ResetPasswordLink(info.Config, account, code))
     }
 
     return map[string]interface{} {
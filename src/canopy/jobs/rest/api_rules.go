@@ -0,0 +1,295 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/datalayer"
+    "canopy/rules"
+    canotime "canopy/util/time"
+    "github.com/gocql/gocql"
+    "time"
+)
+
+// Rules are automations owned by an account.  See package rules for the
+// supported actions.
+//
+//  GET /api/user/self/rules
+//  POST /api/user/self/rules
+//      {
+//          "name" : "too-hot",
+//          "condition" : "temperature > 80",
+//          "devices" : ["<device id>", ...],
+//          "match" : "any",
+//          "actions" : [{"type" : "notify", "msg" : "Too hot!"}],
+//          "cooldown_s" : 600,
+//          "enabled" : true
+//      }
+//  GET /api/user/self/rules/{id}
+//  POST /api/user/self/rules/{id}
+//      Same fields as above, all optional.
+//  DELETE /api/user/self/rules/{id}
+
+func ruleToJsonObj(rule datalayer.Rule, timestamp_type string) map[string]interface{} {
+    devices := []interface{}{}
+    for _, deviceId := range rule.DeviceIDs() {
+        devices = append(devices, deviceId.String())
+    }
+    actions := []interface{}{}
+    for _, action := range rule.Actions() {
+        actionJson := map[string]interface{}{}
+        for k, v := range action.Params {
+            actionJson[k] = v
+        }
+        actionJson["type"] = action.Type
+        actions = append(actions, actionJson)
+    }
+
+    out := map[string]interface{}{
+        "id" : rule.ID().String(),
+        "owner" : rule.Owner(),
+        "name" : rule.Name(),
+        "condition" : rule.Condition(),
+        "devices" : devices,
+        "match" : datalayer.RuleMatchToString(rule.Match()),
+        "actions" : actions,
+        "cooldown_s" : int(rule.Cooldown()/time.Second),
+        "enabled" : rule.Enabled(),
+        "active" : rule.LastState(),
+    }
+    timestamps := map[string]time.Time{
+        "time_created" : rule.TimeCreated(),
+        "last_fired" : rule.LastFired(),
+    }
+    for k, t := range timestamps {
+        if t.IsZero() {
+            out[k] = nil
+        } else if timestamp_type == "epoch_us" {
+            out[k] = canotime.EpochMicroseconds(t)
+        } else {
+            out[k] = canotime.RFC3339(t)
+        }
+    }
+    return out
+}
+
+// Apply the rule settings in a request body to <params>.  Fields that are
+// not present are left unchanged.
+func ruleParamsFromJson(info *RestRequestInfo, params *datalayer.RuleParams) RestError {
+    body := info.BodyObj
+    var ok bool
+
+    if _, present := body["name"]; present {
+        params.Name, ok = body["name"].(string)
+        if !ok {
+            return BadInputError("Expected string \"name\"")
+        }
+    }
+    if _, present := body["condition"]; present {
+        params.Condition, ok = body["condition"].(string)
+        if !ok {
+            return BadInputError("Expected string \"condition\"")
+        }
+    }
+    if devicesItf, present := body["devices"]; present {
+        devices, ok := devicesItf.([]interface{})
+        if !ok {
+            return BadInputError("Expected list \"devices\"")
+        }
+        params.DeviceIDs = []gocql.UUID{}
+        for _, deviceItf := range devices {
+            deviceIdString, _ := deviceItf.(string)
+            deviceId, err := gocql.ParseUUID(deviceIdString)
+            if err != nil {
+                return BadInputError("Invalid device ID in \"devices\"")
+            }
+            params.DeviceIDs = append(params.DeviceIDs, deviceId)
+        }
+    }
+    if _, present := body["match"]; present {
+        matchString, ok := body["match"].(string)
+        if !ok {
+            return BadInputError("Expected string \"match\"")
+        }
+        match, err := datalayer.RuleMatchFromString(matchString)
+        if err != nil {
+            return BadInputError(err.Error())
+        }
+        params.Match = match
+    }
+    if actionsItf, present := body["actions"]; present {
+        actions, ok := actionsItf.([]interface{})
+        if !ok {
+            return BadInputError("Expected list \"actions\"")
+        }
+        params.Actions = []datalayer.RuleAction{}
+        for _, actionItf := range actions {
+            actionJson, ok := actionItf.(map[string]interface{})
+            if !ok {
+                return BadInputError("Expected objects in \"actions\"")
+            }
+            action := datalayer.RuleAction{Params: map[string]interface{}{}}
+            for k, v := range actionJson {
+                if k == "type" {
+                    action.Type, _ = v.(string)
+                } else {
+                    action.Params[k] = v
+                }
+            }
+            params.Actions = append(params.Actions, action)
+        }
+    }
+    if _, present := body["cooldown_s"]; present {
+        cooldown, ok := body["cooldown_s"].(float64)
+        if !ok {
+            return BadInputError("Expected number \"cooldown_s\"")
+        }
+        params.Cooldown = time.Duration(cooldown)*time.Second
+    }
+    if _, present := body["enabled"]; present {
+        params.Enabled, ok = body["enabled"].(bool)
+        if !ok {
+            return BadInputError("Expected boolean \"enabled\"")
+        }
+    }
+
+    err := rules.ValidateRuleParams(*params)
+    if err != nil {
+        return BadInputError(err.Error())
+    }
+
+    // Rules may only watch devices the owner has access to, and act on
+    // devices and webhooks the owner controls.
+    err = rules.CheckRuleAccess(info.Conn, info.Account, *params)
+    if err != nil {
+        return BadInputError(err.Error())
+    }
+    return nil
+}
+
+// Lookup the rule referenced by the {id} URL variable.
+func getRuleByIdString(info *RestRequestInfo) (datalayer.Rule, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+    id, err := gocql.ParseUUID(info.URLVars["id"])
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+    rule, err := info.Account.Rule(id)
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+    return rule, nil
+}
+
+func GET__api__user__self__rules(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    accountRules, err := info.Account.Rules()
+    if err != nil {
+        return nil, InternalServerError("Fetching rules: " + err.Error()).Log()
+    }
+
+    timestamp_type := timestampTypeParam(info)
+    rulesJson := []interface{}{}
+    for _, rule := range accountRules {
+        rulesJson = append(rulesJson, ruleToJsonObj(rule, timestamp_type))
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "rules" : rulesJson,
+    }, nil
+}
+
+func POST__api__user__self__rules(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    params := datalayer.RuleParams{Enabled: true}
+    restErr := ruleParamsFromJson(info, &params)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    rule, err := info.Account.CreateRule(params)
+    if err != nil {
+        return nil, InternalServerError("Creating rule: " + err.Error()).Log()
+    }
+
+    out := ruleToJsonObj(rule, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func GET__api__user__self__rules__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    rule, restErr := getRuleByIdString(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    out := ruleToJsonObj(rule, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+// Changes the rule's settings.  This resets the rule's state.
+func POST__api__user__self__rules__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    rule, restErr := getRuleByIdString(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    params := datalayer.RuleParams{
+        Name: rule.Name(),
+        Condition: rule.Condition(),
+        DeviceIDs: rule.DeviceIDs(),
+        Match: rule.Match(),
+        Actions: rule.Actions(),
+        Cooldown: rule.Cooldown(),
+        Enabled: rule.Enabled(),
+    }
+    restErr = ruleParamsFromJson(info, &params)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    err := rule.Update(params)
+    if err != nil {
+        return nil, InternalServerError("Updating rule: " + err.Error()).Log()
+    }
+
+    out := ruleToJsonObj(rule, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func DELETE__api__user__self__rules__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    rule, restErr := getRuleByIdString(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    err := info.Account.DeleteRule(rule.ID())
+    if err != nil {
+        return nil, InternalServerError("Deleting rule: " + err.Error()).Log()
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+    }, nil
+}
@@ -0,0 +1,252 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "canopy/sddl"
+    canotime "canopy/util/time"
+)
+
+// SDDL classes are SDDL documents owned by an account and shared by many
+// devices:
+//
+//  GET /api/user/self/sddl_classes
+//  POST /api/user/self/sddl_classes
+//      {"name" : "thermostat", "description" : "...", "var_decls" : {...}}
+//  GET /api/user/self/sddl_classes/{name}
+//  POST /api/user/self/sddl_classes/{name}
+//      {"description" : "...", "var_decls" : {...}}
+//  DELETE /api/user/self/sddl_classes/{name}
+
+func sddlClassToJsonObj(class datalayer.SDDLClass, timestamp_type string) map[string]interface{} {
+    doc := class.Document()
+    authors := []interface{}{}
+    for _, author := range doc.Authors() {
+        authors = append(authors, author)
+    }
+
+    out := map[string]interface{}{
+        "name" : class.Name(),
+        "owner" : class.Owner(),
+        "version" : class.Version(),
+        "description" : doc.Description(),
+        "authors" : authors,
+        "var_decls" : doc.Json(),
+    }
+    if timestamp_type == "epoch_us" {
+        out["time_updated"] = canotime.EpochMicroseconds(class.TimeUpdated())
+    } else {
+        out["time_updated"] = canotime.RFC3339(class.TimeUpdated())
+    }
+    return out
+}
+
+// Build the JSON used to create or extend an SDDL class document from a
+// request body.
+func sddlClassUpdateJson(body map[string]interface{}) (map[string]interface{}, RestError) {
+    jsn := map[string]interface{}{}
+
+    varDeclsItf, ok := body["var_decls"]
+    if ok {
+        varDecls, ok := varDeclsItf.(map[string]interface{})
+        if !ok {
+            return nil, BadInputError("Expected object \"var_decls\"")
+        }
+        for k, v := range varDecls {
+            jsn[k] = v
+        }
+    }
+
+    descriptionItf, ok := body["description"]
+    if ok {
+        description, ok := descriptionItf.(string)
+        if !ok {
+            return nil, BadInputError("Expected string \"description\"")
+        }
+        jsn["description"] = description
+    }
+
+    authorsItf, ok := body["authors"]
+    if ok {
+        _, ok := authorsItf.([]interface{})
+        if !ok {
+            return nil, BadInputError("Expected list \"authors\"")
+        }
+        jsn["authors"] = authorsItf
+    }
+    return jsn, nil
+}
+
+func timestampTypeParam(info *RestRequestInfo) string {
+    timestamps := info.Query["timestamps"]
+    if timestamps != nil && timestamps[0] == "rfc3339" {
+        return "rfc3339"
+    }
+    return "epoch_us"
+}
+
+func GET__api__user__self__sddl_classes(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    classes, err := info.Account.SDDLClasses()
+    if err != nil {
+        return nil, InternalServerError("Fetching SDDL classes: " + err.Error()).Log()
+    }
+
+    timestamp_type := timestampTypeParam(info)
+    classesJson := []interface{}{}
+    for _, class := range classes {
+        classesJson = append(classesJson, sddlClassToJsonObj(class, timestamp_type))
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "sddl_classes" : classesJson,
+    }, nil
+}
+
+func POST__api__user__self__sddl_classes(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    name, ok := info.BodyObj["name"].(string)
+    if !ok {
+        return nil, BadInputError("String \"name\" expected")
+    }
+
+    jsn, restErr := sddlClassUpdateJson(info.BodyObj)
+    if restErr != nil {
+        return nil, restErr
+    }
+    doc, err := sddl.Sys.ParseDocument(jsn)
+    if err != nil {
+        return nil, BadInputError(err.Error())
+    }
+
+    class, err := info.Account.CreateSDDLClass(name, doc)
+    if err != nil {
+        switch err.(type) {
+        case *datalayer.ValidationError:
+            return nil, BadInputError(err.Error())
+        }
+        return nil, InternalServerError("Creating SDDL class: " + err.Error()).Log()
+    }
+
+    out := sddlClassToJsonObj(class, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func GET__api__user__self__sddl_classes__name(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    class, err := info.Account.SDDLClass(info.URLVars["name"])
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+
+    members, err := class.Members()
+    if err != nil {
+        return nil, InternalServerError("Fetching SDDL class members: " + err.Error()).Log()
+    }
+    membersJson := []interface{}{}
+    for _, deviceId := range members {
+        membersJson = append(membersJson, deviceId.String())
+    }
+
+    out := sddlClassToJsonObj(class, timestampTypeParam(info))
+    out["result"] = "ok"
+    out["members"] = membersJson
+    return out, nil
+}
+
+// Extends the class's document.  Member devices use the new document
+// immediately, and a background job records the change in their SDDL
+// history.
+func POST__api__user__self__sddl_classes__name(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    class, err := info.Account.SDDLClass(info.URLVars["name"])
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+
+    jsn, restErr := sddlClassUpdateJson(info.BodyObj)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    // Work on a copy so that the class is unchanged if anything fails.
+    doc, err := sddl.Sys.ParseDocumentString(class.DocumentString())
+    if err != nil {
+        return nil, InternalServerError("Parsing SDDL class: " + err.Error()).Log()
+    }
+    err = doc.Extend(jsn)
+    if err != nil {
+        return nil, BadInputError(err.Error())
+    }
+
+    changed, err := class.SetDocument(doc)
+    if err != nil {
+        switch err.(type) {
+        case *datalayer.ValidationError:
+            return nil, BadInputError(err.Error())
+        }
+        return nil, InternalServerError("Updating SDDL class: " + err.Error()).Log()
+    }
+
+    if changed {
+        err = LaunchSDDLClassChanged(info.PigeonOutbox, class)
+        if err != nil {
+            canolog.Error("Error launching SDDL class propagation: ", err)
+        }
+    }
+
+    out := sddlClassToJsonObj(class, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func DELETE__api__user__self__sddl_classes__name(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    _, err := info.Account.SDDLClass(info.URLVars["name"])
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+
+    err = info.Account.DeleteSDDLClass(info.URLVars["name"])
+    if err != nil {
+        switch err.(type) {
+        case *datalayer.ValidationError:
+            return nil, BadInputError(err.Error())
+        }
+        return nil, InternalServerError("Deleting SDDL class: " + err.Error()).Log()
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+    }, nil
+}
@@ -14,7 +14,8 @@
 package rest
 
 import (
-    "canopy/mail"
+    "canopy/datalayer"
+    "canopy/mail/messages"
 )
 
 func POST__api__share(info *RestRequestInfo, sideEffects *RestSideEffects) (map[string]interface{}, RestError) {
@@ -22,69 +23,102 @@ func POST__api__share(info *RestRequestInfo, sideEffects *RestSideEffects) (map[
      *  POST
      *  {
      *      "device_id" : <DEVICE_ID>,
-     *      "access_level" : <ACCESS_LEVEL>,
-     *      "sharing_level" : <SHARING_LEVEL>,
-     *      "email_address" : <EMAIL_ADDRESS>,
+     *      "access_level" : "read-only" | "read-write",
+     *      "sharing_level" : "none" | "share" | "share-revoke",
+     *      "email" : <EMAIL_ADDRESS>,
      *  }
      *
+     * Emails an invitation to <EMAIL_ADDRESS>.  The recipient accepts it by
+     * logging in with the account for <EMAIL_ADDRESS> and calling POST
+     * /api/finish_share_transaction with the invitation's token.
+     * "access_level" defaults to "read-only" and "sharing_level" defaults to
+     * "none".  Neither may exceed the sharer's own permissions.
+     *
      * TODO: Add to REST API documentation
      */
+    if info.Account == nil {
+        return nil, NotLoggedInError()
+    }
+
     deviceId, ok := info.BodyObj["device_id"].(string)
     if !ok {
         return nil, BadInputError("String \"device_id\" expected")
     }
 
-    device, err := info.Conn.LookupDeviceByStringID(deviceId)
-    if err != nil {
-        return nil, BadInputError("Device not found")
-    }
-
-    //accessLevel, ok := data["access_level"].(int)
-    /*_, ok = data["access_level"].(float)
-    if !ok {
-        fmt.Fprintf(w, "{\"error\" : \"access_level expected\"}")
-        return
-    }*/
-
-    //sharingLevel, ok := data["sharing_level"].(int)
-    /*_, ok = data["sharing_level"].(float)
-    if !ok {
-        fmt.Fprintf(w, "{\"error\" : \"sharing_level expected\"}")
-        return
-    }*/
-
     email, ok := info.BodyObj["email"].(string)
     if !ok {
         return nil, BadInputError("String \"email\" expected")
     }
 
-    if info.Account == nil {
-        return nil, NotLoggedInError()
+    access := datalayer.AccessLevel(datalayer.ReadOnlyAccess)
+    if _, ok := info.BodyObj["access_level"]; ok {
+        accessString, ok := info.BodyObj["access_level"].(string)
+        if !ok {
+            return nil, BadInputError("String \"access_level\" expected")
+        }
+        var err error
+        access, err = datalayer.AccessLevelFromString(accessString)
+        if err != nil {
+            return nil, BadInputError(err.Error())
+        }
+    }
+
+    sharing := datalayer.ShareLevel(datalayer.NoSharing)
+    if _, ok := info.BodyObj["sharing_level"]; ok {
+        sharingString, ok := info.BodyObj["sharing_level"].(string)
+        if !ok {
+            return nil, BadInputError("String \"sharing_level\" expected")
+        }
+        var err error
+        sharing, err = datalayer.ShareLevelFromString(sharingString)
+        if err != nil {
+            return nil, BadInputError(err.Error())
+        }
     }
 
-    mailer, err := mail.NewMailClient(info.Config)
+    device, restErr := lookupDeviceForOp(info, deviceId, datalayer.DeviceOpShare)
+    if device == nil {
+        return nil, restErr
+    }
+
+    // The sharer can't hand out more access than they have.
+    myAccess, mySharing, err := device.AccountAccess(info.Account)
     if err != nil {
-        return nil, InternalServerError("Error initializing mail client")
+        return nil, InternalServerError("Looking up permissions")
+    }
+    if access > myAccess {
+        return nil, ForbiddenError("Cannot grant more access than you have")
+    }
+    if sharing > mySharing {
+        return nil, ForbiddenError("Cannot grant more sharing than you have")
     }
-    mail := mailer.NewMail();
-    err = mail.AddTo(email, "")
+
+    token, err := device.CreateShareInvitation(info.Account, email, access, sharing)
     if err != nil {
-        return nil, BadInputError("Invalid email recipient")
+        switch err.(type) {
+        case *datalayer.ValidationError:
+            return nil, BadInputError(err.Error())
+        default:
+            return nil, InternalServerError("Creating share invitation")
+        }
+    }
+
+    // Use the recipient's locale if they have an account here.
+    locale := info.Account.Locale()
+    recipient, err := info.Conn.LookupAccount(email)
+    if err == nil && recipient.Locale() != "" {
+        locale = recipient.Locale()
     }
-    mail.SetSubject(device.Name())
-    mail.SetHTML(`
-<img src="http://devel.canopy.link/canopy_logo.jpg"></img>
-<h2>I've shared a device with you.</h2>
-<a href="http://devel.canopy.link/go.php?share_device=` + deviceId + `">` + device.Name() + `</a>
-<h2>What is Canopy?</h2>
-<b>Canopy</b> is a secure platform for monitoring and controlling physical
-devices.  Learn more at <a href=http://devel.canopy.link>http://canopy.link</a>
-`)
-    mail.SetFrom("greg@canopy.link", "greg (via Canopy)")
-    err = mailer.Send(mail)
+
+    msg := sideEffects.SendEmail()
+    err = msg.AddTo(email, "")
     if err != nil {
-        return nil, InternalServerError("Error sending mail")
+        return nil, BadInputError("Invalid email recipient")
     }
+    msg.SetFrom("no-reply@canopy.link", info.Account.Username() + " (via Canopy)")
+    msg.SetReplyTo(info.Account.Email())
+    messages.MailMessageShareInvite(msg, info.Config, info.Account, locale,
+            device, messages.ShareInviteLink(info.Config, token))
 
     return map[string]interface{} {
         "result" : "ok",
@@ -15,7 +15,10 @@
 package rest
 
 import (
+    "canopy/datalayer"
     "canopy/mail/messages"
+    "canopy/notify"
+    "time"
 )
 
 // Constructs the response body for the /api/user/self REST endpoint
@@ -23,11 +26,28 @@ func GET__api__user__self(info *RestRequestInfo, sideEffect *RestSideEffects) (m
     if info.Account == nil {
         return nil, NotLoggedInError().Log()
     }
+    prefs, err := info.Account.NotificationPrefs()
+    if err != nil {
+        return nil, InternalServerError("Fetching notification preferences: " + err.Error()).Log()
+    }
+    prefsJson := map[string]interface{}{}
+    for channel, pref := range prefs {
+        prefsJson[datalayer.NotificationChannelToString(channel)] = map[string]interface{}{
+            "enabled" : pref.Enabled,
+            "min_priority" : datalayer.NotificationPriorityToString(pref.MinPriority),
+            "digest" : pref.Digest,
+        }
+    }
     return map[string]interface{}{
         "validated" : info.Account.IsActivated(),
         "email" : info.Account.Email(),
         "result" : "ok",
         "username" : info.Account.Username(),
+        "default_var_decl_policy" : datalayer.VarDeclPolicyToString(info.Account.DefaultVarDeclPolicy()),
+        "locale" : info.Account.Locale(),
+        "notification_prefs" : prefsJson,
+        "phone_number" : info.Account.PhoneNumber(),
+        "phone_verified" : info.Account.PhoneVerified(),
     }, nil
 }
 
@@ -67,34 +87,138 @@ func POST__api__user__self(info *RestRequestInfo, sideEffect *RestSideEffects) (
                 }
             }
             if !skipEmail {
-                protocol := "http://"
-                if info.Config.OptEnableHTTPS() {
-                    protocol = "https://"
-                }
-
-                activationLink := protocol + info.Config.OptHostname() + 
-                    "/mgr/activate.html?username=" + info.Account.Username() + 
-                    "&code=" + info.Account.ActivationCode()
-
                 awayMsg := sideEffect.SendEmail()
                 awayMsg.AddTo(oldEmail, info.Account.Username())
                 awayMsg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
                 awayMsg.SetReplyTo("no-reply@canopy.link")
-                messages.MailMessageEmailChangedAway(awayMsg,
-                    info.Account.Username(), 
-                    activationLink,
-                    protocol + info.Config.OptHostname(),
-                    info.Config.OptHostname())
+                messages.MailMessageEmailChangedAway(awayMsg, info.Config,
+                    info.Account)
 
                 toMsg := sideEffect.SendEmail()
                 toMsg.AddTo(newEmail, info.Account.Username())
                 toMsg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
                 toMsg.SetReplyTo("no-reply@canopy.link")
-                messages.MailMessageEmailChangedTo(toMsg,
-                    info.Account.Username(), 
-                    activationLink,
-                    protocol + info.Config.OptHostname(),
-                    info.Config.OptHostname())
+                messages.MailMessageEmailChangedTo(toMsg, info.Config,
+                    info.Account,
+                    messages.ActivationLink(info.Config, info.Account))
+            }
+
+        case "default_var_decl_policy":
+            policyString, ok := value.(string)
+            if !ok {
+                return nil, BadInputError("Expected string \"default_var_decl_policy\"")
+            }
+            policy, err := datalayer.VarDeclPolicyFromString(policyString)
+            if err != nil {
+                return nil, BadInputError(err.Error())
+            }
+            err = info.Account.SetDefaultVarDeclPolicy(policy)
+            if err != nil {
+                return nil, InternalServerError("Problem changing default_var_decl_policy")
+            }
+
+        case "locale":
+            locale, ok := value.(string)
+            if !ok {
+                return nil, BadInputError("Expected string \"locale\"")
+            }
+            err := info.Account.SetLocale(locale)
+            if err != nil {
+                switch err.(type) {
+                case *datalayer.ValidationError:
+                    return nil, BadInputError(err.Error())
+                }
+                return nil, InternalServerError("Problem changing locale")
+            }
+
+        case "notification_prefs":
+            // Channels and fields that are not present are left unchanged,
+            // ex: {"email" : {"min_priority" : "med"}}
+            prefsJson, ok := value.(map[string]interface{})
+            if !ok {
+                return nil, BadInputError("Expected object \"notification_prefs\"")
+            }
+            prefs, err := info.Account.NotificationPrefs()
+            if err != nil {
+                return nil, InternalServerError("Fetching notification preferences: " + err.Error()).Log()
+            }
+            for channelString, prefItf := range prefsJson {
+                channel, err := datalayer.NotificationChannelFromString(channelString)
+                if err != nil {
+                    return nil, BadInputError(err.Error())
+                }
+                prefJson, ok := prefItf.(map[string]interface{})
+                if !ok {
+                    return nil, BadInputError("Expected object for \"" + channelString + "\"")
+                }
+                pref := prefs[channel]
+                if enabledItf, ok := prefJson["enabled"]; ok {
+                    pref.Enabled, ok = enabledItf.(bool)
+                    if !ok {
+                        return nil, BadInputError("Expected boolean \"enabled\"")
+                    }
+                }
+                if digestItf, ok := prefJson["digest"]; ok {
+                    pref.Digest, ok = digestItf.(bool)
+                    if !ok {
+                        return nil, BadInputError("Expected boolean \"digest\"")
+                    }
+                    if pref.Digest && channel != datalayer.NotificationChannelEmail {
+                        return nil, BadInputError("\"digest\" is only supported for email")
+                    }
+                }
+                if priorityItf, ok := prefJson["min_priority"]; ok {
+                    priorityString, _ := priorityItf.(string)
+                    pref.MinPriority, err = datalayer.NotificationPriorityFromString(priorityString)
+                    if err != nil {
+                        return nil, BadInputError(err.Error())
+                    }
+                }
+                err = info.Account.SetNotificationPref(channel, pref)
+                if err != nil {
+                    return nil, InternalServerError("Problem changing notification_prefs")
+                }
+            }
+
+        case "phone_number":
+            // A verification code is sent to the new number by SMS.  Setting
+            // the same number again sends a new code, unless the number is
+            // already verified.
+            number, ok := value.(string)
+            if !ok {
+                return nil, BadInputError("Expected string \"phone_number\"")
+            }
+            if number == info.Account.PhoneNumber() && info.Account.PhoneVerified() {
+                break
+            }
+            services := notify.ServicesFromUserCtx(info.UserCtx)
+            if number != "" {
+                // Don't change the number if the code can't be sent.
+                status, err := notify.CheckSMS(info.Account, services, time.Now().UTC())
+                switch status {
+                case datalayer.DeliverySkipped:
+                    return nil, BadInputError("Could not send verification code: " + err.Error())
+                case datalayer.DeliveryFailed:
+                    return nil, InternalServerError("Could not send verification code: " + err.Error()).Log()
+                }
+            }
+            code, err := info.Account.SetPhoneNumber(number)
+            if err != nil {
+                switch err.(type) {
+                case *datalayer.ValidationError:
+                    return nil, BadInputError(err.Error())
+                }
+                return nil, InternalServerError("Problem changing phone number: " + err.Error()).Log()
+            }
+            if number != "" {
+                status, err := notify.SendSMS(info.Account, services,
+                        "Your Canopy verification code is " + code)
+                switch status {
+                case datalayer.DeliverySkipped:
+                    return nil, BadInputError("Could not send verification code: " + err.Error())
+                case datalayer.DeliveryFailed:
+                    return nil, InternalServerError("Could not send verification code: " + err.Error()).Log()
+                }
             }
 
         case "new_password":
@@ -125,6 +249,37 @@ func POST__api__user__self(info *RestRequestInfo, sideEffect *RestSideEffects) (
         "result" : "ok",
         "username" : info.Account.Username(),
         "email" : info.Account.Email(),
+        "locale" : info.Account.Locale(),
+        "phone_number" : info.Account.PhoneNumber(),
+        "phone_verified" : info.Account.PhoneVerified(),
+    }, nil
+}
+
+// Verify the account's phone number, using the code sent by SMS when it was
+// set.
+//
+//  POST /api/user/self/phone/verify
+//      {"code" : "123456"}
+func POST__api__user__self__phone__verify(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+    code, ok := info.BodyObj["code"].(string)
+    if !ok {
+        return nil, BadInputError("Expected string \"code\"")
+    }
+    err := info.Account.VerifyPhoneNumber(code)
+    if err != nil {
+        switch err.(type) {
+        case *datalayer.ValidationError:
+            return nil, BadInputError(err.Error())
+        }
+        return nil, InternalServerError("Problem verifying phone number: " + err.Error()).Log()
+    }
+    return map[string]interface{}{
+        "result" : "ok",
+        "phone_number" : info.Account.PhoneNumber(),
+        "phone_verified" : true,
     }, nil
 }
 
@@ -157,10 +312,7 @@ func DELETE__api__user__self(info *RestRequestInfo, sideEffect *RestSideEffects)
         msg.AddTo(info.Account.Email(), info.Account.Username())
         msg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
         msg.SetReplyTo("no-reply@canopy.link")
-        messages.MailMessageAccountDeleted(msg,
-            info.Account.Username(), 
-            info.Config.OptHostname(),
-        )
+        messages.MailMessageAccountDeleted(msg, info.Config, info.Account)
     }
 
     // Log the user out
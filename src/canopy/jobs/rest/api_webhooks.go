@@ -0,0 +1,287 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/datalayer"
+    canotime "canopy/util/time"
+    "canopy/webhooks"
+    "github.com/gocql/gocql"
+)
+
+// Webhooks deliver device events to an account's own endpoints.  See
+// package webhooks for the payload format and signing scheme.
+//
+//  GET /api/user/self/webhooks
+//  POST /api/user/self/webhooks
+//      {
+//          "url" : "https://example.com/canopy-events",
+//          "devices" : ["<device id>", ...],
+//          "filter" : "temperature > 80",
+//          "events" : ["sample", "notification"],
+//          "enabled" : true
+//      }
+//      The response includes the generated "secret".
+//  GET /api/user/self/webhooks/{id}
+//  POST /api/user/self/webhooks/{id}
+//      Same fields as above, all optional.
+//  DELETE /api/user/self/webhooks/{id}
+//  GET /api/user/self/webhooks/{id}/deliveries
+//      Lists recent delivery attempts, newest first.
+
+// Maximum number of delivery attempts listed.
+const webhookDeliveriesLimit = 100
+
+func webhookToJsonObj(webhook datalayer.Webhook, timestamp_type string) map[string]interface{} {
+    devices := []interface{}{}
+    for _, deviceId := range webhook.DeviceIDs() {
+        devices = append(devices, deviceId.String())
+    }
+    events := []interface{}{}
+    for _, event := range webhook.Events() {
+        events = append(events, event)
+    }
+
+    out := map[string]interface{}{
+        "id" : webhook.ID().String(),
+        "url" : webhook.URL(),
+        "devices" : devices,
+        "filter" : webhook.Filter(),
+        "events" : events,
+        "enabled" : webhook.Enabled(),
+        "secret" : webhook.Secret(),
+    }
+    if timestamp_type == "epoch_us" {
+        out["time_created"] = canotime.EpochMicroseconds(webhook.TimeCreated())
+    } else {
+        out["time_created"] = canotime.RFC3339(webhook.TimeCreated())
+    }
+    return out
+}
+
+// Apply the webhook settings in a request body to <params>.  Fields that are
+// not present are left unchanged.
+func webhookParamsFromJson(info *RestRequestInfo, params *datalayer.WebhookParams) RestError {
+    body := info.BodyObj
+    var ok bool
+
+    if _, present := body["url"]; present {
+        params.URL, ok = body["url"].(string)
+        if !ok {
+            return BadInputError("Expected string \"url\"")
+        }
+    }
+    if devicesItf, present := body["devices"]; present {
+        devices, ok := devicesItf.([]interface{})
+        if !ok {
+            return BadInputError("Expected list \"devices\"")
+        }
+        params.DeviceIDs = []gocql.UUID{}
+        for _, deviceItf := range devices {
+            deviceIdString, _ := deviceItf.(string)
+            deviceId, err := gocql.ParseUUID(deviceIdString)
+            if err != nil {
+                return BadInputError("Invalid device ID in \"devices\"")
+            }
+            _, err = info.Account.Device(deviceId)
+            if err != nil {
+                return BadInputError("Device not found: " + deviceIdString)
+            }
+            params.DeviceIDs = append(params.DeviceIDs, deviceId)
+        }
+    }
+    if _, present := body["filter"]; present {
+        params.Filter, ok = body["filter"].(string)
+        if !ok {
+            return BadInputError("Expected string \"filter\"")
+        }
+    }
+    if eventsItf, present := body["events"]; present {
+        events, ok := eventsItf.([]interface{})
+        if !ok {
+            return BadInputError("Expected list \"events\"")
+        }
+        params.Events = []string{}
+        for _, eventItf := range events {
+            event, ok := eventItf.(string)
+            if !ok {
+                return BadInputError("Expected strings in \"events\"")
+            }
+            params.Events = append(params.Events, event)
+        }
+    }
+    if _, present := body["enabled"]; present {
+        params.Enabled, ok = body["enabled"].(bool)
+        if !ok {
+            return BadInputError("Expected boolean \"enabled\"")
+        }
+    }
+
+    err := webhooks.ValidateWebhookParams(*params)
+    if err != nil {
+        return BadInputError(err.Error())
+    }
+    return nil
+}
+
+// Lookup the webhook referenced by the {id} URL variable.
+func getWebhookByIdString(info *RestRequestInfo) (datalayer.Webhook, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+    id, err := gocql.ParseUUID(info.URLVars["id"])
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+    webhook, err := info.Account.Webhook(id)
+    if err != nil {
+        return nil, URLNotFoundError()
+    }
+    return webhook, nil
+}
+
+func GET__api__user__self__webhooks(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    accountWebhooks, err := info.Account.Webhooks()
+    if err != nil {
+        return nil, InternalServerError("Fetching webhooks: " + err.Error()).Log()
+    }
+
+    timestamp_type := timestampTypeParam(info)
+    webhooksJson := []interface{}{}
+    for _, webhook := range accountWebhooks {
+        webhooksJson = append(webhooksJson, webhookToJsonObj(webhook, timestamp_type))
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "webhooks" : webhooksJson,
+    }, nil
+}
+
+func POST__api__user__self__webhooks(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    if info.Account == nil {
+        return nil, NotLoggedInError().Log()
+    }
+
+    params := datalayer.WebhookParams{Enabled: true}
+    restErr := webhookParamsFromJson(info, &params)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    webhook, err := info.Account.CreateWebhook(params)
+    if err != nil {
+        return nil, InternalServerError("Creating webhook: " + err.Error()).Log()
+    }
+
+    out := webhookToJsonObj(webhook, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func GET__api__user__self__webhooks__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    webhook, restErr := getWebhookByIdString(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    out := webhookToJsonObj(webhook, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func POST__api__user__self__webhooks__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    webhook, restErr := getWebhookByIdString(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    params := datalayer.WebhookParams{
+        URL: webhook.URL(),
+        DeviceIDs: webhook.DeviceIDs(),
+        Filter: webhook.Filter(),
+        Events: webhook.Events(),
+        Enabled: webhook.Enabled(),
+    }
+    restErr = webhookParamsFromJson(info, &params)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    err := webhook.Update(params)
+    if err != nil {
+        return nil, InternalServerError("Updating webhook: " + err.Error()).Log()
+    }
+
+    out := webhookToJsonObj(webhook, timestampTypeParam(info))
+    out["result"] = "ok"
+    return out, nil
+}
+
+func DELETE__api__user__self__webhooks__id(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    webhook, restErr := getWebhookByIdString(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    err := info.Account.DeleteWebhook(webhook.ID())
+    if err != nil {
+        return nil, InternalServerError("Deleting webhook: " + err.Error()).Log()
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+    }, nil
+}
+
+func GET__api__user__self__webhooks__id__deliveries(info *RestRequestInfo, sideEffect *RestSideEffects) (map[string]interface{}, RestError) {
+    webhook, restErr := getWebhookByIdString(info)
+    if restErr != nil {
+        return nil, restErr
+    }
+
+    deliveries, err := webhook.Deliveries(webhookDeliveriesLimit)
+    if err != nil {
+        return nil, InternalServerError("Fetching webhook deliveries: " + err.Error()).Log()
+    }
+
+    timestamp_type := timestampTypeParam(info)
+    deliveriesJson := []interface{}{}
+    for _, delivery := range deliveries {
+        deliveryJson := map[string]interface{}{
+            "delivery_id" : delivery.ID.String(),
+            "event" : delivery.Event,
+            "device_id" : delivery.DeviceID.String(),
+            "attempt" : delivery.Attempt,
+            "status_code" : delivery.StatusCode,
+            "succeeded" : delivery.Error == "",
+            "error" : delivery.Error,
+        }
+        if timestamp_type == "epoch_us" {
+            deliveryJson["time"] = canotime.EpochMicroseconds(delivery.Time)
+        } else {
+            deliveryJson["time"] = canotime.RFC3339(delivery.Time)
+        }
+        deliveriesJson = append(deliveriesJson, deliveryJson)
+    }
+
+    return map[string]interface{}{
+        "result" : "ok",
+        "deliveries" : deliveriesJson,
+    }, nil
+}
@@ -0,0 +1,74 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/datalayer"
+)
+
+// Get the access and sharing levels that the requester has for <device>.
+// A device authenticated with its own credentials has ReadWriteAccess to
+// itself, but can't share or delete itself.  If anonymous devices are
+// allowed, everyone gets at least the device's PublicAccessLevel.
+func requesterDeviceAccess(info *RestRequestInfo, device datalayer.Device) (datalayer.AccessLevel, datalayer.ShareLevel, error) {
+    access := datalayer.AccessLevel(datalayer.NoAccess)
+    sharing := datalayer.ShareLevel(datalayer.NoSharing)
+
+    if info.Account != nil {
+        var err error
+        access, sharing, err = device.AccountAccess(info.Account)
+        if err != nil {
+            return datalayer.NoAccess, datalayer.NoSharing, err
+        }
+    } else if info.Device != nil && info.Device.ID() == device.ID() {
+        access = datalayer.ReadWriteAccess
+    }
+
+    if info.Config.OptAllowAnonDevices() && device.PublicAccessLevel() > access {
+        access = device.PublicAccessLevel()
+    }
+    return access, sharing, nil
+}
+
+// Check that the requester may perform <op> on <device>, as decided by
+// datalayer.DeviceOpAllowed, returning an error if not.  Every device
+// endpoint calls this.  Devices the requester has no access to are reported as not found
+// so that their existence isn't revealed.
+func authorizeDeviceOp(info *RestRequestInfo, device datalayer.Device, op datalayer.DeviceOp) RestError {
+    access, sharing, err := requesterDeviceAccess(info, device)
+    if err != nil {
+        return InternalServerError("Looking up permissions: " + err.Error()).Log()
+    }
+    if access == datalayer.NoAccess {
+        if info.Account == nil && info.Device == nil {
+            return NotLoggedInError()
+        }
+        return URLNotFoundError()
+    }
+
+    if datalayer.DeviceOpAllowed(op, access, sharing) {
+        return nil
+    }
+    switch op {
+    case datalayer.DeviceOpWrite:
+        return ForbiddenError("You have read-only access to this device")
+    case datalayer.DeviceOpShare:
+        return ForbiddenError("You are not allowed to share this device")
+    case datalayer.DeviceOpRevoke:
+        return ForbiddenError("You are not allowed to change access to this device")
+    case datalayer.DeviceOpDelete:
+        return ForbiddenError("Only owners can delete this device")
+    }
+    return InternalServerError("Unknown device operation").Log()
+}
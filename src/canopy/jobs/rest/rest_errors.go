@@ -89,6 +89,10 @@ func EmailTakenError() *GenericRestError {
     return NewGenericRestError(http.StatusBadRequest, "email_taken", "")
 }
 
+func ForbiddenError(msg string) *GenericRestError {
+    return NewGenericRestError(http.StatusForbidden, "forbidden", msg)
+}
+
 func IncorrectUsernameOrPasswordError() *GenericRestError {
     return NewGenericRestError(http.StatusUnauthorized, "incorrect_username_or_password", "")
 }
@@ -63,9 +63,10 @@ func (sideEffect *RestSideEffects) Logout() {
 }
 
 // Causes an email to be sent as a side-effect during REST endpoint handling.
-// This does not actually send the cookie.
+// This does not actually send the email.
 //
-// When Perform() is called, the email will be sent.
+// When Perform() is called, the email will be handed to the mailer, which
+// normally queues it to be sent in the background.
 // 
 // Returns a new mail.MailMessage object that the caller must use to compose
 // the message.
@@ -78,7 +79,7 @@ func (sideEffect *RestSideEffects) SendEmail() mail.MailMessage {
 // Carries out the side-effect actions.
 // Specifically:
 //
-//  1) Sends emails
+//  1) Sends emails, through the mailer
 //  2) Appends "set-cookies" and "clear-cookies" to the response object, as
 //  appropriate.
 func (sideEffect *RestSideEffects) Perform(req jobqueue.Request, resp jobqueue.Response) error {
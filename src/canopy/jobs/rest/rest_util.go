@@ -16,12 +16,15 @@ package rest
 import (
     "canopy/cloudvar"
     "canopy/datalayer"
+    "canopy/notify"
+    "canopy/sddl"
     canotime "canopy/util/time"
     "encoding/base64"
     "encoding/json"
     "errors"
     "fmt"
     "net/http"
+    "strconv"
     "strings"
     "time"
 )
@@ -94,6 +97,8 @@ func basicAuthFromRequest(r *http.Request) (username string, password string, er
 // float32               float64 -->    float32
 // float64               float64 -->    float64
 // datetime              string  -->    time.Time
+// struct                object  -->    map[string]cloudvar.CloudVarValue
+// <type>[N]             array   -->    []cloudvar.CloudVarValue
 //
 
 type jsonSample struct {
@@ -105,13 +110,94 @@ type jsonSamples struct {
     Samples []jsonSample `json:"samples"`
 }
 
-type jsonNotification struct {
-    Time string `json:"t"`
-    Dismissed bool `json:"dismissed"`
-    Msg string `json:"msg"`
+// Parse the "limit" query parameter, of the form "start,count", used for
+// paging.  Returns a count of -1 (no limit) if the parameter is absent.
+func limitParam(info *RestRequestInfo) (int64, int64, RestError) {
+    limit := info.Query["limit"]
+    start := int64(0)
+    count := int64(-1)
+    if limit != nil {
+        var err error
+        limitStrings := strings.Split(limit[0], ",")
+        if len(limitStrings) != 2 {
+            return 0, 0, BadInputError("Expected \"start,count\" for \"limit\"")
+        }
+        start, err = strconv.ParseInt(limitStrings[0], 10, 32)
+        if err != nil {
+            return 0, 0, BadInputError("Expected int for limit start")
+        }
+        count, err = strconv.ParseInt(limitStrings[1], 10, 32)
+        if err != nil {
+            return 0, 0, BadInputError("Expected int for limit count")
+        }
+    }
+    return start, count, nil
 }
 
-func deviceToJsonObj(device datalayer.Device, timestamp_type string) (map[string]interface{}, error) {
+// Parse the "units" query parameter, a comma-separated list of units to
+// convert values to, ex: "units=degrees_f,psi".  Returns nil if the
+// parameter is absent.
+func unitsParam(info *RestRequestInfo) ([]string, RestError) {
+    unitsParam := info.Query["units"]
+    if unitsParam == nil || unitsParam[0] == "" {
+        return nil, nil
+    }
+    units := strings.Split(unitsParam[0], ",")
+    for _, name := range units {
+        _, err := sddl.LookupUnit(name)
+        if err != nil {
+            return nil, BadInputError(err.Error())
+        }
+    }
+    return units, nil
+}
+
+// Convert a Cloud Variable value to whichever of <units> measures the same
+// quantity as the variable's declared units.  Struct members are converted
+// individually.  Returns the (possibly unchanged) value and the units it is
+// expressed in, or "" if the variable has no units.
+func valueInUnits(varDef sddl.VarDef, value cloudvar.CloudVarValue, units []string) (cloudvar.CloudVarValue, string) {
+    if varDef.Datatype() == sddl.DATATYPE_STRUCT {
+        v, ok := value.(map[string]cloudvar.CloudVarValue)
+        if !ok {
+            return value, ""
+        }
+        members, _ := varDef.StructMembers()
+        out := map[string]cloudvar.CloudVarValue{}
+        for _, member := range members {
+            memberValue, ok := v[member.Name()]
+            if ok {
+                out[member.Name()], _ = valueInUnits(member, memberValue, units)
+            }
+        }
+        return out, ""
+    }
+
+    varUnits, _ := varDef.Units()
+    if varUnits == "" {
+        return value, ""
+    }
+    fromUnit, err := sddl.LookupUnit(varUnits)
+    if err != nil {
+        return value, varUnits
+    }
+    for _, name := range units {
+        toUnit, err := sddl.LookupUnit(name)
+        if err != nil || toUnit.Quantity() != fromUnit.Quantity() {
+            continue
+        }
+        converted, err := cloudvar.ConvertValueUnits(varDef, value, name)
+        if err != nil {
+            return value, varUnits
+        }
+        return converted, name
+    }
+    return value, varUnits
+}
+
+// Generate JSON for a device.  Cloud Variable values are converted to <units>
+// where applicable (see valueInUnits); pass nil to leave them unconverted.
+func deviceToJsonObj(device datalayer.Device, timestamp_type string, units []string) (map[string]interface{}, error) {
     statusJsonObj := map[string]interface{} {
         "ws_connected" : device.WSConnected(),
     }
@@ -133,6 +219,9 @@ func deviceToJsonObj(device datalayer.Device, timestamp_type string) (map[string
         "status" : statusJsonObj,
         "var_decls" : nil,
         "secret_key" : device.SecretKey(),
+        "var_decl_policy" : datalayer.VarDeclPolicyToString(device.VarDeclPolicy()),
+        "sddl_class" : nil,
+        "enum_values" : map[string]interface{} {},
         "vars" : map[string]interface{} {},
         "notifs" : []interface{} {},
     }
@@ -142,6 +231,14 @@ func deviceToJsonObj(device datalayer.Device, timestamp_type string) (map[string
         out["var_decls"] = sddlDoc.Json()
     }
 
+    if device.SDDLClassRef() != "" {
+        out["sddl_class"] = device.SDDLClassRef()
+    }
+
+    if sddlDoc != nil {
+        addEnumValuesJson(out["enum_values"].(map[string]interface{}), sddlDoc.VarDefs())
+    }
+
     outDoc := device.SDDLDocument()
     if outDoc != nil {
         // get most recent value of each sensor/control
@@ -150,46 +247,76 @@ func deviceToJsonObj(device datalayer.Device, timestamp_type string) (map[string
             if err != nil {
                 continue
             }
+            value, varUnits := valueInUnits(varDef, sample.Value, units)
+            varJsonObj := map[string]interface{} {
+                "v" : cloudvar.CloudVarValueToJson(value),
+            }
             if timestamp_type == "epoch_us" {
-                out["vars"].(map[string]interface{})[varDef.Name()] = map[string]interface{} {
-                    "t" : canotime.EpochMicroseconds(sample.Timestamp),
-                    "v" : sample.Value,
-                }
+                varJsonObj["t"] = canotime.EpochMicroseconds(sample.Timestamp)
             } else {
-                out["vars"].(map[string]interface{})[varDef.Name()] = map[string]interface{} {
-                    "t" : canotime.RFC3339(sample.Timestamp),
-                    "v" : sample.Value,
-                }
+                varJsonObj["t"] = canotime.RFC3339(sample.Timestamp)
+            }
+            if varUnits != "" {
+                varJsonObj["units"] = varUnits
             }
+            out["vars"].(map[string]interface{})[varDef.Name()] = varJsonObj
         }
 
+    }
 
-        // Generate JSON for notifications
-        //
-        /*notifications, err := device.HistoricNotifications()
-        canolog.Info("Reading notifications")
-        if err != nil {
-            canolog.Info("Error reading notifications %s", err)
-            return nil, err
+    // Generate JSON for notifications
+    notifications, err := device.HistoricNotifications()
+    if err != nil {
+        return nil, err
+    }
+    outNotifications := []interface{}{}
+    for _, notification := range notifications {
+        notifJsonObj := map[string]interface{}{
+            "id" : notification.ID(),
+            "dismissed" : notification.IsDismissed(),
+            "msg" : notification.Msg(),
+            "notify_type" : notify.NotifyTypeToString(notification.NotifyType()),
         }
-
-        outNotifications := []jsonNotification{};
-        for _, notification := range notifications {
-            outNotifications = append(
-                    outNotifications, 
-                    jsonNotification{
-                        notification.Datetime().Format(time.RFC3339),
-                        notification.IsDismissed(),
-                        notification.Msg(),
-                    })
-        }*/
+        if timestamp_type == "epoch_us" {
+            notifJsonObj["t"] = canotime.EpochMicroseconds(notification.Datetime())
+        } else {
+            notifJsonObj["t"] = canotime.RFC3339(notification.Datetime())
+        }
+        outNotifications = append(outNotifications, notifJsonObj)
     }
-    
+    out["notifs"] = outNotifications
+
     return out, nil
 
 }
+// Add the allowed values of each enum Cloud Variable in <varDefs> (including
+// struct members and array elements) to <out>, keyed by full variable name.
+// This lets UIs populate dropdowns without parsing "var_decls".
+func addEnumValuesJson(out map[string]interface{}, varDefs []sddl.VarDef) {
+    for _, varDef := range varDefs {
+        switch varDef.Datatype() {
+        case sddl.DATATYPE_ENUM:
+            values, err := varDef.EnumValues()
+            if err == nil {
+                out[varDef.Fullname()] = values
+            }
+        case sddl.DATATYPE_STRUCT:
+            members, _ := varDef.StructMembers()
+            addEnumValuesJson(out, members)
+        case sddl.DATATYPE_ARRAY:
+            elemDef, err := varDef.ArrayElement()
+            if err == nil && elemDef.Datatype() == sddl.DATATYPE_ENUM {
+                values, err := elemDef.EnumValues()
+                if err == nil {
+                    out[varDef.Fullname()] = values
+                }
+            }
+        }
+    }
+}
+
 func deviceToJsonString(device datalayer.Device, timestamp_type string) (string, error) {
-    out, err := deviceToJsonObj(device, timestamp_type)
+    out, err := deviceToJsonObj(device, timestamp_type, nil)
     if err != nil {
         return "", err;
     }
@@ -208,7 +335,7 @@ func devicesToJsonObj(devices []datalayer.Device, timestamp_type string) (map[st
     }
 
     for _, device := range devices {
-        deviceJsonObj, err := deviceToJsonObj(device, timestamp_type)
+        deviceJsonObj, err := deviceToJsonObj(device, timestamp_type, nil)
         if err != nil {
             continue
         }
@@ -238,7 +365,7 @@ func samplesToJsonObj(samples []cloudvar.CloudVarSample) (map[string]interface{}
     for _, sample := range samples {
         out["samples"] = append(out["samples"].([]interface{}), map[string]interface{}{
             "t" : canotime.EpochMicroseconds(sample.Timestamp),
-            "v" : sample.Value,
+            "v" : cloudvar.CloudVarValueToJson(sample.Value),
         })
     }
     return out
@@ -250,7 +377,7 @@ func samplesToJson(samples []cloudvar.CloudVarSample) (string, error) {
     for _, sample := range samples {
         out.Samples = append(out.Samples, jsonSample{
             sample.Timestamp.Format(time.RFC3339),
-            sample.Value})
+            cloudvar.CloudVarValueToJson(sample.Value)})
     }
 
     jsn, err := json.Marshal(out)
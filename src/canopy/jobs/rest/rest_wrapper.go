@@ -182,6 +182,13 @@ func RestJobWrapper(handler RestJobHandler) jobqueue.HandlerFunc {
             return
         }
 
+        // Get Pigeon Outbox from userCtx
+        info.PigeonOutbox, ok = userCtx["pigeon-outbox"].(jobqueue.Outbox)
+        if !ok {
+            RestSetError(resp, InternalServerError("Expected Outbox for 'pigeon-outbox'").Log())
+            return
+        }
+
         // Check for BASIC AUTH
         authHeader, ok := body["auth-header"].([]string)
         if !ok {
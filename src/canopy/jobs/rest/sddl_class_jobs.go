@@ -0,0 +1,90 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package rest
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "canopy/pigeon"
+    "canopy/webhooks"
+)
+
+// Pigeon message key for jobs that propagate a changed SDDL class document
+// to the class's member devices.
+const SDDLClassChangedJobKey = "sddl_class/changed"
+
+// Launch a job that propagates the current document of <class> to its
+// member devices.  Does not wait for the job to finish.
+func LaunchSDDLClassChanged(outbox jobqueue.Outbox, class datalayer.SDDLClass) error {
+    if outbox == nil {
+        return nil
+    }
+    respChan, err := outbox.Launch(SDDLClassChangedJobKey, map[string]interface{}{
+        "owner" : class.Owner(),
+        "name" : class.Name(),
+    })
+    if err != nil {
+        return err
+    }
+
+    // Nobody is interested in the result, but the response must be consumed.
+    go func() {
+        <-respChan
+    }()
+    return nil
+}
+
+// Pigeon handler for SDDLClassChangedJobKey jobs.  Expects a userCtx with
+// "db-conn" and "pigeon-outbox", and a request body of the form:
+//
+//      {"owner" : string, "name" : string}
+func SDDLClassChangedHandler(jobKey string, userCtxItf interface{}, req jobqueue.Request, resp jobqueue.Response) {
+    resp.SetBody(map[string]interface{}{"result" : "ok"})
+
+    userCtx, ok := userCtxItf.(map[string]interface{})
+    if !ok {
+        canolog.Error("SDDL classes: expected map[string]interface{} for userCtx")
+        return
+    }
+    conn, ok := userCtx["db-conn"].(datalayer.Connection)
+    if !ok {
+        canolog.Error("SDDL classes: expected datalayer.Connection for 'db-conn'")
+        return
+    }
+    outbox, _ := userCtx["pigeon-outbox"].(jobqueue.Outbox)
+
+    body := req.Body()
+    owner, _ := body["owner"].(string)
+    name, _ := body["name"].(string)
+    class, err := conn.LookupSDDLClass(owner, name)
+    if err != nil {
+        canolog.Error("SDDL classes: class ", owner, "/", name, " not found: ", err)
+        return
+    }
+
+    updated, err := class.PropagateDocument()
+    if err != nil {
+        canolog.Error("SDDL classes: error propagating ", owner, "/", name, ": ", err)
+        return
+    }
+    for _, deviceId := range updated {
+        err = webhooks.LaunchEvent(outbox, deviceId, webhooks.EventSDDLChange, map[string]interface{}{
+            "sddl_class" : owner + "/" + name,
+            "class_version" : class.Version(),
+        })
+        if err != nil {
+            canolog.Error("Error launching webhook delivery: ", err)
+        }
+    }
+}
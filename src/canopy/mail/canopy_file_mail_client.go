@@ -0,0 +1,226 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mail
+
+import (
+    "canopy/canolog"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "mime"
+    "mime/multipart"
+    "mime/quotedprintable"
+    netmail "net/mail"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// CanopyFileMailClient writes each message to its own .eml file in a
+// directory instead of sending it.  Useful for development and integration
+// testing, where the captured messages can be inspected with:
+//
+//      canopy-ops mail-outbox
+//
+// Filenames start with the UTC time the message was written, so they sort
+// in the order the messages were sent.
+type CanopyFileMailClient struct {
+    dir string
+}
+
+// StoredMail is a message read back from a mail directory.
+type StoredMail struct {
+    Filename string
+    From string
+    To string
+    Subject string
+    Date time.Time
+    Text string
+    HTML string
+}
+
+func NewFileMailClient(dir string) (MailClient, error) {
+    if dir == "" {
+        return nil, fmt.Errorf("email-dir must be set")
+    }
+    return &CanopyFileMailClient{dir: dir}, nil
+}
+
+func (*CanopyFileMailClient) NewMail() MailMessage {
+    return &CanopySMTPMail{}
+}
+
+func (client *CanopyFileMailClient) Send(m MailMessage) error {
+    mail, ok := m.(*CanopySMTPMail)
+    if !ok {
+        return errors.New("Message was not constructed with CanopyFileMailClient")
+    }
+    if len(mail.to) == 0 {
+        return errors.New("Message has no recipients")
+    }
+    if mail.from == nil {
+        return errors.New("Message has no sender")
+    }
+
+    body, err := mail.encode(mail.from)
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(client.dir, 0700)
+    if err != nil {
+        return err
+    }
+    suffix, err := randomHex(4)
+    if err != nil {
+        return err
+    }
+    name := time.Now().UTC().Format("20060102T150405.000000000Z") + "-" + suffix + ".eml"
+
+    // Write to a temporary file first so that readers never see a partial
+    // message.
+    tmp, err := ioutil.TempFile(client.dir, ".tmp-")
+    if err != nil {
+        return err
+    }
+    _, err = tmp.Write(body)
+    if err == nil {
+        err = tmp.Close()
+    } else {
+        tmp.Close()
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    err = os.Rename(tmp.Name(), filepath.Join(client.dir, name))
+    if err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+
+    canolog.Info("Wrote email to ", mail.to, " as ", name)
+    return nil
+}
+
+// List the .eml files in <dir>, oldest first.
+func ListStoredMail(dir string) ([]string, error) {
+    entries, err := ioutil.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    names := []string{}
+    for _, entry := range entries {
+        if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".eml") {
+            names = append(names, entry.Name())
+        }
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+// Read and decode a message written by CanopyFileMailClient (or any simple
+// text, HTML or multipart/alternative message).
+func ReadStoredMail(filename string) (*StoredMail, error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    msg, err := netmail.ReadMessage(f)
+    if err != nil {
+        return nil, err
+    }
+
+    date, _ := msg.Header.Date()
+    out := &StoredMail{
+        Filename: filepath.Base(filename),
+        From: decodeHeader(msg.Header.Get("From")),
+        To: decodeHeader(msg.Header.Get("To")),
+        Subject: decodeHeader(msg.Header.Get("Subject")),
+        Date: date,
+    }
+
+    err = readMailPart(out, msg.Header.Get("Content-Type"),
+            msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+    if err != nil {
+        return nil, err
+    }
+    return out, nil
+}
+
+// Decode RFC 2047 encoded-words in a header value, leaving it unchanged if
+// it can't be decoded.
+func decodeHeader(value string) string {
+    decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+    if err != nil {
+        return value
+    }
+    return decoded
+}
+
+// Decode a single body part into <out>, recursing into multipart parts.
+func readMailPart(out *StoredMail, contentType, encoding string, body io.Reader) error {
+    if contentType == "" {
+        contentType = "text/plain"
+    }
+    mediaType, params, err := mime.ParseMediaType(contentType)
+    if err != nil {
+        return err
+    }
+
+    if strings.HasPrefix(mediaType, "multipart/") {
+        r := multipart.NewReader(body, params["boundary"])
+        for {
+            part, err := r.NextPart()
+            if err == io.EOF {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            err = readMailPart(out, part.Header.Get("Content-Type"),
+                    part.Header.Get("Content-Transfer-Encoding"), part)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    switch strings.ToLower(encoding) {
+    case "base64":
+        body = base64.NewDecoder(base64.StdEncoding, body)
+    case "quoted-printable":
+        body = quotedprintable.NewReader(body)
+    }
+    content, err := ioutil.ReadAll(body)
+    if err != nil {
+        return err
+    }
+
+    switch mediaType {
+    case "text/plain":
+        out.Text += string(content)
+    case "text/html":
+        out.HTML += string(content)
+    }
+    return nil
+}
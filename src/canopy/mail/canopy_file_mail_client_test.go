@@ -0,0 +1,124 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mail
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestFileMailClientRequiresDir(t *testing.T) {
+    if _, err := NewFileMailClient(""); err == nil {
+        t.Errorf("Expected error for empty directory")
+    }
+}
+
+func TestFileMailClientRoundTrip(t *testing.T) {
+    dir, err := ioutil.TempDir("", "canopy-mail")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    outbox := filepath.Join(dir, "outbox")
+
+    client, err := NewFileMailClient(outbox)
+    if err != nil {
+        t.Fatal(err)
+    }
+    date := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+
+    m := newTestMail(t, client)
+    m.SetDate(date)
+    if err := client.Send(m); err != nil {
+        t.Fatalf("Send: %s", err)
+    }
+
+    m = client.NewMail()
+    m.SetFrom("alerts@example.com", "")
+    m.AddTo("three@example.com", "")
+    m.SetSubject("Plain")
+    m.SetText("Text only")
+    if err := client.Send(m); err != nil {
+        t.Fatalf("Send: %s", err)
+    }
+
+    // Messages without recipients are refused, and leave nothing behind.
+    m = client.NewMail()
+    m.SetFrom("alerts@example.com", "")
+    if err := client.Send(m); err == nil {
+        t.Errorf("Expected error for message without recipients")
+    }
+
+    names, err := ListStoredMail(outbox)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(names) != 2 {
+        t.Fatalf("Expected 2 stored messages, got %v", names)
+    }
+    entries, _ := ioutil.ReadDir(outbox)
+    if len(entries) != 2 {
+        t.Errorf("Expected only the stored messages in %s, got %d files", outbox, len(entries))
+    }
+
+    first, err := ReadStoredMail(filepath.Join(outbox, names[0]))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if first.Filename != names[0] {
+        t.Errorf("Filename %q, expected %q", first.Filename, names[0])
+    }
+    if first.From != `"Canopy Alerts" <alerts@example.com>` {
+        t.Errorf("From %q", first.From)
+    }
+    if first.To != `"One" <one@example.com>, <two@example.com>` {
+        t.Errorf("To %q", first.To)
+    }
+    if first.Subject != "Température élevée" {
+        t.Errorf("Subject %q", first.Subject)
+    }
+    if !first.Date.Equal(date) {
+        t.Errorf("Date %s, expected %s", first.Date, date)
+    }
+    if first.Text != "Device is hot" || first.HTML != "<b>Device is hot</b>" {
+        t.Errorf("Body %q / %q", first.Text, first.HTML)
+    }
+
+    second, err := ReadStoredMail(filepath.Join(outbox, names[1]))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if second.Subject != "Plain" || second.Text != "Text only" || second.HTML != "" {
+        t.Errorf("Unexpected second message %+v", second)
+    }
+}
+
+func TestNoOpMailClient(t *testing.T) {
+    client, err := NewNoOpMailClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    m := client.NewMail()
+    m.SetFrom("alerts@example.com", "")
+    m.AddTo("one@example.com", "")
+    m.SetSubject("Hello")
+    if err := client.Send(m); err != nil {
+        t.Errorf("Send: %s", err)
+    }
+}
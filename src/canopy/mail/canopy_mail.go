@@ -18,6 +18,7 @@ package mail
 import (
     "canopy/config"
     "fmt"
+    "net/textproto"
     "time"
 )
 
@@ -45,7 +46,20 @@ func NewMailClient(cfg config.Config) (MailClient, error) {
         username := cfg.OptSendgridUsername()
         secret := cfg.OptSendgridSecretKey()
         return NewSendGridMailClient(username, secret)
+    case "smtp":
+        return NewSMTPMailClient(cfg.OptSMTPHost(), cfg.OptSMTPPort(),
+                cfg.OptSMTPSecurity(), cfg.OptSMTPUsername(),
+                cfg.OptSMTPPassword(), cfg.OptSMTPFrom())
+    case "file":
+        return NewFileMailClient(cfg.OptEmailDir())
     default:
         return nil, fmt.Errorf("Unsupported mail service: %s", cfg.OptEmailService())
     }
 }
+
+// Did sending fail for a reason that retrying won't fix, ex: the recipient
+// does not exist?  Only the SMTP client reports these, as 5xx replies.
+func IsPermanentError(err error) bool {
+    protoErr, ok := err.(*textproto.Error)
+    return ok && protoErr.Code >= 500
+}
@@ -0,0 +1,376 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mail
+
+import (
+    "bytes"
+    "canopy/canolog"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "mime/multipart"
+    "net"
+    netmail "net/mail"
+    "net/smtp"
+    "net/textproto"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// CanopySMTPClient sends mail through an SMTP server.  The connection is
+// secured according to <security>, which is one of:
+//
+//      "starttls"  Connect in plaintext and upgrade with STARTTLS, which the
+//                  server must support.
+//      "tls"       Connect with TLS from the start, ex: on port 465.
+//      "none"      Never encrypt.  Only suitable for a local relay.
+//
+// If <from> is set, it replaces the address each message is sent from,
+// keeping the sender's display name.  Relays often only accept mail from the
+// authenticated user's address.
+type CanopySMTPClient struct {
+    host string
+    port int16
+    security string
+    username string
+    password string
+    from string
+}
+
+type CanopySMTPMail struct {
+    to []*netmail.Address
+    from *netmail.Address
+    replyTo string
+    subject string
+    text string
+    html string
+    date time.Time
+}
+
+// Timeout for connecting to the SMTP server.
+const smtpDialTimeout = 30*time.Second
+
+func NewSMTPMailClient(host string, port int16, security, username, password, from string) (MailClient, error) {
+    if host == "" {
+        return nil, fmt.Errorf("smtp-host must be set")
+    }
+    if security != "starttls" && security != "tls" && security != "none" {
+        return nil, fmt.Errorf("Invalid smtp-security: %s", security)
+    }
+    if from != "" {
+        _, err := netmail.ParseAddress(from)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid smtp-from: %s", err)
+        }
+    }
+    return &CanopySMTPClient{
+        host: host,
+        port: port,
+        security: security,
+        username: username,
+        password: password,
+        from: from,
+    }, nil
+}
+
+func (*CanopySMTPClient) NewMail() MailMessage {
+    return &CanopySMTPMail{}
+}
+
+// Connect to the SMTP server and authenticate.
+func (client *CanopySMTPClient) dial() (*smtp.Client, error) {
+    addr := net.JoinHostPort(client.host, strconv.Itoa(int(client.port)))
+    tlsConfig := &tls.Config{ServerName: client.host}
+
+    var conn net.Conn
+    var err error
+    if client.security == "tls" {
+        dialer := &net.Dialer{Timeout: smtpDialTimeout}
+        conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+    } else {
+        conn, err = net.DialTimeout("tcp", addr, smtpDialTimeout)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    c, err := smtp.NewClient(conn, client.host)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    if client.security == "starttls" {
+        if ok, _ := c.Extension("STARTTLS"); !ok {
+            c.Close()
+            return nil, errors.New("SMTP server does not support STARTTLS")
+        }
+        err = c.StartTLS(tlsConfig)
+        if err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+
+    if client.username != "" {
+        if ok, _ := c.Extension("AUTH"); !ok {
+            c.Close()
+            return nil, errors.New("SMTP server does not support AUTH")
+        }
+        err = c.Auth(smtp.PlainAuth("", client.username, client.password, client.host))
+        if err != nil {
+            c.Close()
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+func (client *CanopySMTPClient) Send(m MailMessage) error {
+    mail, ok := m.(*CanopySMTPMail)
+    if !ok {
+        return errors.New("Message was not constructed with CanopySMTPClient")
+    }
+    if len(mail.to) == 0 {
+        return errors.New("Message has no recipients")
+    }
+
+    from := mail.from
+    if client.from != "" {
+        addr, _ := netmail.ParseAddress(client.from)
+        if from != nil {
+            addr.Name = from.Name
+        }
+        from = addr
+    }
+    if from == nil {
+        return errors.New("Message has no sender")
+    }
+
+    body, err := mail.encode(from)
+    if err != nil {
+        return err
+    }
+
+    canolog.Info("Sending email via SMTP to ", mail.to)
+    c, err := client.dial()
+    if err != nil {
+        canolog.Warn("Error connecting to SMTP server: ", err)
+        return err
+    }
+    defer c.Close()
+
+    err = c.Mail(from.Address)
+    if err != nil {
+        return err
+    }
+    for _, to := range mail.to {
+        err = c.Rcpt(to.Address)
+        if err != nil {
+            return err
+        }
+    }
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    _, err = w.Write(body)
+    if err != nil {
+        w.Close()
+        return err
+    }
+    err = w.Close()
+    if err != nil {
+        canolog.Warn("Error sending email: ", err)
+        return err
+    }
+    return c.Quit()
+}
+
+// Remove line breaks, so that values can't inject headers.
+func sanitizeHeader(value string) string {
+    return strings.NewReplacer("\r", "", "\n", " ").Replace(value)
+}
+
+// Encode a header value as an RFC 2047 encoded-word if it isn't plain
+// ASCII.
+func encodeHeader(value string) string {
+    value = sanitizeHeader(value)
+    for _, c := range value {
+        if c >= 0x80 {
+            return "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(value)) + "?="
+        }
+    }
+    return value
+}
+
+// Write <content> base64-encoded, with lines of at most 76 characters.
+func writeBase64(buf *bytes.Buffer, content string) {
+    encoded := base64.StdEncoding.EncodeToString([]byte(content))
+    for len(encoded) > 76 {
+        buf.WriteString(encoded[:76] + "\r\n")
+        encoded = encoded[76:]
+    }
+    buf.WriteString(encoded + "\r\n")
+}
+
+func randomHex(numBytes int) (string, error) {
+    randBytes := make([]byte, numBytes)
+    _, err := rand.Read(randBytes)
+    if err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(randBytes), nil
+}
+
+// Encode the message in RFC 5322 format.  Messages with both text and HTML
+// are sent as multipart/alternative.
+func (mail *CanopySMTPMail) encode(from *netmail.Address) ([]byte, error) {
+    var buf bytes.Buffer
+
+    date := mail.date
+    if date.IsZero() {
+        date = time.Now()
+    }
+    messageId, err := randomHex(16)
+    if err != nil {
+        return nil, err
+    }
+    domain := from.Address[strings.LastIndex(from.Address, "@") + 1:]
+
+    tos := []string{}
+    for _, to := range mail.to {
+        tos = append(tos, to.String())
+    }
+
+    buf.WriteString("From: " + from.String() + "\r\n")
+    buf.WriteString("To: " + strings.Join(tos, ", ") + "\r\n")
+    if mail.replyTo != "" {
+        buf.WriteString("Reply-To: " + mail.replyTo + "\r\n")
+    }
+    buf.WriteString("Subject: " + encodeHeader(mail.subject) + "\r\n")
+    buf.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+    buf.WriteString("Message-ID: <" + messageId + "@" + domain + ">\r\n")
+    buf.WriteString("MIME-Version: 1.0\r\n")
+
+    if mail.html == "" || mail.text == "" {
+        contentType := "text/plain; charset=UTF-8"
+        content := mail.text
+        if mail.html != "" {
+            contentType = "text/html; charset=UTF-8"
+            content = mail.html
+        }
+        buf.WriteString("Content-Type: " + contentType + "\r\n")
+        buf.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+        writeBase64(&buf, content)
+        return buf.Bytes(), nil
+    }
+
+    var parts bytes.Buffer
+    w := multipart.NewWriter(&parts)
+    buf.WriteString("Content-Type: multipart/alternative; boundary=" + w.Boundary() + "\r\n\r\n")
+    // Clients display the last part they understand, so HTML goes last.
+    for _, part := range []struct{ contentType, content string }{
+        {"text/plain; charset=UTF-8", mail.text},
+        {"text/html; charset=UTF-8", mail.html},
+    } {
+        header := textproto.MIMEHeader{}
+        header.Set("Content-Type", part.contentType)
+        header.Set("Content-Transfer-Encoding", "base64")
+        partWriter, err := w.CreatePart(header)
+        if err != nil {
+            return nil, err
+        }
+        var encoded bytes.Buffer
+        writeBase64(&encoded, part.content)
+        _, err = partWriter.Write(encoded.Bytes())
+        if err != nil {
+            return nil, err
+        }
+    }
+    err = w.Close()
+    if err != nil {
+        return nil, err
+    }
+    buf.Write(parts.Bytes())
+    return buf.Bytes(), nil
+}
+
+func (mail *CanopySMTPMail) AddTo(email string, name string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    if name != "" {
+        addr.Name = sanitizeHeader(name)
+    }
+    mail.to = append(mail.to, addr)
+    return nil
+}
+
+func (mail *CanopySMTPMail) AddTos(emails []string, names []string) error {
+    for i, email := range emails {
+        name := ""
+        if i < len(names) {
+            name = names[i]
+        }
+        err := mail.AddTo(email, name)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (mail *CanopySMTPMail) SetSubject(subject string) {
+    mail.subject = subject
+}
+
+func (mail *CanopySMTPMail) SetText(text string) {
+    mail.text = text
+}
+
+func (mail *CanopySMTPMail) SetHTML(html string) {
+    mail.html = html
+}
+
+func (mail *CanopySMTPMail) SetFrom(email string, name string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    addr.Name = sanitizeHeader(name)
+    mail.from = addr
+    return nil
+}
+
+func (mail *CanopySMTPMail) SetReplyTo(email string) error {
+    addr, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    mail.replyTo = addr.String()
+    return nil
+}
+
+func (mail *CanopySMTPMail) SetDate(date time.Time) error {
+    mail.date = date
+    return nil
+}
@@ -0,0 +1,270 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package mail
+
+import (
+    "bytes"
+    "canopy/canolog"
+    "encoding/base64"
+    "net"
+    netmail "net/mail"
+    "net/textproto"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func init() {
+    canolog.InitFallback()
+}
+
+// smtpStandIn is a minimal in-process SMTP server that records what each
+// client sends.  Recipients listed in <reject> get a 550 reply.
+type smtpStandIn struct {
+    listener net.Listener
+    reject map[string]bool
+    done chan bool
+
+    auth string
+    from string
+    rcpts []string
+    data []byte
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+    // Ports are configured as int16, and ephemeral ports are usually above
+    // that range, so look for a free one below it.
+    var listener net.Listener
+    var err error
+    for port := 20025; port < 32768; port += 100 {
+        listener, err = net.Listen("tcp", "127.0.0.1:" + strconv.Itoa(port))
+        if err == nil {
+            break
+        }
+    }
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := &smtpStandIn{
+        listener: listener,
+        reject: map[string]bool{},
+        done: make(chan bool, 1),
+    }
+    go server.serve()
+    return server
+}
+
+func (server *smtpStandIn) port() int16 {
+    _, port, _ := net.SplitHostPort(server.listener.Addr().String())
+    p, _ := strconv.Atoi(port)
+    return int16(p)
+}
+
+// Handle a single session.
+func (server *smtpStandIn) serve() {
+    defer func() { server.done <- true }()
+    conn, err := server.listener.Accept()
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+    tp := textproto.NewConn(conn)
+
+    tp.PrintfLine("220 localhost ESMTP stand-in")
+    for {
+        line, err := tp.ReadLine()
+        if err != nil {
+            return
+        }
+        cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+        arg := strings.TrimSpace(line[len(cmd):])
+        switch cmd {
+        case "EHLO":
+            tp.PrintfLine("250-localhost")
+            tp.PrintfLine("250 AUTH PLAIN")
+        case "AUTH":
+            server.auth = arg
+            tp.PrintfLine("235 Authenticated")
+        case "MAIL":
+            server.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+            tp.PrintfLine("250 OK")
+        case "RCPT":
+            rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+            if server.reject[rcpt] {
+                tp.PrintfLine("550 No such user")
+                continue
+            }
+            server.rcpts = append(server.rcpts, rcpt)
+            tp.PrintfLine("250 OK")
+        case "DATA":
+            tp.PrintfLine("354 Go ahead")
+            server.data, err = tp.ReadDotBytes()
+            if err != nil {
+                return
+            }
+            tp.PrintfLine("250 Queued")
+        case "QUIT":
+            tp.PrintfLine("221 Bye")
+            return
+        default:
+            tp.PrintfLine("502 Not implemented")
+        }
+    }
+}
+
+func (server *smtpStandIn) close() {
+    server.listener.Close()
+    <-server.done
+}
+
+func newTestMail(t *testing.T, client MailClient) MailMessage {
+    m := client.NewMail()
+    if err := m.SetFrom("alerts@example.com", "Canopy Alerts"); err != nil {
+        t.Fatal(err)
+    }
+    if err := m.AddTos([]string{"one@example.com", "two@example.com"}, []string{"One"}); err != nil {
+        t.Fatal(err)
+    }
+    m.SetSubject("Température élevée")
+    m.SetText("Device is hot")
+    m.SetHTML("<b>Device is hot</b>")
+    return m
+}
+
+func TestSMTPSend(t *testing.T) {
+    server := newSMTPStandIn(t)
+    client, err := NewSMTPMailClient("127.0.0.1", server.port(), "none", "user", "secret", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = client.Send(newTestMail(t, client))
+    server.close()
+    if err != nil {
+        t.Fatalf("Send: %s", err)
+    }
+
+    expectedAuth := "PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+    if server.auth != expectedAuth {
+        t.Errorf("AUTH %q, expected %q", server.auth, expectedAuth)
+    }
+    if server.from != "alerts@example.com" {
+        t.Errorf("MAIL FROM %q", server.from)
+    }
+    if strings.Join(server.rcpts, ",") != "one@example.com,two@example.com" {
+        t.Errorf("RCPT TO %v", server.rcpts)
+    }
+
+    msg, err := netmail.ReadMessage(bytes.NewReader(server.data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    received := &StoredMail{
+        From: decodeHeader(msg.Header.Get("From")),
+        To: decodeHeader(msg.Header.Get("To")),
+        Subject: decodeHeader(msg.Header.Get("Subject")),
+    }
+    err = readMailPart(received, msg.Header.Get("Content-Type"),
+            msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if received.From != `"Canopy Alerts" <alerts@example.com>` {
+        t.Errorf("From %q", received.From)
+    }
+    if received.To != `"One" <one@example.com>, <two@example.com>` {
+        t.Errorf("To %q", received.To)
+    }
+    if received.Subject != "Température élevée" {
+        t.Errorf("Subject %q", received.Subject)
+    }
+    if received.Text != "Device is hot" || received.HTML != "<b>Device is hot</b>" {
+        t.Errorf("Body %q / %q", received.Text, received.HTML)
+    }
+}
+
+func TestSMTPFromOverride(t *testing.T) {
+    server := newSMTPStandIn(t)
+    client, err := NewSMTPMailClient("127.0.0.1", server.port(), "none", "", "", "relay@example.net")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = client.Send(newTestMail(t, client))
+    server.close()
+    if err != nil {
+        t.Fatalf("Send: %s", err)
+    }
+    if server.auth != "" {
+        t.Errorf("Authenticated without a username")
+    }
+    if server.from != "relay@example.net" {
+        t.Errorf("MAIL FROM %q", server.from)
+    }
+    msg, err := netmail.ReadMessage(bytes.NewReader(server.data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if msg.Header.Get("From") != `"Canopy Alerts" <relay@example.net>` {
+        t.Errorf("From %q", msg.Header.Get("From"))
+    }
+}
+
+func TestSMTPRejectedRecipient(t *testing.T) {
+    server := newSMTPStandIn(t)
+    server.reject["two@example.com"] = true
+    client, err := NewSMTPMailClient("127.0.0.1", server.port(), "none", "", "", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = client.Send(newTestMail(t, client))
+    server.close()
+    if err == nil {
+        t.Fatalf("Expected error for rejected recipient")
+    }
+    if !IsPermanentError(err) {
+        t.Errorf("Expected permanent error, got %s", err)
+    }
+    if server.data != nil {
+        t.Errorf("Message sent despite rejected recipient")
+    }
+}
+
+func TestSMTPStartTLSRequired(t *testing.T) {
+    server := newSMTPStandIn(t)
+    client, err := NewSMTPMailClient("127.0.0.1", server.port(), "starttls", "", "", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = client.Send(newTestMail(t, client))
+    server.close()
+    if err == nil {
+        t.Fatalf("Sent without STARTTLS")
+    }
+    if server.from != "" {
+        t.Errorf("Message sent without STARTTLS")
+    }
+}
+
+func TestNewSMTPMailClientValidation(t *testing.T) {
+    if _, err := NewSMTPMailClient("", 25, "none", "", "", ""); err == nil {
+        t.Errorf("Expected error for empty host")
+    }
+    if _, err := NewSMTPMailClient("localhost", 25, "ssl", "", "", ""); err == nil {
+        t.Errorf("Expected error for invalid security")
+    }
+    if _, err := NewSMTPMailClient("localhost", 25, "none", "", "", "not an address"); err == nil {
+        t.Errorf("Expected error for invalid from address")
+    }
+}
@@ -0,0 +1,293 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+// Built-in English email templates.  Copy these into "email-template-dir"
+// as a starting point for overrides and translations.
+var builtinTemplates = map[string]string{
+    "layout.html": `<html>
+    <body style='font-family: sans-serif'>
+    <table align="center" width="600" border=0 cellspacing=0 cellpadding=0 style="border-collapse: collapse;">
+        <tr>
+            <td bgcolor=#204080 style='border:4px solid #204080; color:#ffffff; padding: 16px 16px 0px 16px;'>
+                {{block "greeting" .}}{{if .Username}}<p>
+                    Hi <b>{{.Username}}</b>,
+                </p>{{end}}{{end}}
+                <p>
+                    <font size=6><b>{{template "heading" .}}</b></font>
+                </p>
+                <p>{{block "tagline" .}}The open cloud for IoT.{{end}}</p>
+                <br>
+            </td>
+        </tr>
+        <tr>
+            <td bgcolor=#f0f0f0 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
+                {{template "body" .}}
+                <br>
+            </td>
+        </tr>
+        <tr>
+            <td bgcolor=#ffff80 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
+                <b>Note</b>: {{template "note" .}}
+            </td>
+        </tr>
+        <tr>
+            <td style='font-size:12px'>
+                <br>
+                <b>Web: </b><a href=http://canopy.link>canopy.link</a>
+                <br><b>Twitter:</b><a href='http://twitter.com/CanopyIOT'>@CanopyIoT</a>
+                <br><b>Github:</b><a href='http://github.com/canopy-project'>github.com/canopy-project</a>
+                <br><b>Forum:</b><a href='http://canopy.lefora.com'>canopy.lefora.com</a>
+            </td>
+        </tr>
+    </table>
+    </body>
+</html>`,
+
+    "new_account.subject": `Your New Canopy Account (on {{.Hostname}})`,
+    "new_account.txt": `Hi {{.Username}},
+
+Welcome to Canopy, the open cloud for IoT.
+
+You must activate your account by visiting the link below:
+
+{{.ActivationLink}}
+
+Manage your Canopy-enabled devices by going here:
+
+{{.ManageURL}}
+
+Note: This account is only for {{.Hostname}}.  Other deployments of the
+Canopy Server require separate accounts.
+`,
+    "new_account.html": `{{define "heading"}}Welcome to Canopy{{end}}
+{{define "body"}}
+                <h3><br>Activate Your Account</h3>
+                <p>
+                    You must activate your account by clicking the link below.
+                </p>
+
+                <p>
+                    <a href="{{.ActivationLink}}">Activate your account.</a>
+                </p>
+                <h3><br>Manage Your Devices</h3>
+                Manage your Canopy-enabled devices by going here:
+                <p>
+                    <a href="{{.ManageURL}}">{{.ManageURL}}</a>
+                </p>
+{{end}}
+{{define "note"}}This account is only for
+                <b>{{.Hostname}}</b>.  Other deployments of the Canopy
+                Server require separate accounts.{{end}}`,
+
+    "reset_password.subject": `Reset your Canopy password (on {{.Hostname}})`,
+    "reset_password.txt": `Hi {{.Username}},
+
+If you believe you have received this email in error then simply disregard
+this message.
+
+To reset your Canopy password, visit the link below.  The link will expire
+in 24 hours.
+
+{{.ResetLink}}
+
+After resetting your password, you can manage your Canopy-enabled devices by
+going here:
+
+{{.ManageURL}}
+
+Note: This is only for {{.Hostname}}.  Other deployments of the Canopy
+Server have separate accounts.
+`,
+    "reset_password.html": `{{define "heading"}}Canopy Password Reset{{end}}
+{{define "tagline"}}<br>{{end}}
+{{define "body"}}
+                <p>
+                    <br><i>If you believe you have received this email in error
+                    then simply disregard this message.</i>
+                </p>
+                <h3><br>Reset Password</h3>
+                <p>
+                    To reset your Canopy password, click the link below.  The
+                    link will expire in 24 hours.
+                </p>
+
+                <p>
+                    <a href="{{.ResetLink}}">Reset your password.</a>
+                </p>
+                <h3><br>Manage Your Devices</h3>
+                After resetting your password, you can manage your
+                Canopy-enabled devices by going here:
+                <p>
+                    <a href="{{.ManageURL}}">{{.ManageURL}}</a>
+                </p>
+{{end}}
+{{define "note"}}This is only for
+                <b>{{.Hostname}}</b>.  Other deployments of the Canopy
+                Server have separate accounts.{{end}}`,
+
+    "email_changed_from.subject": `Your email address has changed (on {{.Hostname}})`,
+    "email_changed_from.txt": `Hi {{.Username}},
+
+Your email address has changed.  You will no longer receive Canopy email at
+this address.  You should receive a verification email at your new email
+address.
+
+Note: This email address change is only for {{.Hostname}}.  Other
+deployments of the Canopy Server may have separate accounts.
+`,
+    "email_changed_from.html": `{{define "heading"}}Canopy{{end}}
+{{define "body"}}
+                <h3><br>Your Email Address Has Changed</h3>
+                <p>
+                    You will no longer receive Canopy email at this address.
+                    You should receive a verification email at your new email
+                    address.
+                </p>
+{{end}}
+{{define "note"}}This email address change is only for
+                <b>{{.Hostname}}</b>.  Other deployments of the Canopy
+                Server may have separate accounts.{{end}}`,
+
+    "email_changed_to.subject": `Verify your new email address (on {{.Hostname}})`,
+    "email_changed_to.txt": `Hi {{.Username}},
+
+You must verify your new email address by visiting the link below:
+
+{{.ActivationLink}}
+
+Manage your Canopy-enabled devices by going here:
+
+{{.ManageURL}}
+
+Note: This email address change is only for {{.Hostname}}.  Other
+deployments of the Canopy Server may have separate accounts.
+`,
+    "email_changed_to.html": `{{define "heading"}}Canopy{{end}}
+{{define "body"}}
+                <h3><br>Verify New Email Address</h3>
+                <p>
+                    You must verify your new email address by clicking the link
+                    below.
+                </p>
+
+                <p>
+                    <a href="{{.ActivationLink}}">Verify my new email address</a>
+                </p>
+                <h3><br>Manage Your Devices</h3>
+                Manage your Canopy-enabled devices by going here:
+                <p>
+                    <a href="{{.ManageURL}}">{{.ManageURL}}</a>
+                </p>
+{{end}}
+{{define "note"}}This email address change is only for
+                <b>{{.Hostname}}</b>.  Other deployments of the Canopy
+                Server may have separate accounts.{{end}}`,
+
+    "account_deleted.subject": `Canopy account deleted (on {{.Hostname}})`,
+    "account_deleted.txt": `Farewell {{.Username}},
+
+Your account has been deleted.
+
+If you believe this is a mistake, then please contact your Canopy system
+admin immediately.  There is a chance your account can be recovered if you
+act quickly.
+
+Note: This message is only for {{.Hostname}}.  You may still have separate
+accounts on other deployments of the Canopy Server.
+`,
+    "account_deleted.html": `{{define "heading"}}Farewell{{end}}
+{{define "tagline"}}We're sorry to see you go.{{end}}
+{{define "body"}}
+                <h3><br>Your account has been deleted.</h3>
+                <p>
+                    If you believe this is a mistake, then please contact your
+                    Canopy system admin immediately.  There is a chance your
+                    account can be recovered if you act quickly.
+                </p>
+{{end}}
+{{define "note"}}This message is only for
+                <b>{{.Hostname}}</b>.  You may still have separate accounts
+                on other deployments of the Canopy Server.{{end}}`,
+
+    "notification_digest.subject": `Canopy notification digest: {{len .Items}} new (on {{.Hostname}})`,
+    "notification_digest.txt": `Hi {{.Username}},
+
+Notifications from your devices since your last digest:
+
+{{range .Items}}{{.Time}}  {{.DeviceName}} [{{.Priority}}]: {{.Msg}}
+{{end}}
+Manage your devices and notification settings here:
+{{.ManageURL}}
+`,
+    "notification_digest.html": `{{define "heading"}}Notification Digest{{end}}
+{{define "tagline"}}What your devices have been saying.{{end}}
+{{define "body"}}
+                <h3><br>Since Your Last Digest</h3>
+                <table border=0 cellspacing=0 cellpadding=0 style="border-collapse: collapse; font-size: 14px;">
+                    {{range .Items}}<tr>
+                        <td style='padding: 4px 8px 4px 0px; white-space: nowrap;'>{{.Time}}</td>
+                        <td style='padding: 4px 8px 4px 0px;'><b>{{.DeviceName}}</b></td>
+                        <td style='padding: 4px 8px 4px 0px;'>{{.Priority}}</td>
+                        <td style='padding: 4px 0px 4px 0px;'>{{.Msg}}</td>
+                    </tr>{{end}}
+                </table>
+                <h3><br>Manage Your Notifications</h3>
+                Change how you receive notifications by going here:
+                <p>
+                    <a href="{{.ManageURL}}">{{.ManageURL}}</a>
+                </p>
+{{end}}
+{{define "note"}}This digest is only for devices on
+                <b>{{.Hostname}}</b>.{{end}}`,
+
+    "share_invite.subject": `{{.Sharer}} shared "{{.DeviceName}}" with you (on {{.Hostname}})`,
+    "share_invite.txt": `Hi,
+
+{{.Sharer}} has shared the device "{{.DeviceName}}" with you on Canopy.
+
+Accept the invitation here:
+
+{{.ShareLink}}
+
+This link can only be used once, and expires in {{.ExpiryDays}} days.
+
+Canopy is a secure platform for monitoring and controlling physical
+devices.  Learn more at http://canopy.link
+
+Note: This device is on {{.Hostname}}.  You need an account there to use
+it.
+`,
+    "share_invite.html": `{{define "heading"}}A device has been shared with you{{end}}
+{{define "body"}}
+                <h3><br>{{.Sharer}} shared a device with you</h3>
+                <p>
+                    <a href="{{.ShareLink}}">{{.DeviceName}}</a>
+                </p>
+                <p>
+                    This link can only be used once, and expires in
+                    {{.ExpiryDays}} days.
+                </p>
+                <h3><br>What is Canopy?</h3>
+                <p>
+                    <b>Canopy</b> is a secure platform for monitoring and
+                    controlling physical devices.  Learn more at
+                    <a href=http://canopy.link>canopy.link</a>
+                </p>
+{{end}}
+{{define "note"}}This device is on
+                <b>{{.Hostname}}</b>.  You need an account there to use
+                it.{{end}}`,
+}
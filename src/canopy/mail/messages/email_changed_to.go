@@ -1,4 +1,4 @@
-// Copyright 2015 Canopy Services, Inc.
+// Copright 2014-2015 Canopy Services, Inc.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -15,63 +15,18 @@
 package messages
 
 import (
+    "canopy/config"
+    "canopy/datalayer"
     "canopy/mail"
 )
 
-func MailMessageEmailChangedTo(msg mail.MailMessage, username, activationLink, manageLink, hostname string) {
-    msg.SetSubject("Verify your new email address (on " + hostname + ")")
-
-    msg.SetHTML(`<html>
-    <body style='font-family: sans-serif'>
-    <table align="center" width="600" border=0 cellspacing=0 cellpadding=0 style="border-collapse: collapse;">
-        <tr>
-            <td bgcolor=#204080 style='border:4px solid #204080; color:#ffffff; padding: 16px 16px 0px 16px;'>
-                <p>
-                    Hi <b>` + username + `</b>,
-                </p>
-                <p>
-                    <font size=6><b>Canopy</b></font>
-                </p>
-                <p>The open cloud for IoT.</p>
-                <br>
-            </td>
-        </tr>
-        <tr>
-            <td bgcolor=#f0f0f0 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
-                <h3><br>Verify New Email Address</h3>
-                <p>
-                    You must verify your new email address by clicking the link
-                    below.
-                </p>
-
-                <p>
-                    <a href=` + activationLink + `>Verify my new email address</a>
-                </p>
-                <h3><br>Manage Your Devices</h3>
-                Manage your Canopy-enabled devices by going here:
-                <p>
-                    <a href=` + manageLink + `>` + manageLink + `</a>
-                </p>
-                <br>
-            </td>
-        </tr>
-        <tr>
-            <td bgcolor=#ffff80 style='border:4px solid #204080; color:#303030; padding: 16px 16px 16px 16px;'>
-                <b>Note</b>: This email address change is only for
-                <b>` + hostname + `</b>.  Other deployments of the Canopy
-                Server may have separate accounts.
-            </td>
-        </tr>
-        <tr>
-            <td style='font-size:12px'>
-                <br>
-                <b>Web: </b><a href=http://canopy.link>canopy.link</a>
-                <br><b>Twitter:</b><a href='http://twitter.com/CanopyIOT'>@CanopyIoT</a>
-                <br><b>Github:</b><a href='http://github.com/canopy-project'>github.com/canopy-project</a>
-                <br><b>Forum:</b><a href='http://canopy.lefora.com'>canopy.lefora.com</a>
-            </td>
-        </tr>
-    </table>
-    </body>
-</html>`)
+// Sent to the new address when an account's email address changes.
+func MailMessageEmailChangedTo(msg mail.MailMessage, cfg config.Config, account datalayer.Account, activationLink string) {
+    render(msg, cfg, account.Locale(), "email_changed_to", struct {
+        TemplateData
+        ActivationLink string
+    }{
+        newTemplateData(cfg, account.Username(), account.Locale()),
+        activationLink,
+    })
 }
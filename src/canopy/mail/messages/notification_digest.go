@@ -0,0 +1,49 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+import (
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/mail"
+)
+
+// A row of the notification digest, formatted for display.
+type DigestRow struct {
+    Time string
+    DeviceName string
+    Priority string
+    Msg string
+}
+
+// Summary of the notifications queued for an account's digest.
+func MailMessageNotificationDigest(msg mail.MailMessage, cfg config.Config, account datalayer.Account, items []datalayer.DigestItem) {
+    rows := []DigestRow{}
+    for _, item := range items {
+        rows = append(rows, DigestRow{
+            Time: item.Time.UTC().Format("Jan 2 15:04 MST"),
+            DeviceName: item.DeviceName,
+            Priority: datalayer.NotificationPriorityToString(item.NotifyType),
+            Msg: item.Msg,
+        })
+    }
+    render(msg, cfg, account.Locale(), "notification_digest", struct {
+        TemplateData
+        Items []DigestRow
+    }{
+        newTemplateData(cfg, account.Username(), account.Locale()),
+        rows,
+    })
+}
@@ -0,0 +1,42 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+import (
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/mail"
+    "time"
+)
+
+// Sent when <sharer> shares a device with someone by email.  The recipient
+// may not have an account, so the email uses <locale>, which is typically
+// the recipient's if known, otherwise the sharer's.  <shareLink> accepts the
+// invitation, and stops working after datalayer.ShareInvitationLifetime.
+func MailMessageShareInvite(msg mail.MailMessage, cfg config.Config, sharer datalayer.Account, locale string, device datalayer.Device, shareLink string) {
+    render(msg, cfg, locale, "share_invite", struct {
+        TemplateData
+        Sharer string
+        DeviceName string
+        ShareLink string
+        ExpiryDays int
+    }{
+        newTemplateData(cfg, "", locale),
+        sharer.Username(),
+        device.Name(),
+        shareLink,
+        int(datalayer.ShareInvitationLifetime/(24*time.Hour)),
+    })
+}
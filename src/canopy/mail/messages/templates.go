@@ -0,0 +1,242 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messages
+
+// Emails are rendered from templates.  Each message <name> has three:
+//
+//      <name>.subject  Subject line (text/template)
+//      <name>.txt      Plain text body (text/template)
+//      <name>.html     HTML body (html/template)
+//
+// HTML bodies are rendered into "layout.html", which supplies the page
+// frame and footer.  Message templates define the "heading", "body" and
+// "note" blocks that the layout uses, and may redefine its "greeting" and
+// "tagline" blocks.
+//
+// Operators can override any template by placing a file with the same name
+// in the "email-template-dir" directory.  Translations go in
+// subdirectories named after the locale, so for an account with locale
+// "pt-BR" these are tried in order:
+//
+//      <email-template-dir>/pt-BR/<file>
+//      <email-template-dir>/pt/<file>
+//      <email-template-dir>/<file>
+//      Built-in English template
+//
+// Templates are read each time a message is sent, so changes take effect
+// without a restart.  If an operator's template fails to render, the
+// built-in templates are used instead.
+
+import (
+    "bytes"
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/mail"
+    "fmt"
+    htmltemplate "html/template"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    texttemplate "text/template"
+)
+
+// TemplateData holds the fields available to every template.
+type TemplateData struct {
+    // Recipient's username, if they have an account.
+    Username string
+
+    // Recipient's locale, or "" for the default.
+    Locale string
+
+    // The server's hostname, ex: "canopy.example.com".
+    Hostname string
+
+    // The server's base URL, ex: "https://canopy.example.com".
+    BaseURL string
+
+    // Link to the web manager.
+    ManageURL string
+}
+
+// Get the base URL of this server, derived from the "hostname",
+// "enable-https" and port options.
+func BaseURL(cfg config.Config) string {
+    if cfg.OptEnableHTTPS() {
+        if cfg.OptHTTPSPort() != 443 {
+            return fmt.Sprintf("https://%s:%d", cfg.OptHostname(), cfg.OptHTTPSPort())
+        }
+        return "https://" + cfg.OptHostname()
+    }
+    if cfg.OptHTTPPort() != 80 {
+        return fmt.Sprintf("http://%s:%d", cfg.OptHostname(), cfg.OptHTTPPort())
+    }
+    return "http://" + cfg.OptHostname()
+}
+
+// Get the URL of the web manager.
+func ManageURL(cfg config.Config) string {
+    return BaseURL(cfg) + "/mgr/"
+}
+
+// Get the link that activates <account>, or verifies its new email address.
+func ActivationLink(cfg config.Config, account datalayer.Account) string {
+    return BaseURL(cfg) + "/mgr/activate.html?username=" +
+            url.QueryEscape(account.Username()) + "&code=" +
+            url.QueryEscape(account.ActivationCode())
+}
+
+// Get the link that resets <account>'s password using <code>.
+func ResetPasswordLink(cfg config.Config, account datalayer.Account, code string) string {
+    return BaseURL(cfg) + "/mgr/reset_password.html?username=" +
+            url.QueryEscape(account.Username()) + "&code=" +
+            url.QueryEscape(code)
+}
+
+// Get the link that accepts the share invitation identified by <token>.
+func ShareInviteLink(cfg config.Config, token string) string {
+    return ManageURL(cfg) + "?share_token=" + url.QueryEscape(token)
+}
+
+func newTemplateData(cfg config.Config, username, locale string) TemplateData {
+    return TemplateData{
+        Username: username,
+        Locale: locale,
+        Hostname: cfg.OptHostname(),
+        BaseURL: BaseURL(cfg),
+        ManageURL: ManageURL(cfg),
+    }
+}
+
+// Reads the template named <file>, returning "" if there is none.
+type templateLoader func(file string) (string, error)
+
+// Loader for the built-in templates.
+func builtinTemplate(file string) (string, error) {
+    return builtinTemplates[file], nil
+}
+
+// Loader for templates in <dir>, falling back to the built-in templates.
+func dirTemplateLoader(dir, locale string) templateLoader {
+    if dir == "" {
+        return builtinTemplate
+    }
+
+    // ex: "pt-BR" tries "pt-BR", "pt", then the top-level directory
+    subdirs := []string{}
+    parts := strings.Split(locale, "-")
+    for i := len(parts); i > 0; i-- {
+        subdir := strings.Join(parts[:i], "-")
+        if subdir != "" && !strings.ContainsAny(subdir, `/\.`) {
+            subdirs = append(subdirs, subdir)
+        }
+    }
+    subdirs = append(subdirs, "")
+
+    return func(file string) (string, error) {
+        for _, subdir := range subdirs {
+            contents, err := ioutil.ReadFile(filepath.Join(dir, subdir, file))
+            if err == nil {
+                return string(contents), nil
+            }
+            if !os.IsNotExist(err) {
+                return "", err
+            }
+        }
+        return builtinTemplate(file)
+    }
+}
+
+func renderText(load templateLoader, file string, data interface{}) (string, error) {
+    source, err := load(file)
+    if err != nil || source == "" {
+        return "", err
+    }
+    tmpl, err := texttemplate.New(file).Parse(source)
+    if err != nil {
+        return "", err
+    }
+    var buf bytes.Buffer
+    err = tmpl.Execute(&buf, data)
+    if err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
+
+func renderHTML(load templateLoader, file string, data interface{}) (string, error) {
+    source, err := load(file)
+    if err != nil || source == "" {
+        return "", err
+    }
+    layout, err := load("layout.html")
+    if err != nil {
+        return "", err
+    }
+    tmpl, err := htmltemplate.New("layout.html").Parse(layout)
+    if err != nil {
+        return "", err
+    }
+    _, err = tmpl.New(file).Parse(source)
+    if err != nil {
+        return "", err
+    }
+    var buf bytes.Buffer
+    err = tmpl.ExecuteTemplate(&buf, "layout.html", data)
+    if err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
+
+func renderAll(load templateLoader, name string, data interface{}) (subject, text, html string, err error) {
+    subject, err = renderText(load, name + ".subject", data)
+    if err != nil {
+        return
+    }
+    if subject == "" {
+        err = fmt.Errorf("No subject template for %s", name)
+        return
+    }
+    subject = strings.TrimSpace(subject)
+    text, err = renderText(load, name + ".txt", data)
+    if err != nil {
+        return
+    }
+    html, err = renderHTML(load, name + ".html", data)
+    return
+}
+
+// Render message <name> into <msg>, using the templates for <locale>.
+func render(msg mail.MailMessage, cfg config.Config, locale, name string, data interface{}) {
+    load := dirTemplateLoader(cfg.OptEmailTemplateDir(), locale)
+    subject, text, html, err := renderAll(load, name, data)
+    if err != nil {
+        canolog.Error("Rendering email template ", name, ": ", err)
+        subject, text, html, err = renderAll(builtinTemplate, name, data)
+        if err != nil {
+            canolog.Error("Rendering built-in email template ", name, ": ", err)
+        }
+    }
+    msg.SetSubject(subject)
+    if text != "" {
+        msg.SetText(text)
+    }
+    if html != "" {
+        msg.SetHTML(html)
+    }
+}
@@ -0,0 +1,346 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mailqueue sends email asynchronously.
+//
+// Client is a mail.MailClient whose Send stores the message in the
+// datalayer's mail queue and launches a SendJobKey job, so that a slow or
+// failing mail service doesn't hold up the caller.  The job sends the
+// message with the configured mail service.  Failed attempts are retried
+// with exponential backoff, up to maxAttempts times.  Messages rejected
+// permanently (see mail.IsPermanentError) are marked bounced and not
+// retried.
+//
+// Retries waiting when a server stops are resumed by Resume when a server
+// starts.
+package mailqueue
+
+import (
+    "canopy/canolog"
+    "canopy/datalayer"
+    "canopy/mail"
+    "canopy/pigeon"
+    "encoding/json"
+    "errors"
+    "github.com/gocql/gocql"
+    netmail "net/mail"
+    "strings"
+    "time"
+)
+
+// Pigeon message key for jobs that send a queued message.
+const SendJobKey = "mail/send"
+
+// Number of times sending is attempted before giving up.
+const maxAttempts = 6
+
+// Delay before the first retry.  Each later retry waits twice as long.
+const retryDelay = time.Minute
+
+// Address is an email address with an optional display name.
+type Address struct {
+    Email string `json:"email"`
+    Name string `json:"name,omitempty"`
+}
+
+// Message is a queued message.  It implements mail.MailMessage, and is
+// stored JSON-encoded.
+type Message struct {
+    To []Address `json:"to"`
+    From Address `json:"from"`
+    ReplyTo string `json:"reply_to,omitempty"`
+    Subject string `json:"subject"`
+    Text string `json:"text,omitempty"`
+    HTML string `json:"html,omitempty"`
+    Date time.Time `json:"date"`
+}
+
+// Client is a mail.MailClient that queues messages instead of sending them.
+type Client struct {
+    conn datalayer.Connection
+    outbox jobqueue.Outbox
+}
+
+// Create a Client that stores messages using <conn> and launches send jobs
+// through <outbox>.  If <outbox> is nil, messages are only stored.
+func NewClient(conn datalayer.Connection, outbox jobqueue.Outbox) *Client {
+    return &Client{conn: conn, outbox: outbox}
+}
+
+func (client *Client) NewMail() mail.MailMessage {
+    return &Message{}
+}
+
+func (client *Client) Send(m mail.MailMessage) error {
+    msg, ok := m.(*Message)
+    if !ok {
+        return errors.New("Message was not constructed with mailqueue.Client")
+    }
+    if len(msg.To) == 0 {
+        return errors.New("Message has no recipients")
+    }
+    encoded, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+
+    queued := datalayer.QueuedMail{
+        Recipients: msg.recipients(),
+        Subject: msg.Subject,
+        Message: string(encoded),
+        Status: datalayer.MailQueued,
+        NextAttempt: time.Now().UTC(),
+    }
+    err = client.conn.EnqueueMail(&queued)
+    if err != nil {
+        return err
+    }
+    canolog.Info("Mail: queued ", queued.ID, " to ", queued.Recipients)
+    return Launch(client.outbox, queued.ID)
+}
+
+// Launch a job that sends queued message <id>.  Does not wait for the job
+// to finish.
+func Launch(outbox jobqueue.Outbox, id gocql.UUID) error {
+    if outbox == nil {
+        return nil
+    }
+    respChan, err := outbox.Launch(SendJobKey, map[string]interface{}{
+        "id" : id.String(),
+    })
+    if err != nil {
+        return err
+    }
+
+    // Nobody is interested in the result, but the response must be consumed.
+    go func() {
+        <-respChan
+    }()
+    return nil
+}
+
+// Launch a job for queued message <id> when <at> arrives.
+func launchAt(outbox jobqueue.Outbox, id gocql.UUID, at time.Time) {
+    time.AfterFunc(at.Sub(time.Now()), func() {
+        err := Launch(outbox, id)
+        if err != nil {
+            canolog.Error("Mail: could not launch send of ", id, ": ", err)
+        }
+    })
+}
+
+// Relaunch the messages that were waiting to be sent or retried.  Call
+// when a server starts.
+//
+// TODO: Every server does this, so messages stranded by a restart may be
+// sent more than once if several servers start together.
+func Resume(conn datalayer.Connection, outbox jobqueue.Outbox) error {
+    mails, err := conn.QueuedMails()
+    if err != nil {
+        return err
+    }
+    for _, queued := range mails {
+        if queued.Status == datalayer.MailQueued || queued.Status == datalayer.MailRetrying {
+            launchAt(outbox, queued.ID, queued.NextAttempt)
+        }
+    }
+    return nil
+}
+
+// Decode a message stored by Client.
+func DecodeMessage(queued datalayer.QueuedMail) (*Message, error) {
+    var msg Message
+    err := json.Unmarshal([]byte(queued.Message), &msg)
+    if err != nil {
+        return nil, err
+    }
+    return &msg, nil
+}
+
+// Send <msg> with <mailer>.
+func deliver(mailer mail.MailClient, msg *Message) error {
+    out := mailer.NewMail()
+    for _, to := range msg.To {
+        err := out.AddTo(to.Email, to.Name)
+        if err != nil {
+            return err
+        }
+    }
+    err := out.SetFrom(msg.From.Email, msg.From.Name)
+    if err != nil {
+        return err
+    }
+    if msg.ReplyTo != "" {
+        err = out.SetReplyTo(msg.ReplyTo)
+        if err != nil {
+            return err
+        }
+    }
+    if !msg.Date.IsZero() {
+        err = out.SetDate(msg.Date)
+        if err != nil {
+            return err
+        }
+    }
+    out.SetSubject(msg.Subject)
+    if msg.Text != "" {
+        out.SetText(msg.Text)
+    }
+    if msg.HTML != "" {
+        out.SetHTML(msg.HTML)
+    }
+    return mailer.Send(out)
+}
+
+// Pigeon handler for SendJobKey jobs.  Expects a userCtx with "db-conn",
+// "pigeon-outbox" and "mail-sender", the mail.MailClient that actually
+// sends, and a request body of the form:
+//
+//      {"id" : string}
+func SendHandler(jobKey string, userCtxItf interface{}, req jobqueue.Request, resp jobqueue.Response) {
+    resp.SetBody(map[string]interface{}{"result" : "ok"})
+
+    userCtx, ok := userCtxItf.(map[string]interface{})
+    if !ok {
+        canolog.Error("Mail: expected map[string]interface{} for userCtx")
+        return
+    }
+    conn, ok := userCtx["db-conn"].(datalayer.Connection)
+    if !ok {
+        canolog.Error("Mail: expected datalayer.Connection for 'db-conn'")
+        return
+    }
+    outbox, _ := userCtx["pigeon-outbox"].(jobqueue.Outbox)
+    sender, ok := userCtx["mail-sender"].(mail.MailClient)
+    if !ok {
+        canolog.Error("Mail: expected mail.MailClient for 'mail-sender'")
+        return
+    }
+
+    idString, _ := req.Body()["id"].(string)
+    id, err := gocql.ParseUUID(idString)
+    if err != nil {
+        canolog.Error("Mail: invalid id ", idString)
+        return
+    }
+    queued, err := conn.LookupQueuedMail(id)
+    if err != nil {
+        canolog.Error("Mail: queued message ", id, " not found: ", err)
+        return
+    }
+    if queued.Status != datalayer.MailQueued && queued.Status != datalayer.MailRetrying {
+        // Already handled, ex: by another server after a restart.
+        return
+    }
+
+    msg, err := DecodeMessage(queued)
+    if err == nil {
+        err = deliver(sender, msg)
+    }
+
+    queued.Attempts++
+    queued.TimeUpdated = time.Now().UTC()
+    queued.NextAttempt = time.Time{}
+    queued.Error = ""
+    switch {
+    case err == nil:
+        queued.Status = datalayer.MailSent
+        canolog.Info("Mail: sent ", id, " to ", queued.Recipients)
+    case mail.IsPermanentError(err):
+        queued.Status = datalayer.MailBounced
+        queued.Error = err.Error()
+        canolog.Warn("Mail: ", id, " to ", queued.Recipients, " bounced: ", err)
+    case queued.Attempts >= maxAttempts:
+        queued.Status = datalayer.MailFailed
+        queued.Error = err.Error()
+        canolog.Warn("Mail: giving up on ", id, " to ", queued.Recipients, ": ", err)
+    default:
+        queued.Status = datalayer.MailRetrying
+        queued.Error = err.Error()
+        delay := retryDelay << uint(queued.Attempts - 1)
+        queued.NextAttempt = queued.TimeUpdated.Add(delay)
+        canolog.Info("Mail: retrying ", id, " in ", delay, ": ", err)
+    }
+
+    err = conn.UpdateQueuedMail(queued)
+    if err != nil {
+        canolog.Error("Mail: could not record attempt for ", id, ": ", err)
+    }
+    if queued.Status == datalayer.MailRetrying {
+        launchAt(outbox, id, queued.NextAttempt)
+    }
+}
+
+// Comma-separated recipients, for display.
+func (msg *Message) recipients() string {
+    tos := []string{}
+    for _, to := range msg.To {
+        tos = append(tos, to.Email)
+    }
+    return strings.Join(tos, ", ")
+}
+
+func (msg *Message) AddTo(email string, name string) error {
+    _, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    msg.To = append(msg.To, Address{Email: email, Name: name})
+    return nil
+}
+
+func (msg *Message) AddTos(emails []string, names []string) error {
+    for i, email := range emails {
+        name := ""
+        if i < len(names) {
+            name = names[i]
+        }
+        err := msg.AddTo(email, name)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (msg *Message) SetSubject(subject string) {
+    msg.Subject = subject
+}
+
+func (msg *Message) SetText(text string) {
+    msg.Text = text
+}
+
+func (msg *Message) SetHTML(html string) {
+    msg.HTML = html
+}
+
+func (msg *Message) SetFrom(email string, name string) error {
+    _, err := netmail.ParseAddress(email)
+    if err != nil {
+        return err
+    }
+    msg.From = Address{Email: email, Name: name}
+    return nil
+}
+
+func (msg *Message) SetReplyTo(email string) error {
+    msg.ReplyTo = email
+    return nil
+}
+
+func (msg *Message) SetDate(date time.Time) error {
+    msg.Date = date
+    return nil
+}
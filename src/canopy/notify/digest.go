@@ -0,0 +1,144 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package notify
+
+import (
+    "canopy/canolog"
+    "canopy/config"
+    "canopy/datalayer"
+    "canopy/mail"
+    "canopy/mail/messages"
+    "canopy/pigeon"
+    "fmt"
+    "time"
+)
+
+// Pigeon job that sends every pending digest.
+const DigestJobKey = "notify/digest"
+
+// Get the next time at or after <now> when digests are sent, at <hour>
+// o'clock UTC.
+func nextDigestTime(now time.Time, hour int) time.Time {
+    now = now.UTC()
+    next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+    if next.Before(now) {
+        next = next.AddDate(0, 0, 1)
+    }
+    return next
+}
+
+// Launch a DigestJobKey job every day at <hour> o'clock UTC.  Does nothing
+// if <hour> is negative.
+//
+// TODO: Every server launches the job, so with several servers each digest
+// may be sent more than once.
+func ScheduleDigests(outbox jobqueue.Outbox, hour int) {
+    if hour < 0 {
+        canolog.Info("Notification digests disabled")
+        return
+    }
+    go func() {
+        for {
+            now := time.Now().UTC()
+            time.Sleep(nextDigestTime(now, hour).Sub(now))
+
+            respChan, err := outbox.Launch(DigestJobKey, map[string]interface{}{})
+            if err != nil {
+                canolog.Error("Notify: could not launch digest job: ", err)
+            } else {
+                <-respChan
+            }
+            // Don't launch twice in the same second.
+            time.Sleep(time.Second)
+        }
+    }()
+}
+
+// Send each account with pending digest items a summary email, and clear
+// the items that were sent.  Failures for individual accounts are logged,
+// and their items are kept for the next digest.
+func SendDigests(conn datalayer.Connection, mailer mail.MailClient, cfg config.Config) error {
+    if mailer == nil {
+        return fmt.Errorf("No mail service configured")
+    }
+    usernames, err := conn.DigestUsernames()
+    if err != nil {
+        return err
+    }
+
+    for _, username := range usernames {
+        account, err := conn.LookupAccount(username)
+        if err != nil {
+            canolog.Error("Notify: could not lookup digest recipient ", username, ": ", err)
+            continue
+        }
+        items, err := account.PendingDigest()
+        if err != nil {
+            canolog.Error("Notify: could not fetch digest for ", username, ": ", err)
+            continue
+        }
+        if len(items) == 0 {
+            continue
+        }
+
+        if account.Email() != "" {
+            msg := mailer.NewMail()
+            msg.AddTo(account.Email(), account.Username())
+            msg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
+            msg.SetReplyTo("no-reply@canopy.link")
+            messages.MailMessageNotificationDigest(msg, cfg, account, items)
+            err = mailer.Send(msg)
+            if err != nil {
+                canolog.Error("Notify: could not send digest to ", username, ": ", err)
+                continue
+            }
+        }
+
+        err = account.ClearDigest(items)
+        if err != nil {
+            canolog.Error("Notify: could not clear digest for ", username, ": ", err)
+        }
+    }
+    return nil
+}
+
+// Pigeon handler for DigestJobKey jobs.  Expects a userCtx with "cfg",
+// "db-conn" and "mailer".
+func DigestHandler(jobKey string, userCtxItf interface{}, req jobqueue.Request, resp jobqueue.Response) {
+    resp.SetBody(map[string]interface{}{"result" : "ok"})
+
+    userCtx, ok := userCtxItf.(map[string]interface{})
+    if !ok {
+        canolog.Error("Notify: expected map[string]interface{} for userCtx")
+        return
+    }
+    conn, ok := userCtx["db-conn"].(datalayer.Connection)
+    if !ok {
+        canolog.Error("Notify: expected datalayer.Connection for 'db-conn'")
+        return
+    }
+    cfg, ok := userCtx["cfg"].(config.Config)
+    if !ok {
+        canolog.Error("Notify: expected config.Config for 'cfg'")
+        return
+    }
+    mailer, _ := userCtx["mailer"].(mail.MailClient)
+
+    err := SendDigests(conn, mailer, cfg)
+    if err != nil {
+        canolog.Error("Notify: sending digests: ", err)
+    }
+}
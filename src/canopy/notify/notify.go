@@ -16,51 +16,387 @@
 package notify
 
 import (
+    "canopy/canolog"
+    "canopy/config"
     "canopy/datalayer"
     "canopy/mail"
+    "canopy/pigeon"
+    "canopy/sms"
+    "canopy/webhooks"
     "fmt"
     "time"
 )
 
-func ProcessNotification(device datalayer.Device, notifyType string, mailer mail.MailClient, msg string) error {
-    // Add to notification log
-    var notifyTypeInt int
+// Services used to deliver notifications, and the limits that apply to
+// them.  Channels whose service is nil are unavailable.  Limits of 0 are
+// disabled.
+type Services struct {
+    Mailer mail.MailClient
+    SMS sms.SMSClient
+
+    // Used to launch webhook deliveries.
+    Outbox jobqueue.Outbox
+
+    // Notifications identical to one issued by the same device within
+    // DedupWindow are dropped.
+    DedupWindow time.Duration
+
+    // Maximum number of notifications issued by each device per hour.
+    // Further notifications are dropped.
+    DeviceRateLimit int
+
+    // Maximum number of email and SMS notifications delivered to each
+    // account per hour.
+    RecipientRateLimit int
+
+    // Maximum number of SMS messages sent to each account per hour,
+    // including verification codes.
+    SMSRateLimit int
+}
+
+// Get the Services available to a pigeon job handler, from a userCtx that
+// may contain "cfg", "mailer", "sms" and "pigeon-outbox".  Services that
+// are missing are left nil.
+func ServicesFromUserCtx(userCtx map[string]interface{}) Services {
+    services := Services{}
+    services.Mailer, _ = userCtx["mailer"].(mail.MailClient)
+    services.SMS, _ = userCtx["sms"].(sms.SMSClient)
+    services.Outbox, _ = userCtx["pigeon-outbox"].(jobqueue.Outbox)
+    if cfg, ok := userCtx["cfg"].(config.Config); ok {
+        services.DedupWindow = time.Duration(cfg.OptNotifyDedupWindow())*time.Second
+        services.DeviceRateLimit = cfg.OptNotifyDeviceRateLimit()
+        services.RecipientRateLimit = cfg.OptNotifyRecipientRateLimit()
+        services.SMSRateLimit = cfg.OptSMSRateLimit()
+    }
+    return services
+}
+
+// Convert a notification type name, ex: "email", to a datalayer
+// NotificationType value.
+func notifyTypeFromString(notifyType string) (int, error) {
     switch notifyType {
     case "low-priority":
-        notifyTypeInt = datalayer.NotificationType_LowPriority
+        return datalayer.NotificationType_LowPriority, nil
     case "med-priority":
-        notifyTypeInt = datalayer.NotificationType_MedPriority
+        return datalayer.NotificationType_MedPriority, nil
     case "high-priority":
-        notifyTypeInt = datalayer.NotificationType_HighPriority
+        return datalayer.NotificationType_HighPriority, nil
     case "sms":
-        notifyTypeInt = datalayer.NotificationType_SMS
+        return datalayer.NotificationType_SMS, nil
     case "email":
-        notifyTypeInt = datalayer.NotificationType_Email
+        return datalayer.NotificationType_Email, nil
     case "in-app":
-        notifyTypeInt = datalayer.NotificationType_InApp
+        return datalayer.NotificationType_InApp, nil
+    case "webhook":
+        return datalayer.NotificationType_Webhook, nil
+    }
+    return 0, fmt.Errorf("Unexpected notifyType: %s", notifyType)
+}
+
+// Convert a datalayer NotificationType value to its name, ex: "email".
+func NotifyTypeToString(notifyType int) string {
+    switch notifyType {
+    case datalayer.NotificationType_LowPriority:
+        return "low-priority"
+    case datalayer.NotificationType_MedPriority:
+        return "med-priority"
+    case datalayer.NotificationType_HighPriority:
+        return "high-priority"
+    case datalayer.NotificationType_SMS:
+        return "sms"
+    case datalayer.NotificationType_Email:
+        return "email"
+    case datalayer.NotificationType_InApp:
+        return "in-app"
+    case datalayer.NotificationType_Webhook:
+        return "webhook"
+    }
+    return ""
+}
+
+// Get the priority of a datalayer NotificationType value, ex:
+// datalayer.NotificationType_HighPriority.  Types that request a specific
+// channel have medium priority.
+func Priority(notifyType int) int {
+    switch notifyType {
+    case datalayer.NotificationType_LowPriority,
+            datalayer.NotificationType_MedPriority,
+            datalayer.NotificationType_HighPriority:
+        return notifyType
+    }
+    return datalayer.NotificationType_MedPriority
+}
+
+// Is <notifyType> a notification type name accepted by ProcessNotification?
+func IsValidNotifyType(notifyType string) bool {
+    _, err := notifyTypeFromString(notifyType)
+    return err == nil
+}
+
+// Get the channel explicitly requested by <notifyType>, if any.  Priority
+// notification types return false.
+func requestedChannel(notifyType int) (datalayer.NotificationChannel, bool) {
+    switch notifyType {
+    case datalayer.NotificationType_SMS:
+        return datalayer.NotificationChannelSMS, true
+    case datalayer.NotificationType_Email:
+        return datalayer.NotificationChannelEmail, true
+    case datalayer.NotificationType_InApp:
+        return datalayer.NotificationChannelInApp, true
+    }
+    return datalayer.NotificationChannelInApp, false
+}
+
+// Should a notification of type <notifyType> be delivered over <channel> to
+// an account with preference <pref>?
+func wantsDelivery(channel datalayer.NotificationChannel, pref datalayer.NotificationPref, notifyType int) bool {
+    if !pref.Enabled {
+        return false
+    }
+    requested, ok := requestedChannel(notifyType)
+    if ok {
+        return channel == requested
+    }
+    return notifyType >= pref.MinPriority
+}
+
+// Get the reason a notification from <device> should be dropped, because it
+// repeats a recent notification or the device has exceeded its rate limit.
+// Returns "" if the notification should be issued.
+func throttleReason(device datalayer.Device, notifyType int, msg string, now time.Time, services Services) (string, error) {
+    if services.DedupWindow <= 0 && services.DeviceRateLimit <= 0 {
+        return "", nil
+    }
+    since := now.Add(-services.DedupWindow)
+    if services.DeviceRateLimit > 0 && since.After(now.Add(-time.Hour)) {
+        since = now.Add(-time.Hour)
+    }
+    recent, err := device.NotificationsSince(since)
+    if err != nil {
+        return "", err
+    }
+
+    count := 0
+    for _, note := range recent {
+        if note.Datetime().After(now.Add(-services.DedupWindow)) &&
+                note.NotifyType() == notifyType && note.Msg() == msg {
+            return "duplicate of " + note.ID(), nil
+        }
+        if note.Datetime().After(now.Add(-time.Hour)) {
+            count++
+        }
+    }
+    if services.DeviceRateLimit > 0 && count >= services.DeviceRateLimit {
+        return "device rate limit exceeded", nil
+    }
+    return "", nil
+}
+
+// Has <account> received its limit of email and SMS notifications?
+func recipientLimited(account datalayer.Account, now time.Time, services Services) (bool, error) {
+    if services.RecipientRateLimit <= 0 {
+        return false, nil
+    }
+    count, err := account.NotificationsSentSince(now.Add(-time.Hour))
+    if err != nil {
+        return false, err
+    }
+    return count >= services.RecipientRateLimit, nil
+}
+
+// Deliver a notification to <account> over <channel>, for which the account
+// has preference <pref>.
+func deliver(account datalayer.Account, channel datalayer.NotificationChannel, pref datalayer.NotificationPref, device datalayer.Device, note datalayer.Notification, services Services) (datalayer.DeliveryStatus, error) {
+    if channel == datalayer.NotificationChannelInApp {
+        // The stored notification is what the app displays.
+        return datalayer.DeliverySent, nil
+    }
+
+    _, requested := requestedChannel(note.NotifyType())
+    if channel == datalayer.NotificationChannelEmail && pref.Digest &&
+            !requested && note.NotifyType() < datalayer.NotificationType_HighPriority {
+        err := account.AddToDigest(datalayer.DigestItem{
+            DeviceID: device.ID(),
+            DeviceName: device.Name(),
+            NotifyType: note.NotifyType(),
+            Msg: note.Msg(),
+            Time: note.Datetime(),
+        })
+        if err != nil {
+            return datalayer.DeliveryFailed, err
+        }
+        return datalayer.DeliveryDigested, nil
+    }
+
+    now := time.Now().UTC()
+    limited, err := recipientLimited(account, now, services)
+    if err != nil {
+        return datalayer.DeliveryFailed, err
+    }
+    if limited {
+        return datalayer.DeliverySkipped, fmt.Errorf("Recipient rate limit exceeded")
+    }
+
+    switch channel {
+    case datalayer.NotificationChannelEmail:
+        mailer := services.Mailer
+        if mailer == nil {
+            return datalayer.DeliverySkipped, fmt.Errorf("No mail service configured")
+        }
+        if account.Email() == "" {
+            return datalayer.DeliverySkipped, fmt.Errorf("Account has no email address")
+        }
+        mailMsg := mailer.NewMail()
+        mailMsg.AddTo(account.Email(), account.Username())
+        mailMsg.SetFrom("no-reply@canopy.link", "Canopy Cloud Service")
+        mailMsg.SetSubject("Message from " + device.Name())
+        mailMsg.SetText(note.Msg())
+        err = mailer.Send(mailMsg)
+        if err != nil {
+            return datalayer.DeliveryFailed, err
+        }
+    case datalayer.NotificationChannelSMS:
+        if account.PhoneNumber() == "" || !account.PhoneVerified() {
+            return datalayer.DeliverySkipped, fmt.Errorf("Account has no verified phone number")
+        }
+        status, err := SendSMS(account, services, device.Name() + ": " + note.Msg())
+        if status != datalayer.DeliverySent {
+            return status, err
+        }
     default:
-        return fmt.Errorf("Unexpected notifyType: %s", notifyType)
+        return datalayer.DeliveryFailed, fmt.Errorf("Unknown channel %d", channel)
+    }
+
+    err = account.RecordNotificationSent(channel, now)
+    if err != nil {
+        canolog.Error("Notify: could not record notification sent to ", account.Username(), ": ", err)
     }
+    return datalayer.DeliverySent, nil
+}
 
-    err := device.InsertNotification(notifyTypeInt, time.Now(), msg)
+// Check whether an SMS could be sent to <account> now: that an SMS service
+// is configured and the account is within the SMS rate limit.  Returns nil
+// if so.  Otherwise returns DeliverySkipped and the reason, or DeliveryFailed
+// if the check itself failed.
+func CheckSMS(account datalayer.Account, services Services, now time.Time) (datalayer.DeliveryStatus, error) {
+    if services.SMS == nil {
+        return datalayer.DeliverySkipped, fmt.Errorf("No SMS service configured")
+    }
+    if services.SMSRateLimit > 0 {
+        count, err := account.SMSSentSince(now.Add(-time.Hour))
+        if err != nil {
+            return datalayer.DeliveryFailed, err
+        }
+        if count >= services.SMSRateLimit {
+            return datalayer.DeliverySkipped, fmt.Errorf("SMS rate limit exceeded")
+        }
+    }
+    return datalayer.DeliverySent, nil
+}
+
+// Send an SMS to <account>'s phone number, subject to the SMS rate limit.
+// The number does not need to be verified, so that this can be used to send
+// verification codes.
+func SendSMS(account datalayer.Account, services Services, body string) (datalayer.DeliveryStatus, error) {
+    now := time.Now().UTC()
+    status, err := CheckSMS(account, services, now)
+    if err != nil {
+        return status, err
+    }
+    if account.PhoneNumber() == "" {
+        return datalayer.DeliverySkipped, fmt.Errorf("Account has no phone number")
+    }
+    err = services.SMS.Send(account.PhoneNumber(), body)
+    if err != nil {
+        return datalayer.DeliveryFailed, err
+    }
+    err = account.RecordSMSSent(now)
+    if err != nil {
+        canolog.Error("Notify: could not record SMS sent to ", account.Username(), ": ", err)
+    }
+    return datalayer.DeliverySent, nil
+}
+
+// Record a notification from <device> and deliver it to every account with
+// access to the device, over the channels each account has enabled for the
+// notification's priority.  The outcome of each delivery is recorded with
+// the notification.  Delivery failures are logged, but not returned.
+//
+// Notifications that repeat one issued within services.DedupWindow, or that
+// exceed services.DeviceRateLimit, are logged and dropped.  Accounts that
+// have enabled the email digest receive low and medium priority
+// notifications in a daily summary instead (see SendDigests).
+//
+// Every notification is also sent to webhooks subscribed to the
+// "notification" event.  Notifications of type "webhook" are only sent to
+// webhooks.
+func ProcessNotification(device datalayer.Device, notifyType string, services Services, msg string) error {
+    // Add to notification log
+    notifyTypeInt, err := notifyTypeFromString(notifyType)
+    if err != nil {
+        return err
+    }
+
+    now := time.Now().UTC()
+    reason, err := throttleReason(device, notifyTypeInt, msg, now, services)
+    if err != nil {
+        // Better to risk a duplicate than to lose the notification.
+        canolog.Error("Notify: could not check recent notifications: ", err)
+    } else if reason != "" {
+        canolog.Info("Notify: dropping notification from ", device.ID(), ": ", reason)
+        return nil
+    }
+
+    notification, err := device.InsertNotification(notifyTypeInt, now, msg)
     if (err != nil) {
         return err
     }
 
-    // Send email
-    if notifyType == "email" && mailer != nil{
-        mailMsg := mailer.NewMail()
-        mailMsg.SetSubject("Message from your device")
-        mailMsg.SetText(msg)
+    err = webhooks.LaunchEvent(services.Outbox, device.ID(), webhooks.EventNotification, map[string]interface{}{
+        "id" : notification.ID(),
+        "msg" : msg,
+        "notify_type" : notifyType,
+    })
+    if err != nil {
+        canolog.Error("Notify: could not launch webhook delivery: ", err)
+    }
+    if notifyTypeInt == datalayer.NotificationType_Webhook {
+        return nil
+    }
 
-        // TODO: hack!
-        mailMsg.AddTo("greg@canopy.link", "Greg")
-        err = mailer.Send(mailMsg)
+    perms, err := device.Permissions()
+    if err != nil {
+        return err
+    }
+
+    for _, perm := range perms {
+        account := perm.Account
+        prefs, err := account.NotificationPrefs()
         if err != nil {
-            return err
+            canolog.Error("Notify: could not fetch preferences for ", account.Username(), ": ", err)
+            continue
+        }
+        for _, channel := range datalayer.NotificationChannels {
+            if !wantsDelivery(channel, prefs[channel], notifyTypeInt) {
+                continue
+            }
+            delivery := datalayer.NotificationDelivery{
+                Username: account.Username(),
+                Channel: channel,
+            }
+            delivery.Status, err = deliver(account, channel, prefs[channel], device, notification, services)
+            if err != nil {
+                delivery.Error = err.Error()
+                canolog.Warn("Notify: ", datalayer.NotificationChannelToString(channel),
+                        " delivery to ", account.Username(), " failed: ", err)
+            }
+            delivery.Time = time.Now().UTC()
+            err = notification.RecordDelivery(delivery)
+            if err != nil {
+                canolog.Error("Notify: could not record delivery: ", err)
+            }
         }
     }
 
     return nil
 }
-
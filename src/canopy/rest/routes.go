@@ -55,16 +55,46 @@ func AddRoutes(r *mux.Router, cfg config.Config, pigeonSys jobqueue.System) erro
     forwardAsPigeonJob("/api/device/{id}", "GET", "GET:api/device/id")
     forwardAsPigeonJob("/api/device/{id}", "POST", "POST:api/device/id")
     forwardAsPigeonJob("/api/device/{id}", "DELETE", "DELETE:api/device/id")
+    forwardAsPigeonJob("/api/device/self/notify", "POST", "POST:api/device/self/notify")
+    forwardAsPigeonJob("/api/device/{id}/sddl/history", "GET", "api/device/id/sddl/history")
+    forwardAsPigeonJob("/api/device/{id}/alarms", "GET", "api/device/id/alarms")
+    forwardAsPigeonJob("/api/device/{id}/alarms/history", "GET", "api/device/id/alarms/history")
+    forwardAsPigeonJob("/api/device/{id}/alarms/{var}/{alarm}/ack", "POST", "POST:api/device/id/alarms/var/alarm/ack")
+    forwardAsPigeonJob("/api/device/{id}/shares", "GET", "api/device/id/shares")
+    forwardAsPigeonJob("/api/device/{id}/shares/{username}", "POST", "POST:api/device/id/shares/username")
+    forwardAsPigeonJob("/api/device/{id}/shares/{username}", "DELETE", "DELETE:api/device/id/shares/username")
     forwardAsPigeonJob("/api/device/{id}/{var}", "GET", "api/device/id/var")
+    forwardAsPigeonJob("/api/device/{id}/{var}", "POST", "POST:api/device/id/var")
+    forwardAsPigeonJob("/api/device/{id}/{var}", "DELETE", "DELETE:api/device/id/var")
     forwardAsPigeonJob("/api/finish_share_transaction", "POST", "api/finish_share_transaction")
     forwardAsPigeonJob("/api/info", "GET", "api/info")
     forwardAsPigeonJob("/api/login", "POST", "api/login")
     forwardAsPigeonJob("/api/logout", "GET", "api/logout")
     forwardAsPigeonJob("/api/logout", "POST", "api/logout")
+    forwardAsPigeonJob("/api/notifications", "GET", "GET:api/notifications")
+    forwardAsPigeonJob("/api/notifications/{id}/dismiss", "POST", "POST:api/notifications/id/dismiss")
+    forwardAsPigeonJob("/api/notifications/{id}/read", "POST", "POST:api/notifications/id/read")
     forwardAsPigeonJob("/api/user/self", "GET", "GET:api/user/self")
     forwardAsPigeonJob("/api/user/self", "POST", "POST:api/user/self")
     forwardAsPigeonJob("/api/user/self", "DELETE", "DELETE:api/user/self")
     forwardAsPigeonJob("/api/user/self/devices", "GET", "api/devices")
+    forwardAsPigeonJob("/api/user/self/sddl_classes", "GET", "GET:api/user/self/sddl_classes")
+    forwardAsPigeonJob("/api/user/self/sddl_classes", "POST", "POST:api/user/self/sddl_classes")
+    forwardAsPigeonJob("/api/user/self/sddl_classes/{name}", "GET", "GET:api/user/self/sddl_classes/name")
+    forwardAsPigeonJob("/api/user/self/sddl_classes/{name}", "POST", "POST:api/user/self/sddl_classes/name")
+    forwardAsPigeonJob("/api/user/self/sddl_classes/{name}", "DELETE", "DELETE:api/user/self/sddl_classes/name")
+    forwardAsPigeonJob("/api/user/self/rules", "GET", "GET:api/user/self/rules")
+    forwardAsPigeonJob("/api/user/self/rules", "POST", "POST:api/user/self/rules")
+    forwardAsPigeonJob("/api/user/self/rules/{id}", "GET", "GET:api/user/self/rules/id")
+    forwardAsPigeonJob("/api/user/self/rules/{id}", "POST", "POST:api/user/self/rules/id")
+    forwardAsPigeonJob("/api/user/self/rules/{id}", "DELETE", "DELETE:api/user/self/rules/id")
+    forwardAsPigeonJob("/api/user/self/phone/verify", "POST", "POST:api/user/self/phone/verify")
+    forwardAsPigeonJob("/api/user/self/webhooks", "GET", "GET:api/user/self/webhooks")
+    forwardAsPigeonJob("/api/user/self/webhooks", "POST", "POST:api/user/self/webhooks")
+    forwardAsPigeonJob("/api/user/self/webhooks/{id}", "GET", "GET:api/user/self/webhooks/id")
+    forwardAsPigeonJob("/api/user/self/webhooks/{id}", "POST", "POST:api/user/self/webhooks/id")
+    forwardAsPigeonJob("/api/user/self/webhooks/{id}", "DELETE", "DELETE:api/user/self/webhooks/id")
+    forwardAsPigeonJob("/api/user/self/webhooks/{id}/deliveries", "GET", "GET:api/user/self/webhooks/id/deliveries")
     forwardAsPigeonJob("/api/reset_password", "POST", "api/reset_password")
     forwardAsPigeonJob("/api/share", "POST", "api/share")
 
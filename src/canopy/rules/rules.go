@@ -0,0 +1,502 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rules implements the rules engine.  Whenever Cloud Variables
+// change, a VarChangedJobKey job is launched through Pigeon.  The datalayer
+// can't launch jobs, so everything that stores samples launches it with
+// LaunchVarChanged: the REST and websocket device endpoints, and "set_var"
+// actions.  The job re-evaluates every enabled rule that watches the device
+// and references one of the changed variables, and performs the rule's
+// actions if its condition has just become satisfied.  The same job
+// evaluates the device's threshold alarms (see package alarms) and delivers
+// "sample" events to webhooks (see package webhooks).
+//
+// A rule's condition uses device filter syntax, ex:
+//
+//      temperature > 80 degrees_f AND humidity > 60
+//
+// Supported actions are:
+//
+//  notify      {"type" : "notify", "msg" : "Too hot!", "notify_type" : "email"}
+//              Sends a notification from the device that triggered the rule,
+//              or from "device_id" if provided.  "notify_type" defaults to
+//              "in-app".
+//
+//  set_var     {"type" : "set_var", "device_id" : "...", "var" : "fan", "value" : true}
+//              Sets a Cloud Variable of a device.
+//
+//  webhook     {"type" : "webhook", "webhook_id" : "..."}
+//              Delivers a "rule_fired" event to one of the owner's webhooks
+//              (see package webhooks).
+//
+// A rule's owner needs read access to the devices it watches, and read-write
+// access to the devices its actions target.  This is checked when the rule
+// is saved (see CheckRuleAccess) and again whenever it is evaluated, since
+// access may have been revoked in between.
+package rules
+
+import (
+    "canopy/alarms"
+    "canopy/canolog"
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "canopy/device_filter"
+    "canopy/notify"
+    "canopy/pigeon"
+    "canopy/webhooks"
+    "fmt"
+    "github.com/gocql/gocql"
+    "strings"
+    "time"
+)
+
+// Pigeon message key for rule evaluation jobs.
+const VarChangedJobKey = "rules/var_changed"
+
+// Launch a job that re-evaluates the rules and alarms that depend on Cloud
+// Variables <varNames> of device <deviceId>.  Does not wait for the job to
+// finish.
+func LaunchVarChanged(outbox jobqueue.Outbox, deviceId gocql.UUID, varNames []string) error {
+    if outbox == nil || len(varNames) == 0 {
+        return nil
+    }
+    respChan, err := outbox.Launch(VarChangedJobKey, map[string]interface{}{
+        "device_id" : deviceId.String(),
+        "vars" : varNames,
+    })
+    if err != nil {
+        return err
+    }
+
+    // Nobody is interested in the result, but the response must be consumed.
+    go func() {
+        <-respChan
+    }()
+    return nil
+}
+
+// Engine evaluates rules and performs their actions.
+type Engine struct {
+    Conn datalayer.Connection
+
+    // Services used to deliver notifications raised by rules and alarms.
+    Notify notify.Services
+
+    // Used to launch rule evaluation for Cloud Variables changed by
+    // "set_var" actions.  May be nil.
+    Outbox jobqueue.Outbox
+}
+
+// Pigeon handler for VarChangedJobKey jobs.  Expects a userCtx with
+// "db-conn" and "pigeon-outbox", and the notification services described by
+// notify.ServicesFromUserCtx.  Expects a request body of the form:
+//
+//      {"device_id" : string, "vars" : []string}
+func VarChangedHandler(jobKey string, userCtxItf interface{}, req jobqueue.Request, resp jobqueue.Response) {
+    resp.SetBody(map[string]interface{}{"result" : "ok"})
+
+    userCtx, ok := userCtxItf.(map[string]interface{})
+    if !ok {
+        canolog.Error("Rules: expected map[string]interface{} for userCtx")
+        return
+    }
+    engine := &Engine{}
+    engine.Conn, ok = userCtx["db-conn"].(datalayer.Connection)
+    if !ok {
+        canolog.Error("Rules: expected datalayer.Connection for 'db-conn'")
+        return
+    }
+    engine.Notify = notify.ServicesFromUserCtx(userCtx)
+    engine.Outbox, _ = userCtx["pigeon-outbox"].(jobqueue.Outbox)
+
+    body := req.Body()
+    deviceIdString, _ := body["device_id"].(string)
+    deviceId, err := gocql.ParseUUID(deviceIdString)
+    if err != nil {
+        canolog.Error("Rules: invalid device_id ", deviceIdString)
+        return
+    }
+    varNames, ok := body["vars"].([]string)
+    if !ok {
+        canolog.Error("Rules: expected []string for 'vars'")
+        return
+    }
+
+    device, err := engine.Conn.LookupDevice(deviceId)
+    if err != nil {
+        canolog.Error("Rules: device ", deviceId, " not found: ", err)
+        return
+    }
+    alarms.ProcessVarChange(device, varNames, engine.Notify)
+
+    err = webhooks.Dispatch(engine.Conn, engine.Outbox, device, webhooks.EventSample, webhooks.SampleData(device, varNames))
+    if err != nil {
+        canolog.Error("Rules: error dispatching webhooks for ", deviceId, ": ", err)
+    }
+
+    err = engine.ProcessVarChange(deviceId, varNames)
+    if err != nil {
+        canolog.Error("Rules: error processing change to ", deviceId, ": ", err)
+    }
+}
+
+// Does a filter that references properties <props> depend on any of the
+// Cloud Variables named in <changed>?  Changes to a struct affect its
+// members, and vice-versa.
+func dependsOn(props []string, changed []string) bool {
+    for _, prop := range props {
+        for _, name := range changed {
+            if prop == name ||
+                    strings.HasPrefix(prop, name + ".") ||
+                    strings.HasPrefix(name, prop + ".") {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Re-evaluate the enabled rules that watch device <deviceId> and depend on
+// Cloud Variables <changed>.  Errors evaluating individual rules are logged,
+// and do not prevent other rules from being evaluated.
+func (engine *Engine) ProcessVarChange(deviceId gocql.UUID, changed []string) error {
+    rules, err := engine.Conn.RulesForDevice(deviceId)
+    if err != nil {
+        return err
+    }
+    if len(rules) == 0 {
+        return nil
+    }
+
+    trigger, err := engine.Conn.LookupDevice(deviceId)
+    if err != nil {
+        return err
+    }
+
+    for _, rule := range rules {
+        if !rule.Enabled() {
+            continue
+        }
+        filter, err := device_filter.Compile(rule.Condition())
+        if err != nil {
+            canolog.Error("Rules: invalid condition for rule ", rule.ID(), ": ", err)
+            continue
+        }
+        if !dependsOn(filter.Properties(), changed) {
+            continue
+        }
+        _, err = engine.Evaluate(rule, filter, trigger)
+        if err != nil {
+            canolog.Error("Rules: error evaluating rule ", rule.ID(), ": ", err)
+        }
+    }
+    return nil
+}
+
+// Is <filter> satisfied by the rule's devices, according to the rule's
+// RuleMatch?  Devices that can't be found, that the rule's <owner> can no
+// longer read, or that have no value for a referenced variable, do not
+// satisfy the filter.
+func (engine *Engine) conditionSatisfied(rule datalayer.Rule, owner datalayer.Account, filter device_filter.DeviceFilter) bool {
+    devices := []datalayer.Device{}
+    for _, deviceId := range rule.DeviceIDs() {
+        device, err := authorizedDevice(engine.Conn, owner, deviceId, datalayer.DeviceOpRead)
+        if err != nil {
+            canolog.Warn("Rules: device ", deviceId, " of rule ", rule.ID(), " unavailable: ", err)
+            continue
+        }
+        devices = append(devices, device)
+    }
+    matches, _ := filter.CountMembers(devices)
+
+    if rule.Match() == datalayer.RuleMatchAll {
+        return matches > 0 && int(matches) == len(rule.DeviceIDs())
+    }
+    return matches > 0
+}
+
+// Evaluate <rule>, whose condition has been compiled into <filter>, and fire
+// it if the condition has just become satisfied and the rule is not cooling
+// down.  <trigger> is the device whose change caused the evaluation.  When
+// workers evaluate the same rule concurrently, only the one that records the
+// transition fires it.
+//
+// Returns true if the rule fired.  Errors performing individual actions are
+// logged, and do not prevent other actions from being performed.
+func (engine *Engine) Evaluate(rule datalayer.Rule, filter device_filter.DeviceFilter, trigger datalayer.Device) (bool, error) {
+    owner, err := engine.Conn.LookupAccount(rule.Owner())
+    if err != nil {
+        return false, err
+    }
+    err = checkDeviceAccess(owner, trigger, datalayer.DeviceOpRead)
+    if err != nil {
+        return false, err
+    }
+
+    now := time.Now().UTC()
+    satisfied := engine.conditionSatisfied(rule, owner, filter)
+
+    // Edge-triggered: only fire on the transition to satisfied.
+    fire := satisfied && !rule.LastState()
+    if fire && !rule.LastFired().IsZero() && now.Sub(rule.LastFired()) < rule.Cooldown() {
+        canolog.Info("Rules: rule ", rule.ID(), " is cooling down")
+        fire = false
+    }
+
+    // Record the transition before acting on it.  If another worker has
+    // recorded a transition since the rule was loaded, that worker is
+    // responsible for acting on it.
+    recorded, err := rule.RecordEvaluation(satisfied, fire, now)
+    if err != nil {
+        return false, err
+    }
+    if !recorded {
+        canolog.Info("Rules: rule ", rule.ID(), " was evaluated concurrently")
+        return false, nil
+    }
+
+    if fire {
+        canolog.Info("Rules: firing rule ", rule.ID())
+        for _, action := range rule.Actions() {
+            err := engine.perform(rule, owner, action, trigger, now)
+            if err != nil {
+                canolog.Error("Rules: ", action.Type, " action of rule ", rule.ID(), " failed: ", err)
+            }
+        }
+    }
+    return fire, nil
+}
+
+func (engine *Engine) perform(rule datalayer.Rule, owner datalayer.Account, action datalayer.RuleAction, trigger datalayer.Device, t time.Time) error {
+    switch action.Type {
+    case "notify":
+        return engine.performNotify(owner, action.Params, trigger)
+    case "set_var":
+        return engine.performSetVar(owner, action.Params)
+    case "webhook":
+        return engine.performWebhook(rule, owner, action.Params, trigger, t)
+    }
+    return fmt.Errorf("Unknown action type %s", action.Type)
+}
+
+// Fail unless <account> may perform <op> on <device>.
+func checkDeviceAccess(account datalayer.Account, device datalayer.Device, op datalayer.DeviceOp) error {
+    access, sharing, err := device.AccountAccess(account)
+    if err != nil {
+        return err
+    }
+    if !datalayer.DeviceOpAllowed(op, access, sharing) {
+        return fmt.Errorf("%s lacks permission for device %s", account.Username(), device.ID())
+    }
+    return nil
+}
+
+// Lookup device <deviceId>, failing unless <account> may perform <op> on it.
+func authorizedDevice(conn datalayer.Connection, account datalayer.Account, deviceId gocql.UUID, op datalayer.DeviceOp) (datalayer.Device, error) {
+    device, err := conn.LookupDevice(deviceId)
+    if err != nil {
+        return nil, err
+    }
+    err = checkDeviceAccess(account, device, op)
+    if err != nil {
+        return nil, err
+    }
+    return device, nil
+}
+
+// Get the device referenced by an action's "device_id" parameter.  Actions
+// change the devices they target, or notify everyone with access to them,
+// so the rule's owner needs read-write access.
+func (engine *Engine) actionDevice(owner datalayer.Account, params map[string]interface{}) (datalayer.Device, error) {
+    deviceIdString, _ := params["device_id"].(string)
+    deviceId, err := gocql.ParseUUID(deviceIdString)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid device_id %s", deviceIdString)
+    }
+    return authorizedDevice(engine.Conn, owner, deviceId, datalayer.DeviceOpWrite)
+}
+
+func (engine *Engine) performNotify(owner datalayer.Account, params map[string]interface{}, trigger datalayer.Device) error {
+    device := trigger
+    if _, ok := params["device_id"]; ok {
+        var err error
+        device, err = engine.actionDevice(owner, params)
+        if err != nil {
+            return err
+        }
+    }
+
+    msg, _ := params["msg"].(string)
+    notifyType, _ := params["notify_type"].(string)
+    if notifyType == "" {
+        notifyType = "in-app"
+    }
+    return notify.ProcessNotification(device, notifyType, engine.Notify, msg)
+}
+
+func (engine *Engine) performSetVar(owner datalayer.Account, params map[string]interface{}) error {
+    device, err := engine.actionDevice(owner, params)
+    if err != nil {
+        return err
+    }
+
+    varName, _ := params["var"].(string)
+    varDef, err := device.LookupVarDef(varName)
+    if err != nil {
+        return err
+    }
+    if varDef.Expression() != "" {
+        return fmt.Errorf("Cannot set derived variable %s", varName)
+    }
+
+    value, warnings, accepted := cloudvar.JsonToValidatedCloudVarValue(varDef, params["value"])
+    if !accepted {
+        return fmt.Errorf("Value rejected: %s", warnings[0].Msg)
+    }
+    err = device.InsertSample(varDef, time.Now(), value)
+    if err != nil {
+        return err
+    }
+
+    updated := []string{varDef.Fullname()}
+    derived, _, err := device_filter.UpdateDerivedVars(device, updated)
+    if err != nil {
+        return err
+    }
+    updated = append(updated, derived...)
+
+    // This may trigger other rules in turn.  Since rules are
+    // edge-triggered, rules that trigger each other do not loop forever.
+    return LaunchVarChanged(engine.Outbox, device.ID(), updated)
+}
+
+// Get the owner's webhook referenced by an action's "webhook_id" parameter.
+func actionWebhook(owner datalayer.Account, params map[string]interface{}) (datalayer.Webhook, error) {
+    webhookIdString, _ := params["webhook_id"].(string)
+    webhookId, err := gocql.ParseUUID(webhookIdString)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid webhook_id %s", webhookIdString)
+    }
+    return owner.Webhook(webhookId)
+}
+
+func (engine *Engine) performWebhook(rule datalayer.Rule, owner datalayer.Account, params map[string]interface{}, trigger datalayer.Device, t time.Time) error {
+    webhook, err := actionWebhook(owner, params)
+    if err != nil {
+        return err
+    }
+    return webhooks.Deliver(engine.Conn, engine.Outbox, webhook, trigger, webhooks.EventRuleFired, map[string]interface{}{
+        "rule_id" : rule.ID().String(),
+        "rule_name" : rule.Name(),
+        "time" : t.Format(time.RFC3339),
+    })
+}
+
+// Check that <owner> may watch the devices of a rule with settings <params>,
+// and perform its actions.  Returns a datalayer.ValidationError describing
+// the first problem found.
+func CheckRuleAccess(conn datalayer.Connection, owner datalayer.Account, params datalayer.RuleParams) error {
+    for _, deviceId := range params.DeviceIDs {
+        _, err := authorizedDevice(conn, owner, deviceId, datalayer.DeviceOpRead)
+        if err != nil {
+            return datalayer.NewValidationError(fmt.Sprintf("Device not found: %s", deviceId))
+        }
+    }
+
+    engine := &Engine{Conn: conn}
+    for _, action := range params.Actions {
+        var err error
+        switch action.Type {
+        case "notify":
+            if _, ok := action.Params["device_id"]; ok {
+                _, err = engine.actionDevice(owner, action.Params)
+            }
+        case "set_var":
+            _, err = engine.actionDevice(owner, action.Params)
+        case "webhook":
+            _, err = actionWebhook(owner, action.Params)
+        }
+        if err != nil {
+            return datalayer.NewValidationError(fmt.Sprintf("Invalid %s action: %s", action.Type, err))
+        }
+    }
+    return nil
+}
+
+// Check a rule's settings before it is saved.  Returns a
+// datalayer.ValidationError describing the first problem found.
+func ValidateRuleParams(params datalayer.RuleParams) error {
+    if params.Name == "" {
+        return datalayer.NewValidationError("Rule name required")
+    }
+    if _, err := device_filter.Compile(params.Condition); err != nil {
+        return datalayer.NewValidationError(fmt.Sprintf("Invalid condition: %s", err))
+    }
+    if len(params.DeviceIDs) == 0 {
+        return datalayer.NewValidationError("Rule requires at least one device")
+    }
+    if len(params.Actions) == 0 {
+        return datalayer.NewValidationError("Rule requires at least one action")
+    }
+    if params.Cooldown < 0 {
+        return datalayer.NewValidationError("Cooldown must not be negative")
+    }
+    for _, action := range params.Actions {
+        err := validateAction(action)
+        if err != nil {
+            return datalayer.NewValidationError(fmt.Sprintf("Invalid %s action: %s", action.Type, err))
+        }
+    }
+    return nil
+}
+
+func validateAction(action datalayer.RuleAction) error {
+    requireString := func(key string) error {
+        s, ok := action.Params[key].(string)
+        if !ok || s == "" {
+            return fmt.Errorf("String \"%s\" expected", key)
+        }
+        return nil
+    }
+
+    switch action.Type {
+    case "notify":
+        if err := requireString("msg"); err != nil {
+            return err
+        }
+        if notifyType, ok := action.Params["notify_type"]; ok {
+            s, _ := notifyType.(string)
+            if !notify.IsValidNotifyType(s) {
+                return fmt.Errorf("Invalid notify_type %v", notifyType)
+            }
+        }
+    case "set_var":
+        if err := requireString("device_id"); err != nil {
+            return err
+        }
+        if err := requireString("var"); err != nil {
+            return err
+        }
+        if _, ok := action.Params["value"]; !ok {
+            return fmt.Errorf("\"value\" expected")
+        }
+    case "webhook":
+        if err := requireString("webhook_id"); err != nil {
+            return err
+        }
+    default:
+        return fmt.Errorf("Unknown action type")
+    }
+    return nil
+}
@@ -0,0 +1,213 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sddl
+
+import (
+    "fmt"
+    "sort"
+    "time"
+)
+
+// AlarmDef is a threshold alarm declared on a numeric Cloud Variable, with
+// the "alarms" property:
+//
+//      "out float32 temperature" : {
+//          "alarms" : {
+//              "overheat" : {
+//                  "high" : 80,
+//                  "hysteresis" : 2,
+//                  "min-duration" : 60,
+//                  "notify-type" : "high-priority",
+//                  "msg" : "Temperature is too high"
+//              }
+//          }
+//      }
+//
+// The alarm is raised when the value goes above "high" or below "low", and
+// the condition has held for "min-duration" seconds.  It clears once the
+// value is back inside the thresholds by at least "hysteresis", so that a
+// value hovering around a threshold doesn't raise the alarm repeatedly.
+type AlarmDef struct {
+    name string
+    high float64
+    low float64
+    hasHigh bool
+    hasLow bool
+    hysteresis float64
+    minDuration time.Duration
+    notifyType string
+    msg string
+}
+
+// Notification types an alarm may use.  These match the types accepted by
+// notify.ProcessNotification.
+var alarmNotifyTypes = map[string]bool{
+    "low-priority" : true,
+    "med-priority" : true,
+    "high-priority" : true,
+    "sms" : true,
+    "email" : true,
+    "in-app" : true,
+    "webhook" : true,
+}
+
+func parseAlarm(name string, defItf interface{}) (*AlarmDef, error) {
+    def, ok := defItf.(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("Expected object for alarm %s", name)
+    }
+    alarm := &AlarmDef{
+        name: name,
+        notifyType: "high-priority",
+    }
+    for k, v := range def {
+        switch k {
+        case "high":
+            alarm.high, ok = v.(float64)
+            if !ok {
+                return nil, fmt.Errorf("Expected number for high in alarm %s", name)
+            }
+            alarm.hasHigh = true
+        case "low":
+            alarm.low, ok = v.(float64)
+            if !ok {
+                return nil, fmt.Errorf("Expected number for low in alarm %s", name)
+            }
+            alarm.hasLow = true
+        case "hysteresis":
+            alarm.hysteresis, ok = v.(float64)
+            if !ok || alarm.hysteresis < 0 {
+                return nil, fmt.Errorf("Expected non-negative number for hysteresis in alarm %s", name)
+            }
+        case "min-duration":
+            seconds, ok := v.(float64)
+            if !ok || seconds < 0 {
+                return nil, fmt.Errorf("Expected non-negative number for min-duration in alarm %s", name)
+            }
+            alarm.minDuration = time.Duration(seconds*float64(time.Second))
+        case "notify-type":
+            alarm.notifyType, ok = v.(string)
+            if !ok || !alarmNotifyTypes[alarm.notifyType] {
+                return nil, fmt.Errorf("Invalid notify-type in alarm %s", name)
+            }
+        case "msg":
+            alarm.msg, ok = v.(string)
+            if !ok {
+                return nil, fmt.Errorf("Expected string for msg in alarm %s", name)
+            }
+        default:
+            return nil, fmt.Errorf("Unknown property %s in alarm %s", k, name)
+        }
+    }
+
+    if !alarm.hasHigh && !alarm.hasLow {
+        return nil, fmt.Errorf("Alarm %s requires high or low", name)
+    }
+    if alarm.hasHigh && alarm.hasLow && alarm.low + alarm.hysteresis > alarm.high - alarm.hysteresis {
+        return nil, fmt.Errorf("Alarm %s: low and high thresholds overlap", name)
+    }
+    return alarm, nil
+}
+
+// Parse the value of an "alarms" property.  Alarms are sorted by name.
+func parseAlarms(v interface{}) ([]*AlarmDef, error) {
+    alarmsJson, ok := v.(map[string]interface{})
+    if !ok {
+        return nil, fmt.Errorf("Expected object for alarms")
+    }
+    names := []string{}
+    for name := range alarmsJson {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    alarms := []*AlarmDef{}
+    for _, name := range names {
+        if name == "" {
+            return nil, fmt.Errorf("Alarm name required")
+        }
+        alarm, err := parseAlarm(name, alarmsJson[name])
+        if err != nil {
+            return nil, err
+        }
+        alarms = append(alarms, alarm)
+    }
+    return alarms, nil
+}
+
+func (alarm *AlarmDef) jsonEncode() map[string]interface{} {
+    jsn := map[string]interface{}{
+        "hysteresis" : alarm.hysteresis,
+        "min-duration" : alarm.minDuration.Seconds(),
+        "notify-type" : alarm.notifyType,
+    }
+    if alarm.hasHigh {
+        jsn["high"] = alarm.high
+    }
+    if alarm.hasLow {
+        jsn["low"] = alarm.low
+    }
+    if alarm.msg != "" {
+        jsn["msg"] = alarm.msg
+    }
+    return jsn
+}
+
+// Name of the alarm, unique for its Cloud Variable.
+func (alarm *AlarmDef) Name() string {
+    return alarm.name
+}
+
+// Get the upper threshold.  Returns false if the alarm has none.
+func (alarm *AlarmDef) High() (float64, bool) {
+    return alarm.high, alarm.hasHigh
+}
+
+// Get the lower threshold.  Returns false if the alarm has none.
+func (alarm *AlarmDef) Low() (float64, bool) {
+    return alarm.low, alarm.hasLow
+}
+
+func (alarm *AlarmDef) Hysteresis() float64 {
+    return alarm.hysteresis
+}
+
+// How long the alarm condition must hold before the alarm is raised.
+func (alarm *AlarmDef) MinDuration() time.Duration {
+    return alarm.minDuration
+}
+
+// Notification type used when the alarm is raised or cleared, ex:
+// "high-priority".
+func (alarm *AlarmDef) NotifyType() string {
+    return alarm.notifyType
+}
+
+// User-provided notification message, or "" for the default message.
+func (alarm *AlarmDef) Msg() string {
+    return alarm.msg
+}
+
+// Is <value> beyond the alarm's thresholds?
+func (alarm *AlarmDef) Exceeded(value float64) bool {
+    return (alarm.hasHigh && value > alarm.high) ||
+            (alarm.hasLow && value < alarm.low)
+}
+
+// Is <value> back inside the alarm's thresholds by at least the hysteresis?
+func (alarm *AlarmDef) Recovered(value float64) bool {
+    return (!alarm.hasHigh || value <= alarm.high - alarm.hysteresis) &&
+            (!alarm.hasLow || value >= alarm.low + alarm.hysteresis)
+}
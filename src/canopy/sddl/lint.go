@@ -0,0 +1,274 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sddl
+
+import (
+    "fmt"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// LintProblem is a mistake found in an SDDL document by Lint.
+type LintProblem struct {
+    // Location of the problem, as a JSON Pointer (RFC 6901) into the
+    // document, ex: "/out struct gps/float32 latitude/min-value"
+    Path string
+
+    // Human-readable description of the problem.
+    Msg string
+}
+
+func (problem LintProblem) String() string {
+    return fmt.Sprintf("%s: %s", problem.Path, problem.Msg)
+}
+
+// Properties that may appear in a Cloud Variable definition.  Any other key
+// is an error, except in structs where it declares a member.
+var lintVarProperties = map[string]bool{
+    "alarms" : true,
+    "description" : true,
+    "expression" : true,
+    "max-value" : true,
+    "min-value" : true,
+    "numeric-display-hint" : true,
+    "out-of-range" : true,
+    "regex" : true,
+    "units" : true,
+    "values" : true,
+}
+
+type linter struct {
+    problems []LintProblem
+}
+
+func (l *linter) report(path []string, format string, args ...interface{}) {
+    escaped := []string{}
+    for _, part := range path {
+        part = strings.Replace(part, "~", "~0", -1)
+        part = strings.Replace(part, "/", "~1", -1)
+        escaped = append(escaped, part)
+    }
+    l.problems = append(l.problems, LintProblem{
+        Path: "/" + strings.Join(escaped, "/"),
+        Msg: fmt.Sprintf(format, args...),
+    })
+}
+
+func sortedKeys(jsn map[string]interface{}) []string {
+    keys := []string{}
+    for k := range jsn {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func appendPath(path []string, key string) []string {
+    out := make([]string, len(path), len(path) + 1)
+    copy(out, path)
+    return append(out, key)
+}
+
+// Check an SDDL document for mistakes.  Unlike ParseDocument, which stops at
+// the first error, every problem found is reported.  In addition to the
+// errors ParseDocument would return, Lint flags mistakes that ParseDocument
+// tolerates, such as unknown properties and "min-value" on a string.
+//
+// Returns an empty list if no problems are found.
+func Lint(jsn map[string]interface{}) []LintProblem {
+    l := &linter{problems: []LintProblem{}}
+    for _, k := range sortedKeys(jsn) {
+        v := jsn[k]
+        path := []string{k}
+        switch k {
+        case "authors":
+            authors, ok := v.([]interface{})
+            if !ok {
+                l.report(path, "Expected list of strings")
+                continue
+            }
+            for _, author := range authors {
+                if _, ok := author.(string); !ok {
+                    l.report(path, "Expected list of strings")
+                    break
+                }
+            }
+        case "description":
+            if _, ok := v.(string); !ok {
+                l.report(path, "Expected string")
+            }
+        default:
+            l.lintVar(path, k, v)
+        }
+    }
+
+    if len(l.problems) == 0 {
+        // Catch anything the checks above missed.
+        _, err := Sys.ParseDocument(jsn)
+        if err != nil {
+            l.report([]string{}, "%s", err)
+        }
+    }
+    return l.problems
+}
+
+// Check the definition of a single Cloud Variable, and its members if it is
+// a struct.
+func (l *linter) lintVar(path []string, decl string, defItf interface{}) {
+    def, ok := defItf.(map[string]interface{})
+    if !ok {
+        l.report(path, "Expected object for variable definition")
+        return
+    }
+
+    varDef, err := parseVarKey(decl)
+    if err != nil {
+        l.report(path, "Invalid declaration %q: %s", decl, err)
+        return
+    }
+
+    datatype := varDef.datatype
+    if varDef.arrayElement != nil {
+        datatype = varDef.arrayElement.datatype
+    }
+    typeName, _ := DatatypeEnumToString(datatype)
+    elemDef := &SDDLVarDef{datatype: datatype}
+    isNumeric := elemDef.IsNumeric()
+
+    var minValue, maxValue float64
+    hasMin, hasMax := false, false
+
+    for _, k := range sortedKeys(def) {
+        v := def[k]
+        propPath := appendPath(path, k)
+
+        if !lintVarProperties[k] {
+            if varDef.datatype == DATATYPE_STRUCT {
+                l.lintVar(propPath, k, v)
+            } else {
+                l.report(propPath, "Unknown property %q", k)
+            }
+            continue
+        }
+
+        switch k {
+        case "alarms":
+            if _, err := parseAlarms(v); err != nil {
+                l.report(propPath, "%s", err)
+            } else if !isNumeric || varDef.arrayElement != nil {
+                l.report(propPath, "alarms not allowed for datatype %s", typeName)
+            }
+        case "description":
+            if _, ok := v.(string); !ok {
+                l.report(propPath, "Expected string")
+            }
+        case "expression":
+            s, ok := v.(string)
+            if !ok || s == "" {
+                l.report(propPath, "Expected non-empty string")
+            } else if !isNumeric || varDef.arrayElement != nil {
+                l.report(propPath, "expression not allowed for datatype %s", typeName)
+            }
+        case "min-value", "max-value":
+            f, ok := v.(float64)
+            if !ok {
+                l.report(propPath, "Expected number")
+                continue
+            }
+            if !isNumeric {
+                l.report(propPath, "%s not allowed for non-numeric datatype %s", k, typeName)
+                continue
+            }
+            if k == "min-value" {
+                minValue, hasMin = f, true
+            } else {
+                maxValue, hasMax = f, true
+            }
+        case "numeric-display-hint":
+            s, ok := v.(string)
+            if !ok {
+                l.report(propPath, "Expected string")
+            } else if NumericDisplayHintStringToEnum(s) == NUMERIC_DISPLAY_HINT_INVALID {
+                l.report(propPath, "Invalid numeric display hint %q", s)
+            } else if !isNumeric {
+                l.report(propPath, "%s not allowed for non-numeric datatype %s", k, typeName)
+            }
+        case "out-of-range":
+            s, ok := v.(string)
+            if !ok {
+                l.report(propPath, "Expected string")
+            } else if OutOfRangePolicyStringToEnum(s) == OUT_OF_RANGE_POLICY_INVALID {
+                l.report(propPath, "Invalid out-of-range policy %q", s)
+            } else if !isNumeric {
+                l.report(propPath, "%s not allowed for non-numeric datatype %s", k, typeName)
+            }
+        case "regex":
+            s, ok := v.(string)
+            if !ok {
+                l.report(propPath, "Expected string")
+                continue
+            }
+            if datatype != DATATYPE_STRING {
+                l.report(propPath, "regex not allowed for datatype %s", typeName)
+            }
+            if _, err := regexp.Compile(s); err != nil {
+                l.report(propPath, "Invalid regex: %s", err)
+            }
+        case "units":
+            s, ok := v.(string)
+            if !ok {
+                l.report(propPath, "Expected string")
+                continue
+            }
+            if _, err := LookupUnit(s); err != nil {
+                l.report(propPath, "%s", err)
+            } else if !isNumeric {
+                l.report(propPath, "units not allowed for non-numeric datatype %s", typeName)
+            }
+        case "values":
+            if datatype != DATATYPE_ENUM {
+                l.report(propPath, "values not allowed for datatype %s", typeName)
+                continue
+            }
+            values, ok := v.([]interface{})
+            if !ok {
+                l.report(propPath, "Expected list of strings")
+                continue
+            }
+            seen := map[string]bool{}
+            for i, valueItf := range values {
+                value, ok := valueItf.(string)
+                if !ok || value == "" {
+                    l.report(appendPath(propPath, fmt.Sprint(i)), "Expected non-empty string")
+                    continue
+                }
+                if seen[value] {
+                    l.report(appendPath(propPath, fmt.Sprint(i)), "Duplicate enum value %q", value)
+                }
+                seen[value] = true
+            }
+        }
+    }
+
+    if hasMin && hasMax && minValue > maxValue {
+        l.report(path, "min-value %v is greater than max-value %v", minValue, maxValue)
+    }
+    if datatype == DATATYPE_ENUM {
+        if _, ok := def["values"]; !ok {
+            l.report(path, "Enum requires a list of values")
+        }
+    }
+}
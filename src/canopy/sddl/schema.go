@@ -0,0 +1,168 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sddl
+
+import (
+    "math"
+)
+
+// Range of the integer datatypes, for the "minimum" and "maximum" keywords.
+var integerSchemaRanges = map[DatatypeEnum][2]float64{
+    DATATYPE_INT8 : {math.MinInt8, math.MaxInt8},
+    DATATYPE_UINT8 : {0, math.MaxUint8},
+    DATATYPE_INT16 : {math.MinInt16, math.MaxInt16},
+    DATATYPE_UINT16 : {0, math.MaxUint16},
+    DATATYPE_INT32 : {math.MinInt32, math.MaxInt32},
+    DATATYPE_UINT32 : {0, math.MaxUint32},
+}
+
+// Generate a JSON Schema (draft 4) describing the "vars" payload that a
+// device reporting <doc> may send, ex:
+//
+//      {"vars" : {"temperature" : 38.0, "gps" : {"latitude" : 38.0}}}
+//
+// The schema mirrors the checks the server performs on ingestion, so
+// firmware can validate payloads offline.  Values outside "min-value" and
+// "max-value" are only disallowed if the variable's "out-of-range" policy is
+// "reject".
+func JSONSchema(doc Document) map[string]interface{} {
+    properties := map[string]interface{}{}
+    for _, varDef := range doc.VarDefs() {
+        properties[varDef.Name()] = varDefSchema(varDef)
+    }
+    varsSchema := map[string]interface{}{
+        "type" : "object",
+        "properties" : properties,
+        "additionalProperties" : false,
+    }
+
+    schema := map[string]interface{}{
+        "$schema" : "http://json-schema.org/draft-04/schema#",
+        "type" : "object",
+        "properties" : map[string]interface{}{
+            "device_id" : map[string]interface{}{"type" : "string"},
+            "secret_key" : map[string]interface{}{"type" : "string"},
+            "sddl_class" : map[string]interface{}{"type" : "string"},
+            "sddl" : map[string]interface{}{"type" : "object"},
+            "vars" : varsSchema,
+        },
+    }
+    if doc.Description() != "" {
+        schema["description"] = doc.Description()
+    }
+    return schema
+}
+
+// Generate the JSON Schema for values of a single Cloud Variable.
+func varDefSchema(varDef VarDef) map[string]interface{} {
+    schema := map[string]interface{}{}
+
+    switch varDef.Datatype() {
+    case DATATYPE_VOID:
+        schema["type"] = "null"
+    case DATATYPE_STRING:
+        schema["type"] = "string"
+        regex, _ := varDef.Regex()
+        if regex != "" {
+            // The server requires the regex to match the entire value.
+            schema["pattern"] = "^(?:" + regex + ")$"
+        }
+    case DATATYPE_BOOL:
+        schema["type"] = "boolean"
+    case DATATYPE_INT8, DATATYPE_UINT8, DATATYPE_INT16, DATATYPE_UINT16,
+            DATATYPE_INT32, DATATYPE_UINT32:
+        schema["type"] = "integer"
+        limits := integerSchemaRanges[varDef.Datatype()]
+        schema["minimum"], schema["maximum"] = limits[0], limits[1]
+        addRangeSchema(varDef, schema)
+    case DATATYPE_INT64:
+        // Decimal strings are preferred, since JSON numbers lose precision
+        // above 2^53.
+        schema["type"] = []interface{}{"string", "integer"}
+        schema["pattern"] = "^-?[0-9]+$"
+        addRangeSchema(varDef, schema)
+    case DATATYPE_UINT64:
+        schema["type"] = []interface{}{"string", "integer"}
+        schema["pattern"] = "^[0-9]+$"
+        addRangeSchema(varDef, schema)
+    case DATATYPE_FLOAT32, DATATYPE_FLOAT64:
+        schema["type"] = "number"
+        addRangeSchema(varDef, schema)
+    case DATATYPE_DATETIME:
+        schema["type"] = "string"
+        schema["format"] = "date-time"
+    case DATATYPE_BYTES:
+        schema["type"] = "string"
+        schema["pattern"] = "^[A-Za-z0-9+/]*={0,2}$"
+    case DATATYPE_ENUM:
+        // Enums may be reported by name or by index.
+        values, _ := varDef.EnumValues()
+        names := []interface{}{}
+        for _, value := range values {
+            names = append(names, value)
+        }
+        schema["anyOf"] = []interface{}{
+            map[string]interface{}{"enum" : names},
+            map[string]interface{}{
+                "type" : "integer",
+                "minimum" : 0,
+                "maximum" : len(values) - 1,
+            },
+        }
+    case DATATYPE_STRUCT:
+        properties := map[string]interface{}{}
+        members, _ := varDef.StructMembers()
+        for _, member := range members {
+            properties[member.Name()] = varDefSchema(member)
+        }
+        schema["type"] = "object"
+        schema["properties"] = properties
+        schema["additionalProperties"] = false
+    case DATATYPE_ARRAY:
+        elemDef, _ := varDef.ArrayElement()
+        size, _ := varDef.ArraySize()
+        schema["type"] = "array"
+        schema["items"] = varDefSchema(elemDef)
+        if size != 0 {
+            schema["minItems"] = size
+            schema["maxItems"] = size
+        }
+    }
+
+    if description, ok := varDef.Json()["description"].(string); ok && description != "" {
+        schema["description"] = description
+    }
+    return schema
+}
+
+// Narrow a numeric schema's "minimum" and "maximum" to the Cloud Variable's
+// "min-value" and "max-value", unless out-of-range values are clamped.
+func addRangeSchema(varDef VarDef, schema map[string]interface{}) {
+    if varDef.OutOfRangePolicy() == OUT_OF_RANGE_POLICY_CLAMP {
+        return
+    }
+    if varDef.HasMinValue() {
+        minValue, _ := varDef.MinValue()
+        if cur, ok := schema["minimum"].(float64); !ok || minValue > cur {
+            schema["minimum"] = minValue
+        }
+    }
+    if varDef.HasMaxValue() {
+        maxValue, _ := varDef.MaxValue()
+        if cur, ok := schema["maximum"].(float64); !ok || maxValue < cur {
+            schema["maximum"] = maxValue
+        }
+    }
+}
@@ -19,6 +19,8 @@ import (
     "errors"
     "fmt"
     "encoding/json"
+    "regexp"
+    "strconv"
     "strings"
 )
 
@@ -38,17 +40,45 @@ type SDDLVarDef struct {
     direction DirectionEnum
     maxValue float64
     minValue float64
+    hasMaxValue bool
+    hasMinValue bool
     numericDisplayHint NumericDisplayHintEnum
+    outOfRangePolicy OutOfRangePolicyEnum
     regex string
+    regexMatcher *regexp.Regexp
+    regexErr error
     units string
+    expression string
     structVars []VarDef
+    parent *SDDLVarDef
     arraySize int
     arrayElement *SDDLVarDef
+    enumValues []string
+    alarms []*AlarmDef
     jsonObj map[string]interface{}
 }
 
 type SDDLSys struct {}
 
+// Top-level Cloud Variable names that can't be used, because the REST
+// endpoints under /api/device/{id}/ with these names would shadow them.
+var reservedVarNames = map[string]bool{
+    "alarms" : true,
+    "notify" : true,
+    "sddl" : true,
+    "shares" : true,
+}
+
+// Check that <name> may be used for a top-level Cloud Variable.  Every
+// document parsed or extended is checked, so this is only needed to reject a
+// name before building a document with it.
+func CheckVarName(name string) error {
+    if reservedVarNames[name] {
+        return fmt.Errorf("Cloud Variable name is reserved: %s", name)
+    }
+    return nil
+}
+
 // Helper routine for parsing defininition keywords
 func keyTokenFromString(s string) (string, int, error) {
     switch s {
@@ -68,6 +98,10 @@ func keyTokenFromString(s string) (string, int, error) {
         return "datatype", int(DATATYPE_INT32), nil
     case "uint32":
         return "datatype", int(DATATYPE_UINT32), nil
+    case "int64":
+        return "datatype", int(DATATYPE_INT64), nil
+    case "uint64":
+        return "datatype", int(DATATYPE_UINT64), nil
     case "float32":
         return "datatype", int(DATATYPE_FLOAT32), nil
     case "float64":
@@ -76,6 +110,12 @@ func keyTokenFromString(s string) (string, int, error) {
         return "datatype", int(DATATYPE_STRING), nil
     case "datetime":
         return "datatype", int(DATATYPE_DATETIME), nil
+    case "bytes":
+        return "datatype", int(DATATYPE_BYTES), nil
+    case "struct":
+        return "datatype", int(DATATYPE_STRUCT), nil
+    case "enum":
+        return "datatype", int(DATATYPE_ENUM), nil
 
     case "inout":
         return "direction", int(DIRECTION_INOUT), nil
@@ -92,69 +132,121 @@ func keyTokenFromString(s string) (string, int, error) {
     return "unknown", 0, nil 
 }
 
-// Helper routine for parsing defininition strings
-func parseVarKey(key string) (OptionalityEnum, DirectionEnum, DatatypeEnum, string, error) {
-    optionality := OPTIONALITY_INVALID;
-    direction := DIRECTION_INVALID;
-    datatype := DATATYPE_INVALID;
-    name := ""
+// Helper routine for parsing array datatype tokens, such as "float32[16]"
+// (fixed-size array) or "float32[]" (variable-length array).  Returns the
+// element datatype and array size (0 for variable-length arrays).
+func parseArrayToken(s string) (DatatypeEnum, int, error) {
+    open := strings.Index(s, "[")
+    if open == -1 || !strings.HasSuffix(s, "]") {
+        return DATATYPE_INVALID, 0, fmt.Errorf("Malformed array datatype: %s", s)
+    }
+
+    tokenType, tokenVal, err := keyTokenFromString(s[:open])
+    if err != nil {
+        return DATATYPE_INVALID, 0, err
+    }
+    elemDatatype := DatatypeEnum(tokenVal)
+    if tokenType != "datatype" || elemDatatype == DATATYPE_VOID || elemDatatype == DATATYPE_STRUCT {
+        return DATATYPE_INVALID, 0, fmt.Errorf("Invalid array element datatype: %s", s)
+    }
+
+    size := 0
+    sizeString := s[open+1:len(s)-1]
+    if sizeString != "" {
+        size, err = strconv.Atoi(sizeString)
+        if err != nil || size <= 0 {
+            return DATATYPE_INVALID, 0, fmt.Errorf("Invalid array size: %s", s)
+        }
+    }
+    return elemDatatype, size, nil
+}
+
+// Helper routine for parsing defininition strings.  Returns a partially
+// initialized variable definition.
+func parseVarKey(key string) (*SDDLVarDef, error) {
+    varDef := &SDDLVarDef{
+        decl: key,
+        optionality: OPTIONALITY_INVALID,
+        direction: DIRECTION_INVALID,
+        datatype: DATATYPE_INVALID,
+    }
 
     parts := strings.Split(key, " ")
 
     for _, part := range parts {
+        if strings.Contains(part, "[") {
+            // Array datatype, such as "float32[16]"
+            if varDef.datatype != DATATYPE_INVALID {
+                return nil, fmt.Errorf("Datatype already specified")
+            }
+            elemDatatype, size, err := parseArrayToken(part)
+            if err != nil {
+                return nil, err
+            }
+            varDef.datatype = DATATYPE_ARRAY
+            varDef.arraySize = size
+            varDef.arrayElement = &SDDLVarDef{
+                datatype: elemDatatype,
+                numericDisplayHint: NUMERIC_DISPLAY_HINT_NORMAL,
+                outOfRangePolicy: OUT_OF_RANGE_POLICY_REJECT,
+            }
+            continue
+        }
+
         tokenType, tokenVal, err := keyTokenFromString(part)
         if err != nil {
-            return 0, 0, 0, "", err
+            return nil, err
         }
 
         switch tokenType {
             case "datatype" :
-                if datatype != DATATYPE_INVALID {
-                    return 0, 0, 0, "", fmt.Errorf("Datatype already specified")
+                if varDef.datatype != DATATYPE_INVALID {
+                    return nil, fmt.Errorf("Datatype already specified")
                 }
-                datatype = DatatypeEnum(tokenVal)
+                varDef.datatype = DatatypeEnum(tokenVal)
             case "direction" :
-                if direction != DIRECTION_INVALID {
-                    return 0, 0, 0, "", fmt.Errorf("Direction already specified")
+                if varDef.direction != DIRECTION_INVALID {
+                    return nil, fmt.Errorf("Direction already specified")
                 }
-                direction = DirectionEnum(tokenVal)
+                varDef.direction = DirectionEnum(tokenVal)
             case "optionality" :
-                if optionality != OPTIONALITY_INVALID {
-                    return 0, 0, 0, "", fmt.Errorf("Optionality already specified")
+                if varDef.optionality != OPTIONALITY_INVALID {
+                    return nil, fmt.Errorf("Optionality already specified")
                 }
-                optionality = OptionalityEnum(tokenVal)
+                varDef.optionality = OptionalityEnum(tokenVal)
             default:
-                if datatype == DATATYPE_INVALID {
-                    return 0, 0, 0, "", fmt.Errorf("Datatype or qualifier expected: %s", part)
+                if varDef.datatype == DATATYPE_INVALID {
+                    return nil, fmt.Errorf("Datatype or qualifier expected: %s", part)
                 }
-                if name != "" {
-                    return 0, 0, 0, "", fmt.Errorf("Variable name already specified")
+                if varDef.name != "" {
+                    return nil, fmt.Errorf("Variable name already specified")
                 }
-                name = part
+                if strings.Contains(part, ".") {
+                    return nil, fmt.Errorf("Variable name may not contain '.': %s", part)
+                }
+                varDef.name = part
         }
     }
-    if name == "" {
-            return 0, 0, 0, "", fmt.Errorf("Variable name expected")
+    if varDef.name == "" {
+            return nil, fmt.Errorf("Variable name expected")
+    }
+    if varDef.arrayElement != nil {
+        varDef.arrayElement.name = varDef.name
     }
 
-    return optionality, direction, datatype, name, nil
+    return varDef, nil
 }
 
 func ParseVar(decl string, defJson map[string]interface{}) (VarDef, error) {
-    optionality, direction, datatype, name, err := parseVarKey(decl)
+    varDef, err := parseVarKey(decl)
     if err != nil {
         return nil, err
     }
+    varDef.numericDisplayHint = NUMERIC_DISPLAY_HINT_NORMAL
+    varDef.outOfRangePolicy = OUT_OF_RANGE_POLICY_REJECT
+    varDef.jsonObj = defJson
+    // TODO: remaining defaults
 
-    varDef := SDDLVarDef{
-        decl: decl, 
-        name: name,
-        optionality: optionality,
-        direction: direction,
-        datatype: datatype,
-        numericDisplayHint: NUMERIC_DISPLAY_HINT_NORMAL,
-        // TODO: remaining defaults
-    }
     for k, v := range defJson {
         var ok bool
         if k == "description" {
@@ -167,11 +259,13 @@ func ParseVar(decl string, defJson map[string]interface{}) (VarDef, error) {
             if !ok {
                 return nil, errors.New("Expected number for max-value")
             }
+            varDef.hasMaxValue = true
         } else if k == "min-value" {
             varDef.minValue, ok = v.(float64)
             if !ok {
                 return nil, errors.New("Expected number for min-value")
             }
+            varDef.hasMinValue = true
         } else if k == "numeric-display-hint" {
             hintString, ok := v.(string)
             if !ok {
@@ -179,23 +273,129 @@ func ParseVar(decl string, defJson map[string]interface{}) (VarDef, error) {
             }
             varDef.numericDisplayHint = NumericDisplayHintStringToEnum(hintString)
             if varDef.numericDisplayHint == NUMERIC_DISPLAY_HINT_INVALID {
-                return nil, fmt.Errorf("Invalid numeric display hint: ", hintString)
+                return nil, fmt.Errorf("Invalid numeric display hint: %s", hintString)
+            }
+        } else if k == "out-of-range" {
+            policyString, ok := v.(string)
+            if !ok {
+                return nil, errors.New("Expected string for out-of-range")
+            }
+            varDef.outOfRangePolicy = OutOfRangePolicyStringToEnum(policyString)
+            if varDef.outOfRangePolicy == OUT_OF_RANGE_POLICY_INVALID {
+                return nil, fmt.Errorf("Invalid out-of-range policy: %s", policyString)
             }
         } else if k == "regex" {
             varDef.regex, ok = v.(string)
             if !ok {
                 return nil, errors.New("Expected string for regex")
             }
+            // Compiled once here rather than for every value validated.
+            // The regex must match the entire value.
+            if varDef.regex != "" {
+                varDef.regexMatcher, varDef.regexErr = regexp.Compile(
+                        "^(?:" + varDef.regex + ")$")
+            }
         } else if k == "units" {
             varDef.units, ok = v.(string)
             if !ok {
                 return nil, errors.New("Expected string for units")
             }
+            if _, err := LookupUnit(varDef.units); err != nil {
+                return nil, err
+            }
+        } else if k == "expression" {
+            varDef.expression, ok = v.(string)
+            if !ok || varDef.expression == "" {
+                return nil, errors.New("Expected non-empty string for expression")
+            }
+        } else if k == "alarms" {
+            varDef.alarms, err = parseAlarms(v)
+            if err != nil {
+                return nil, err
+            }
+        } else if k == "values" {
+            valuesList, ok := v.([]interface{})
+            if !ok {
+                return nil, errors.New("Expected list for values")
+            }
+            varDef.enumValues = []string{}
+            for _, valueItf := range valuesList {
+                value, ok := valueItf.(string)
+                if !ok || value == "" {
+                    return nil, errors.New("Expected non-empty string for enum value")
+                }
+                for _, existing := range varDef.enumValues {
+                    if existing == value {
+                        return nil, fmt.Errorf("Duplicate enum value %s", value)
+                    }
+                }
+                varDef.enumValues = append(varDef.enumValues, value)
+            }
+        } else if varDef.datatype == DATATYPE_STRUCT {
+            // Any other key in a struct definition declares a member
+            // variable, ex: "float32 latitude" : {}
+            vObj, ok := v.(map[string]interface{})
+            if !ok {
+                return nil, fmt.Errorf("Expected object for struct member %s", k)
+            }
+            member, err := ParseVar(k, vObj)
+            if err != nil {
+                return nil, err
+            }
+            memberDef := member.(*SDDLVarDef)
+            for _, existing := range varDef.structVars {
+                if existing.Name() == memberDef.name {
+                    return nil, fmt.Errorf("Duplicate struct member %s", memberDef.name)
+                }
+            }
+            memberDef.setParent(varDef)
+            varDef.structVars = append(varDef.structVars, memberDef)
         }
     }
-    return &varDef, nil
+
+    // Constraints declared on an array apply to each of its elements.
+    if varDef.arrayElement != nil {
+        elem := varDef.arrayElement
+        elem.parent = varDef.parent
+        elem.maxValue, elem.hasMaxValue = varDef.maxValue, varDef.hasMaxValue
+        elem.minValue, elem.hasMinValue = varDef.minValue, varDef.hasMinValue
+        elem.outOfRangePolicy = varDef.outOfRangePolicy
+        elem.numericDisplayHint = varDef.numericDisplayHint
+        elem.regex = varDef.regex
+        elem.regexMatcher, elem.regexErr = varDef.regexMatcher, varDef.regexErr
+        elem.units = varDef.units
+        elem.enumValues = varDef.enumValues
+    }
+
+    if varDef.expression != "" && !varDef.IsNumeric() {
+        return nil, fmt.Errorf("Derived variable %s must have a numeric datatype", varDef.name)
+    }
+
+    if len(varDef.alarms) > 0 && !varDef.IsNumeric() {
+        return nil, fmt.Errorf("Alarms not allowed for non-numeric variable %s", varDef.name)
+    }
+
+    if varDef.units != "" && !varDef.IsNumeric() && (varDef.arrayElement == nil || !varDef.arrayElement.IsNumeric()) {
+        return nil, fmt.Errorf("Units not allowed for non-numeric variable %s", varDef.name)
+    }
+
+    if (varDef.datatype == DATATYPE_ENUM || (varDef.arrayElement != nil && varDef.arrayElement.datatype == DATATYPE_ENUM)) && len(varDef.enumValues) == 0 {
+        return nil, fmt.Errorf("Enum %s requires a list of values", varDef.name)
+    }
+
+    return varDef, nil
 }
 
+// Set the struct that contains this variable.
+func (varDef *SDDLVarDef) setParent(parent *SDDLVarDef) {
+    varDef.parent = parent
+    if varDef.arrayElement != nil {
+        varDef.arrayElement.parent = parent
+    }
+}
+
+// Parse an SDDL document.  Fails if a top-level Cloud Variable uses a
+// reserved name (see CheckVarName).
 func (sys *SDDLSys) ParseDocument(jsn map[string]interface{}) (Document, error) {
     doc := SDDLDocument{
         jsonObj: jsn, 
@@ -221,7 +421,11 @@ func (sys *SDDLSys) ParseDocumentString(doc string) (Document, error) {
 }
 
 func (sys *SDDLSys) NewEmptyDocument() (Document) {
-    var doc SDDLDocument;
+    doc := SDDLDocument{
+        jsonObj: map[string]interface{}{},
+        vars: []VarDef{},
+        authors: []string{},
+    }
     return &doc;
 }
 
@@ -232,6 +436,24 @@ func (sys *SDDLSys) NewEmptyStruct() (VarDef) {
     return &varDef;
 }
 
+func (varDef *SDDLVarDef) Alarms() []*AlarmDef {
+    return varDef.alarms
+}
+
+func (varDef *SDDLVarDef) ArrayElement() (VarDef, error) {
+    if varDef.datatype != DATATYPE_ARRAY {
+        return nil, fmt.Errorf("ArrayElement() can only be called on an array")
+    }
+    return varDef.arrayElement, nil
+}
+
+func (varDef *SDDLVarDef) ArraySize() (int, error) {
+    if varDef.datatype != DATATYPE_ARRAY {
+        return 0, fmt.Errorf("ArraySize() can only be called on an array")
+    }
+    return varDef.arraySize, nil
+}
+
 func (varDef *SDDLVarDef) Datatype() DatatypeEnum {
     return varDef.datatype
 }
@@ -240,12 +462,34 @@ func (varDef *SDDLVarDef) Declaration() string {
     return varDef.decl
 }
 
+func (varDef *SDDLVarDef) EnumValues() ([]string, error) {
+    if varDef.datatype != DATATYPE_ENUM {
+        return nil, fmt.Errorf("EnumValues() can only be called on an enum")
+    }
+    return varDef.enumValues, nil
+}
+
 func (varDef *SDDLVarDef) Fullname() string {
-    return varDef.name // TODO: implement correctly
+    if varDef.parent != nil {
+        return varDef.parent.Fullname() + "." + varDef.name
+    }
+    return varDef.name
+}
+
+func (varDef *SDDLVarDef) HasMaxValue() bool {
+    return varDef.IsNumeric() && varDef.hasMaxValue
+}
+
+func (varDef *SDDLVarDef) HasMinValue() bool {
+    return varDef.IsNumeric() && varDef.hasMinValue
+}
+
+func (varDef *SDDLVarDef) Expression() string {
+    return varDef.expression
 }
 
 func (varDef *SDDLVarDef) IsNumeric() bool {
-    return ((varDef.datatype == DATATYPE_FLOAT32) || (varDef.datatype == DATATYPE_FLOAT64) || (varDef.datatype == DATATYPE_INT8) || (varDef.datatype == DATATYPE_INT16) || (varDef.datatype == DATATYPE_INT32) || (varDef.datatype == DATATYPE_UINT8) || (varDef.datatype == DATATYPE_UINT16) || (varDef.datatype == DATATYPE_UINT32))
+    return ((varDef.datatype == DATATYPE_FLOAT32) || (varDef.datatype == DATATYPE_FLOAT64) || (varDef.datatype == DATATYPE_INT8) || (varDef.datatype == DATATYPE_INT16) || (varDef.datatype == DATATYPE_INT32) || (varDef.datatype == DATATYPE_UINT8) || (varDef.datatype == DATATYPE_UINT16) || (varDef.datatype == DATATYPE_UINT32) || (varDef.datatype == DATATYPE_INT64) || (varDef.datatype == DATATYPE_UINT64))
 }
 
 func (varDef *SDDLVarDef) Json() map[string]interface{} {
@@ -266,10 +510,20 @@ func (varDef *SDDLVarDef) jsonEncode() (map[string]interface{}, error) {
     }
     jsn["datatype"] = datatype
 
-    // TODO: Don't always have these?
     if varDef.IsNumeric() {
-        jsn["max-value"] = varDef.maxValue
-        jsn["min-value"] = varDef.minValue
+        if varDef.hasMaxValue {
+            jsn["max-value"] = varDef.maxValue
+        }
+        if varDef.hasMinValue {
+            jsn["min-value"] = varDef.minValue
+        }
+        if varDef.hasMaxValue || varDef.hasMinValue {
+            policy, err := OutOfRangePolicyEnumToString(varDef.outOfRangePolicy)
+            if err != nil {
+                return nil, err
+            }
+            jsn["out-of-range"] = policy
+        }
 
         numericDisplayHint, err := NumericDisplayHintEnumToString(varDef.numericDisplayHint)
         if err != nil {
@@ -282,8 +536,47 @@ func (varDef *SDDLVarDef) jsonEncode() (map[string]interface{}, error) {
         jsn["regex"] = varDef.regex
     }
 
+    if varDef.datatype == DATATYPE_ENUM || (varDef.arrayElement != nil && varDef.arrayElement.datatype == DATATYPE_ENUM) {
+        values := []interface{}{}
+        for _, value := range varDef.enumValues {
+            values = append(values, value)
+        }
+        jsn["values"] = values
+    }
+
+    if varDef.datatype == DATATYPE_STRUCT {
+        for _, member := range varDef.structVars {
+            memberJsn, err := member.jsonEncode()
+            if err != nil {
+                return nil, err
+            }
+            jsn[member.Declaration()] = memberJsn
+        }
+    }
+
+    if varDef.datatype == DATATYPE_ARRAY {
+        elemDatatype, err := DatatypeEnumToString(varDef.arrayElement.datatype)
+        if err != nil {
+            return nil, err
+        }
+        jsn["element-datatype"] = elemDatatype
+        jsn["array-size"] = varDef.arraySize
+    }
+
     jsn["units"] = varDef.units
 
+    if varDef.expression != "" {
+        jsn["expression"] = varDef.expression
+    }
+
+    if len(varDef.alarms) > 0 {
+        alarms := map[string]interface{}{}
+        for _, alarm := range varDef.alarms {
+            alarms[alarm.name] = alarm.jsonEncode()
+        }
+        jsn["alarms"] = alarms
+    }
+
     return jsn, nil
 }
 
@@ -329,6 +622,10 @@ func (varDef *SDDLVarDef) NumericDisplayHint() (NumericDisplayHintEnum, error) {
     return varDef.numericDisplayHint, nil
 }
 
+func (varDef *SDDLVarDef) OutOfRangePolicy() OutOfRangePolicyEnum {
+    return varDef.outOfRangePolicy
+}
+
 func (varDef *SDDLVarDef) Regex() (string, error) {
     if varDef.datatype != DATATYPE_STRING {
         return "", fmt.Errorf("Regex() can only be called on a string var")
@@ -336,6 +633,13 @@ func (varDef *SDDLVarDef) Regex() (string, error) {
     return varDef.regex, nil
 }
 
+func (varDef *SDDLVarDef) RegexMatcher() (*regexp.Regexp, error) {
+    if varDef.datatype != DATATYPE_STRING {
+        return nil, fmt.Errorf("RegexMatcher() can only be called on a string var")
+    }
+    return varDef.regexMatcher, varDef.regexErr
+}
+
 func (varDef *SDDLVarDef) StructMembers() ([]VarDef, error) {
     if varDef.datatype != DATATYPE_STRUCT {
         return nil, fmt.Errorf("StructMembers() can only be called on a structure")
@@ -397,6 +701,11 @@ func (varDef *SDDLVarDef) Units() (string, error) {
 func (doc *SDDLDocument) AddVarDef(name string, datatype DatatypeEnum) (VarDef, error) {
     // TODO: What if cloud variable already exists?
 
+    err := CheckVarName(name)
+    if err != nil {
+        return nil, err
+    }
+
     datatypeString, err := DatatypeEnumToString(datatype)
     if err != nil {
         return nil, err
@@ -407,6 +716,7 @@ func (doc *SDDLDocument) AddVarDef(name string, datatype DatatypeEnum) (VarDef,
         datatype: datatype,
         decl: datatypeString + " " + name,
         numericDisplayHint: NUMERIC_DISPLAY_HINT_NORMAL,
+        outOfRangePolicy: OUT_OF_RANGE_POLICY_REJECT,
     }
 
     doc.vars = append(doc.vars, varDef)
@@ -417,6 +727,10 @@ func (doc *SDDLDocument) AddVarDef(name string, datatype DatatypeEnum) (VarDef,
         return nil, err
     }
     varDef.jsonObj = jsonObj
+    if doc.jsonObj == nil {
+        doc.jsonObj = map[string]interface{} {}
+    }
+    doc.jsonObj[varDef.decl] = jsonObj
 
     return varDef, nil
 }
@@ -435,7 +749,6 @@ func (doc *SDDLDocument) Extend(jsn map[string]interface{}) error {
     for k, v := range jsn {
         if k == "authors" {
             authorsList, ok := v.([]interface{})
-            /* TODO: finish */
             if !ok {
                 return errors.New("Expected list for authors")
             }
@@ -444,13 +757,17 @@ func (doc *SDDLDocument) Extend(jsn map[string]interface{}) error {
                 if !ok {
                     return errors.New("Expect string for author")
                 }
-                doc.authors = append(doc.authors, authorString)
+                if !doc.hasAuthor(authorString) {
+                    doc.authors = append(doc.authors, authorString)
+                }
             }
+            doc.setJsonMetadata("authors", doc.authorsJson())
         } else if k == "description" {
             doc.description, ok = v.(string)
             if !ok {
                 return errors.New("Expected string for description")
             }
+            doc.setJsonMetadata("description", doc.description)
         } else {
             vObj, ok := v.(map[string]interface{})
             if !ok {
@@ -460,6 +777,10 @@ func (doc *SDDLDocument) Extend(jsn map[string]interface{}) error {
             if (err != nil) {
                 return err;
             }
+            err = CheckVarName(varDef.Name())
+            if err != nil {
+                return err
+            }
 
             doc.RemoveVarDef(varDef.Name()) // If var already exists, remove it first
             doc.vars = append(doc.vars, varDef);
@@ -475,6 +796,32 @@ func (doc *SDDLDocument) Extend(jsn map[string]interface{}) error {
     return nil
 }
 
+func (doc *SDDLDocument) hasAuthor(author string) bool {
+    for _, a := range doc.authors {
+        if a == author {
+            return true
+        }
+    }
+    return false
+}
+
+func (doc *SDDLDocument) authorsJson() []interface{} {
+    authors := []interface{}{}
+    for _, author := range doc.authors {
+        authors = append(authors, author)
+    }
+    return authors
+}
+
+// Update a metadata entry ("authors" or "description") of the document's
+// JSON representation.
+func (doc *SDDLDocument) setJsonMetadata(key string, value interface{}) {
+    if doc.jsonObj == nil {
+        doc.jsonObj = map[string]interface{} {}
+    }
+    doc.jsonObj[key] = value
+}
+
 // Encode document as golang JSON object.
 // Does the actual work of encoding/marshalling, unlike .Json() which just re
 func (doc *SDDLDocument) jsonEncode() (map[string]interface{}, error) {
@@ -487,8 +834,12 @@ func (doc *SDDLDocument) jsonEncode() (map[string]interface{}, error) {
         }
         jsn[varDef.Declaration()] = val
     }
-    // TODO: authors
-    // TODO: description
+    if len(doc.authors) > 0 {
+        jsn["authors"] = doc.authorsJson()
+    }
+    if doc.description != "" {
+        jsn["description"] = doc.description
+    }
     return jsn, nil
 }
 
@@ -513,10 +864,27 @@ func (doc *SDDLDocument) Json() map[string]interface{} {
 
 func (doc *SDDLDocument) LookupVarDef(varName string) (VarDef, error) {
     // TODO: improve implementation
-    for _, varDef := range doc.vars {
-        if (varDef.Name() == varName) {
-            return varDef, nil
+    // Struct members are addressed by their full name: "gps.latitude"
+    parts := strings.Split(varName, ".")
+    candidates := doc.vars
+    for i, part := range parts {
+        var found VarDef
+        for _, varDef := range candidates {
+            if (varDef.Name() == part) {
+                found = varDef
+                break
+            }
+        }
+        if found == nil {
+            break
+        }
+        if i == len(parts) - 1 {
+            return found, nil
+        }
+        if found.Datatype() != DATATYPE_STRUCT {
+            break
         }
+        candidates, _ = found.StructMembers()
     }
     return nil, fmt.Errorf("Variable %s not found in document", varName)
 }
@@ -15,6 +15,7 @@
 package sddl
 
 import (
+    "regexp"
 )
 
 // DatatypeEnum is the datatype of a Cloud Variable
@@ -35,6 +36,10 @@ const (
     DATATYPE_DATETIME
     DATATYPE_STRUCT
     DATATYPE_ARRAY
+    DATATYPE_ENUM
+    DATATYPE_INT64
+    DATATYPE_UINT64
+    DATATYPE_BYTES
 )
 
 // DirectionEnum is the "direction" of a Cloud Variable -- that is, who can
@@ -67,6 +72,15 @@ const (
     NUMERIC_DISPLAY_HINT_HEX
 )
 
+// OutOfRangePolicyEnum determines what happens when a reported value falls
+// outside of a Cloud Variable's "min-value"/"max-value" range.
+type OutOfRangePolicyEnum int
+const (
+    OUT_OF_RANGE_POLICY_INVALID OutOfRangePolicyEnum = iota
+    OUT_OF_RANGE_POLICY_REJECT
+    OUT_OF_RANGE_POLICY_CLAMP
+)
+
 // SDDL provides an abstracted interface for working with SDDL content
 type SDDL interface {
     // Parse an SDDL document, provided as a golang JSON object.
@@ -82,6 +96,7 @@ type SDDL interface {
     //          "min-value" : -100,
     //          "max-value" : 150,
     //          "units" : "degrees_c",
+    //          "out-of-range" : "clamp",
     //          ...
     //      }
     ParseVarDef(decl string, propsJson map[string]interface{}) (*VarDef, error)
@@ -102,7 +117,45 @@ type SDDL interface {
 //   - A declaration: "optional out float32 temperature"
 //   - Additional properties: {min-value: -100.0}
 //   - Child members for composite types (like arrays & structs)
+//
+// Structs declare their members as nested declarations:
+//
+//      "out struct gps" : {
+//          "float32 latitude" : {},
+//          "float32 longitude" : {}
+//      }
+//
+// Arrays of basic types are declared with a size suffix on the datatype
+// (omit the size for a variable-length array):
+//
+//      "out float32[16] readings" : {}
+//
+// Enums declare their allowed values with the "values" property:
+//
+//      "inout enum mode" : {
+//          "values" : ["off", "heat", "cool", "auto"]
+//      }
+//
+// Derived Cloud Variables are computed by the server from other variables
+// using the "expression" property, rather than being reported:
+//
+//      "out float32 power" : {
+//          "expression" : "voltage * current"
+//      }
 type VarDef interface {
+    // Get the threshold alarms declared on this Cloud Variable with the
+    // "alarms" property, sorted by name.  See AlarmDef.
+    Alarms() []*AlarmDef
+
+    // Get the element definition of this Cloud Variable if it is an "array".
+    // Returns an error if the Cloud Variable is not DATATYPE_ARRAY
+    ArrayElement() (VarDef, error)
+
+    // Get the fixed number of elements of this Cloud Variable if it is an
+    // "array", or 0 for variable-length arrays.
+    // Returns an error if the Cloud Variable is not DATATYPE_ARRAY
+    ArraySize() (int, error)
+
     // Get the datatype of this Cloud Variable, ex: DATATYPE_FLOAT32 or
     // DATATYPE_STRUCT
     Datatype() DatatypeEnum
@@ -110,9 +163,25 @@ type VarDef interface {
     // Get the full declaration string, ex: "optional out float32 temperature"
     Declaration() string
 
+    // Get the allowed values of this Cloud Variable if it is an "enum", in
+    // declaration order.
+    // Returns an error if the Cloud Variable is not DATATYPE_ENUM
+    EnumValues() ([]string, error)
+
+    // Get the "expression" property of a derived Cloud Variable, or "" if
+    // the Cloud Variable's value is reported normally.  See
+    // device_filter.ParseDerivedExpression.
+    Expression() string
+
     // Get full name of this Cloud Variable, ex: "temperature", "gps.longitude"
     Fullname() string
 
+    // Has the "max-value" property been specified for this Cloud Variable?
+    HasMaxValue() bool
+
+    // Has the "min-value" property been specified for this Cloud Variable?
+    HasMinValue() bool
+
     // Does this Cloud Variable have a numeric datatype?
     IsNumeric() bool
 
@@ -137,10 +206,19 @@ type VarDef interface {
     // Returns an error if the Cloud Variable does not have a numeric type.
     NumericDisplayHint() (NumericDisplayHintEnum, error)
 
+    // Get the "out-of-range" property, which determines whether values
+    // outside of the min/max range are rejected or clamped.
+    OutOfRangePolicy() OutOfRangePolicyEnum
+
     // Get the "regex" property, used for string input validation.
     // Returns an error if the Cloud Variable does not have a string type
     Regex() (string, error)
 
+    // Get the compiled "regex" property, anchored to match the entire value.
+    // Returns nil if there is no regex, or an error if the Cloud Variable
+    // does not have a string type or its regex is invalid.
+    RegexMatcher() (*regexp.Regexp, error)
+
     // Get the children of this Cloud Variable if it is a "struct".
     // Returns an error if the Cloud Variable is not DATATYPE_STRUCT
     StructMembers() ([]VarDef, error)
@@ -148,7 +226,8 @@ type VarDef interface {
     // Get a string JSON representation of this Cloud Variable definition.
     ToString() (string, error)
 
-    // Get the "units" property for this Cloud Variable.
+    // Get the "units" property for this Cloud Variable.  This is "" or the
+    // name of a unit in the units registry (see LookupUnit).
     // Returns an error if the Cloud Variable does not have a basic type.
     Units() (string, error)
 }
@@ -165,7 +244,9 @@ type Document interface{
     // Get the document's "description" metadata
     Description() string
 
-    // Add new member variables to this document
+    // Add new member variables to this document.  The "authors" and
+    // "description" metadata may also be provided; new authors are appended
+    // to the existing list.
     Extend(jsn map[string]interface{}) error
 
     // Get a golang JSON representation of this SDDL document.
@@ -0,0 +1,83 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sddl
+
+import (
+    "testing"
+)
+
+func TestReservedVarNames(t *testing.T) {
+    // The same declarations are fine with an unreserved name.
+    _, err := Sys.ParseDocumentString(`{"in float32 temperature" : {}, "optional out string status" : {}}`)
+    if err != nil {
+        t.Fatalf("ParseDocumentString: %s", err)
+    }
+
+    for _, name := range []string{"alarms", "notify", "sddl", "shares"} {
+        if CheckVarName(name) == nil {
+            t.Errorf("CheckVarName accepted %q", name)
+        }
+
+        _, err = Sys.ParseDocument(map[string]interface{}{
+            "in float32 " + name : map[string]interface{}{},
+        })
+        if err == nil {
+            t.Errorf("ParseDocument accepted Cloud Variable %q", name)
+        }
+
+        _, err = Sys.ParseDocumentString(`{"optional out string ` + name + `" : {}}`)
+        if err == nil {
+            t.Errorf("ParseDocumentString accepted Cloud Variable %q", name)
+        }
+
+        doc := Sys.NewEmptyDocument()
+        err = doc.Extend(map[string]interface{}{
+            "float32 " + name : map[string]interface{}{},
+        })
+        if err == nil {
+            t.Errorf("Extend accepted Cloud Variable %q", name)
+        }
+
+        _, err = doc.AddVarDef(name, DATATYPE_FLOAT32)
+        if err == nil {
+            t.Errorf("AddVarDef accepted Cloud Variable %q", name)
+        }
+        if len(doc.VarDefs()) != 0 {
+            t.Errorf("Reserved Cloud Variable %q was added", name)
+        }
+    }
+}
+
+func TestReservedVarNamesAllowedElsewhere(t *testing.T) {
+    for _, name := range []string{"temperature", "share", "alarm", "sddl_version"} {
+        if err := CheckVarName(name); err != nil {
+            t.Errorf("CheckVarName rejected %q: %s", name, err)
+        }
+    }
+
+    // Only top-level names are routed, so struct members may use them.
+    doc, err := Sys.ParseDocument(map[string]interface{}{
+        "struct config" : map[string]interface{}{
+            "float32 alarms" : map[string]interface{}{},
+            "string shares" : map[string]interface{}{},
+        },
+    })
+    if err != nil {
+        t.Fatalf("ParseDocument: %s", err)
+    }
+    if _, err := doc.LookupVarDef("config.alarms"); err != nil {
+        t.Errorf("LookupVarDef: %s", err)
+    }
+}
@@ -38,16 +38,24 @@ func DatatypeEnumToString(in DatatypeEnum) (string, error) {
         return "int32", nil
     case DATATYPE_UINT32:
         return "uint32", nil
+    case DATATYPE_INT64:
+        return "int64", nil
+    case DATATYPE_UINT64:
+        return "uint64", nil
     case DATATYPE_FLOAT32:
         return "float32", nil
     case DATATYPE_FLOAT64:
         return "float64", nil
     case DATATYPE_DATETIME:
         return "datetime", nil
+    case DATATYPE_BYTES:
+        return "bytes", nil
     case DATATYPE_STRUCT:
         return "struct", nil
     case DATATYPE_ARRAY:
         return "array", nil
+    case DATATYPE_ENUM:
+        return "enum", nil
     default:
         return "", fmt.Errorf("Invalid DatatypeEnum value: ", in)
     }
@@ -72,16 +80,24 @@ func DatatypeStringToEnum(in string) DatatypeEnum {
         return DATATYPE_INT32
     } else if in == "uint32" {
         return DATATYPE_UINT32
+    } else if in == "int64" {
+        return DATATYPE_INT64
+    } else if in == "uint64" {
+        return DATATYPE_UINT64
     } else if in == "float32" {
         return DATATYPE_FLOAT32
     } else if in == "float64" {
         return DATATYPE_FLOAT64
     } else if in == "datetime" {
         return DATATYPE_DATETIME
+    } else if in == "bytes" {
+        return DATATYPE_BYTES
     } else if in == "struct" {
         return DATATYPE_STRUCT
     } else if in == "array" {
-        return DATATYPE_STRUCT
+        return DATATYPE_ARRAY
+    } else if in == "enum" {
+        return DATATYPE_ENUM
     }
     return DATATYPE_INVALID
 }
@@ -111,3 +127,99 @@ func NumericDisplayHintStringToEnum(in string) NumericDisplayHintEnum {
     }
     return NUMERIC_DISPLAY_HINT_INVALID
 }
+
+func OutOfRangePolicyEnumToString(in OutOfRangePolicyEnum) (string, error) {
+    if in == OUT_OF_RANGE_POLICY_REJECT {
+        return "reject", nil
+    } else if in == OUT_OF_RANGE_POLICY_CLAMP {
+        return "clamp", nil
+    }
+    return "", fmt.Errorf("Invalid OutOfRangePolicyEnum value %d", in)
+}
+
+func OutOfRangePolicyStringToEnum(in string) OutOfRangePolicyEnum {
+    if in == "reject" {
+        return OUT_OF_RANGE_POLICY_REJECT
+    } else if in == "clamp" {
+        return OUT_OF_RANGE_POLICY_CLAMP
+    }
+    return OUT_OF_RANGE_POLICY_INVALID
+}
+
+// Get the index of <value> in an enum Cloud Variable's list of allowed
+// values.  Returns -1 if <value> is not allowed or <varDef> is not an enum.
+func EnumValueIndex(varDef VarDef, value string) int {
+    values, err := varDef.EnumValues()
+    if err != nil {
+        return -1
+    }
+    for i, v := range values {
+        if v == value {
+            return i
+        }
+    }
+    return -1
+}
+
+// Infer the basic datatype of a golang JSON value.
+func inferBasicDatatype(value interface{}) (string, error) {
+    switch value.(type) {
+    case nil:
+        return "void", nil
+    case bool:
+        return "bool", nil
+    case string:
+        return "string", nil
+    case float64:
+        // JSON does not distinguish integers from reals, so use the widest
+        // numeric type to avoid losing precision.
+        return "float64", nil
+    }
+    return "", fmt.Errorf("Cannot infer datatype for value %v", value)
+}
+
+// Infer a Cloud Variable declaration from a reported golang JSON value.
+// Returns the declaration string and properties object, suitable for passing
+// to Document.Extend:
+//
+//      decl, props, err := sddl.InferVarDecl("gps", value)
+//      doc.Extend(map[string]interface{}{decl : props})
+//
+// Objects become structs (with inferred members) and arrays become
+// variable-length arrays of their elements' common basic datatype.
+func InferVarDecl(name string, value interface{}) (string, map[string]interface{}, error) {
+    switch v := value.(type) {
+    case map[string]interface{}:
+        props := map[string]interface{}{}
+        for memberName, memberValue := range v {
+            memberDecl, memberProps, err := InferVarDecl(memberName, memberValue)
+            if err != nil {
+                return "", nil, err
+            }
+            props[memberDecl] = memberProps
+        }
+        return "struct " + name, props, nil
+    case []interface{}:
+        if len(v) == 0 {
+            return "", nil, fmt.Errorf("Cannot infer datatype for empty array %s", name)
+        }
+        elemDatatype := ""
+        for _, elem := range v {
+            datatype, err := inferBasicDatatype(elem)
+            if err != nil || datatype == "void" {
+                return "", nil, fmt.Errorf("Cannot infer element datatype for array %s", name)
+            }
+            if elemDatatype != "" && datatype != elemDatatype {
+                return "", nil, fmt.Errorf("Array %s has elements of mixed datatypes", name)
+            }
+            elemDatatype = datatype
+        }
+        return elemDatatype + "[] " + name, map[string]interface{}{}, nil
+    }
+
+    datatype, err := inferBasicDatatype(value)
+    if err != nil {
+        return "", nil, err
+    }
+    return datatype + " " + name, map[string]interface{}{}, nil
+}
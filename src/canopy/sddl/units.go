@@ -0,0 +1,158 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sddl
+
+import (
+    "fmt"
+    "sort"
+)
+
+// Unit is an entry in the units registry.  Values in a unit are converted to
+// the base unit of its quantity with:
+//
+//      base = (value + offset)*scale
+//
+// The base units are SI: kelvin, pascal, joule, meter, etc.
+type Unit struct {
+    name string
+    quantity string
+    scale float64
+    offset float64
+}
+
+var unitRegistry = map[string]*Unit{}
+
+func registerUnit(name, quantity string, scale, offset float64) {
+    unitRegistry[name] = &Unit{name, quantity, scale, offset}
+}
+
+func init() {
+    registerUnit("kelvin", "temperature", 1, 0)
+    registerUnit("degrees_c", "temperature", 1, 273.15)
+    registerUnit("degrees_f", "temperature", 5.0/9.0, 459.67)
+
+    registerUnit("pascal", "pressure", 1, 0)
+    registerUnit("hectopascal", "pressure", 100, 0)
+    registerUnit("kilopascal", "pressure", 1000, 0)
+    registerUnit("millibar", "pressure", 100, 0)
+    registerUnit("bar", "pressure", 100000, 0)
+    registerUnit("atmosphere", "pressure", 101325, 0)
+    registerUnit("psi", "pressure", 6894.757293168, 0)
+    registerUnit("inches_hg", "pressure", 3386.389, 0)
+    registerUnit("mm_hg", "pressure", 133.322387415, 0)
+
+    registerUnit("joule", "energy", 1, 0)
+    registerUnit("kilojoule", "energy", 1000, 0)
+    registerUnit("watt_hours", "energy", 3600, 0)
+    registerUnit("kilowatt_hours", "energy", 3600000, 0)
+    registerUnit("calorie", "energy", 4.184, 0)
+    registerUnit("kilocalorie", "energy", 4184, 0)
+    registerUnit("btu", "energy", 1055.05585262, 0)
+
+    registerUnit("watt", "power", 1, 0)
+    registerUnit("kilowatt", "power", 1000, 0)
+    registerUnit("horsepower", "power", 745.69987158227022, 0)
+
+    registerUnit("meter", "length", 1, 0)
+    registerUnit("kilometer", "length", 1000, 0)
+    registerUnit("centimeter", "length", 0.01, 0)
+    registerUnit("millimeter", "length", 0.001, 0)
+    registerUnit("inch", "length", 0.0254, 0)
+    registerUnit("foot", "length", 0.3048, 0)
+    registerUnit("yard", "length", 0.9144, 0)
+    registerUnit("mile", "length", 1609.344, 0)
+
+    registerUnit("kilogram", "mass", 1, 0)
+    registerUnit("gram", "mass", 0.001, 0)
+    registerUnit("pound", "mass", 0.45359237, 0)
+    registerUnit("ounce", "mass", 0.028349523125, 0)
+
+    registerUnit("liter", "volume", 0.001, 0)
+    registerUnit("milliliter", "volume", 0.000001, 0)
+    registerUnit("cubic_meter", "volume", 1, 0)
+    registerUnit("gallon", "volume", 0.003785411784, 0)
+
+    registerUnit("meters_per_second", "speed", 1, 0)
+    registerUnit("kilometers_per_hour", "speed", 1000.0/3600.0, 0)
+    registerUnit("miles_per_hour", "speed", 0.44704, 0)
+    registerUnit("knot", "speed", 1852.0/3600.0, 0)
+
+    registerUnit("second", "time", 1, 0)
+    registerUnit("millisecond", "time", 0.001, 0)
+    registerUnit("minute", "time", 60, 0)
+    registerUnit("hour", "time", 3600, 0)
+    registerUnit("day", "time", 86400, 0)
+
+    registerUnit("volt", "voltage", 1, 0)
+    registerUnit("millivolt", "voltage", 0.001, 0)
+    registerUnit("ampere", "current", 1, 0)
+    registerUnit("milliampere", "current", 0.001, 0)
+
+    registerUnit("ratio", "ratio", 1, 0)
+    registerUnit("percent", "ratio", 0.01, 0)
+    registerUnit("ppm", "ratio", 0.000001, 0)
+}
+
+// Name of the unit, ex: "degrees_c"
+func (unit *Unit) Name() string {
+    return unit.name
+}
+
+// Physical quantity measured by the unit, ex: "temperature".  Values can only
+// be converted between units of the same quantity.
+func (unit *Unit) Quantity() string {
+    return unit.quantity
+}
+
+// Lookup a unit in the registry by name.
+func LookupUnit(name string) (*Unit, error) {
+    unit, ok := unitRegistry[name]
+    if !ok {
+        return nil, fmt.Errorf("Unknown units: %s", name)
+    }
+    return unit, nil
+}
+
+// Get the names of all registered units, sorted.
+func UnitNames() []string {
+    out := []string{}
+    for name := range unitRegistry {
+        out = append(out, name)
+    }
+    sort.Strings(out)
+    return out
+}
+
+// Convert <value> from units <from> to units <to>.  Returns an error if
+// either unit is unknown or they measure different quantities.
+func ConvertUnits(value float64, from, to string) (float64, error) {
+    fromUnit, err := LookupUnit(from)
+    if err != nil {
+        return 0, err
+    }
+    toUnit, err := LookupUnit(to)
+    if err != nil {
+        return 0, err
+    }
+    if fromUnit.quantity != toUnit.quantity {
+        return 0, fmt.Errorf("Cannot convert %s (%s) to %s (%s)",
+                from, fromUnit.quantity, to, toUnit.quantity)
+    }
+    if fromUnit == toUnit {
+        return value, nil
+    }
+    base := (value + fromUnit.offset)*fromUnit.scale
+    return base/toUnit.scale - toUnit.offset, nil
+}
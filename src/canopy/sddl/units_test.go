@@ -0,0 +1,112 @@
+// Copright 2014-2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package sddl
+
+import (
+    "math"
+    "testing"
+)
+
+func closeTo(a, b float64) bool {
+    return math.Abs(a - b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+func TestConvertUnits(t *testing.T) {
+    tests := []struct {
+        value float64
+        from string
+        to string
+        expected float64
+    }{
+        {100, "degrees_c", "degrees_f", 212},
+        {-40, "degrees_f", "degrees_c", -40},
+        {0, "kelvin", "degrees_c", -273.15},
+        {32, "degrees_f", "kelvin", 273.15},
+        {1, "atmosphere", "hectopascal", 1013.25},
+        {1, "bar", "millibar", 1000},
+        {1, "kilowatt_hours", "kilojoule", 3600},
+        {1, "kilocalorie", "calorie", 1000},
+        {1, "mile", "foot", 5280},
+        {1, "yard", "inch", 36},
+        {1, "pound", "ounce", 16},
+        {1, "cubic_meter", "liter", 1000},
+        {36, "kilometers_per_hour", "meters_per_second", 10},
+        {1, "knot", "kilometers_per_hour", 1.852},
+        {1, "day", "minute", 1440},
+        {1500, "millivolt", "volt", 1.5},
+        {250, "milliampere", "ampere", 0.25},
+        {1, "percent", "ppm", 10000},
+        {7.5, "meter", "meter", 7.5},
+    }
+    for _, test := range tests {
+        result, err := ConvertUnits(test.value, test.from, test.to)
+        if err != nil {
+            t.Errorf("ConvertUnits(%v, %s, %s): %s", test.value, test.from, test.to, err)
+            continue
+        }
+        if !closeTo(result, test.expected) {
+            t.Errorf("ConvertUnits(%v, %s, %s) = %v, expected %v",
+                test.value, test.from, test.to, result, test.expected)
+        }
+    }
+}
+
+func TestConvertUnitsRoundTrip(t *testing.T) {
+    names := UnitNames()
+    for _, from := range names {
+        fromUnit, _ := LookupUnit(from)
+        for _, to := range names {
+            toUnit, _ := LookupUnit(to)
+            if fromUnit.Quantity() != toUnit.Quantity() {
+                _, err := ConvertUnits(1, from, to)
+                if err == nil {
+                    t.Errorf("ConvertUnits(%s, %s) converted between quantities", from, to)
+                }
+                continue
+            }
+            for _, value := range []float64{-40, 0, 1, 123.456} {
+                converted, err := ConvertUnits(value, from, to)
+                if err != nil {
+                    t.Errorf("ConvertUnits(%v, %s, %s): %s", value, from, to, err)
+                    continue
+                }
+                back, err := ConvertUnits(converted, to, from)
+                if err != nil {
+                    t.Errorf("ConvertUnits(%v, %s, %s): %s", converted, to, from, err)
+                    continue
+                }
+                if !closeTo(back, value) {
+                    t.Errorf("%v %s -> %v %s -> %v %s", value, from, converted, to, back, from)
+                }
+            }
+        }
+    }
+}
+
+func TestUnknownUnits(t *testing.T) {
+    _, err := ConvertUnits(1, "furlong", "meter")
+    if err == nil {
+        t.Errorf("ConvertUnits accepted unknown units")
+    }
+    _, err = ConvertUnits(1, "meter", "furlong")
+    if err == nil {
+        t.Errorf("ConvertUnits accepted unknown units")
+    }
+    _, err = ParseVar("in float32 distance", map[string]interface{}{"units" : "furlong"})
+    if err == nil {
+        t.Errorf("ParseVar accepted unknown units")
+    }
+}
@@ -21,10 +21,12 @@ import (
     "canopy/config"
     "canopy/datalayer"
     "canopy/datalayer/cassandra_datalayer"
+    "canopy/device_filter"
     "canopy/sddl"
     "time"
     "github.com/gocql/gocql"
     "net/http"
+    "strings"
     "fmt"
 )
 
@@ -33,12 +35,20 @@ type ServiceResponse struct {
     Err error
     Response string
     Device datalayer.Device
+
+    // Full names of the Cloud Variables that were stored, including derived
+    // variables.
+    UpdatedVars []string
+
+    // Did the device's SDDL document change?
+    SDDLChanged bool
 }
 
 
 // Process communication payload from device (via websocket. or REST)
 //  {
 //      "device_id" : "9dfe2a00-efe2-45f9-a84c-8afc69caf4e7", 
+//        "sddl_class" : "acme/thermostat-v2",
 //        "sddl" : {
 //          "optional inbound bool onoff" : {}
 //        },
@@ -67,6 +77,10 @@ type ServiceResponse struct {
 //  payload's "secret_key" field will be used.
 //
 //  <payload> is a string containing the JSON payload.
+//
+//  "sddl_class" has the form "<owner>/<class name>".  The device joins that
+//  SDDL class, which must be owned by an account that has access to the
+//  device.  Any "sddl" provided alongside it extends the class document.
 func ProcessDeviceComm(
         cfg config.Config,
         conn datalayer.Connection, 
@@ -221,9 +235,42 @@ func ProcessDeviceComm(
         }
     }
     out.Device = device
+    sddlVersion := device.SDDLVersion()
 
     device.UpdateLastActivityTime(nil)
 
+    // If "sddl_class" is present, join that SDDL class.
+    _, ok = payloadObj["sddl_class"]
+    if ok {
+        classRef, ok := payloadObj["sddl_class"].(string)
+        if !ok {
+            return ServiceResponse{
+                HttpCode: http.StatusBadRequest,
+                Err: fmt.Errorf("Expected string for \"sddl_class\" field"),
+                Response: `{"result" : "error", "error_type" : "bad_payload"}`,
+                Device: nil,
+            }
+        }
+        class, err := lookupReportedSDDLClass(conn, device, classRef)
+        if err != nil {
+            return ServiceResponse{
+                HttpCode: http.StatusBadRequest,
+                Err: err,
+                Response: `{"result" : "error", "error_type" : "sddl_class_not_found"}`,
+                Device: nil,
+            }
+        }
+        err = device.SetSDDLClass(class, datalayer.SDDLOriginDevice)
+        if err != nil {
+            return ServiceResponse{
+                HttpCode: http.StatusInternalServerError,
+                Err: fmt.Errorf("Error setting device's SDDL class: %s", err),
+                Response: `{"result" : "error", "error_type" : "database_error"}`,
+                Device: nil,
+            }
+        }
+    }
+
     // If "sddl" is present, create new / reconfigure Cloud Variables.
     _, ok = payloadObj["sddl"]
     if ok {
@@ -236,8 +283,15 @@ func ProcessDeviceComm(
                 Device: nil,
             }
         }
-        err = device.ExtendSDDL(updateMap)
-        if err != nil {
+        err = device.ExtendSDDL(updateMap, datalayer.SDDLOriginDevice)
+        if _, ok := err.(*datalayer.ValidationError); ok {
+            return ServiceResponse{
+                HttpCode: http.StatusBadRequest,
+                Err: fmt.Errorf("Invalid SDDL: %s", err),
+                Response: `{"result" : "error", "error_type" : "bad_payload"}`,
+                Device: nil,
+            }
+        } else if err != nil {
             return ServiceResponse{
                 HttpCode: http.StatusInternalServerError,
                 Err: fmt.Errorf("Error updating device's SDDL: %s", err),
@@ -250,6 +304,9 @@ func ProcessDeviceComm(
     // If "vars" is present, update value of all Cloud Variables (creating new
     // Cloud Variables as necessary)
     doc := device.SDDLDocument()
+    warnings := []cloudvar.ValidationWarning{}
+    autoDeclared := []string{}
+    updated := []string{}
     _, ok = payloadObj["vars"]
     canolog.Info("vars present:", ok)
     if ok {
@@ -265,14 +322,13 @@ func ProcessDeviceComm(
         canolog.Info("varsMap: ", varsMap)
         for varName, value := range varsMap {
             varDef, err := doc.LookupVarDef(varName)
-            // TODO: an error doesn't necessarily mean prop should be created?
             canolog.Info("Looking up property ", varName)
             if (varDef == nil) {
-                // Property doesn't exist.  Add it.
-                canolog.Info("Not found.  Add property ", varName)
-                // TODO: What datatype?
-                // TODO: What other parameters?
-                varDef, err = doc.AddVarDef(varName, sddl.DATATYPE_FLOAT32)
+                // Property doesn't exist.  What happens next depends on the
+                // device's VarDeclPolicy.
+                var warning *cloudvar.ValidationWarning
+                varDef, warning, err = declareReportedVar(device, varName, value)
+                doc = device.SDDLDocument()
                 if err != nil {
                     return ServiceResponse{
                         HttpCode: http.StatusInternalServerError,
@@ -281,31 +337,36 @@ func ProcessDeviceComm(
                         Device: nil,
                     }
                 }
+                if warning != nil {
+                    canolog.Warn(warning.Msg)
+                    warnings = append(warnings, *warning)
+                    continue
+                }
+                autoDeclared = append(autoDeclared, varDef.Fullname())
+            }
 
-                // save modified SDDL 
-                // TODO: Save at the end?
-                canolog.Info("SetSDDLDocument ", doc)
-                err = device.SetSDDLDocument(doc)
-                if err != nil {
-                    return ServiceResponse{
-                        HttpCode: http.StatusInternalServerError,
-                        Err: fmt.Errorf("Error updating SDDL: %s", err),
-                        Response: `{"result" : "error", "error_type" : "database_error"}`,
-                        Device: nil,
-                    }
+            // Derived Cloud Variables are computed by the server.
+            if varDef.Expression() != "" {
+                warning := cloudvar.ValidationWarning{
+                    VarName: varDef.Fullname(),
+                    Problem: "derived_variable",
+                    Action: "rejected",
+                    Msg: fmt.Sprintf("%s is derived from other variables and cannot be reported", varDef.Fullname()),
                 }
+                canolog.Warn(warning.Msg)
+                warnings = append(warnings, warning)
+                continue
             }
 
             // Store property value.
-            // Convert value datatype
-            varVal, err := cloudvar.JsonToCloudVarValue(varDef, value)
-            if err != nil {
-                return ServiceResponse{
-                    HttpCode: http.StatusInternalServerError,
-                    Err: fmt.Errorf("Error converting JSON to propertyValue: %s", err),
-                    Response: `{"result" : "error", "error_type" : "bad_payload"}`,
-                    Device: nil,
-                }
+            // Convert value datatype and validate against SDDL constraints
+            varVal, varWarnings, accepted := cloudvar.JsonToValidatedCloudVarValue(varDef, value)
+            for _, warning := range varWarnings {
+                canolog.Warn(warning.Msg)
+            }
+            warnings = append(warnings, varWarnings...)
+            if !accepted {
+                continue
             }
             canolog.Info("InsertStample")
             err = device.InsertSample(varDef, time.Now(), varVal)
@@ -317,13 +378,158 @@ func ProcessDeviceComm(
                     Device: nil,
                 }
             }
+            updated = append(updated, varDef.Fullname())
+        }
+    }
+
+    // Recompute derived Cloud Variables whose inputs changed.
+    derivedUpdated, derivedWarnings, err := device_filter.UpdateDerivedVars(device, updated)
+    updated = append(updated, derivedUpdated...)
+    for _, warning := range derivedWarnings {
+        canolog.Warn(warning.Msg)
+    }
+    warnings = append(warnings, derivedWarnings...)
+    if err != nil {
+        return ServiceResponse{
+            HttpCode: http.StatusInternalServerError,
+            Err: fmt.Errorf("Error updating derived cloud variables: %s", err),
+            Response: `{"result" : "error", "error_type" : "database_error"}`,
+            Device: nil,
+        }
+    }
+
+    response := `{"result" : "ok"}`
+    if len(warnings) > 0 || len(autoDeclared) > 0 {
+        responseObj := map[string]interface{}{
+            "result" : "ok",
+        }
+        if len(warnings) > 0 {
+            responseObj["warnings"] = cloudvar.ValidationWarningsToJson(warnings)
+        }
+        if len(autoDeclared) > 0 {
+            responseObj["auto_declared"] = autoDeclared
+        }
+        responseBytes, err := json.Marshal(responseObj)
+        if err != nil {
+            return ServiceResponse{
+                HttpCode: http.StatusInternalServerError,
+                Err: fmt.Errorf("Error JSON encoding response: %s", err),
+                Response: `{"result" : "error", "error_type" : "internal_error"}`,
+                Device: nil,
+            }
         }
+        response = string(responseBytes)
     }
 
     return ServiceResponse{
         HttpCode: http.StatusOK,
         Err: nil,
-        Response: `{"result" : "ok"}`,
+        Response: response,
         Device: device,
+        UpdatedVars: updated,
+        SDDLChanged: device.SDDLVersion() != sddlVersion,
+    }
+}
+
+// Lookup the SDDL class referenced by a device report's "sddl_class" field.
+// Devices may only join classes owned by an account that has access to them.
+func lookupReportedSDDLClass(
+        conn datalayer.Connection,
+        device datalayer.Device,
+        classRef string) (datalayer.SDDLClass, error) {
+    parts := strings.SplitN(classRef, "/", 2)
+    if len(parts) != 2 {
+        return nil, fmt.Errorf("Expected \"sddl_class\" of the form <owner>/<name>, got %s", classRef)
+    }
+
+    owner, err := conn.LookupAccount(parts[0])
+    if err != nil {
+        return nil, fmt.Errorf("SDDL class %s not found", classRef)
+    }
+    _, err = owner.Device(device.ID())
+    if err != nil {
+        return nil, fmt.Errorf("SDDL class %s not found", classRef)
+    }
+    class, err := owner.SDDLClass(parts[1])
+    if err != nil {
+        return nil, fmt.Errorf("SDDL class %s not found", classRef)
+    }
+    return class, nil
+}
+
+// Handle a reported value for a Cloud Variable that is not declared in the
+// device's SDDL document, according to the device's VarDeclPolicy:
+//
+//  strict  The value is rejected.
+//  infer   The Cloud Variable is declared with a datatype inferred from the
+//          reported JSON value.
+//  legacy  The Cloud Variable is declared as float32.  This is the default.
+//          Values that can't be stored as float32, such as strings, are
+//          rejected without declaring anything.
+//
+// Returns the new Cloud Variable definition, or a warning if the value was
+// rejected.  Returns an error if the modified SDDL could not be saved.  The
+// device's SDDL document is replaced, so callers must fetch it again.
+func declareReportedVar(
+        device datalayer.Device,
+        varName string,
+        value interface{}) (sddl.VarDef, *cloudvar.ValidationWarning, error) {
+
+    var decl string
+    props := map[string]interface{}{}
+    switch device.VarDeclPolicy() {
+    case datalayer.VarDeclStrict:
+        return nil, &cloudvar.ValidationWarning{
+            VarName: varName,
+            Problem: "undeclared",
+            Action: "rejected",
+            Msg: fmt.Sprintf("Cloud variable %s is not declared", varName),
+        }, nil
+    case datalayer.VarDeclInfer:
+        var err error
+        decl, props, err = sddl.InferVarDecl(varName, value)
+        if err != nil {
+            return nil, &cloudvar.ValidationWarning{
+                VarName: varName,
+                Problem: "cannot_infer_datatype",
+                Action: "rejected",
+                Msg: err.Error(),
+            }, nil
+        }
+    default:
+        decl = "float32 " + varName
+        // Don't leave behind a Cloud Variable that can never accept the
+        // value it was declared for.
+        varDef, err := sddl.ParseVar(decl, props)
+        if err == nil {
+            _, err = cloudvar.JsonToCloudVarValue(varDef, value)
+            if err != nil {
+                return nil, &cloudvar.ValidationWarning{
+                    VarName: varName,
+                    Problem: "bad_value",
+                    Action: "rejected",
+                    Msg: fmt.Sprintf("Cannot declare cloud variable %s as float32: %s", varName, err),
+                }, nil
+            }
+        }
+    }
+
+    canolog.Info("Not found.  Add property ", decl)
+    err := device.ExtendSDDL(map[string]interface{}{decl : props}, datalayer.SDDLOriginDevice)
+    if _, ok := err.(*datalayer.ValidationError); ok {
+        // Ex: the reported name is not a valid Cloud Variable name.
+        return nil, &cloudvar.ValidationWarning{
+            VarName: varName,
+            Problem: "invalid_declaration",
+            Action: "rejected",
+            Msg: fmt.Sprintf("Cannot declare cloud variable %s: %s", varName, err),
+        }, nil
+    } else if err != nil {
+        return nil, nil, err
+    }
+    varDef, err := device.SDDLDocument().LookupVarDef(varName)
+    if err != nil {
+        return nil, nil, err
     }
+    return varDef, nil, nil
 }
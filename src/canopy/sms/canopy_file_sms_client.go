@@ -0,0 +1,51 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sms
+
+import (
+    "fmt"
+    "os"
+    "sync"
+    "time"
+)
+
+// CanopyFileSMSClient appends each message to a file instead of sending it.
+// Useful for development and testing.
+type CanopyFileSMSClient struct {
+    filename string
+    mutex sync.Mutex
+}
+
+func NewFileSMSClient(filename string) (SMSClient, error) {
+    if filename == "" {
+        return nil, fmt.Errorf("sms-file must be set")
+    }
+    return &CanopyFileSMSClient{filename: filename}, nil
+}
+
+func (client *CanopyFileSMSClient) Send(to string, body string) error {
+    client.mutex.Lock()
+    defer client.mutex.Unlock()
+
+    f, err := os.OpenFile(client.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    _, err = fmt.Fprintf(f, "%s TO %s\n%s\n\n", time.Now().UTC().Format(time.RFC3339), to, body)
+    return err
+}
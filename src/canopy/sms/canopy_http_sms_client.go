@@ -0,0 +1,83 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sms
+
+import (
+    "bytes"
+    "canopy/canolog"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "time"
+)
+
+// CanopyHTTPSMSClient sends messages through a generic HTTP gateway.  Each
+// message is POSTed to the gateway URL as:
+//
+//      {"to" : "+15551234567", "from" : "<sms-from>", "body" : "..."}
+//
+// with an "Authorization: Bearer <sms-gateway-token>" header if a token is
+// configured.  Any 2xx response is treated as success.
+type CanopyHTTPSMSClient struct {
+    url string
+    token string
+    from string
+    client *http.Client
+}
+
+func NewHTTPSMSClient(url, token, from string) (SMSClient, error) {
+    if url == "" {
+        return nil, fmt.Errorf("sms-gateway-url must be set")
+    }
+    return &CanopyHTTPSMSClient{
+        url: url,
+        token: token,
+        from: from,
+        client: &http.Client{Timeout: 10*time.Second},
+    }, nil
+}
+
+func (client *CanopyHTTPSMSClient) Send(to string, body string) error {
+    payload, err := json.Marshal(map[string]string{
+        "to" : to,
+        "from" : client.from,
+        "body" : body,
+    })
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest("POST", client.url, bytes.NewReader(payload))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if client.token != "" {
+        req.Header.Set("Authorization", "Bearer " + client.token)
+    }
+
+    canolog.Info("Sending SMS to ", to)
+    resp, err := client.client.Do(req)
+    if err != nil {
+        canolog.Warn("Error sending SMS: ", err)
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("SMS gateway responded with %s", resp.Status)
+    }
+    return nil
+}
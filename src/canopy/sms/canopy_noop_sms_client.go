@@ -0,0 +1,32 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sms
+
+import (
+    "canopy/canolog"
+)
+
+type CanopyNoOpSMSClient struct {
+}
+
+func NewNoOpSMSClient() (SMSClient, error) {
+    return &CanopyNoOpSMSClient{}, nil
+}
+
+func (client *CanopyNoOpSMSClient) Send(to string, body string) error {
+    canolog.Info("Noop SMS Client: not sending message")
+    return nil
+}
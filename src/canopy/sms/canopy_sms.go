@@ -0,0 +1,40 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sms
+
+import (
+    "canopy/config"
+    "fmt"
+)
+
+// SMSClient sends text messages.  Phone numbers are in E.164 format, ex:
+// "+15551234567".
+type SMSClient interface {
+    Send(to string, body string) error
+}
+
+func NewSMSClient(cfg config.Config) (SMSClient, error) {
+    switch cfg.OptSMSService() {
+    case "none":
+        return NewNoOpSMSClient()
+    case "http":
+        return NewHTTPSMSClient(cfg.OptSMSGatewayURL(), cfg.OptSMSGatewayToken(), cfg.OptSMSFrom())
+    case "file":
+        return NewFileSMSClient(cfg.OptSMSFile())
+    default:
+        return nil, fmt.Errorf("Unsupported SMS service: %s", cfg.OptSMSService())
+    }
+}
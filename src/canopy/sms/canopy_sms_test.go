@@ -0,0 +1,76 @@
+/*
+ * Copright 2015 Canopy Services, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package sms
+
+import (
+    "canopy/canolog"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "regexp"
+    "testing"
+)
+
+func init() {
+    canolog.InitFallback()
+}
+
+func TestFileSMSClientRequiresFilename(t *testing.T) {
+    _, err := NewFileSMSClient("")
+    if err == nil {
+        t.Errorf("Expected error for empty filename")
+    }
+}
+
+func TestFileSMSClientAppends(t *testing.T) {
+    dir, err := ioutil.TempDir("", "canopy-sms")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    filename := filepath.Join(dir, "sms.txt")
+
+    client, err := NewFileSMSClient(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.Send("+15555550100", "Your code is 123456"); err != nil {
+        t.Fatal(err)
+    }
+    if err := client.Send("+15555550101", "Device offline"); err != nil {
+        t.Fatal(err)
+    }
+
+    contents, err := ioutil.ReadFile(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := regexp.MustCompile(`^\S+Z TO \+15555550100\nYour code is 123456\n\n` +
+            `\S+Z TO \+15555550101\nDevice offline\n\n$`)
+    if !expected.Match(contents) {
+        t.Errorf("Unexpected file contents:\n%s", contents)
+    }
+}
+
+func TestNoOpSMSClient(t *testing.T) {
+    client, err := NewNoOpSMSClient()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.Send("+15555550100", "Hello"); err != nil {
+        t.Errorf("Send: %s", err)
+    }
+}
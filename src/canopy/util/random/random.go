@@ -54,3 +54,23 @@ func SelectionStrings(in []string, count uint32) []string {
     }
     return out
 }
+
+// Returns a random string of <numDigits> decimal digits, ex: for use as a
+// verification code.
+func DigitString(numDigits int) (string, error) {
+    out := make([]byte, 0, numDigits)
+    randBytes := make([]byte, numDigits)
+    for len(out) < numDigits {
+        _, err := cryptorand.Read(randBytes)
+        if err != nil {
+            return "", err
+        }
+        for _, b := range randBytes {
+            // Discard values that would bias the result towards low digits.
+            if b < 250 && len(out) < numDigits {
+                out = append(out, '0' + b % 10)
+            }
+        }
+    }
+    return string(out), nil
+}
@@ -0,0 +1,144 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package webhooks
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// How long to wait for a webhook to respond.
+const deliveryTimeout = 10*time.Second
+
+// Address ranges that webhooks may not be delivered to, in addition to
+// loopback, link-local, multicast and unspecified addresses.
+var privateBlocks = parseCIDRs(
+    "0.0.0.0/8",
+    "10.0.0.0/8",
+    "100.64.0.0/10",
+    "172.16.0.0/12",
+    "192.168.0.0/16",
+    "198.18.0.0/15",    // Benchmarking
+    "240.0.0.0/4",      // Reserved, including broadcast
+    "64:ff9b::/96",     // NAT64, which can reach any IPv4 address
+    "64:ff9b:1::/48",   // Local-use NAT64
+    "fc00::/7",
+)
+
+// Set by tests, which deliver to servers on the loopback interface.
+var allowPrivateAddresses = false
+
+// Client used for all deliveries.  It refuses to connect to non-public
+// addresses, which also covers redirects and host names that resolve
+// differently than when the webhook was saved.
+var httpClient = &http.Client{
+    Timeout: deliveryTimeout,
+    Transport: &http.Transport{
+        Dial: dialPublic,
+    },
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+    blocks := []*net.IPNet{}
+    for _, cidr := range cidrs {
+        _, block, err := net.ParseCIDR(cidr)
+        if err != nil {
+            panic(err)
+        }
+        blocks = append(blocks, block)
+    }
+    return blocks
+}
+
+// May webhooks be delivered to <ip>?
+func isPublicIP(ip net.IP) bool {
+    if allowPrivateAddresses {
+        return true
+    }
+    if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+            ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+        return false
+    }
+    for _, block := range privateBlocks {
+        if block.Contains(ip) {
+            return false
+        }
+    }
+    return true
+}
+
+// Get the addresses of <host>, failing if any of them is not public.
+func resolvePublic(host string) ([]net.IP, error) {
+    ips := []net.IP{}
+    if ip := net.ParseIP(host); ip != nil {
+        ips = append(ips, ip)
+    } else {
+        var err error
+        ips, err = net.LookupIP(host)
+        if err != nil {
+            return nil, err
+        }
+        if len(ips) == 0 {
+            return nil, fmt.Errorf("%s has no addresses", host)
+        }
+    }
+    for _, ip := range ips {
+        if !isPublicIP(ip) {
+            return nil, fmt.Errorf("%s is not a public address", host)
+        }
+    }
+    return ips, nil
+}
+
+// Dial <addr> only if its host resolves to public addresses.  Connects to
+// the resolved address, so the check can't be bypassed by a DNS record that
+// changes in between.
+func dialPublic(network, addr string) (net.Conn, error) {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return nil, err
+    }
+    ips, err := resolvePublic(host)
+    if err != nil {
+        return nil, err
+    }
+    dialer := &net.Dialer{Timeout: deliveryTimeout}
+    return dialer.Dial(network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// Check that <rawurl> is an http or https URL whose host resolves to public
+// addresses only.
+func CheckURL(rawurl string) error {
+    u, err := url.Parse(rawurl)
+    if err != nil {
+        return err
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+        return fmt.Errorf("must be an http or https URL")
+    }
+    host := u.Host
+    if h, _, err := net.SplitHostPort(u.Host); err == nil {
+        host = h
+    }
+    host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+    if host == "" {
+        return fmt.Errorf("host required")
+    }
+    _, err = resolvePublic(host)
+    return err
+}
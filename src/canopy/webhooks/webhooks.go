@@ -0,0 +1,516 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhooks delivers device events to the webhooks of every account
+// with access to the device.
+//
+// Events are dispatched by an EventJobKey job, which stores each delivery
+// in the datalayer's webhook queue and launches a DeliverJobKey job for it.
+// Failed deliveries are retried with exponential backoff, up to maxAttempts
+// times.  Every attempt is recorded in the webhook's delivery log.  Retries
+// waiting when a server stops are resumed by Resume when a server starts.
+//
+// Webhooks may only be delivered to public addresses, so that they can't be
+// used to reach services on Canopy's own network.  See CheckURL.
+//
+// Each delivery is a POST with a JSON body:
+//
+//      {
+//          "event" : "sample",
+//          "delivery_id" : "<uuid>",
+//          "time" : "2015-06-01T12:00:00Z",
+//          "device_id" : "<uuid>",
+//          "device_name" : "Thermostat",
+//          "data" : { ... }
+//      }
+//
+// The body is signed with the webhook's secret.  The X-Canopy-Signature
+// header contains "sha256=" followed by the hex-encoded HMAC-SHA256 of the
+// body.  See Sign.
+package webhooks
+
+import (
+    "bytes"
+    "canopy/canolog"
+    "canopy/cloudvar"
+    "canopy/datalayer"
+    "canopy/device_filter"
+    "canopy/pigeon"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "github.com/gocql/gocql"
+    "net/http"
+    "time"
+)
+
+// Event types.
+const (
+    EventSample = "sample"             // Cloud Variables changed
+    EventNotification = "notification" // Device raised a notification
+    EventConnect = "connect"           // Device websocket connected
+    EventDisconnect = "disconnect"     // Device websocket disconnected
+    EventSDDLChange = "sddl_change"    // Device's SDDL document changed
+
+    // A rule fired.  Only delivered to the webhook named by the rule's
+    // action, so webhooks can't subscribe to it.
+    EventRuleFired = "rule_fired"
+)
+
+var validEvents = map[string]bool{
+    EventSample : true,
+    EventNotification : true,
+    EventConnect : true,
+    EventDisconnect : true,
+    EventSDDLChange : true,
+}
+
+// Pigeon message key for jobs that dispatch an event to webhooks.
+const EventJobKey = "webhooks/event"
+
+// Pigeon message key for jobs that deliver an event to one webhook.
+const DeliverJobKey = "webhooks/deliver"
+
+// Number of times delivery is attempted before giving up.
+const maxAttempts = 6
+
+// Delay before the first retry.  Each later retry waits twice as long.
+const retryDelay = 10*time.Second
+
+
+// Is <event> a supported event type?
+func IsValidEvent(event string) bool {
+    return validEvents[event]
+}
+
+// Compute the signature of <body> sent in the X-Canopy-Signature header.
+func Sign(secret string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Launch a job through <outbox> and ignore its response.
+func launch(outbox jobqueue.Outbox, key string, payload map[string]interface{}) error {
+    respChan, err := outbox.Launch(key, payload)
+    if err != nil {
+        return err
+    }
+
+    // Nobody is interested in the result, but the response must be consumed.
+    go func() {
+        <-respChan
+    }()
+    return nil
+}
+
+// Launch a job that delivers <event> from device <deviceId> to the
+// subscribed webhooks.  <data> must be JSON-encodable and becomes the
+// payload's "data" field.  Does not wait for the job to finish.
+func LaunchEvent(outbox jobqueue.Outbox, deviceId gocql.UUID, event string, data map[string]interface{}) error {
+    if outbox == nil {
+        return nil
+    }
+    dataBytes, err := json.Marshal(data)
+    if err != nil {
+        return err
+    }
+    return launch(outbox, EventJobKey, map[string]interface{}{
+        "device_id" : deviceId.String(),
+        "event" : event,
+        "data" : string(dataBytes),
+    })
+}
+
+// Does <webhook> want <event> from <device>?
+func subscribed(webhook datalayer.Webhook, device datalayer.Device, event string) bool {
+    if !webhook.Enabled() {
+        return false
+    }
+
+    found := false
+    for _, e := range webhook.Events() {
+        if e == event {
+            found = true
+        }
+    }
+    if !found {
+        return false
+    }
+
+    if len(webhook.DeviceIDs()) > 0 {
+        found = false
+        for _, deviceId := range webhook.DeviceIDs() {
+            if deviceId == device.ID() {
+                found = true
+            }
+        }
+        if !found {
+            return false
+        }
+    }
+
+    if webhook.Filter() != "" {
+        filter, err := device_filter.Compile(webhook.Filter())
+        if err != nil {
+            canolog.Error("Webhooks: invalid filter for webhook ", webhook.ID(), ": ", err)
+            return false
+        }
+        count, _ := filter.CountMembers([]datalayer.Device{device})
+        if count == 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// Queue a delivery to each webhook subscribed to <event> from <device>.
+// <data> becomes the payload's "data" field.
+func Dispatch(conn datalayer.Connection, outbox jobqueue.Outbox, device datalayer.Device, event string, data interface{}) error {
+    if outbox == nil {
+        return nil
+    }
+    perms, err := device.Permissions()
+    if err != nil {
+        return err
+    }
+
+    for _, perm := range perms {
+        webhooks, err := perm.Account.Webhooks()
+        if err != nil {
+            canolog.Error("Webhooks: could not fetch webhooks of ", perm.Account.Username(), ": ", err)
+            continue
+        }
+        for _, webhook := range webhooks {
+            if !subscribed(webhook, device, event) {
+                continue
+            }
+            err = Deliver(conn, outbox, webhook, device, event, data)
+            if err != nil {
+                canolog.Error("Webhooks: could not queue delivery to ", webhook.ID(), ": ", err)
+            }
+        }
+    }
+    return nil
+}
+
+// Queue a delivery of <event> from <device> to <webhook>, whether or not it
+// is subscribed to the event.  Used for events that name their webhook
+// explicitly, such as EventRuleFired.  The delivery is signed, retried and
+// logged like any other.
+func Deliver(conn datalayer.Connection, outbox jobqueue.Outbox, webhook datalayer.Webhook, device datalayer.Device, event string, data interface{}) error {
+    if outbox == nil {
+        return nil
+    }
+    deliveryId, err := gocql.RandomUUID()
+    if err != nil {
+        return err
+    }
+    body, err := json.Marshal(map[string]interface{}{
+        "event" : event,
+        "delivery_id" : deliveryId.String(),
+        "time" : time.Now().UTC().Format(time.RFC3339),
+        "device_id" : device.ID().String(),
+        "device_name" : device.Name(),
+        "data" : data,
+    })
+    if err != nil {
+        return err
+    }
+
+    delivery := datalayer.QueuedWebhookDelivery{
+        ID: deliveryId,
+        Owner: webhook.Owner(),
+        WebhookID: webhook.ID(),
+        Event: event,
+        DeviceID: device.ID(),
+        Body: string(body),
+        Attempt: 1,
+        NextAttempt: time.Now().UTC(),
+    }
+    err = conn.EnqueueWebhookDelivery(&delivery)
+    if err != nil {
+        return err
+    }
+    return launchDelivery(outbox, delivery)
+}
+
+// Launch a job that makes the next attempt of queued <delivery>.
+func launchDelivery(outbox jobqueue.Outbox, delivery datalayer.QueuedWebhookDelivery) error {
+    return launch(outbox, DeliverJobKey, map[string]interface{}{
+        "id" : delivery.ID.String(),
+        "attempt" : delivery.Attempt,
+    })
+}
+
+// Launch a job for queued <delivery> when its next attempt is due.
+func launchDeliveryAt(outbox jobqueue.Outbox, delivery datalayer.QueuedWebhookDelivery) {
+    time.AfterFunc(delivery.NextAttempt.Sub(time.Now()), func() {
+        err := launchDelivery(outbox, delivery)
+        if err != nil {
+            canolog.Error("Webhooks: could not launch delivery ", delivery.ID, ": ", err)
+        }
+    })
+}
+
+// Relaunch the deliveries that were waiting to be attempted or retried.
+// Call when a server starts.
+//
+// TODO: Every server does this, so deliveries stranded by a restart may be
+// attempted more than once if several servers start together.
+func Resume(conn datalayer.Connection, outbox jobqueue.Outbox) error {
+    deliveries, err := conn.QueuedWebhookDeliveries()
+    if err != nil {
+        return err
+    }
+    for _, delivery := range deliveries {
+        launchDeliveryAt(outbox, delivery)
+    }
+    return nil
+}
+
+// Get the "data" of a sample event reporting the latest values of Cloud
+// Variables <varNames>:
+//
+//      {"vars" : {"temperature" : {"v" : 71.5, "t" : "2015-06-01T12:00:00Z"}}}
+func SampleData(device datalayer.Device, varNames []string) map[string]interface{} {
+    vars := map[string]interface{}{}
+    for _, name := range varNames {
+        sample, err := device.LatestDataByName(name)
+        if err != nil {
+            continue
+        }
+        vars[name] = map[string]interface{}{
+            "v" : cloudvar.CloudVarValueToJson(sample.Value),
+            "t" : sample.Timestamp.UTC().Format(time.RFC3339),
+        }
+    }
+    return map[string]interface{}{
+        "vars" : vars,
+    }
+}
+
+// Read "db-conn" and "pigeon-outbox" from a job's userCtx.
+func jobContext(userCtxItf interface{}) (datalayer.Connection, jobqueue.Outbox, error) {
+    userCtx, ok := userCtxItf.(map[string]interface{})
+    if !ok {
+        return nil, nil, fmt.Errorf("Expected map[string]interface{} for userCtx")
+    }
+    conn, ok := userCtx["db-conn"].(datalayer.Connection)
+    if !ok {
+        return nil, nil, fmt.Errorf("Expected datalayer.Connection for 'db-conn'")
+    }
+    outbox, ok := userCtx["pigeon-outbox"].(jobqueue.Outbox)
+    if !ok {
+        return nil, nil, fmt.Errorf("Expected jobqueue.Outbox for 'pigeon-outbox'")
+    }
+    return conn, outbox, nil
+}
+
+// Pigeon handler for EventJobKey jobs.  Expects a userCtx with "db-conn"
+// and "pigeon-outbox", and a request body of the form:
+//
+//      {"device_id" : string, "event" : string, "data" : JSON string}
+func EventHandler(jobKey string, userCtxItf interface{}, req jobqueue.Request, resp jobqueue.Response) {
+    resp.SetBody(map[string]interface{}{"result" : "ok"})
+
+    conn, outbox, err := jobContext(userCtxItf)
+    if err != nil {
+        canolog.Error("Webhooks: ", err)
+        return
+    }
+
+    body := req.Body()
+    deviceIdString, _ := body["device_id"].(string)
+    deviceId, err := gocql.ParseUUID(deviceIdString)
+    if err != nil {
+        canolog.Error("Webhooks: invalid device_id ", deviceIdString)
+        return
+    }
+    event, _ := body["event"].(string)
+    dataString, _ := body["data"].(string)
+    var data interface{}
+    err = json.Unmarshal([]byte(dataString), &data)
+    if err != nil {
+        canolog.Error("Webhooks: invalid event data: ", err)
+        return
+    }
+
+    device, err := conn.LookupDevice(deviceId)
+    if err != nil {
+        canolog.Error("Webhooks: device ", deviceId, " not found: ", err)
+        return
+    }
+    err = Dispatch(conn, outbox, device, event, data)
+    if err != nil {
+        canolog.Error("Webhooks: error dispatching ", event, " from ", deviceId, ": ", err)
+    }
+}
+
+// POST <body> to <webhook>.  Returns the HTTP status code, or 0 if there was
+// no response.
+func post(webhook datalayer.Webhook, event string, deliveryId string, body []byte) (int, error) {
+    req, err := http.NewRequest("POST", webhook.URL(), bytes.NewReader(body))
+    if err != nil {
+        return 0, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Canopy-Event", event)
+    req.Header.Set("X-Canopy-Delivery", deliveryId)
+    req.Header.Set("X-Canopy-Signature", Sign(webhook.Secret(), body))
+
+    resp, err := httpClient.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return resp.StatusCode, fmt.Errorf("Webhook responded with %s", resp.Status)
+    }
+    return resp.StatusCode, nil
+}
+
+// Should a delivery that failed with <statusCode> be retried?
+func retryable(statusCode int) bool {
+    // The endpoint rejected the request itself.
+    if statusCode >= 400 && statusCode < 500 &&
+            statusCode != http.StatusRequestTimeout &&
+            statusCode != 429 {
+        return false
+    }
+    return true
+}
+
+// Pigeon handler for DeliverJobKey jobs.  Expects a userCtx with "db-conn"
+// and "pigeon-outbox", and a request body of the form:
+//
+//      {"id" : string, "attempt" : int}
+//
+// where "id" is a delivery in the webhook queue.
+func DeliverHandler(jobKey string, userCtxItf interface{}, req jobqueue.Request, resp jobqueue.Response) {
+    resp.SetBody(map[string]interface{}{"result" : "ok"})
+
+    conn, outbox, err := jobContext(userCtxItf)
+    if err != nil {
+        canolog.Error("Webhooks: ", err)
+        return
+    }
+
+    payload := req.Body()
+    idString, _ := payload["id"].(string)
+    attempt, _ := payload["attempt"].(int)
+    id, err := gocql.ParseUUID(idString)
+    if err != nil {
+        canolog.Error("Webhooks: invalid delivery id ", idString)
+        return
+    }
+    queued, err := conn.LookupQueuedWebhookDelivery(id)
+    if err != nil {
+        // Already finished, ex: by another server after a restart.
+        canolog.Info("Webhooks: queued delivery ", id, " not found: ", err)
+        return
+    }
+    if queued.Attempt != attempt {
+        // Stale job for an attempt that has already been made.
+        return
+    }
+
+    // Remove the delivery from the queue once nothing more will be
+    // attempted.
+    finish := func() {
+        err := conn.RemoveQueuedWebhookDelivery(id)
+        if err != nil {
+            canolog.Error("Webhooks: could not remove queued delivery ", id, ": ", err)
+        }
+    }
+    account, err := conn.LookupAccount(queued.Owner)
+    if err != nil {
+        canolog.Error("Webhooks: owner ", queued.Owner, " not found: ", err)
+        finish()
+        return
+    }
+    webhook, err := account.Webhook(queued.WebhookID)
+    if err != nil {
+        // Deleted since the event was dispatched.
+        canolog.Info("Webhooks: webhook ", queued.WebhookID, " not found: ", err)
+        finish()
+        return
+    }
+    if !webhook.Enabled() {
+        finish()
+        return
+    }
+
+    delivery := datalayer.WebhookDelivery{
+        ID: queued.ID,
+        Event: queued.Event,
+        DeviceID: queued.DeviceID,
+        Attempt: queued.Attempt,
+    }
+    delivery.StatusCode, err = post(webhook, queued.Event, idString, []byte(queued.Body))
+    if err != nil {
+        delivery.Error = err.Error()
+    }
+    delivery.Time = time.Now().UTC()
+    if recordErr := webhook.RecordDelivery(delivery); recordErr != nil {
+        canolog.Error("Webhooks: could not record delivery: ", recordErr)
+    }
+
+    switch {
+    case err == nil:
+        finish()
+    case !retryable(delivery.StatusCode):
+        canolog.Warn("Webhooks: delivery ", id, " rejected: ", err)
+        finish()
+    case queued.Attempt >= maxAttempts:
+        canolog.Warn("Webhooks: giving up on delivery ", id, ": ", err)
+        finish()
+    default:
+        delay := retryDelay << uint(queued.Attempt - 1)
+        queued.Attempt++
+        queued.NextAttempt = delivery.Time.Add(delay)
+        err = conn.UpdateQueuedWebhookDelivery(queued)
+        if err != nil {
+            canolog.Error("Webhooks: could not record attempt for ", id, ": ", err)
+            return
+        }
+        canolog.Info("Webhooks: retrying delivery ", id, " in ", delay)
+        launchDeliveryAt(outbox, queued)
+    }
+}
+
+// Check a webhook's settings before it is saved.  Returns a
+// datalayer.ValidationError describing the first problem found.
+func ValidateWebhookParams(params datalayer.WebhookParams) error {
+    err := CheckURL(params.URL)
+    if err != nil {
+        return datalayer.NewValidationError(fmt.Sprintf("Invalid url: %s", err))
+    }
+    if params.Filter != "" {
+        if _, err := device_filter.Compile(params.Filter); err != nil {
+            return datalayer.NewValidationError(fmt.Sprintf("Invalid filter: %s", err))
+        }
+    }
+    if len(params.Events) == 0 {
+        return datalayer.NewValidationError("Webhook requires at least one event")
+    }
+    for _, event := range params.Events {
+        if !IsValidEvent(event) {
+            return datalayer.NewValidationError(fmt.Sprintf("Invalid event %s", event))
+        }
+    }
+    return nil
+}
@@ -0,0 +1,202 @@
+// Copright 2015 Canopy Services, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package webhooks
+
+import (
+    "canopy/datalayer"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// Only the methods used by post are implemented.
+type testWebhook struct {
+    datalayer.Webhook
+    url string
+    secret string
+}
+
+func (webhook *testWebhook) URL() string {
+    return webhook.url
+}
+
+func (webhook *testWebhook) Secret() string {
+    return webhook.secret
+}
+
+// Receiver records the requests it gets, and responds with each of
+// <statuses> in turn.
+type receiver struct {
+    statuses []int
+    requests []*http.Request
+    bodies [][]byte
+}
+
+func (recv *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    body, _ := ioutil.ReadAll(req.Body)
+    recv.requests = append(recv.requests, req)
+    recv.bodies = append(recv.bodies, body)
+    status := recv.statuses[0]
+    if len(recv.statuses) > 1 {
+        recv.statuses = recv.statuses[1:]
+    }
+    w.WriteHeader(status)
+}
+
+func withPrivateAddresses(f func()) {
+    allowPrivateAddresses = true
+    defer func() {
+        allowPrivateAddresses = false
+    }()
+    f()
+}
+
+func TestPostSignsBody(t *testing.T) {
+    recv := &receiver{statuses: []int{http.StatusOK}}
+    server := httptest.NewServer(recv)
+    defer server.Close()
+
+    withPrivateAddresses(func() {
+        webhook := &testWebhook{url: server.URL + "/hook", secret: "s3cret"}
+        body := []byte(`{"event":"sample"}`)
+        status, err := post(webhook, EventSample, "delivery-1", body)
+        if err != nil || status != http.StatusOK {
+            t.Fatalf("post: status %d, err %v", status, err)
+        }
+        if len(recv.requests) != 1 {
+            t.Fatalf("Expected 1 request, got %d", len(recv.requests))
+        }
+        req := recv.requests[0]
+        if req.Method != "POST" || req.URL.Path != "/hook" {
+            t.Errorf("Unexpected request %s %s", req.Method, req.URL.Path)
+        }
+        if string(recv.bodies[0]) != string(body) {
+            t.Errorf("Body %q, expected %q", recv.bodies[0], body)
+        }
+        if req.Header.Get("X-Canopy-Signature") != Sign("s3cret", body) {
+            t.Errorf("Bad signature %q", req.Header.Get("X-Canopy-Signature"))
+        }
+        if req.Header.Get("X-Canopy-Event") != EventSample {
+            t.Errorf("Bad event header %q", req.Header.Get("X-Canopy-Event"))
+        }
+        if req.Header.Get("X-Canopy-Delivery") != "delivery-1" {
+            t.Errorf("Bad delivery header %q", req.Header.Get("X-Canopy-Delivery"))
+        }
+    })
+}
+
+func TestSign(t *testing.T) {
+    // echo -n '{}' | openssl dgst -sha256 -hmac key
+    expected := "sha256=a777724d943eb48dc69bca8a4a6d57a04db3f9ec7e1de4e581e860265bdf3032"
+    if Sign("key", []byte("{}")) != expected {
+        t.Errorf("Sign = %q, expected %q", Sign("key", []byte("{}")), expected)
+    }
+}
+
+func TestRetries(t *testing.T) {
+    recv := &receiver{statuses: []int{
+        http.StatusServiceUnavailable,
+        429,
+        http.StatusBadRequest,
+    }}
+    server := httptest.NewServer(recv)
+    defer server.Close()
+
+    withPrivateAddresses(func() {
+        webhook := &testWebhook{url: server.URL, secret: "s3cret"}
+        expected := []struct {
+            status int
+            retry bool
+        }{
+            {http.StatusServiceUnavailable, true},
+            {429, true},
+            {http.StatusBadRequest, false},
+        }
+        for _, e := range expected {
+            status, err := post(webhook, EventSample, "delivery-1", []byte("{}"))
+            if err == nil {
+                t.Errorf("Expected error for status %d", e.status)
+            }
+            if status != e.status {
+                t.Errorf("Status %d, expected %d", status, e.status)
+            }
+            if retryable(status) != e.retry {
+                t.Errorf("retryable(%d) = %v, expected %v", status, retryable(status), e.retry)
+            }
+        }
+    })
+
+    // No response at all, ex: connection refused.
+    server.Close()
+    withPrivateAddresses(func() {
+        webhook := &testWebhook{url: server.URL, secret: "s3cret"}
+        status, err := post(webhook, EventSample, "delivery-1", []byte("{}"))
+        if err == nil || status != 0 {
+            t.Errorf("Expected failure without status, got %d, %v", status, err)
+        }
+        if !retryable(status) {
+            t.Errorf("Expected connection failures to be retried")
+        }
+    })
+}
+
+func TestPrivateAddressesRefused(t *testing.T) {
+    recv := &receiver{statuses: []int{http.StatusOK}}
+    server := httptest.NewServer(recv)
+    defer server.Close()
+
+    if err := CheckURL(server.URL); err == nil {
+        t.Errorf("CheckURL accepted loopback URL %s", server.URL)
+    }
+    webhook := &testWebhook{url: server.URL, secret: "s3cret"}
+    _, err := post(webhook, EventSample, "delivery-1", []byte("{}"))
+    if err == nil {
+        t.Errorf("Delivered to loopback URL %s", server.URL)
+    }
+    if len(recv.requests) != 0 {
+        t.Errorf("Receiver got %d requests", len(recv.requests))
+    }
+
+    for _, url := range []string{
+        "http://10.0.0.1/",
+        "http://172.16.5.4:8080/",
+        "http://192.168.1.1/",
+        "http://169.254.169.254/latest/meta-data",
+        "http://[::1]/",
+        "http://[fd00::1]/",
+        "http://198.18.0.1/",
+        "http://198.19.255.254/",
+        "http://240.0.0.1/",
+        "http://255.255.255.255/",
+        "http://[64:ff9b::a00:1]/",
+        "http://[64:ff9b::808:808]/",
+        "http://[64:ff9b:1::a00:1]/",
+        "http://0.0.0.0/",
+        "ftp://8.8.8.8/",
+    } {
+        if err := CheckURL(url); err == nil {
+            t.Errorf("CheckURL accepted %s", url)
+        }
+    }
+    for _, url := range []string{
+        "http://8.8.8.8/",
+        "http://198.20.0.1/",
+        "https://[2001:4860:4860::8888]:8443/hook",
+    } {
+        if err := CheckURL(url); err != nil {
+            t.Errorf("CheckURL rejected %s: %s", url, err)
+        }
+    }
+}
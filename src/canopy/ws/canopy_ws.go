@@ -27,7 +27,9 @@ import (
     "canopy/datalayer"
     "canopy/datalayer/cassandra_datalayer"
     "canopy/pigeon"
+    "canopy/rules"
     "canopy/service"
+    "canopy/webhooks"
 )
 
 
@@ -35,6 +37,14 @@ import (
     return (pigeonSys.Mailbox(deviceIdString) != nil)
 }*/
 
+// Deliver a connect or disconnect event to webhooks.
+func launchConnectionEvent(outbox jobqueue.Outbox, device datalayer.Device, event string) {
+    err := webhooks.LaunchEvent(outbox, device.ID(), event, map[string]interface{}{})
+    if err != nil {
+        canolog.Error("Error launching webhook delivery: ", err)
+    }
+}
+
 func NewCanopyWebsocketServer(cfg config.Config, outbox jobqueue.Outbox, pigeonServer jobqueue.Server) func(ws *websocket.Conn) {
     // Main websocket server routine.
     // This event loop runs until the websocket connection is broken.
@@ -72,6 +82,18 @@ func NewCanopyWebsocketServer(cfg config.Config, outbox jobqueue.Outbox, pigeonS
                     canolog.Error("Error processing device communications: ", resp.Err)
                 } else {
                     device = resp.Device
+                    err = rules.LaunchVarChanged(outbox, device.ID(), resp.UpdatedVars)
+                    if err != nil {
+                        canolog.Error("Error launching rule evaluation: ", err)
+                    }
+                    if resp.SDDLChanged {
+                        err = webhooks.LaunchEvent(outbox, device.ID(), webhooks.EventSDDLChange, map[string]interface{}{
+                            "version" : device.SDDLVersion(),
+                        })
+                        if err != nil {
+                            canolog.Error("Error launching webhook delivery: ", err)
+                        }
+                    }
                     if inbox == nil {
                         deviceIdString := device.ID().String()
                         inbox, err = pigeonServer.CreateInbox("canopy_ws:" + deviceIdString)
@@ -86,6 +108,7 @@ func NewCanopyWebsocketServer(cfg config.Config, outbox jobqueue.Outbox, pigeonS
                         if err != nil {
                             canolog.Error("Unexpected error: ", err)
                         }
+                        launchConnectionEvent(outbox, device, webhooks.EventConnect)
                     }
                 }
             } else if err == io.EOF {
@@ -97,6 +120,7 @@ func NewCanopyWebsocketServer(cfg config.Config, outbox jobqueue.Outbox, pigeonS
                         if err != nil {
                             canolog.Error("Unexpected error: ", err)
                         }
+                        launchConnectionEvent(outbox, device, webhooks.EventDisconnect)
                     }
                     inbox.Close()
                 }
@@ -119,6 +143,7 @@ func NewCanopyWebsocketServer(cfg config.Config, outbox jobqueue.Outbox, pigeonS
                             if err != nil {
                                 canolog.Error("Unexpected error: ", err)
                             }
+                            launchConnectionEvent(outbox, device, webhooks.EventDisconnect)
                         }
                         inbox.Close()
                     }